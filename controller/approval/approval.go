@@ -0,0 +1,307 @@
+package approval
+
+import (
+	"encoding/pem"
+	"fmt"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/hbahadorzadeh/key-master/model"
+	"github.com/hbahadorzadeh/key-master/service"
+	"github.com/hbahadorzadeh/key-master/util"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+type submitRequest struct {
+	Reason string `json:"reason" validate:"required"`
+}
+
+type decideRequest struct {
+	Comment string `json:"comment"`
+}
+
+// keyParams names the key an operation is about.
+type keyParams struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+type approvalController struct {
+	tokenManager *service.TokenManager
+	mdb          *service.MongoDB
+	sealer       *service.Sealer
+	policies     *service.PolicyEngine
+	approvals    *service.ApprovalWorkflow
+	validate     *validator.Validate
+	logger       *log.Logger
+}
+
+func NewApprovalController(tokenManager *service.TokenManager, mdb *service.MongoDB, sealer *service.Sealer, policies *service.PolicyEngine, approvals *service.ApprovalWorkflow, validate *validator.Validate) (a *approvalController) {
+	return &approvalController{
+		tokenManager: tokenManager,
+		mdb:          mdb,
+		sealer:       sealer,
+		policies:     policies,
+		approvals:    approvals,
+		validate:     validate,
+	}
+}
+
+func (a *approvalController) Init(configs *util.Configs, logger *log.Logger, app *fiber.App) {
+	a.logger = logger
+	a.approvals.Register(service.ApprovalKeyDestroy, a.destroyKey)
+	a.approvals.Register(service.ApprovalRootKeyExport, a.exportRootKey)
+
+	app.Post("/approvals/keys/:kind/:name/destroy", a.tokenManager.Require(service.PermissionKeysManage), a.submitDestroy)
+	app.Post("/approvals/pki/:name/export", a.tokenManager.Require(service.PermissionKeysManage), a.policies.Enforce(service.OperationExport, "pki"), a.submitExport)
+	app.Get("/approvals", a.list)
+	app.Get("/approvals/:id", a.get)
+	app.Post("/approvals/:id/approve", a.approve)
+	app.Post("/approvals/:id/reject", a.reject)
+	app.Post("/approvals/:id/cancel", a.cancel)
+	app.Get("/approvals/:id/result", a.result)
+}
+
+func (a *approvalController) submitDestroy(ctx *fiber.Ctx) error {
+	params := keyParams{Kind: ctx.Params("kind"), Name: ctx.Params("name")}
+	if _, _, err := keyRecord(a.mdb, params); err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	req, err := a.policies.Request(ctx, service.OperationDestroy, service.KeyLabel(params.Kind, params.Name))
+	if err != nil {
+		return ctx.Status(503).SendString(err.Error())
+	}
+	decision, err := a.policies.Evaluate(req)
+	if err != nil {
+		return ctx.Status(503).SendString(err.Error())
+	}
+	if !decision.Allowed {
+		return ctx.Status(403).SendString(decision.Reason)
+	}
+	return a.submit(ctx, service.ApprovalKeyDestroy, params)
+}
+
+func (a *approvalController) submitExport(ctx *fiber.Ctx) error {
+	ca := &model.CertificateAuthority{}
+	if err := a.mdb.Select(ca, bson.M{"name": ctx.Params("name")}); err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	if !ca.IsRoot() {
+		return ctx.Status(400).SendString(fmt.Sprintf("`%s` is not a root certificate authority", ca.Name))
+	}
+	return a.submit(ctx, service.ApprovalRootKeyExport, keyParams{Kind: "pki", Name: ca.Name})
+}
+
+func (a *approvalController) submit(ctx *fiber.Ctx, operation string, params keyParams) error {
+	body := &submitRequest{}
+	if err := ctx.BodyParser(body); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if err := a.validate.Struct(body); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	request, err := a.approvals.Submit(a.tokenManager.GetEmail(ctx), operation, service.KeyLabel(params.Kind, params.Name), body.Reason, params)
+	if err == service.ErrApprovalDisabled {
+		return ctx.Status(503).SendString(err.Error())
+	}
+	if err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	return ctx.Status(202).JSON(request)
+}
+
+// list shows the requests of the caller and those waiting for them, auditors see all of them.
+func (a *approvalController) list(ctx *fiber.Ctx) error {
+	filter := bson.M{}
+	if status := ctx.Query("status"); status != "" {
+		filter["status"] = status
+	}
+	auditor, err := a.tokenManager.HasPermission(ctx, service.PermissionAuditRead)
+	if err != nil {
+		return ctx.Status(503).SendString(err.Error())
+	}
+	if !auditor {
+		email := a.tokenManager.GetEmail(ctx)
+		filter["$or"] = bson.A{bson.M{"requested_by": email}, bson.M{"approvers": email}}
+	}
+	requests, err := a.approvals.List(filter)
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	return ctx.JSON(requests)
+}
+
+func (a *approvalController) get(ctx *fiber.Ctx) error {
+	request, status, err := a.load(ctx)
+	if err != nil {
+		return ctx.Status(status).SendString(err.Error())
+	}
+	return ctx.JSON(request)
+}
+
+func (a *approvalController) approve(ctx *fiber.Ctx) error {
+	return a.decide(ctx, true)
+}
+
+func (a *approvalController) reject(ctx *fiber.Ctx) error {
+	return a.decide(ctx, false)
+}
+
+func (a *approvalController) decide(ctx *fiber.Ctx, approve bool) error {
+	body := &decideRequest{}
+	if len(ctx.Body()) > 0 {
+		if err := ctx.BodyParser(body); err != nil {
+			return ctx.Status(400).SendString(err.Error())
+		}
+	}
+	request, status, err := a.load(ctx)
+	if err != nil {
+		return ctx.Status(status).SendString(err.Error())
+	}
+	mfa, _ := a.tokenManager.GetClaims(ctx)["mfa"].(bool)
+	switch err := a.approvals.Decide(request, a.tokenManager.GetEmail(ctx), approve, mfa, body.Comment, ctx.IP()); err {
+	case nil:
+		return ctx.JSON(request)
+	case service.ErrApprovalNotApprover, service.ErrApprovalMfa:
+		return ctx.Status(403).SendString(err.Error())
+	default:
+		return ctx.Status(409).SendString(err.Error())
+	}
+}
+
+func (a *approvalController) cancel(ctx *fiber.Ctx) error {
+	request, status, err := a.load(ctx)
+	if err != nil {
+		return ctx.Status(status).SendString(err.Error())
+	}
+	if err := a.approvals.Cancel(request, a.tokenManager.GetEmail(ctx)); err != nil {
+		return ctx.Status(409).SendString(err.Error())
+	}
+	return ctx.JSON(request)
+}
+
+// result hands the output of an executed operation, such as an exported key, to the requester once.
+func (a *approvalController) result(ctx *fiber.Ctx) error {
+	request, status, err := a.load(ctx)
+	if err != nil {
+		return ctx.Status(status).SendString(err.Error())
+	}
+	result, err := a.approvals.TakeResult(request, a.tokenManager.GetEmail(ctx))
+	if err != nil {
+		return ctx.Status(409).SendString(err.Error())
+	}
+	a.logger.Warnf("Result of approval request `%s` for %s of `%s` was taken by `%s`", request.ID.Hex(), request.Operation, request.Target, request.RequestedBy)
+	ctx.Set(fiber.HeaderContentType, "application/x-pem-file")
+	return ctx.Send(result)
+}
+
+// load finds the request of the path, only its requester, its approvers and auditors may see it.
+func (a *approvalController) load(ctx *fiber.Ctx) (*service.ApprovalRequest, int, error) {
+	request, err := a.approvals.Find(ctx.Params("id"))
+	if err != nil {
+		return nil, 404, err
+	}
+	email := a.tokenManager.GetEmail(ctx)
+	if request.RequestedBy == email {
+		return request, 200, nil
+	}
+	for _, approver := range request.Approvers {
+		if approver == email {
+			return request, 200, nil
+		}
+	}
+	auditor, err := a.tokenManager.HasPermission(ctx, service.PermissionAuditRead)
+	if err != nil {
+		return nil, 503, err
+	}
+	if !auditor {
+		return nil, 404, errors.Newf("Approval request `%s` not found", ctx.Params("id"))
+	}
+	return request, 200, nil
+}
+
+// destroyKey deletes the key and erases its key material, wrapped copies included.
+func (a *approvalController) destroyKey(request *service.ApprovalRequest) ([]byte, error) {
+	params := keyParams{}
+	if err := request.DecodeParams(&params); err != nil {
+		return nil, err
+	}
+	record, secretID, err := keyRecord(a.mdb, params)
+	if err != nil {
+		return nil, err
+	}
+	secret := &model.Secret{}
+	if err := a.mdb.Select(secret, bson.M{"_id": secretID}); err == nil {
+		secret.EncryptedPrivate = nil
+		secret.SealedKey = nil
+		secret.EncryptedKeys = []model.EncryptedKey{}
+		if err := a.mdb.Delete(secret); err != nil {
+			return nil, err
+		}
+	}
+	if err := a.mdb.Delete(record); err != nil {
+		return nil, err
+	}
+	a.logger.Warnf("Key `%s` was destroyed, requested by `%s`", request.Target, request.RequestedBy)
+	return nil, nil
+}
+
+// exportRootKey returns the private key of a root certificate authority as PKCS#8 PEM.
+func (a *approvalController) exportRootKey(request *service.ApprovalRequest) ([]byte, error) {
+	params := keyParams{}
+	if err := request.DecodeParams(&params); err != nil {
+		return nil, err
+	}
+	ca := &model.CertificateAuthority{}
+	if err := a.mdb.Select(ca, bson.M{"name": params.Name}); err != nil {
+		return nil, err
+	}
+	if !ca.IsRoot() {
+		return nil, errors.Newf("`%s` is not a root certificate authority", ca.Name)
+	}
+	secret := &model.Secret{}
+	if err := a.mdb.Select(secret, bson.M{"_id": ca.SecretID}); err != nil {
+		return nil, err
+	}
+	private, err := secret.Private(a.sealer)
+	if err != nil {
+		return nil, err
+	}
+	a.logger.Warnf("Root key of `%s` was exported, requested by `%s`", ca.Name, request.RequestedBy)
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: private}), nil
+}
+
+// keyRecord loads the key of kind, as routes label it, and the id of its secret.
+func keyRecord(mdb *service.MongoDB, params keyParams) (interface{}, primitive.ObjectID, error) {
+	filter := bson.M{"name": params.Name}
+	switch params.Kind {
+	case "pgp":
+		key := &model.PgpKey{}
+		err := mdb.Select(key, filter)
+		return key, key.SecretID, err
+	case "jose":
+		key := &model.JoseKey{}
+		err := mdb.Select(key, filter)
+		return key, key.SecretID, err
+	case "pki":
+		key := &model.CertificateAuthority{}
+		err := mdb.Select(key, filter)
+		return key, key.SecretID, err
+	case "fpe":
+		key := &model.FpeKey{}
+		err := mdb.Select(key, filter)
+		return key, key.SecretID, err
+	case "tokenization":
+		key := &model.TokenVault{}
+		err := mdb.Select(key, filter)
+		return key, key.SecretID, err
+	case "ssh":
+		key := &model.SshAuthority{}
+		err := mdb.Select(key, filter)
+		return key, key.SecretID, err
+	}
+	return nil, primitive.NilObjectID, errors.Newf("Unknown key kind `%s`", params.Kind)
+}
@@ -0,0 +1,72 @@
+package audit
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/hbahadorzadeh/key-master/service"
+	"github.com/hbahadorzadeh/key-master/util"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+type auditController struct {
+	tokenManager *service.TokenManager
+	audit        *service.AuditLog
+	logger       *log.Logger
+}
+
+func NewAuditController(tokenManager *service.TokenManager, audit *service.AuditLog) (a *auditController) {
+	return &auditController{
+		tokenManager: tokenManager,
+		audit:        audit,
+	}
+}
+
+func (a *auditController) Init(configs *util.Configs, logger *log.Logger, app *fiber.App) {
+	a.logger = logger
+	app.Get("/audit", a.tokenManager.Require(service.PermissionAuditRead), a.search)
+}
+
+// search pages through the audit log, filtered by exact actor, action, target or incident and by an RFC 3339 time range.
+func (a *auditController) search(ctx *fiber.Ctx) error {
+	page, err := strconv.Atoi(ctx.Query("page", "1"))
+	if err != nil || page < 1 {
+		return ctx.Status(400).SendString("page must be a positive number")
+	}
+	size, err := strconv.Atoi(ctx.Query("per_page", strconv.Itoa(defaultPageSize)))
+	if err != nil || size < 1 || size > maxPageSize {
+		return ctx.Status(400).SendString("per_page must be between 1 and 500")
+	}
+	filter := bson.M{}
+	for _, field := range []string{"actor", "action", "target", "incident"} {
+		if value := ctx.Query(field); value != "" {
+			filter[field] = value
+		}
+	}
+	created := bson.M{}
+	for param, operator := range map[string]string{"since": "$gte", "until": "$lt"} {
+		if value := ctx.Query(param); value != "" {
+			at, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return ctx.Status(400).SendString(err.Error())
+			}
+			created[operator] = primitive.NewDateTimeFromTime(at)
+		}
+	}
+	if len(created) > 0 {
+		filter["created_at"] = created
+	}
+	entries, total, err := a.audit.Search(filter, int64((page-1)*size), int64(size))
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	return ctx.JSON(fiber.Map{"entries": entries, "page": page, "per_page": size, "total": total})
+}
@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/hbahadorzadeh/key-master/model"
+	"github.com/hbahadorzadeh/key-master/service"
+	"github.com/hbahadorzadeh/key-master/util"
+	"github.com/markbates/goth"
+	log "github.com/sirupsen/logrus"
+)
+
+const ldapProvider = "ldap"
+
+type ldapLoginRequest struct {
+	Username string `json:"username" validate:"required"`
+	Password string `json:"password" validate:"required"`
+}
+
+type ldapController struct {
+	tokenManager  *service.TokenManager
+	mdb           *service.MongoDB
+	authenticator *service.LdapAuthenticator
+	validate      *validator.Validate
+	logger        *log.Logger
+}
+
+func NewLdapController(tokenManager *service.TokenManager, mdb *service.MongoDB, authenticator *service.LdapAuthenticator, validate *validator.Validate) (l *ldapController) {
+	return &ldapController{
+		tokenManager:  tokenManager,
+		mdb:           mdb,
+		authenticator: authenticator,
+		validate:      validate,
+	}
+}
+
+func (l *ldapController) Init(configs *util.Configs, logger *log.Logger, app *fiber.App) {
+	l.logger = logger
+	if !l.authenticator.Enabled() {
+		return
+	}
+	l.tokenManager.AddPublicPath("/auth/ldap/login")
+
+	app.Post("/auth/ldap/login", l.login)
+	logger.Infof("LDAP login enabled against `%s`", configs.Ldap.Url)
+}
+
+// login checks the credentials against the directory and syncs the profile, groups and roles of the user.
+func (l *ldapController) login(ctx *fiber.Ctx) error {
+	req := &ldapLoginRequest{}
+	if err := ctx.BodyParser(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if err := l.validate.Struct(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	identifier := "ldap:" + req.Username
+	if locked, err := l.tokenManager.LoginLocked(identifier); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	} else if locked {
+		return ctx.Status(429).SendString("Too many failed login attempts, try again later")
+	}
+
+	entry, err := l.authenticator.Authenticate(req.Username, req.Password)
+	if err == service.ErrLdapInvalidCredentials {
+		if err := l.tokenManager.LoginFailed(identifier); err != nil {
+			return ctx.Status(500).SendString(err.Error())
+		}
+		return ctx.Status(401).SendString(err.Error())
+	} else if err != nil {
+		l.logger.Errorf("LDAP login of `%s` failed: %v", req.Username, err)
+		return ctx.Status(502).SendString("Directory is unavailable")
+	}
+	l.tokenManager.LoginSucceeded(identifier)
+
+	user, err := model.ProvisionRemoteUser(l.mdb, ldapProvider, entry.DN, entry.Email, entry.FirstName, entry.LastName, entry.Groups)
+	if err == model.ErrLocalAccount || err == model.ErrOtherProvider {
+		return ctx.Status(403).SendString(err.Error())
+	} else if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	if user.Disabled {
+		return ctx.Status(403).SendString("Account is disabled")
+	}
+	if err := user.SetDirectoryRoles(l.mdb, l.authenticator.Roles(entry.Groups)); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+
+	gothUser := goth.User{Email: user.Email, Name: strings.TrimSpace(user.FirstName + " " + user.LastName)}
+	if user.HasSecondFactor() {
+		token, err := l.tokenManager.InvokeMfaToken(gothUser, ldapProvider)
+		if err != nil {
+			return ctx.Status(500).SendString(err.Error())
+		}
+		return ctx.JSON(fiber.Map{"mfa_token": token, "mfa_required": true, "mfa_methods": mfaMethods(user)})
+	}
+	return sendTokens(ctx, l.tokenManager, gothUser, ldapProvider)
+}
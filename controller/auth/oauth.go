@@ -2,15 +2,17 @@ package auth
 
 import (
 	"fmt"
-	jwt "github.com/form3tech-oss/jwt-go"
 	"github.com/gofiber/fiber/v2"
+	"github.com/hbahadorzadeh/key-master/model"
 	"github.com/hbahadorzadeh/key-master/service"
 	"github.com/hbahadorzadeh/key-master/util"
 	"github.com/markbates/goth"
 	"github.com/markbates/goth/providers/github"
 	"github.com/markbates/goth/providers/google"
+	"github.com/markbates/goth/providers/openidConnect"
 	"github.com/shareed2k/goth_fiber"
 	log "github.com/sirupsen/logrus"
+	"gopkg.in/errgo.v2/fmt/errors"
 	"strings"
 )
 
@@ -21,16 +23,32 @@ type oAuthProvider struct {
 	handler      goth.Provider
 }
 
+// oidcProvider keeps what is needed to validate and map the ID tokens of a generic OpenID Connect provider.
+type oidcProvider struct {
+	verifier    *service.OidcVerifier
+	emailClaim  string
+	groupsClaim string
+}
+
 type oAuthController struct {
-	tokenManager *service.TokenManager
+	tokenManager  *service.TokenManager
+	mdb           *service.MongoDB
+	oidcProviders map[string]*oidcProvider
 }
 
-func NewOAuthController(tokenManager *service.TokenManager) (o *oAuthController) {
+func NewOAuthController(tokenManager *service.TokenManager, mdb *service.MongoDB) (o *oAuthController) {
 	return &oAuthController{
-		tokenManager: tokenManager,
+		tokenManager:  tokenManager,
+		mdb:           mdb,
+		oidcProviders: map[string]*oidcProvider{},
 	}
 }
 func (o *oAuthController) Init(configs *util.Configs, logger *log.Logger, app *fiber.App) {
+	// goth keeps one global set of providers whose callbacks point at the default namespace, a namespace
+	// registering them again would send its logins there
+	if o.mdb.NamespaceName() != service.DefaultNamespace {
+		return
+	}
 	providers := make([]goth.Provider, 0)
 	for _, d := range configs.OAuthProviders {
 		callback := fmt.Sprintf("%s:%s/auth/callback/%s", configs.Web.ApiBaseUrl, configs.Web.BindPort, strings.ToLower(d.Name))
@@ -41,10 +59,24 @@ func (o *oAuthController) Init(configs *util.Configs, logger *log.Logger, app *f
 		case "google":
 			providers = append(providers, google.New(d.ClientId, d.ClientSecret, callback))
 			logger.Infof("OAuth provider added for `%s`", d.Name)
+		default:
+			if d.DiscoveryUrl == "" {
+				logger.Warnf("OAuth provider `%s` is unknown and has no discovery url", d.Name)
+				continue
+			}
+			provider, err := o.newOidcProvider(d, callback)
+			if err != nil {
+				logger.Errorf("OpenID Connect provider `%s` could not be set up: %v", d.Name, err)
+				continue
+			}
+			providers = append(providers, provider)
+			logger.Infof("OpenID Connect provider added for `%s`", d.Name)
 		}
 	}
 
 	goth.UseProviders(providers...)
+	o.tokenManager.AddPublicPath("/auth/login/")
+	o.tokenManager.AddPublicPath("/auth/callback/")
 
 	app.Get("/auth/login/:provider", goth_fiber.BeginAuthHandler)
 	app.Get("/auth/callback/:provider", func(ctx *fiber.Ctx) error {
@@ -56,22 +88,108 @@ func (o *oAuthController) Init(configs *util.Configs, logger *log.Logger, app *f
 		if err != nil {
 			return ctx.Status(500).SendString(err.Error())
 		}
-		token, err := o.tokenManager.InvokeToken(user, provider)
-		if err != nil {
-			return ctx.Status(500).SendString(err.Error())
+		if oidc, ok := o.oidcProviders[provider]; ok {
+			if user, err = o.oidcUser(oidc, user); err == model.ErrLocalAccount || err == model.ErrOtherProvider {
+				return ctx.Status(403).SendString(err.Error())
+			} else if err != nil {
+				return ctx.Status(401).SendString(err.Error())
+			}
+		}
+		u, err := model.FindUserByEmail(o.mdb, user.Email)
+		if err == nil && !u.IsRemote {
+			return ctx.Status(403).SendString(model.ErrLocalAccount.Error())
+		}
+		if err == nil && !u.OwnedBy(provider, user.UserID) {
+			return ctx.Status(403).SendString(model.ErrOtherProvider.Error())
+		}
+		if err == nil && u.Disabled {
+			return ctx.Status(403).SendString("Account is disabled")
 		}
-		return ctx.JSON(fiber.Map{"token": token})
+		if err == nil && u.HasSecondFactor() {
+			token, err := o.tokenManager.InvokeMfaToken(user, provider)
+			if err != nil {
+				return ctx.Status(500).SendString(err.Error())
+			}
+			return ctx.JSON(fiber.Map{"mfa_token": token, "mfa_required": true, "mfa_methods": mfaMethods(u)})
+		}
+		return sendTokens(ctx, o.tokenManager, user, provider)
 	})
 
 	app.Get("/auth/logout/:provider", func(ctx *fiber.Ctx) error {
 		if err := goth_fiber.Logout(ctx); err != nil {
 			return ctx.Status(500).SendString(err.Error())
 		}
-		token := ctx.Locals("user").(jwt.Token)
-		err := o.tokenManager.RevokeToken(token)
-		if err != nil {
+		if err := revokeCurrentSession(ctx, o.tokenManager); err != nil {
 			return ctx.Status(500).SendString(err.Error())
 		}
 		return ctx.SendString("logout")
 	})
 }
+
+func (o *oAuthController) newOidcProvider(d *util.OAuthProvider, callback string) (goth.Provider, error) {
+	scopes := d.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"email", "profile"}
+	}
+	provider, err := openidConnect.New(d.ClientId, d.ClientSecret, callback, d.DiscoveryUrl, scopes...)
+	if err != nil {
+		return nil, err
+	}
+	provider.SetName(strings.ToLower(d.Name))
+	verifier, err := service.NewOidcVerifier(d.DiscoveryUrl, d.ClientId)
+	if err != nil {
+		return nil, err
+	}
+	oidc := &oidcProvider{
+		verifier:    verifier,
+		emailClaim:  d.EmailClaim,
+		groupsClaim: d.GroupsClaim,
+	}
+	if oidc.emailClaim == "" {
+		oidc.emailClaim = "email"
+	}
+	if oidc.groupsClaim == "" {
+		oidc.groupsClaim = "groups"
+	}
+	o.oidcProviders[provider.Name()] = oidc
+	return provider, nil
+}
+
+// oidcUser verifies the ID token signature, which goth skips, maps the configured claims
+// and provisions the matching remote user.
+func (o *oAuthController) oidcUser(oidc *oidcProvider, user goth.User) (goth.User, error) {
+	claims, err := oidc.verifier.Verify(user.IDToken)
+	if err != nil {
+		return user, err
+	}
+	// Claims from the userinfo endpoint complement the ID token but never override it
+	for k, v := range user.RawData {
+		if _, ok := claims[k]; !ok {
+			claims[k] = v
+		}
+	}
+	if verified, _ := claims["email_verified"].(bool); !verified {
+		return user, errors.New("Email address is not verified by the identity provider")
+	}
+	user.Email = service.ClaimString(claims, oidc.emailClaim)
+	if user.Email == "" {
+		return user, errors.Newf("Claim `%s` is missing from the ID token", oidc.emailClaim)
+	}
+	groups := service.ClaimStrings(claims, oidc.groupsClaim)
+	if _, err := model.ProvisionRemoteUser(o.mdb, user.Provider, service.ClaimString(claims, "sub"), user.Email, user.FirstName, user.LastName, groups); err != nil {
+		return user, err
+	}
+	return user, nil
+}
+
+// mfaMethods lists the second factors the user may complete a login with.
+func mfaMethods(u *model.User) []string {
+	methods := []string{}
+	if u.TotpEnabled {
+		methods = append(methods, "otp")
+	}
+	if len(u.WebAuthnCredentials) > 0 {
+		methods = append(methods, "webauthn")
+	}
+	return methods
+}
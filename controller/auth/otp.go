@@ -1,84 +1,231 @@
 package auth
 
 import (
-	"bufio"
 	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base32"
+	"encoding/base64"
 	"fmt"
 	"image/png"
-	"io/ioutil"
-	"os"
-	"time"
+	"strings"
 
+	"github.com/go-playground/validator/v10"
 	"github.com/gofiber/fiber/v2"
+	"github.com/hbahadorzadeh/key-master/model"
+	"github.com/hbahadorzadeh/key-master/service"
 	"github.com/hbahadorzadeh/key-master/util"
-	"github.com/pquerna/otp"
-	"github.com/pquerna/otp/totp"
+	"github.com/markbates/goth"
 	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
 )
 
-func display(key *otp.Key, data []byte) {
-	fmt.Printf("Issuer:       %s\n", key.Issuer())
-	fmt.Printf("Account Name: %s\n", key.AccountName())
-	fmt.Printf("Secret:       %s\n", key.Secret())
-	fmt.Println("Writing PNG to qr-code.png....")
-	ioutil.WriteFile("qr-code.png", data, 0644)
-	fmt.Println("")
-	fmt.Println("Please add your TOTP to your OTP Application now!")
-	fmt.Println("")
+const (
+	otpIssuer         = "key-master"
+	recoveryCodeCount = 10
+)
+
+type otpCodeRequest struct {
+	Code string `json:"code" validate:"required,numeric,len=6"`
 }
 
-func promptForPasscode() string {
-	reader := bufio.NewReader(os.Stdin)
-	fmt.Print("Enter Passcode: ")
-	text, _ := reader.ReadString('\n')
-	return text
+type otpVerifyRequest struct {
+	Code         string `json:"code" validate:"required_without=RecoveryCode"`
+	RecoveryCode string `json:"recovery_code"`
 }
 
-// Demo function, not used in main
-// Generates Passcode using a UTF-8 (not base32) secret and custom parameters
-func GeneratePassCode(utf8string string) string {
-	secret := base32.StdEncoding.EncodeToString([]byte(utf8string))
-	passcode, err := totp.GenerateCodeCustom(secret, time.Now(), totp.ValidateOpts{
-		Period:    30,
-		Skew:      1,
-		Digits:    otp.DigitsSix,
-		Algorithm: otp.AlgorithmSHA512,
-	})
-	if err != nil {
-		panic(err)
+type otpController struct {
+	tokenManager *service.TokenManager
+	mdb          *service.MongoDB
+	otpValidator *service.OtpValidator
+	validate     *validator.Validate
+	logger       *log.Logger
+}
+
+func NewOtpController(tokenManager *service.TokenManager, mdb *service.MongoDB, otpValidator *service.OtpValidator, validate *validator.Validate) (o *otpController) {
+	return &otpController{
+		tokenManager: tokenManager,
+		mdb:          mdb,
+		otpValidator: otpValidator,
+		validate:     validate,
 	}
-	return passcode
 }
 
-func Init(configs *util.Configs, logger *log.Logger, app *fiber.App) {
-	key, err := totp.Generate(totp.GenerateOpts{
-		Issuer:      "Example.com",
-		AccountName: "alice@example.com",
-	})
+func (o *otpController) Init(configs *util.Configs, logger *log.Logger, app *fiber.App) {
+	o.logger = logger
+	o.tokenManager.AddMfaPath("/auth/otp/verify")
+
+	app.Post("/auth/otp/enroll", o.enroll)
+	app.Post("/auth/otp/confirm", o.confirm)
+	app.Post("/auth/otp/verify", o.verify)
+	app.Post("/auth/otp/recovery-codes", o.regenerateRecoveryCodes)
+}
+
+// enroll starts a new TOTP enrollment, it only takes effect once confirmed with a first code.
+func (o *otpController) enroll(ctx *fiber.Ctx) error {
+	user, err := model.FindUserByEmail(o.mdb, o.tokenManager.GetEmail(ctx))
 	if err != nil {
-		panic(err)
+		return ctx.Status(404).SendString(err.Error())
+	}
+	if user.TotpEnabled {
+		return ctx.Status(409).SendString("TOTP is already enabled")
+	}
+	key, sealed, err := o.otpValidator.Generate(otpIssuer, user.Email)
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
 	}
-	// Convert TOTP key into a PNG
-	var buf bytes.Buffer
 	img, err := key.Image(200, 200)
 	if err != nil {
-		panic(err)
+		return ctx.Status(500).SendString(err.Error())
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	if err := o.mdb.Update(user, bson.M{"$set": bson.M{"totp_secret": sealed, "totp_enabled": false}}); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	return ctx.JSON(fiber.Map{
+		"provisioning_uri": key.URL(),
+		"qr_png":           base64.StdEncoding.EncodeToString(buf.Bytes()),
+	})
+}
+
+func (o *otpController) confirm(ctx *fiber.Ctx) error {
+	req := &otpCodeRequest{}
+	if err := ctx.BodyParser(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if err := o.validate.Struct(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	user, err := model.FindUserByEmail(o.mdb, o.tokenManager.GetEmail(ctx))
+	if err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	if user.TotpEnabled || len(user.TotpSecret) == 0 {
+		return ctx.Status(409).SendString("No pending TOTP enrollment")
+	}
+	if valid, err := o.otpValidator.Validate(user.ID.Hex(), user.TotpSecret, req.Code); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	} else if !valid {
+		return ctx.Status(401).SendString("Invalid code")
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	if err := o.mdb.Update(user, bson.M{"$set": bson.M{"totp_enabled": true, "recovery_codes": hashes}}); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	o.logger.Infof("TOTP enabled for `%s`", user.Email)
+	return ctx.JSON(fiber.Map{"recovery_codes": codes})
+}
+
+// verify exchanges a token from InvokeMfaToken and a second factor for a fully privileged token.
+// Wrong codes and recovery codes count towards the lockout of the user.
+func (o *otpController) verify(ctx *fiber.Ctx) error {
+	req := &otpVerifyRequest{}
+	if err := ctx.BodyParser(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if err := o.validate.Struct(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	claims := o.tokenManager.GetClaims(ctx)
+	if pending, _ := claims["mfa_pending"].(bool); !pending {
+		return ctx.Status(400).SendString("Token is not waiting for a second factor")
+	}
+	user, err := model.FindUserByEmail(o.mdb, o.tokenManager.GetEmail(ctx))
+	if err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	if !user.TotpEnabled {
+		return ctx.Status(409).SendString("TOTP is not enabled")
+	}
+	identifier := "otp:" + user.Email
+	if locked, err := o.tokenManager.LoginLocked(identifier); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	} else if locked {
+		return ctx.Status(429).SendString("Too many failed attempts, try again later")
+	}
+	factor := "otp"
+	if req.RecoveryCode != "" {
+		factor = "recovery_code"
+		hash := hashRecoveryCode(req.RecoveryCode)
+		// Pulling the code only when it is still there spends it once, however many requests race for it
+		spent, err := o.mdb.UpdateIf(user, bson.M{"recovery_codes": hash}, bson.M{"$pull": bson.M{"recovery_codes": hash}})
+		if err != nil {
+			return ctx.Status(500).SendString(err.Error())
+		}
+		if !spent {
+			if err := o.tokenManager.LoginFailed(identifier); err != nil {
+				return ctx.Status(500).SendString(err.Error())
+			}
+			return ctx.Status(401).SendString("Invalid recovery code")
+		}
+		o.logger.Warnf("Recovery code used by `%s`, `%d` left", user.Email, len(user.RecoveryCodes)-1)
+	} else if valid, err := o.otpValidator.Validate(user.ID.Hex(), user.TotpSecret, req.Code); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	} else if !valid {
+		if err := o.tokenManager.LoginFailed(identifier); err != nil {
+			return ctx.Status(500).SendString(err.Error())
+		}
+		return ctx.Status(401).SendString("Invalid code")
 	}
-	png.Encode(&buf, img)
+	o.tokenManager.LoginSucceeded(identifier)
+	provider, _ := claims["provider"].(string)
+	name, _ := claims["name"].(string)
+	return sendTokens(ctx, o.tokenManager, goth.User{Email: user.Email, Name: name}, provider, factor)
+}
 
-	// display the QR code to the user.
-	display(key, buf.Bytes())
+func (o *otpController) regenerateRecoveryCodes(ctx *fiber.Ctx) error {
+	req := &otpCodeRequest{}
+	if err := ctx.BodyParser(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if err := o.validate.Struct(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	user, err := model.FindUserByEmail(o.mdb, o.tokenManager.GetEmail(ctx))
+	if err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	if !user.TotpEnabled {
+		return ctx.Status(409).SendString("TOTP is not enabled")
+	}
+	if valid, err := o.otpValidator.Validate(user.ID.Hex(), user.TotpSecret, req.Code); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	} else if !valid {
+		return ctx.Status(401).SendString("Invalid code")
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	if err := o.mdb.Update(user, bson.M{"$set": bson.M{"recovery_codes": hashes}}); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	return ctx.JSON(fiber.Map{"recovery_codes": codes})
+}
 
-	// Now Validate that the user's successfully added the passcode.
-	fmt.Println("Validating TOTP...")
-	passcode := promptForPasscode()
-	valid := totp.Validate(passcode, key.Secret())
-	if valid {
-		println("Valid passcode!")
-		os.Exit(0)
-	} else {
-		println("Invalid passcode!")
-		os.Exit(1)
+// newRecoveryCodes returns one-time codes for the user and the hashes to store.
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+		code = fmt.Sprintf("%s-%s", code[:8], code[8:16])
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
 	}
+	return codes, hashes, nil
+}
+
+func hashRecoveryCode(code string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(code)))))
 }
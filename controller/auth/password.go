@@ -0,0 +1,188 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/go-redis/redis/v8"
+	"github.com/gofiber/fiber/v2"
+	"github.com/hbahadorzadeh/key-master/model"
+	"github.com/hbahadorzadeh/key-master/service"
+	"github.com/hbahadorzadeh/key-master/util"
+	"github.com/markbates/goth"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	localProvider        = "local"
+	passwordResetTTL     = 30 * time.Minute
+	passwordResetSubject = "key-master password reset"
+)
+
+type loginRequest struct {
+	Email    string `json:"email" validate:"required,email"`
+	Password string `json:"password" validate:"required"`
+}
+
+type forgotPasswordRequest struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+type resetPasswordRequest struct {
+	Token    string `json:"token" validate:"required"`
+	Password string `json:"password" validate:"required,min=12"`
+}
+
+type passwordController struct {
+	tokenManager *service.TokenManager
+	mdb          *service.MongoDB
+	rdb          *redis.Client
+	mailer       *service.Mailer
+	validate     *validator.Validate
+	logger       *log.Logger
+	resetUrl     string
+}
+
+func NewPasswordController(tokenManager *service.TokenManager, mdb *service.MongoDB, rdb *redis.Client, mailer *service.Mailer, validate *validator.Validate) (p *passwordController) {
+	return &passwordController{
+		tokenManager: tokenManager,
+		mdb:          mdb,
+		rdb:          rdb,
+		mailer:       mailer,
+		validate:     validate,
+	}
+}
+
+func (p *passwordController) Init(configs *util.Configs, logger *log.Logger, app *fiber.App) {
+	p.logger = logger
+	p.resetUrl = fmt.Sprintf("%s/reset-password", strings.TrimSuffix(configs.Web.UiUrl, "/"))
+	p.tokenManager.AddPublicPath("/auth/login")
+	p.tokenManager.AddPublicPath("/auth/password/forgot")
+	p.tokenManager.AddPublicPath("/auth/password/reset")
+
+	app.Post("/auth/login", p.login)
+	app.Post("/auth/password/forgot", p.forgot)
+	app.Post("/auth/password/reset", p.reset)
+}
+
+// login authenticates local accounts, remote accounts have to use their identity provider.
+func (p *passwordController) login(ctx *fiber.Ctx) error {
+	req := new(loginRequest)
+	if err := ctx.BodyParser(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if err := p.validate.Struct(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if locked, err := p.tokenManager.LoginLocked(req.Email); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	} else if locked {
+		return ctx.Status(429).SendString("Too many failed login attempts, try again later")
+	}
+
+	user, err := model.FindUserByEmail(p.mdb, req.Email)
+	ok := false
+	if err == nil && !user.IsRemote && user.Password != "" {
+		if ok, err = user.CheckPassword(p.mdb, req.Password); err != nil {
+			return ctx.Status(500).SendString(err.Error())
+		}
+	} else {
+		service.SimulatePasswordCheck(req.Password)
+	}
+	if !ok {
+		if err := p.tokenManager.LoginFailed(req.Email); err != nil {
+			return ctx.Status(500).SendString(err.Error())
+		}
+		return ctx.Status(401).SendString("Invalid email or password")
+	}
+	p.tokenManager.LoginSucceeded(req.Email)
+	if user.Disabled {
+		return ctx.Status(403).SendString("Account is disabled")
+	}
+
+	gothUser := goth.User{Email: user.Email, Name: strings.TrimSpace(user.FirstName + " " + user.LastName)}
+	if user.HasSecondFactor() {
+		token, err := p.tokenManager.InvokeMfaToken(gothUser, localProvider)
+		if err != nil {
+			return ctx.Status(500).SendString(err.Error())
+		}
+		return ctx.JSON(fiber.Map{"mfa_token": token, "mfa_required": true, "mfa_methods": mfaMethods(user)})
+	}
+	return sendTokens(ctx, p.tokenManager, gothUser, localProvider)
+}
+
+// forgot mails a one-time reset link, it answers the same way whether the account exists or not.
+func (p *passwordController) forgot(ctx *fiber.Ctx) error {
+	req := new(forgotPasswordRequest)
+	if err := ctx.BodyParser(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if err := p.validate.Struct(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	user, err := model.FindUserByEmail(p.mdb, req.Email)
+	if err != nil || user.IsRemote {
+		return ctx.SendStatus(202)
+	}
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+	if err := p.rdb.Set(context.Background(), resetKey(p.tokenManager.Subject(token)), user.ID.Hex(), passwordResetTTL).Err(); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	body := fmt.Sprintf("A password reset was requested for your account.\n\n"+
+		"Use the link below within %s to choose a new password:\n\n%s?token=%s\n\n"+
+		"If you did not request this, you can ignore this message.", passwordResetTTL, p.resetUrl, token)
+	if err := p.mailer.Send([]string{user.Email}, passwordResetSubject, body); err != nil {
+		p.logger.Errorf("Sending password reset mail to `%s` failed: %v", user.Email, err)
+	}
+	return ctx.SendStatus(202)
+}
+
+func (p *passwordController) reset(ctx *fiber.Ctx) error {
+	req := new(resetPasswordRequest)
+	if err := ctx.BodyParser(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if err := p.validate.Struct(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	userID, err := p.rdb.GetDel(context.Background(), resetKey(p.tokenManager.Subject(req.Token))).Result()
+	if err == redis.Nil {
+		return ctx.Status(400).SendString("Reset link is invalid or expired")
+	} else if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	user := new(model.User)
+	if err := p.mdb.Select(user, bson.M{"_id": id}); err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	if err := user.SetPassword(p.mdb, req.Password); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	// Whoever knew the old password may still hold a session
+	if err := p.tokenManager.RevokeUserSessions(user.Email); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	p.tokenManager.LoginSucceeded(user.Email)
+	return ctx.SendStatus(204)
+}
+
+// resetKey stores reset tokens hashed so a Redis dump cannot be replayed.
+func resetKey(token string) string {
+	return fmt.Sprintf("password:reset:%x", sha256.Sum256([]byte(token)))
+}
@@ -0,0 +1,128 @@
+package auth
+
+import (
+	jwt "github.com/form3tech-oss/jwt-go"
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/hbahadorzadeh/key-master/service"
+	"github.com/hbahadorzadeh/key-master/util"
+	"github.com/markbates/goth"
+	log "github.com/sirupsen/logrus"
+)
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token" validate:"required"`
+}
+
+type tokenController struct {
+	tokenManager *service.TokenManager
+	validate     *validator.Validate
+}
+
+func NewTokenController(tokenManager *service.TokenManager, validate *validator.Validate) (t *tokenController) {
+	return &tokenController{
+		tokenManager: tokenManager,
+		validate:     validate,
+	}
+}
+
+func (t *tokenController) Init(configs *util.Configs, logger *log.Logger, app *fiber.App) {
+	t.tokenManager.AddPublicPath("/auth/refresh")
+	t.tokenManager.AddPublicPath("/.well-known/jwks.json")
+
+	app.Get("/.well-known/jwks.json", t.jwks)
+	app.Post("/auth/refresh", t.refresh)
+	app.Post("/auth/logout", t.logout)
+	app.Get("/auth/sessions", t.sessions)
+	app.Delete("/auth/sessions/:id", t.revokeSession)
+	app.Delete("/admin/users/:email/sessions", t.tokenManager.Require(service.PermissionUsersManage), t.revokeUserSessions)
+}
+
+// jwks publishes the keys access tokens are verified with, retired keys drop out after their overlap.
+func (t *tokenController) jwks(ctx *fiber.Ctx) error {
+	set, err := t.tokenManager.GetJWKS()
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	ctx.Set(fiber.HeaderCacheControl, "public, max-age=300")
+	return ctx.JSON(set)
+}
+
+// refresh rotates the refresh token, every refresh token can be exchanged only once.
+func (t *tokenController) refresh(ctx *fiber.Ctx) error {
+	req := &refreshRequest{}
+	if err := ctx.BodyParser(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if err := t.validate.Struct(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	token, refreshToken, err := t.tokenManager.RefreshToken(req.RefreshToken)
+	if err != nil {
+		return ctx.Status(401).SendString(err.Error())
+	}
+	return ctx.JSON(fiber.Map{"token": token, "refresh_token": refreshToken})
+}
+
+// logout ends the session of the calling token, other devices stay logged in.
+func (t *tokenController) logout(ctx *fiber.Ctx) error {
+	if err := revokeCurrentSession(ctx, t.tokenManager); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	return ctx.SendStatus(204)
+}
+
+func (t *tokenController) sessions(ctx *fiber.Ctx) error {
+	sid, _ := t.tokenManager.GetClaims(ctx)["sid"].(string)
+	sessions, err := t.tokenManager.GetSessions(t.tokenManager.GetEmail(ctx), sid)
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	return ctx.JSON(sessions)
+}
+
+func (t *tokenController) revokeSession(ctx *fiber.Ctx) error {
+	email := t.tokenManager.GetEmail(ctx)
+	sessions, err := t.tokenManager.GetSessions(email, "")
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	for _, session := range sessions {
+		if session.ID == ctx.Params("id") {
+			if err := t.tokenManager.RevokeSession(email, session.ID); err != nil {
+				return ctx.Status(500).SendString(err.Error())
+			}
+			return ctx.SendStatus(204)
+		}
+	}
+	return ctx.Status(404).SendString("Session not found")
+}
+
+// revokeUserSessions logs a user out of every device, e.g. after a credential leak.
+func (t *tokenController) revokeUserSessions(ctx *fiber.Ctx) error {
+	if err := t.tokenManager.RevokeUserSessions(ctx.Params("email")); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	return ctx.SendStatus(204)
+}
+
+// revokeCurrentSession revokes the session of the calling token, or the token alone if it has none.
+func revokeCurrentSession(ctx *fiber.Ctx, tokenManager *service.TokenManager) error {
+	token, ok := ctx.Locals("user").(*jwt.Token)
+	if !ok {
+		return nil
+	}
+	if sid, _ := tokenManager.GetClaims(ctx)["sid"].(string); sid != "" {
+		return tokenManager.RevokeSession(tokenManager.GetEmail(ctx), sid)
+	}
+	return tokenManager.RevokeToken(token)
+}
+
+// sendTokens completes a login, the refresh token starts a new token family.
+func sendTokens(ctx *fiber.Ctx, tokenManager *service.TokenManager, user goth.User, provider string, amr ...string) error {
+	token, refreshToken, err := tokenManager.InvokeTokens(ctx, user, provider, amr...)
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	return ctx.JSON(fiber.Map{"token": token, "refresh_token": refreshToken})
+}
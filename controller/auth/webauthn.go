@@ -0,0 +1,334 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/duo-labs/webauthn/protocol"
+	"github.com/duo-labs/webauthn/webauthn"
+	"github.com/go-playground/validator/v10"
+	redis "github.com/go-redis/redis/v8"
+	"github.com/gofiber/fiber/v2"
+	"github.com/hbahadorzadeh/key-master/model"
+	"github.com/hbahadorzadeh/key-master/service"
+	"github.com/hbahadorzadeh/key-master/util"
+	"github.com/markbates/goth"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+const webAuthnSessionTTL = 5 * time.Minute
+
+type webAuthnLoginRequest struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+// webAuthnUser adapts model.User to the webauthn.User interface.
+type webAuthnUser struct {
+	*model.User
+}
+
+func (u webAuthnUser) WebAuthnID() []byte {
+	return u.ID[:]
+}
+
+func (u webAuthnUser) WebAuthnName() string {
+	return u.Email
+}
+
+func (u webAuthnUser) WebAuthnDisplayName() string {
+	return fmt.Sprintf("%s %s", u.FirstName, u.LastName)
+}
+
+func (u webAuthnUser) WebAuthnIcon() string {
+	return ""
+}
+
+func (u webAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := make([]webauthn.Credential, 0, len(u.User.WebAuthnCredentials))
+	for _, c := range u.User.WebAuthnCredentials {
+		credentials = append(credentials, webauthn.Credential{
+			ID:              c.ID,
+			PublicKey:       c.PublicKey,
+			AttestationType: c.AttestationType,
+			Authenticator: webauthn.Authenticator{
+				AAGUID:    c.AAGUID,
+				SignCount: c.SignCount,
+			},
+		})
+	}
+	return credentials
+}
+
+type webAuthnController struct {
+	tokenManager *service.TokenManager
+	mdb          *service.MongoDB
+	rdb          *redis.Client
+	validate     *validator.Validate
+	logger       *log.Logger
+	webAuthn     *webauthn.WebAuthn
+}
+
+func NewWebAuthnController(tokenManager *service.TokenManager, mdb *service.MongoDB, rdb *redis.Client, validate *validator.Validate) (w *webAuthnController) {
+	return &webAuthnController{
+		tokenManager: tokenManager,
+		mdb:          mdb,
+		rdb:          rdb,
+		validate:     validate,
+	}
+}
+
+func (w *webAuthnController) Init(configs *util.Configs, logger *log.Logger, app *fiber.App) {
+	w.logger = logger
+	rpID := configs.Web.WebAuthn.RPID
+	if rpID == "" {
+		if u, err := url.Parse(configs.Web.ApiBaseUrl); err == nil {
+			rpID = u.Hostname()
+		}
+	}
+	displayName := configs.Web.WebAuthn.RPDisplayName
+	if displayName == "" {
+		displayName = "key-master"
+	}
+	web, err := webauthn.New(&webauthn.Config{
+		RPDisplayName: displayName,
+		RPID:          rpID,
+		RPOrigin:      configs.Web.WebAuthn.RPOrigin,
+	})
+	if err != nil {
+		logger.Errorf("WebAuthn disabled: %s", err)
+		return
+	}
+	w.webAuthn = web
+
+	app.Post("/auth/webauthn/register/begin", w.beginRegistration)
+	app.Post("/auth/webauthn/register/finish", w.finishRegistration)
+	app.Get("/auth/webauthn/credentials", w.listCredentials)
+	app.Delete("/auth/webauthn/credentials/:id", w.deleteCredential)
+
+	// Second factor after a provider login, with a token from InvokeMfaToken.
+	w.tokenManager.AddMfaPath("/auth/webauthn/verify/")
+	app.Post("/auth/webauthn/verify/begin", w.beginVerify)
+	app.Post("/auth/webauthn/verify/finish", w.finishVerify)
+
+	// Passwordless login, identified by email and proven by the authenticator.
+	w.tokenManager.AddPublicPath("/auth/webauthn/login/")
+	app.Post("/auth/webauthn/login/begin", w.beginLogin)
+	app.Post("/auth/webauthn/login/finish", w.finishLogin)
+}
+
+func (w *webAuthnController) beginRegistration(ctx *fiber.Ctx) error {
+	user, err := model.FindUserByEmail(w.mdb, w.tokenManager.GetEmail(ctx))
+	if err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	wu := webAuthnUser{user}
+	exclusions := []protocol.CredentialDescriptor{}
+	for _, c := range wu.WebAuthnCredentials() {
+		exclusions = append(exclusions, protocol.CredentialDescriptor{
+			Type:         protocol.PublicKeyCredentialType,
+			CredentialID: c.ID,
+		})
+	}
+	options, session, err := w.webAuthn.BeginRegistration(wu, webauthn.WithExclusions(exclusions))
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	if err := w.storeSession("register", user, session); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	return ctx.JSON(options)
+}
+
+func (w *webAuthnController) finishRegistration(ctx *fiber.Ctx) error {
+	user, err := model.FindUserByEmail(w.mdb, w.tokenManager.GetEmail(ctx))
+	if err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	session, err := w.loadSession("register", user)
+	if err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	parsed, err := protocol.ParseCredentialCreationResponseBody(bytes.NewReader(ctx.Body()))
+	if err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	credential, err := w.webAuthn.CreateCredential(webAuthnUser{user}, *session, parsed)
+	if err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	name := ctx.Query("name")
+	if name == "" {
+		name = fmt.Sprintf("Authenticator %d", len(user.WebAuthnCredentials)+1)
+	}
+	stored := model.WebAuthnCredential{
+		ID:              credential.ID,
+		Name:            name,
+		PublicKey:       credential.PublicKey,
+		AttestationType: credential.AttestationType,
+		AAGUID:          credential.Authenticator.AAGUID,
+		SignCount:       credential.Authenticator.SignCount,
+		CreatedAt:       primitive.NewDateTimeFromTime(time.Now()),
+	}
+	if err := w.mdb.Update(user, bson.M{"$push": bson.M{"web_authn_credentials": stored}}); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	w.logger.Infof("WebAuthn credential `%s` registered for `%s`", name, user.Email)
+	return ctx.JSON(stored)
+}
+
+func (w *webAuthnController) listCredentials(ctx *fiber.Ctx) error {
+	user, err := model.FindUserByEmail(w.mdb, w.tokenManager.GetEmail(ctx))
+	if err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	if user.WebAuthnCredentials == nil {
+		return ctx.JSON([]model.WebAuthnCredential{})
+	}
+	return ctx.JSON(user.WebAuthnCredentials)
+}
+
+// deleteCredential removes the credential whose base64url id is given in the path. Only sessions which passed
+// a second factor may remove one, a stolen session must not be able to strip the second factor of the user.
+func (w *webAuthnController) deleteCredential(ctx *fiber.Ctx) error {
+	if mfa, _ := w.tokenManager.GetClaims(ctx)["mfa"].(bool); !mfa {
+		return ctx.Status(403).SendString("Removing a security key requires a login with a second factor")
+	}
+	id, err := base64.RawURLEncoding.DecodeString(ctx.Params("id"))
+	if err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	user, err := model.FindUserByEmail(w.mdb, w.tokenManager.GetEmail(ctx))
+	if err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	if err := w.mdb.Update(user, bson.M{"$pull": bson.M{"web_authn_credentials": bson.M{"id": id}}}); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	return ctx.SendStatus(204)
+}
+
+func (w *webAuthnController) beginVerify(ctx *fiber.Ctx) error {
+	user, err := model.FindUserByEmail(w.mdb, w.tokenManager.GetEmail(ctx))
+	if err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	return w.beginAssertion(ctx, "verify", user)
+}
+
+func (w *webAuthnController) finishVerify(ctx *fiber.Ctx) error {
+	claims := w.tokenManager.GetClaims(ctx)
+	if pending, _ := claims["mfa_pending"].(bool); !pending {
+		return ctx.Status(400).SendString("Token is not waiting for a second factor")
+	}
+	user, err := model.FindUserByEmail(w.mdb, w.tokenManager.GetEmail(ctx))
+	if err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	if err := w.finishAssertion(ctx, "verify", user); err != nil {
+		return ctx.Status(401).SendString(err.Error())
+	}
+	provider, _ := claims["provider"].(string)
+	name, _ := claims["name"].(string)
+	return sendTokens(ctx, w.tokenManager, goth.User{Email: user.Email, Name: name}, provider, "hwk")
+}
+
+func (w *webAuthnController) beginLogin(ctx *fiber.Ctx) error {
+	req := &webAuthnLoginRequest{}
+	if err := ctx.BodyParser(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if err := w.validate.Struct(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	user, err := model.FindUserByEmail(w.mdb, req.Email)
+	if err != nil || user.Disabled {
+		return ctx.Status(401).SendString("Unknown user or no registered authenticator")
+	}
+	// Without a password the authenticator has to verify the user itself, by PIN or biometrics
+	return w.beginAssertion(ctx, "login", user, webauthn.WithUserVerification(protocol.VerificationRequired))
+}
+
+// finishLogin completes a passwordless login, the email is passed as a query parameter next to the assertion body.
+func (w *webAuthnController) finishLogin(ctx *fiber.Ctx) error {
+	user, err := model.FindUserByEmail(w.mdb, ctx.Query("email"))
+	if err != nil || user.Disabled {
+		return ctx.Status(401).SendString("Unknown user or no registered authenticator")
+	}
+	if err := w.finishAssertion(ctx, "login", user); err != nil {
+		return ctx.Status(401).SendString(err.Error())
+	}
+	return sendTokens(ctx, w.tokenManager, goth.User{Email: user.Email, Name: fmt.Sprintf("%s %s", user.FirstName, user.LastName)}, "webauthn", "hwk")
+}
+
+func (w *webAuthnController) beginAssertion(ctx *fiber.Ctx, purpose string, user *model.User, opts ...webauthn.LoginOption) error {
+	if len(user.WebAuthnCredentials) == 0 {
+		return ctx.Status(401).SendString("Unknown user or no registered authenticator")
+	}
+	options, session, err := w.webAuthn.BeginLogin(webAuthnUser{user}, opts...)
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	if err := w.storeSession(purpose, user, session); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	return ctx.JSON(options)
+}
+
+// finishAssertion validates the assertion in the request body and records the new signature counter.
+// A counter which did not increase means the authenticator was cloned, the assertion fails.
+func (w *webAuthnController) finishAssertion(ctx *fiber.Ctx, purpose string, user *model.User) error {
+	session, err := w.loadSession(purpose, user)
+	if err != nil {
+		return err
+	}
+	parsed, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(ctx.Body()))
+	if err != nil {
+		return err
+	}
+	credential, err := w.webAuthn.ValidateLogin(webAuthnUser{user}, *session, parsed)
+	if err != nil {
+		return err
+	}
+	if credential.Authenticator.CloneWarning {
+		w.logger.Warnf("WebAuthn credential of `%s` reported a non increasing counter, it may be cloned", user.Email)
+		return errors.New("Authenticator counter did not increase, the authenticator may be cloned")
+	}
+	for i, c := range user.WebAuthnCredentials {
+		if bytes.Equal(c.ID, credential.ID) {
+			user.WebAuthnCredentials[i].SignCount = credential.Authenticator.SignCount
+			user.WebAuthnCredentials[i].LastUsedAt = primitive.NewDateTimeFromTime(time.Now())
+		}
+	}
+	return w.mdb.Update(user, bson.M{"$set": bson.M{"web_authn_credentials": user.WebAuthnCredentials}})
+}
+
+// storeSession keeps the challenge in Redis until the ceremony is finished, at most webAuthnSessionTTL.
+func (w *webAuthnController) storeSession(purpose string, user *model.User, session *webauthn.SessionData) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	return w.rdb.Set(context.Background(), sessionKey(purpose, user), data, webAuthnSessionTTL).Err()
+}
+
+// loadSession returns the pending challenge and deletes it so it can't be answered twice.
+func (w *webAuthnController) loadSession(purpose string, user *model.User) (*webauthn.SessionData, error) {
+	data, err := w.rdb.GetDel(context.Background(), sessionKey(purpose, user)).Bytes()
+	if err != nil {
+		return nil, errors.New("No pending WebAuthn challenge")
+	}
+	session := &webauthn.SessionData{}
+	return session, json.Unmarshal(data, session)
+}
+
+func sessionKey(purpose string, user *model.User) string {
+	return fmt.Sprintf("webauthn:%s:%s", purpose, user.ID.Hex())
+}
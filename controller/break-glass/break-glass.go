@@ -0,0 +1,353 @@
+package break_glass
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/hbahadorzadeh/key-master/model"
+	"github.com/hbahadorzadeh/key-master/service"
+	"github.com/hbahadorzadeh/key-master/util"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+// Break-glass procedure:
+//  1. An administrator seals a credential with POST /break-glass/credentials and stores the plaintext offline.
+//  2. In an emergency the operator trades it at POST /break-glass/activate for a token carrying the configured
+//     roles for the configured window. The credential is spent, every admin is alerted by mail and webhook,
+//     and every request made with the token lands in the audit log.
+//  3. The incident is closed when the window ends or with POST /break-glass/incidents/:id/close.
+//  4. An administrator records the post-incident review. Until every incident is reviewed no new credential
+//     can be sealed.
+
+type activateRequest struct {
+	Credential string `json:"credential" validate:"required"`
+	Operator   string `json:"operator" validate:"required,max=128"`
+	Reason     string `json:"reason" validate:"required,min=10"`
+}
+
+type reviewRequest struct {
+	Summary   string   `json:"summary" validate:"required"`
+	RootCause string   `json:"root_cause" validate:"required"`
+	Actions   []string `json:"actions" validate:"required,min=1,dive,required"`
+}
+
+type breakGlassController struct {
+	tokenManager *service.TokenManager
+	mdb          *service.MongoDB
+	mailer       *service.Mailer
+	audit        *service.AuditLog
+	validate     *validator.Validate
+	logger       *log.Logger
+	window       time.Duration
+	roles        []string
+	webhook      string
+	client       *http.Client
+}
+
+func NewBreakGlassController(tokenManager *service.TokenManager, mdb *service.MongoDB, mailer *service.Mailer, audit *service.AuditLog, validate *validator.Validate) (b *breakGlassController) {
+	return &breakGlassController{
+		tokenManager: tokenManager,
+		mdb:          mdb,
+		mailer:       mailer,
+		audit:        audit,
+		validate:     validate,
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (b *breakGlassController) Init(configs *util.Configs, logger *log.Logger, app *fiber.App) {
+	b.logger = logger
+	window, err := time.ParseDuration(configs.BreakGlass.Window)
+	if err != nil || window <= 0 {
+		logger.Warnf("Break-glass window `%s` is invalid, using 1h", configs.BreakGlass.Window)
+		window = time.Hour
+	}
+	b.window = window
+	b.roles = configs.BreakGlass.Roles
+	if len(b.roles) == 0 {
+		logger.Warn("Break-glass roles are not configured, activated tokens would carry no permissions")
+	}
+	b.webhook = configs.BreakGlass.Webhook
+	b.mdb.CreateCollection(model.BreakGlassCredential{})
+	b.mdb.CreateCollection(model.BreakGlassIncident{})
+	admin := b.tokenManager.Require(service.PermissionAll)
+	audit := b.tokenManager.Require(service.PermissionAuditRead)
+
+	b.tokenManager.AddPublicPath("/break-glass/activate")
+	app.Post("/break-glass/activate", b.activate)
+	app.Get("/break-glass/credentials", admin, b.credentials)
+	app.Post("/break-glass/credentials", admin, b.seal)
+	app.Get("/break-glass/incidents", audit, b.incidents)
+	app.Get("/break-glass/incidents/:id", audit, b.incident)
+	app.Post("/break-glass/incidents/:id/close", admin, b.close)
+	app.Post("/break-glass/incidents/:id/review", admin, b.review)
+}
+
+// seal generates the credential, replacing any unused one. It is refused while an incident awaits its review.
+func (b *breakGlassController) seal(ctx *fiber.Ctx) error {
+	email := b.tokenManager.GetEmail(ctx)
+	if email == "" || b.tokenManager.GetBreakGlassIncident(ctx) != "" {
+		return ctx.Status(403).SendString("Break-glass credentials are sealed by a named administrator")
+	}
+	unreviewed, err := model.UnreviewedIncidents(b.mdb)
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	if len(unreviewed) > 0 {
+		return ctx.Status(409).SendString(fmt.Sprintf("%d break-glass incidents await their post-incident review", len(unreviewed)))
+	}
+	unused := make([]model.BreakGlassCredential, 0)
+	if err := b.mdb.SelectAll(&unused, bson.M{"used_at": primitive.DateTime(0)}); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	for i := range unused {
+		if err := b.mdb.Delete(&unused[i]); err != nil {
+			return ctx.Status(500).SendString(err.Error())
+		}
+	}
+	credential, plaintext, err := model.NewBreakGlassCredential(email)
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	if err := b.mdb.Create(credential); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	b.record(ctx, email, "break-glass.seal", credential.ID.Hex(), fmt.Sprintf("%d unused credentials retired", len(unused)), "")
+	return ctx.Status(201).JSON(fiber.Map{"credential": plaintext, "hint": credential.Hint, "id": credential.ID})
+}
+
+func (b *breakGlassController) credentials(ctx *fiber.Ctx) error {
+	credentials := make([]model.BreakGlassCredential, 0)
+	if err := b.mdb.SelectAll(&credentials, bson.M{}); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	return ctx.JSON(credentials)
+}
+
+// activate spends the credential on an incident and issues its elevated token.
+func (b *breakGlassController) activate(ctx *fiber.Ctx) error {
+	req := &activateRequest{}
+	if err := ctx.BodyParser(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if err := b.validate.Struct(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	// The route is public, guesses are limited per address like logins
+	identifier := "break-glass:" + ctx.IP()
+	if locked, err := b.tokenManager.LoginLocked(identifier); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	} else if locked {
+		return ctx.Status(429).SendString("Too many failed attempts, try again later")
+	}
+	credential := &model.BreakGlassCredential{}
+	if err := b.mdb.Select(credential, bson.M{"hash": service.HashSecret(req.Credential)}); err != nil {
+		if err := b.tokenManager.LoginFailed(identifier); err != nil {
+			return ctx.Status(500).SendString(err.Error())
+		}
+		b.record(ctx, req.Operator, "break-glass.denied", "", "Unknown credential", "")
+		return ctx.Status(401).SendString("Invalid break-glass credential")
+	}
+	b.tokenManager.LoginSucceeded(identifier)
+	now := time.Now()
+	incident := &model.BreakGlassIncident{
+		CredentialID: credential.ID,
+		Operator:     req.Operator,
+		Reason:       req.Reason,
+		IP:           ctx.IP(),
+		Roles:        b.roles,
+		ExpiresAt:    primitive.NewDateTimeFromTime(now.Add(b.window)),
+	}
+	incident.ID = primitive.NewObjectID()
+	spent, err := b.mdb.UpdateIf(credential, bson.M{"used_at": primitive.DateTime(0)}, bson.M{"$set": bson.M{
+		"used_at":  primitive.NewDateTimeFromTime(now),
+		"incident": incident.ID,
+	}})
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	if !spent {
+		b.record(ctx, req.Operator, "break-glass.denied", credential.ID.Hex(), "Credential was used already", "")
+		return ctx.Status(401).SendString("Break-glass credential was used already")
+	}
+	if err := b.mdb.Create(incident); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	token, err := b.tokenManager.InvokeBreakGlassToken(incident.ID.Hex(), incident.Operator, incident.Roles, b.window)
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	b.record(ctx, incident.Operator, "break-glass.activate", credential.ID.Hex(), incident.Reason, incident.ID.Hex())
+	b.logger.Warnf("Break-glass incident `%s` opened by `%s` from %s: %s", incident.ID.Hex(), incident.Operator, incident.IP, incident.Reason)
+	go b.alert(incident)
+	return ctx.JSON(fiber.Map{
+		"access_token": token,
+		"token_type":   "Bearer",
+		"expires_in":   int(b.window.Seconds()),
+		"incident":     incident,
+	})
+}
+
+func (b *breakGlassController) incidents(ctx *fiber.Ctx) error {
+	incidents := make([]model.BreakGlassIncident, 0)
+	if _, err := b.mdb.SelectPage(&incidents, bson.M{}, bson.D{{Key: "created_at", Value: -1}}, 0, 0); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	return ctx.JSON(incidents)
+}
+
+func (b *breakGlassController) incident(ctx *fiber.Ctx) error {
+	incident, err := b.load(ctx)
+	if err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	return ctx.JSON(incident)
+}
+
+// close revokes the token of an incident before its window ends.
+func (b *breakGlassController) close(ctx *fiber.Ctx) error {
+	incident, err := b.load(ctx)
+	if err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	if incident.ClosedAt != 0 {
+		return ctx.Status(409).SendString("Incident is closed already")
+	}
+	if err := b.tokenManager.RevokeBreakGlass(incident.ID.Hex(), time.Until(incident.ExpiresAt.Time())); err != nil {
+		return ctx.Status(503).SendString(err.Error())
+	}
+	actor := b.actor(ctx)
+	if err := b.mdb.Update(incident, bson.M{"$set": bson.M{"closed_at": primitive.NewDateTimeFromTime(time.Now()), "closed_by": actor}}); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	b.record(ctx, actor, "break-glass.close", incident.ID.Hex(), "", incident.ID.Hex())
+	return b.incident(ctx)
+}
+
+// review records the mandatory post-incident review, once the elevated access is over.
+func (b *breakGlassController) review(ctx *fiber.Ctx) error {
+	req := &reviewRequest{}
+	if err := ctx.BodyParser(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if err := b.validate.Struct(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	email := b.tokenManager.GetEmail(ctx)
+	if email == "" || b.tokenManager.GetBreakGlassIncident(ctx) != "" {
+		return ctx.Status(403).SendString("Incidents are reviewed by a named administrator")
+	}
+	incident, err := b.load(ctx)
+	if err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	if incident.ClosedAt == 0 && time.Now().Before(incident.ExpiresAt.Time()) {
+		return ctx.Status(409).SendString("Incident is still open, close it first")
+	}
+	review := &model.IncidentReview{
+		Reviewer:  email,
+		Summary:   req.Summary,
+		RootCause: req.RootCause,
+		Actions:   req.Actions,
+		At:        primitive.NewDateTimeFromTime(time.Now()),
+	}
+	ok, err := b.mdb.UpdateIf(incident, bson.M{"review": nil}, bson.M{"$set": bson.M{"review": review}})
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	if !ok {
+		return ctx.Status(409).SendString("Incident was reviewed already")
+	}
+	b.record(ctx, email, "break-glass.review", incident.ID.Hex(), req.Summary, incident.ID.Hex())
+	return b.incident(ctx)
+}
+
+func (b *breakGlassController) load(ctx *fiber.Ctx) (*model.BreakGlassIncident, error) {
+	id, err := primitive.ObjectIDFromHex(ctx.Params("id"))
+	if err != nil {
+		return nil, err
+	}
+	incident := &model.BreakGlassIncident{}
+	if err := b.mdb.Select(incident, bson.M{"_id": id}); err != nil {
+		return nil, err
+	}
+	return incident, nil
+}
+
+// alert tells every admin by mail and the webhook, failures are recorded in the audit log.
+func (b *breakGlassController) alert(incident *model.BreakGlassIncident) {
+	subject := fmt.Sprintf("key-master: BREAK-GLASS access activated by %s", incident.Operator)
+	body := fmt.Sprintf("Break-glass access was activated.\n\nOperator: %s\nReason: %s\nFrom: %s\nRoles: %s\nUntil: %s\nIncident: %s\n\nA post-incident review is required.\n",
+		incident.Operator, incident.Reason, incident.IP, strings.Join(incident.Roles, ", "), incident.ExpiresAt.Time().Format(time.RFC1123), incident.ID.Hex())
+	admins, err := model.Admins(b.mdb)
+	if err == nil {
+		to := make([]string, 0, len(admins))
+		for _, admin := range admins {
+			to = append(to, admin.Email)
+		}
+		err = b.mailer.Send(to, subject, body)
+	}
+	if err != nil {
+		b.alertFailed(incident, "mail", err)
+	}
+	if b.webhook == "" {
+		return
+	}
+	payload, err := json.Marshal(fiber.Map{"event": "break-glass.activate", "incident": incident})
+	if err != nil {
+		b.alertFailed(incident, "webhook", err)
+		return
+	}
+	res, err := b.client.Post(b.webhook, fiber.MIMEApplicationJSON, bytes.NewReader(payload))
+	if err != nil {
+		b.alertFailed(incident, "webhook", err)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		b.alertFailed(incident, "webhook", errors.Newf("status %d", res.StatusCode))
+	}
+}
+
+func (b *breakGlassController) alertFailed(incident *model.BreakGlassIncident, channel string, err error) {
+	b.logger.Errorf("Break-glass %s alert of incident `%s` failed: %v", channel, incident.ID.Hex(), err)
+	if err := b.audit.Record(&service.AuditEntry{
+		Actor:    "key-master",
+		Action:   "break-glass.alert-failed",
+		Target:   channel,
+		Detail:   err.Error(),
+		Incident: incident.ID.Hex(),
+	}); err != nil {
+		b.logger.Error(err)
+	}
+}
+
+func (b *breakGlassController) actor(ctx *fiber.Ctx) string {
+	if email := b.tokenManager.GetEmail(ctx); email != "" {
+		return email
+	}
+	subject, _ := b.tokenManager.GetClaims(ctx)["sub"].(string)
+	return subject
+}
+
+func (b *breakGlassController) record(ctx *fiber.Ctx, actor, action, target, detail, incident string) {
+	if err := b.audit.Record(&service.AuditEntry{
+		Actor:    actor,
+		Action:   action,
+		Target:   target,
+		IP:       ctx.IP(),
+		Detail:   detail,
+		Incident: incident,
+	}); err != nil {
+		b.logger.Errorf("Audit entry `%s` could not be stored: %v", action, err)
+	}
+}
@@ -0,0 +1,207 @@
+package fpe
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/hbahadorzadeh/key-master/model"
+	"github.com/hbahadorzadeh/key-master/service"
+	"github.com/hbahadorzadeh/key-master/util"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const defaultAlphabet = "0123456789"
+
+type keyRequest struct {
+	Name     string        `json:"name" validate:"required"`
+	Mode     model.FpeMode `json:"mode" validate:"required,oneof=ff1 ff3-1"`
+	Alphabet string        `json:"alphabet"`
+}
+
+type cipherRequest struct {
+	Value string `json:"value" validate:"required"`
+	// Tweak is hex encoded, FF3-1 requires exactly 7 bytes and defaults to zeros.
+	Tweak string `json:"tweak" validate:"omitempty,hexadecimal"`
+}
+
+type formatPreservingCipher interface {
+	Encrypt(x []uint16, tweak []byte) ([]uint16, error)
+	Decrypt(x []uint16, tweak []byte) ([]uint16, error)
+}
+
+type fpeController struct {
+	tokenManager *service.TokenManager
+	mdb          *service.MongoDB
+	sealer       *service.Sealer
+	policies     *service.PolicyEngine
+	validate     *validator.Validate
+	logger       *log.Logger
+}
+
+func NewFpeController(tokenManager *service.TokenManager, mdb *service.MongoDB, sealer *service.Sealer, policies *service.PolicyEngine, validate *validator.Validate) (f *fpeController) {
+	return &fpeController{
+		tokenManager: tokenManager,
+		mdb:          mdb,
+		sealer:       sealer,
+		policies:     policies,
+		validate:     validate,
+	}
+}
+
+func (f *fpeController) Init(configs *util.Configs, logger *log.Logger, app *fiber.App) {
+	f.logger = logger
+	f.mdb.CreateCollection(model.FpeKey{})
+	f.mdb.CreateCollection(model.TokenVault{})
+	f.mdb.CreateCollection(model.VaultToken{})
+	// A value maps to one token and a token to one value, also when they are tokenized concurrently
+	f.mdb.CreateUniqueIndex(model.VaultToken{}, "vault_id", "value_hash")
+	f.mdb.CreateUniqueIndex(model.VaultToken{}, "vault_id", "token")
+
+	app.Post("/fpe/keys", f.tokenManager.Require(service.PermissionKeysManage), f.policies.Enforce(service.OperationCreate, "fpe"), f.createKey)
+	app.Post("/fpe/encrypt/:name", f.tokenManager.Require(service.PermissionKeysUse), f.policies.Enforce(service.OperationEncrypt, "fpe"), f.encrypt)
+	app.Post("/fpe/decrypt/:name", f.tokenManager.Require(service.PermissionKeysUse), f.policies.Enforce(service.OperationDecrypt, "fpe"), f.decrypt)
+
+	app.Post("/tokenization/vaults", f.tokenManager.Require(service.PermissionKeysManage), f.policies.Enforce(service.OperationCreate, "tokenization"), f.createVault)
+	app.Post("/tokenization/vaults/:name/detokenizers", f.tokenManager.Require(service.PermissionKeysManage), f.policies.Enforce(service.OperationManage, "tokenization"), f.addDetokenizer)
+	app.Delete("/tokenization/vaults/:name/detokenizers/:email", f.tokenManager.Require(service.PermissionKeysManage), f.policies.Enforce(service.OperationManage, "tokenization"), f.removeDetokenizer)
+	app.Post("/tokenization/tokenize/:name", f.tokenManager.Require(service.PermissionKeysUse), f.policies.Enforce(service.OperationTokenize, "tokenization"), f.tokenize)
+	app.Post("/tokenization/detokenize/:name", f.tokenManager.Require(service.PermissionKeysUse), f.policies.Enforce(service.OperationDetokenize, "tokenization"), f.detokenize)
+}
+
+func (f *fpeController) createKey(ctx *fiber.Ctx) error {
+	req := &keyRequest{}
+	if err := ctx.BodyParser(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if err := f.validate.Struct(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if req.Alphabet == "" {
+		req.Alphabet = defaultAlphabet
+	}
+	if _, err := service.NewAlphabet(req.Alphabet); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if f.mdb.Select(&model.FpeKey{}, bson.M{"name": req.Name}) == nil {
+		return ctx.Status(409).SendString(fmt.Sprintf("Key `%s` already exists", req.Name))
+	}
+	secret, err := f.newAESSecret(ctx, fmt.Sprintf("fpe/%s", req.Name))
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	key := &model.FpeKey{
+		Name:     req.Name,
+		Mode:     req.Mode,
+		Alphabet: req.Alphabet,
+		SecretID: secret.ID,
+	}
+	if err := f.mdb.Create(key); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	f.logger.Infof("FPE key `%s` created", req.Name)
+	return ctx.JSON(key)
+}
+
+func (f *fpeController) encrypt(ctx *fiber.Ctx) error {
+	return f.apply(ctx, true)
+}
+
+func (f *fpeController) decrypt(ctx *fiber.Ctx) error {
+	return f.apply(ctx, false)
+}
+
+// apply transforms the characters of value found in the key's alphabet, leaving separators in place.
+func (f *fpeController) apply(ctx *fiber.Ctx, encrypt bool) error {
+	req := &cipherRequest{}
+	if err := ctx.BodyParser(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if err := f.validate.Struct(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	key := &model.FpeKey{}
+	if err := f.mdb.Select(key, bson.M{"name": ctx.Params("name")}); err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	alphabet, err := service.NewAlphabet(key.Alphabet)
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	tweak, err := hex.DecodeString(req.Tweak)
+	if err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if key.Mode == model.FpeModeFF31 && len(tweak) == 0 {
+		tweak = make([]byte, 7)
+	}
+	aesKey, status, err := f.heldKey(ctx, key.SecretID)
+	if err != nil {
+		return ctx.Status(status).SendString(err.Error())
+	}
+	var fpe formatPreservingCipher
+	if key.Mode == model.FpeModeFF31 {
+		fpe, err = service.NewFF3(aesKey, alphabet.Radix())
+	} else {
+		fpe, err = service.NewFF1(aesKey, alphabet.Radix())
+	}
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	numerals, template := alphabet.Split(req.Value)
+	if encrypt {
+		numerals, err = fpe.Encrypt(numerals, tweak)
+	} else {
+		numerals, err = fpe.Decrypt(numerals, tweak)
+	}
+	if err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	return ctx.JSON(fiber.Map{"value": alphabet.Join(numerals, template)})
+}
+
+func (f *fpeController) newAESSecret(ctx *fiber.Ctx, label string) (*model.Secret, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	secret, err := model.NewSecret(f.sealer, label, model.SecretTypeAES, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	if owner, err := model.FindUserByEmail(f.mdb, f.tokenManager.GetEmail(ctx)); err == nil {
+		if err := secret.Grant(f.sealer, owner); err != nil {
+			return nil, err
+		}
+	}
+	return secret, f.mdb.Create(secret)
+}
+
+// heldKey opens the data key of a secret the caller holds a grant on.
+func (f *fpeController) heldKey(ctx *fiber.Ctx, id primitive.ObjectID) ([]byte, int, error) {
+	secret := &model.Secret{}
+	if err := f.mdb.Select(secret, bson.M{"_id": id}); err != nil {
+		return nil, 500, err
+	}
+	if err := secret.CheckHolder(f.mdb, f.tokenManager.GetEmail(ctx), f.tokenManager.GetServiceAccount(ctx)); err != nil {
+		return nil, 403, err
+	}
+	key, err := secret.Private(f.sealer)
+	if err != nil {
+		return nil, 500, err
+	}
+	return key, 200, nil
+}
+
+// secretKey opens the data key of a secret without a grant, callers check their own permissions.
+func (f *fpeController) secretKey(id primitive.ObjectID) ([]byte, error) {
+	secret := &model.Secret{}
+	if err := f.mdb.Select(secret, bson.M{"_id": id}); err != nil {
+		return nil, err
+	}
+	return secret.Private(f.sealer)
+}
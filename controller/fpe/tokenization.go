@@ -0,0 +1,279 @@
+package fpe
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/big"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/hbahadorzadeh/key-master/model"
+	"github.com/hbahadorzadeh/key-master/service"
+	"go.mongodb.org/mongo-driver/bson"
+	"golang.org/x/crypto/hkdf"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+const (
+	tokenAlphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	tokenLength   = 24
+	tokenAttempts = 10
+)
+
+type vaultRequest struct {
+	Name         string   `json:"name" validate:"required"`
+	Alphabet     string   `json:"alphabet"`
+	Detokenizers []string `json:"detokenizers" validate:"dive,email"`
+}
+
+type detokenizerRequest struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+type tokenizeRequest struct {
+	Value string `json:"value" validate:"required"`
+}
+
+type detokenizeRequest struct {
+	Token string `json:"token" validate:"required"`
+}
+
+func (f *fpeController) createVault(ctx *fiber.Ctx) error {
+	req := &vaultRequest{}
+	if err := ctx.BodyParser(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if err := f.validate.Struct(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if req.Alphabet != "" {
+		if _, err := service.NewAlphabet(req.Alphabet); err != nil {
+			return ctx.Status(400).SendString(err.Error())
+		}
+	}
+	if f.mdb.Select(&model.TokenVault{}, bson.M{"name": req.Name}) == nil {
+		return ctx.Status(409).SendString(fmt.Sprintf("Vault `%s` already exists", req.Name))
+	}
+	secret, err := f.newAESSecret(ctx, fmt.Sprintf("tokenization/%s", req.Name))
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	vault := &model.TokenVault{
+		Name:         req.Name,
+		Alphabet:     req.Alphabet,
+		Owner:        f.tokenManager.GetEmail(ctx),
+		Detokenizers: req.Detokenizers,
+		SecretID:     secret.ID,
+	}
+	if vault.Detokenizers == nil {
+		vault.Detokenizers = []string{}
+	}
+	if err := f.mdb.Create(vault); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	f.logger.Infof("Token vault `%s` created", req.Name)
+	return ctx.JSON(vault)
+}
+
+func (f *fpeController) addDetokenizer(ctx *fiber.Ctx) error {
+	req := &detokenizerRequest{}
+	if err := ctx.BodyParser(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if err := f.validate.Struct(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	vault, status, err := f.ownedVault(ctx)
+	if err != nil {
+		return ctx.Status(status).SendString(err.Error())
+	}
+	if !vault.CanDetokenize(req.Email) {
+		vault.Detokenizers = append(vault.Detokenizers, req.Email)
+		if err := f.mdb.Set(vault); err != nil {
+			return ctx.Status(500).SendString(err.Error())
+		}
+	}
+	return ctx.JSON(vault)
+}
+
+func (f *fpeController) removeDetokenizer(ctx *fiber.Ctx) error {
+	vault, status, err := f.ownedVault(ctx)
+	if err != nil {
+		return ctx.Status(status).SendString(err.Error())
+	}
+	detokenizers := []string{}
+	for _, d := range vault.Detokenizers {
+		if d != ctx.Params("email") {
+			detokenizers = append(detokenizers, d)
+		}
+	}
+	vault.Detokenizers = detokenizers
+	if err := f.mdb.Set(vault); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	return ctx.JSON(vault)
+}
+
+// ownedVault loads the vault named in the path, detokenize permissions are only managed by its owner.
+func (f *fpeController) ownedVault(ctx *fiber.Ctx) (*model.TokenVault, int, error) {
+	vault := &model.TokenVault{}
+	if err := f.mdb.Select(vault, bson.M{"name": ctx.Params("name")}); err != nil {
+		return nil, 404, err
+	}
+	if vault.Owner != f.tokenManager.GetEmail(ctx) {
+		return nil, 403, errors.Newf("Only the owner may manage vault `%s`", vault.Name)
+	}
+	return vault, 200, nil
+}
+
+// tokenize returns the existing token for value or maps it to a new random one.
+func (f *fpeController) tokenize(ctx *fiber.Ctx) error {
+	req := &tokenizeRequest{}
+	if err := ctx.BodyParser(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if err := f.validate.Struct(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	vault := &model.TokenVault{}
+	if err := f.mdb.Select(vault, bson.M{"name": ctx.Params("name")}); err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	key, status, err := f.heldKey(ctx, vault.SecretID)
+	if err != nil {
+		return ctx.Status(status).SendString(err.Error())
+	}
+	macKey, key, err := vaultKeys(key)
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write([]byte(req.Value))
+	valueHash := hex.EncodeToString(mac.Sum(nil))
+
+	existing := &model.VaultToken{}
+	if err := f.mdb.Select(existing, bson.M{"vault_id": vault.ID, "value_hash": valueHash}); err == nil {
+		return ctx.JSON(fiber.Map{"token": existing.Token})
+	}
+	encrypted, err := service.Encrypt(key, []byte(req.Value))
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	for i := 0; i < tokenAttempts; i++ {
+		token, err := randomToken(vault.Alphabet, req.Value)
+		if err != nil {
+			return ctx.Status(400).SendString(err.Error())
+		}
+		if token == req.Value || f.mdb.Select(&model.VaultToken{}, bson.M{"vault_id": vault.ID, "token": token}) == nil {
+			continue
+		}
+		err = f.mdb.Create(&model.VaultToken{
+			VaultID:        vault.ID,
+			Token:          token,
+			ValueHash:      valueHash,
+			EncryptedValue: encrypted,
+		})
+		if service.IsDuplicate(err) {
+			// Either the value was tokenized concurrently or the token was taken meanwhile
+			if f.mdb.Select(existing, bson.M{"vault_id": vault.ID, "value_hash": valueHash}) == nil {
+				return ctx.JSON(fiber.Map{"token": existing.Token})
+			}
+			continue
+		}
+		if err != nil {
+			return ctx.Status(500).SendString(err.Error())
+		}
+		return ctx.JSON(fiber.Map{"token": token})
+	}
+	return ctx.Status(409).SendString("Unable to allocate a unique token, the format leaves too few values")
+}
+
+func (f *fpeController) detokenize(ctx *fiber.Ctx) error {
+	req := &detokenizeRequest{}
+	if err := ctx.BodyParser(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if err := f.validate.Struct(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	vault := &model.TokenVault{}
+	if err := f.mdb.Select(vault, bson.M{"name": ctx.Params("name")}); err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	if !vault.CanDetokenize(f.tokenManager.GetEmail(ctx)) {
+		return ctx.Status(403).SendString(fmt.Sprintf("Not allowed to detokenize from vault `%s`", vault.Name))
+	}
+	token := &model.VaultToken{}
+	if err := f.mdb.Select(token, bson.M{"vault_id": vault.ID, "token": req.Token}); err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	// Being a detokenizer of the vault is the grant
+	key, err := f.secretKey(vault.SecretID)
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	_, key, err = vaultKeys(key)
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	value, err := service.Decrypt(key, token.EncryptedValue)
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	return ctx.JSON(fiber.Map{"value": string(value)})
+}
+
+// vaultKeys derives the keys of the value MAC and of the value encryption from the vault key.
+func vaultKeys(key []byte) (macKey, encryptionKey []byte, err error) {
+	macKey, encryptionKey = make([]byte, 32), make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, nil, []byte("key-master tokenization mac")), macKey); err != nil {
+		return nil, nil, err
+	}
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, nil, []byte("key-master tokenization encryption")), encryptionKey); err != nil {
+		return nil, nil, err
+	}
+	return macKey, encryptionKey, nil
+}
+
+// randomToken draws a token in the format of value when the vault has an alphabet, otherwise an opaque one.
+func randomToken(alphabetChars string, value string) (string, error) {
+	length := tokenLength
+	var template []rune
+	if alphabetChars == "" {
+		alphabetChars = tokenAlphabet
+	} else {
+		alphabet, err := service.NewAlphabet(alphabetChars)
+		if err != nil {
+			return "", err
+		}
+		var numerals []uint16
+		numerals, template = alphabet.Split(value)
+		length = len(numerals)
+		if length == 0 {
+			return "", errors.New("Value has no characters of the vault alphabet")
+		}
+	}
+	chars := []rune(alphabetChars)
+	token := make([]rune, 0, length)
+	max := big.NewInt(int64(len(chars)))
+	for len(token) < length {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		token = append(token, chars[n.Int64()])
+	}
+	if template == nil {
+		return string(token), nil
+	}
+	for i, j := 0, 0; i < len(template); i++ {
+		if template[i] == -1 {
+			template[i] = token[j]
+			j++
+		}
+	}
+	return string(template), nil
+}
@@ -0,0 +1,353 @@
+package group
+
+import (
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/hbahadorzadeh/key-master/model"
+	"github.com/hbahadorzadeh/key-master/service"
+	"github.com/hbahadorzadeh/key-master/util"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+type groupRequest struct {
+	Name        string `json:"name" validate:"required,hostname_rfc1123"`
+	Description string `json:"description"`
+}
+
+// groupView is a group with its members resolved to email addresses.
+type groupView struct {
+	*model.Group
+	MemberEmails    []string `json:"member_emails"`
+	AllMemberEmails []string `json:"all_member_emails"`
+	SecretLabels    []string `json:"secret_labels"`
+}
+
+type groupController struct {
+	tokenManager *service.TokenManager
+	mdb          *service.MongoDB
+	sealer       *service.Sealer
+	validate     *validator.Validate
+	logger       *log.Logger
+}
+
+func NewGroupController(tokenManager *service.TokenManager, mdb *service.MongoDB, sealer *service.Sealer, validate *validator.Validate) (g *groupController) {
+	return &groupController{
+		tokenManager: tokenManager,
+		mdb:          mdb,
+		sealer:       sealer,
+		validate:     validate,
+	}
+}
+
+func (g *groupController) Init(configs *util.Configs, logger *log.Logger, app *fiber.App) {
+	g.logger = logger
+	g.mdb.CreateCollection(model.Group{})
+	manage := g.tokenManager.Require(service.PermissionUsersManage)
+	grant := g.tokenManager.Require(service.PermissionKeysManage)
+
+	app.Post("/groups", manage, g.create)
+	app.Get("/groups", manage, g.list)
+	app.Get("/groups/:name", manage, g.get)
+	app.Delete("/groups/:name", manage, g.delete)
+	app.Post("/groups/:name/members/:email", manage, g.setMember(true))
+	app.Delete("/groups/:name/members/:email", manage, g.setMember(false))
+	app.Post("/groups/:name/subgroups/:group", manage, g.setSubgroup(true))
+	app.Delete("/groups/:name/subgroups/:group", manage, g.setSubgroup(false))
+	// Secret labels contain slashes, e.g. pgp/release
+	app.Post("/groups/:name/secrets/*", grant, g.setSecret(true))
+	app.Delete("/groups/:name/secrets/*", grant, g.setSecret(false))
+}
+
+func (g *groupController) create(ctx *fiber.Ctx) error {
+	req := &groupRequest{}
+	if err := ctx.BodyParser(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if err := g.validate.Struct(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if _, err := model.FindGroup(g.mdb, req.Name); err == nil {
+		return ctx.Status(409).SendString("Group already exists")
+	}
+	group := &model.Group{
+		Name:        req.Name,
+		Description: req.Description,
+		Members:     []primitive.ObjectID{},
+		Subgroups:   []string{},
+		Secrets:     []primitive.ObjectID{},
+		CreatedBy:   g.tokenManager.GetEmail(ctx),
+	}
+	if err := g.mdb.Create(group); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	return ctx.JSON(group)
+}
+
+func (g *groupController) list(ctx *fiber.Ctx) error {
+	groups := make([]model.Group, 0)
+	if err := g.mdb.SelectAll(&groups, bson.M{}); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	return ctx.JSON(groups)
+}
+
+func (g *groupController) get(ctx *fiber.Ctx) error {
+	group, err := model.FindGroup(g.mdb, ctx.Params("name"))
+	if err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	all, err := group.ExpandMembers(g.mdb)
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	view := &groupView{Group: group}
+	if view.MemberEmails, err = g.emails(group.Members); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	if view.AllMemberEmails, err = g.emails(all); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	secrets := make([]model.Secret, 0)
+	if err := g.mdb.SelectAll(&secrets, bson.M{"_id": bson.M{"$in": group.Secrets}}); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	view.SecretLabels = make([]string, 0, len(secrets))
+	for _, secret := range secrets {
+		view.SecretLabels = append(view.SecretLabels, secret.Label)
+	}
+	return ctx.JSON(view)
+}
+
+// delete removes the group from its parents as well, its members lose the secrets it granted.
+func (g *groupController) delete(ctx *fiber.Ctx) error {
+	group, err := model.FindGroup(g.mdb, ctx.Params("name"))
+	if err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	affected, err := group.ExpandMembers(g.mdb)
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	parents := make([]model.Group, 0)
+	if err := g.mdb.SelectAll(&parents, bson.M{"subgroups": group.Name}); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	for i := range parents {
+		parents[i].Subgroups = without(parents[i].Subgroups, group.Name)
+		if err := g.mdb.Update(&parents[i], bson.M{"$set": bson.M{"subgroups": parents[i].Subgroups}}); err != nil {
+			return ctx.Status(500).SendString(err.Error())
+		}
+	}
+	if err := g.mdb.Delete(group); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	if err := g.sync(affected); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	return ctx.SendStatus(204)
+}
+
+func (g *groupController) setMember(join bool) fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		group, err := model.FindGroup(g.mdb, ctx.Params("name"))
+		if err != nil {
+			return ctx.Status(404).SendString(err.Error())
+		}
+		user, err := model.FindUserByEmail(g.mdb, ctx.Params("email"))
+		if err != nil {
+			return ctx.Status(404).SendString(err.Error())
+		}
+		if status, err := g.mayChangeMembers(ctx, group); err != nil {
+			return ctx.Status(status).SendString(err.Error())
+		}
+		members := make([]primitive.ObjectID, 0, len(group.Members)+1)
+		for _, id := range group.Members {
+			if id != user.ID {
+				members = append(members, id)
+			}
+		}
+		change := bson.M{"$pull": bson.M{"members": user.ID}}
+		if join {
+			members = append(members, user.ID)
+			change = bson.M{"$addToSet": bson.M{"members": user.ID}}
+		}
+		group.Members = members
+		if err := g.mdb.Update(group, change); err != nil {
+			return ctx.Status(500).SendString(err.Error())
+		}
+		if err := model.SyncGroupSecrets(g.mdb, g.sealer, user); err != nil {
+			return ctx.Status(500).SendString(err.Error())
+		}
+		return ctx.JSON(group)
+	}
+}
+
+func (g *groupController) setSubgroup(nest bool) fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		group, err := model.FindGroup(g.mdb, ctx.Params("name"))
+		if err != nil {
+			return ctx.Status(404).SendString(err.Error())
+		}
+		subgroup, err := model.FindGroup(g.mdb, ctx.Params("group"))
+		if err != nil {
+			return ctx.Status(404).SendString(err.Error())
+		}
+		if status, err := g.mayChangeMembers(ctx, group); err != nil {
+			return ctx.Status(status).SendString(err.Error())
+		}
+		if nest {
+			if err := group.CheckNesting(g.mdb, subgroup); err != nil {
+				return ctx.Status(409).SendString(err.Error())
+			}
+		}
+		affected, err := subgroup.ExpandMembers(g.mdb)
+		if err != nil {
+			return ctx.Status(500).SendString(err.Error())
+		}
+		group.Subgroups = without(group.Subgroups, subgroup.Name)
+		if nest {
+			group.Subgroups = append(group.Subgroups, subgroup.Name)
+		}
+		if err := g.mdb.Update(group, bson.M{"$set": bson.M{"subgroups": group.Subgroups}}); err != nil {
+			return ctx.Status(500).SendString(err.Error())
+		}
+		if err := g.sync(affected); err != nil {
+			return ctx.Status(500).SendString(err.Error())
+		}
+		return ctx.JSON(group)
+	}
+}
+
+// setSecret grants a secret to every current and future member of the group, or takes it back.
+// Only holders of the secret may hand it on.
+func (g *groupController) setSecret(grant bool) fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		group, err := model.FindGroup(g.mdb, ctx.Params("name"))
+		if err != nil {
+			return ctx.Status(404).SendString(err.Error())
+		}
+		secret := &model.Secret{}
+		if err := g.mdb.Select(secret, bson.M{"label": ctx.Params("*")}); err != nil {
+			return ctx.Status(404).SendString(err.Error())
+		}
+		if grant {
+			if err := secret.CheckHolder(g.mdb, g.tokenManager.GetEmail(ctx), g.tokenManager.GetServiceAccount(ctx)); err != nil {
+				return ctx.Status(403).SendString(err.Error())
+			}
+		}
+		secrets := make([]primitive.ObjectID, 0, len(group.Secrets)+1)
+		for _, id := range group.Secrets {
+			if id != secret.ID {
+				secrets = append(secrets, id)
+			}
+		}
+		if grant {
+			secrets = append(secrets, secret.ID)
+		}
+		group.Secrets = secrets
+		if err := g.mdb.Update(group, bson.M{"$set": bson.M{"secrets": secrets}}); err != nil {
+			return ctx.Status(500).SendString(err.Error())
+		}
+		affected, err := group.ExpandMembers(g.mdb)
+		if err != nil {
+			return ctx.Status(500).SendString(err.Error())
+		}
+		if err := g.sync(affected); err != nil {
+			return ctx.Status(500).SendString(err.Error())
+		}
+		g.logger.Infof("Secret `%s` granted to group `%s`: %t, by `%s`", secret.Label, group.Name, grant, g.tokenManager.GetEmail(ctx))
+		return ctx.JSON(group)
+	}
+}
+
+// mayChangeMembers makes sure that whoever changes who is in a group may hand out what membership grants:
+// secrets of the group or a group it is nested in need keys:manage, their roles need roles:manage and
+// every permission of the roles.
+func (g *groupController) mayChangeMembers(ctx *fiber.Ctx, group *model.Group) (int, error) {
+	ancestors, err := group.Ancestors(g.mdb)
+	if err != nil {
+		return 500, err
+	}
+	if grantsSecrets(ancestors) {
+		allowed, err := g.tokenManager.HasPermission(ctx, service.PermissionKeysManage)
+		if err != nil {
+			return 503, err
+		}
+		if !allowed {
+			return 403, errors.Newf("Group `%s` grants secrets, permission `%s` is required", group.Name, service.PermissionKeysManage)
+		}
+	}
+	roles, err := model.FindRolesOfGroups(g.mdb, model.GroupNames(ancestors), nil)
+	if err != nil {
+		return 500, err
+	}
+	if len(roles) == 0 {
+		return 200, nil
+	}
+	permissions := []string{service.PermissionRolesManage}
+	for _, role := range roles {
+		permissions = append(permissions, role.Permissions...)
+	}
+	allowed, err := g.tokenManager.HasPermissions(ctx, permissions)
+	if err != nil {
+		return 503, err
+	}
+	if !allowed {
+		return 403, errors.Newf("Group `%s` grants roles, permission `%s` and every permission of its roles are required", group.Name, service.PermissionRolesManage)
+	}
+	return 200, nil
+}
+
+// sync brings the group grants of users in line with their memberships.
+func (g *groupController) sync(ids []primitive.ObjectID) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	users := make([]model.User, 0)
+	if err := g.mdb.SelectAll(&users, bson.M{"_id": bson.M{"$in": ids}}); err != nil {
+		return err
+	}
+	for i := range users {
+		if err := model.SyncGroupSecrets(g.mdb, g.sealer, &users[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *groupController) emails(ids []primitive.ObjectID) ([]string, error) {
+	emails := make([]string, 0, len(ids))
+	if len(ids) == 0 {
+		return emails, nil
+	}
+	users := make([]model.User, 0)
+	if err := g.mdb.SelectAll(&users, bson.M{"_id": bson.M{"$in": ids}}); err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		emails = append(emails, user.Email)
+	}
+	return emails, nil
+}
+
+func grantsSecrets(groups []model.Group) bool {
+	for _, group := range groups {
+		if len(group.Secrets) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func without(names []string, name string) []string {
+	result := make([]string, 0, len(names))
+	for _, n := range names {
+		if n != name {
+			result = append(result, n)
+		}
+	}
+	return result
+}
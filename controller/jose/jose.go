@@ -0,0 +1,189 @@
+package jose
+
+import (
+	"fmt"
+	"time"
+
+	jwt "github.com/form3tech-oss/jwt-go"
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/hbahadorzadeh/key-master/model"
+	"github.com/hbahadorzadeh/key-master/service"
+	"github.com/hbahadorzadeh/key-master/util"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type keyAlgorithm struct {
+	keyType model.SecretType
+	bits    int
+}
+
+var algorithms = map[string]keyAlgorithm{
+	"RS256": {model.SecretTypeRSA, 2048},
+	"RS384": {model.SecretTypeRSA, 3072},
+	"RS512": {model.SecretTypeRSA, 4096},
+	"PS256": {model.SecretTypeRSA, 2048},
+	"PS384": {model.SecretTypeRSA, 3072},
+	"PS512": {model.SecretTypeRSA, 4096},
+	"ES256": {model.SecretTypeEC, 256},
+	"ES384": {model.SecretTypeEC, 384},
+	"ES512": {model.SecretTypeEC, 521},
+	"EdDSA": {model.SecretTypeEd25519, 0},
+}
+
+type keyRequest struct {
+	Name      string `json:"name" validate:"required"`
+	Algorithm string `json:"algorithm" validate:"required"`
+}
+
+type signRequest struct {
+	Claims jwt.MapClaims `json:"claims" validate:"required"`
+	TTL    string        `json:"ttl"`
+}
+
+type joseController struct {
+	tokenManager *service.TokenManager
+	mdb          *service.MongoDB
+	sealer       *service.Sealer
+	policies     *service.PolicyEngine
+	validate     *validator.Validate
+	logger       *log.Logger
+}
+
+func NewJoseController(tokenManager *service.TokenManager, mdb *service.MongoDB, sealer *service.Sealer, policies *service.PolicyEngine, validate *validator.Validate) (j *joseController) {
+	return &joseController{
+		tokenManager: tokenManager,
+		mdb:          mdb,
+		sealer:       sealer,
+		policies:     policies,
+		validate:     validate,
+	}
+}
+
+func (j *joseController) Init(configs *util.Configs, logger *log.Logger, app *fiber.App) {
+	j.logger = logger
+	j.mdb.CreateCollection(model.JoseKey{})
+
+	app.Post("/jose/keys", j.tokenManager.Require(service.PermissionKeysManage), j.policies.Enforce(service.OperationCreate, "jose"), j.createKey)
+	app.Post("/jose/sign/:name", j.tokenManager.Require(service.PermissionKeysUse), j.policies.Enforce(service.OperationSign, "jose"), j.sign)
+
+	// Verifiers fetch key sets anonymously.
+	j.tokenManager.AddPublicPath("/jose/jwks/")
+	app.Get("/jose/jwks/:name", j.jwks)
+}
+
+func (j *joseController) createKey(ctx *fiber.Ctx) error {
+	req := &keyRequest{}
+	if err := ctx.BodyParser(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if err := j.validate.Struct(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	alg, ok := algorithms[req.Algorithm]
+	if !ok {
+		return ctx.Status(400).SendString(fmt.Sprintf("Algorithm `%s` not supported", req.Algorithm))
+	}
+	if j.mdb.Select(&model.JoseKey{}, bson.M{"name": req.Name}) == nil {
+		return ctx.Status(409).SendString(fmt.Sprintf("Key `%s` already exists", req.Name))
+	}
+	signer, err := model.GenerateKeyPair(alg.keyType, alg.bits)
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	jwk, err := service.NewJSONWebKey(signer.Public(), req.Algorithm)
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	secret, err := model.NewKeyPairSecret(j.sealer, fmt.Sprintf("jose/%s", req.Name), signer)
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	if owner, err := model.FindUserByEmail(j.mdb, j.tokenManager.GetEmail(ctx)); err == nil {
+		if err := secret.Grant(j.sealer, owner); err != nil {
+			return ctx.Status(500).SendString(err.Error())
+		}
+	}
+	if err := j.mdb.Create(secret); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	key := &model.JoseKey{
+		Name:      req.Name,
+		Algorithm: req.Algorithm,
+		KeyID:     jwk.Kid,
+		SecretID:  secret.ID,
+	}
+	if err := j.mdb.Create(key); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	j.logger.Infof("JOSE key `%s` created", req.Name)
+	return ctx.JSON(key)
+}
+
+// sign returns a compact JWS over the submitted claims, filling iat and exp when absent.
+func (j *joseController) sign(ctx *fiber.Ctx) error {
+	req := &signRequest{}
+	if err := ctx.BodyParser(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if err := j.validate.Struct(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	key := &model.JoseKey{}
+	if err := j.mdb.Select(key, bson.M{"name": ctx.Params("name")}); err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	now := time.Now()
+	if _, ok := req.Claims["iat"]; !ok {
+		req.Claims["iat"] = now.Unix()
+	}
+	if req.TTL != "" {
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil {
+			return ctx.Status(400).SendString(err.Error())
+		}
+		req.Claims["exp"] = now.Add(ttl).Unix()
+	}
+	if err := req.Claims.Valid(); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	secret := &model.Secret{}
+	if err := j.mdb.Select(secret, bson.M{"_id": key.SecretID}); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	if err := secret.CheckHolder(j.mdb, j.tokenManager.GetEmail(ctx), j.tokenManager.GetServiceAccount(ctx)); err != nil {
+		return ctx.Status(403).SendString(err.Error())
+	}
+	signer, err := secret.Signer(j.sealer)
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(key.Algorithm), req.Claims)
+	token.Header["kid"] = key.KeyID
+	signed, err := token.SignedString(signer)
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	return ctx.JSON(fiber.Map{"token": signed})
+}
+
+func (j *joseController) jwks(ctx *fiber.Ctx) error {
+	key := &model.JoseKey{}
+	if err := j.mdb.Select(key, bson.M{"name": ctx.Params("name")}); err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	secret := &model.Secret{}
+	if err := j.mdb.Select(secret, bson.M{"_id": key.SecretID}); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	public, err := secret.PublicKey()
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	jwk, err := service.NewJSONWebKey(public, key.Algorithm)
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	return ctx.JSON(service.JSONWebKeySet{Keys: []service.JSONWebKey{jwk}})
+}
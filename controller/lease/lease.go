@@ -0,0 +1,239 @@
+package lease
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/hbahadorzadeh/key-master/model"
+	"github.com/hbahadorzadeh/key-master/service"
+	"github.com/hbahadorzadeh/key-master/util"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+type leaseRequest struct {
+	SecretLabel   string `json:"secret_label" validate:"required"`
+	Duration      string `json:"duration" validate:"required"`
+	Justification string `json:"justification" validate:"required,min=10"`
+}
+
+// decisionRequest may shorten the requested duration when granting.
+type decisionRequest struct {
+	Duration string `json:"duration"`
+	Comment  string `json:"comment"`
+}
+
+type leaseController struct {
+	tokenManager *service.TokenManager
+	mdb          *service.MongoDB
+	sealer       *service.Sealer
+	mailer       *service.Mailer
+	validate     *validator.Validate
+	logger       *log.Logger
+	approvers    []string
+}
+
+func NewLeaseController(tokenManager *service.TokenManager, mdb *service.MongoDB, sealer *service.Sealer, mailer *service.Mailer, validate *validator.Validate) (l *leaseController) {
+	return &leaseController{
+		tokenManager: tokenManager,
+		mdb:          mdb,
+		sealer:       sealer,
+		mailer:       mailer,
+		validate:     validate,
+	}
+}
+
+func (l *leaseController) Init(configs *util.Configs, logger *log.Logger, app *fiber.App) {
+	l.logger = logger
+	l.approvers = configs.Approval.Approvers
+	l.mdb.CreateCollection(model.Lease{})
+	manage := l.tokenManager.Require(service.PermissionKeysManage)
+
+	app.Post("/leases", l.request)
+	app.Get("/leases", l.list)
+	app.Get("/leases/:id", l.get)
+	app.Post("/leases/:id/grant", manage, l.grant)
+	app.Post("/leases/:id/deny", manage, l.deny)
+	app.Post("/leases/:id/revoke", l.revoke)
+}
+
+func (l *leaseController) request(ctx *fiber.Ctx) error {
+	req := &leaseRequest{}
+	if err := ctx.BodyParser(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if err := l.validate.Struct(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	duration, err := time.ParseDuration(req.Duration)
+	if err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if duration <= 0 || duration > model.MaxLeaseDuration {
+		return ctx.Status(400).SendString(fmt.Sprintf("Lease duration has to be positive and at most %s", model.MaxLeaseDuration))
+	}
+	user := &model.User{}
+	if err := l.mdb.Select(user, bson.M{"email": l.tokenManager.GetEmail(ctx)}); err != nil {
+		return ctx.Status(403).SendString("Only users can request leases")
+	}
+	secret := &model.Secret{}
+	if err := l.mdb.Select(secret, bson.M{"label": req.SecretLabel}); err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	if secret.IsOwner(user.ID) {
+		return ctx.Status(409).SendString(fmt.Sprintf("You already have access to `%s`", secret.Label))
+	}
+	if l.mdb.Select(&model.Lease{}, bson.M{"user_id": user.ID, "secret_id": secret.ID, "status": bson.M{"$in": bson.A{model.LeaseStatusPending, model.LeaseStatusActive}}}) == nil {
+		return ctx.Status(409).SendString(fmt.Sprintf("You already have an open lease on `%s`", secret.Label))
+	}
+	lease := &model.Lease{
+		UserID:        user.ID,
+		Email:         user.Email,
+		SecretID:      secret.ID,
+		SecretLabel:   secret.Label,
+		Justification: req.Justification,
+		Duration:      duration.String(),
+		Status:        model.LeaseStatusPending,
+	}
+	if err := l.mdb.Create(lease); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	l.logger.Infof("Lease `%s` on `%s` for %s requested by `%s`", lease.ID.Hex(), lease.SecretLabel, lease.Duration, lease.Email)
+	if len(l.approvers) > 0 {
+		if err := l.mailer.Send(l.approvers, fmt.Sprintf("key-master: %s requests access to %s", lease.Email, lease.SecretLabel),
+			fmt.Sprintf("%s requests access to %s for %s.\n\nJustification: %s\n\nLease: %s\n", lease.Email, lease.SecretLabel, lease.Duration, lease.Justification, lease.ID.Hex())); err != nil {
+			l.logger.Errorf("Lease notification could not be sent: %v", err)
+		}
+	}
+	return ctx.Status(201).JSON(lease)
+}
+
+// list shows the leases of the caller, key managers see every lease.
+func (l *leaseController) list(ctx *fiber.Ctx) error {
+	filter := bson.M{}
+	if status := ctx.Query("status"); status != "" {
+		filter["status"] = status
+	}
+	manager, err := l.tokenManager.HasPermission(ctx, service.PermissionKeysManage)
+	if err != nil {
+		return ctx.Status(503).SendString(err.Error())
+	}
+	if !manager {
+		filter["email"] = l.tokenManager.GetEmail(ctx)
+	}
+	leases := make([]model.Lease, 0)
+	if _, err := l.mdb.SelectPage(&leases, filter, bson.D{{Key: "created_at", Value: -1}}, 0, 0); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	return ctx.JSON(leases)
+}
+
+func (l *leaseController) get(ctx *fiber.Ctx) error {
+	lease, status, err := l.load(ctx)
+	if err != nil {
+		return ctx.Status(status).SendString(err.Error())
+	}
+	return ctx.JSON(lease)
+}
+
+func (l *leaseController) grant(ctx *fiber.Ctx) error {
+	req, lease, status, err := l.decision(ctx)
+	if err != nil {
+		return ctx.Status(status).SendString(err.Error())
+	}
+	duration, err := time.ParseDuration(lease.Duration)
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	if req.Duration != "" {
+		shorter, err := time.ParseDuration(req.Duration)
+		if err != nil {
+			return ctx.Status(400).SendString(err.Error())
+		}
+		if shorter > duration {
+			return ctx.Status(400).SendString("A lease cannot be granted for longer than requested")
+		}
+		duration = shorter
+	}
+	approver := l.tokenManager.GetEmail(ctx)
+	if err := lease.Grant(l.mdb, l.sealer, approver, duration, req.Comment); err != nil {
+		return ctx.Status(409).SendString(err.Error())
+	}
+	l.logger.Infof("Lease `%s` on `%s` granted to `%s` by `%s` until %s", lease.ID.Hex(), lease.SecretLabel, lease.Email, approver, lease.ExpiresAt.Time())
+	l.notify(lease, fmt.Sprintf("Your access to %s was granted by %s until %s.\n", lease.SecretLabel, approver, lease.ExpiresAt.Time().Format(time.RFC1123)))
+	return ctx.JSON(lease)
+}
+
+func (l *leaseController) deny(ctx *fiber.Ctx) error {
+	req, lease, status, err := l.decision(ctx)
+	if err != nil {
+		return ctx.Status(status).SendString(err.Error())
+	}
+	approver := l.tokenManager.GetEmail(ctx)
+	if err := lease.Deny(l.mdb, approver, req.Comment); err != nil {
+		return ctx.Status(409).SendString(err.Error())
+	}
+	l.logger.Infof("Lease `%s` on `%s` denied to `%s` by `%s`", lease.ID.Hex(), lease.SecretLabel, lease.Email, approver)
+	l.notify(lease, fmt.Sprintf("Your access to %s was denied by %s.\n\n%s\n", lease.SecretLabel, approver, req.Comment))
+	return ctx.JSON(lease)
+}
+
+// revoke ends an active lease early, the lease holder may give it back as well.
+func (l *leaseController) revoke(ctx *fiber.Ctx) error {
+	lease, status, err := l.load(ctx)
+	if err != nil {
+		return ctx.Status(status).SendString(err.Error())
+	}
+	by := l.tokenManager.GetEmail(ctx)
+	if err := lease.Revoke(l.mdb, model.LeaseStatusRevoked, by); err != nil {
+		return ctx.Status(409).SendString(err.Error())
+	}
+	l.logger.Infof("Lease `%s` on `%s` of `%s` revoked by `%s`", lease.ID.Hex(), lease.SecretLabel, lease.Email, by)
+	return ctx.JSON(lease)
+}
+
+// decision loads the lease an approver decides on, nobody decides on their own lease.
+func (l *leaseController) decision(ctx *fiber.Ctx) (*decisionRequest, *model.Lease, int, error) {
+	req := &decisionRequest{}
+	if len(ctx.Body()) > 0 {
+		if err := ctx.BodyParser(req); err != nil {
+			return nil, nil, 400, err
+		}
+	}
+	lease, status, err := l.load(ctx)
+	if err != nil {
+		return nil, nil, status, err
+	}
+	if lease.Email == l.tokenManager.GetEmail(ctx) {
+		return nil, nil, 403, errors.New("You cannot decide on your own lease")
+	}
+	return req, lease, 200, nil
+}
+
+// load finds the lease of the path, visible to its holder and to key managers.
+func (l *leaseController) load(ctx *fiber.Ctx) (*model.Lease, int, error) {
+	lease, err := model.FindLease(l.mdb, ctx.Params("id"))
+	if err != nil {
+		return nil, 404, err
+	}
+	if lease.Email == l.tokenManager.GetEmail(ctx) {
+		return lease, 200, nil
+	}
+	manager, err := l.tokenManager.HasPermission(ctx, service.PermissionKeysManage)
+	if err != nil {
+		return nil, 503, err
+	}
+	if !manager {
+		return nil, 404, errors.Newf("Lease `%s` not found", ctx.Params("id"))
+	}
+	return lease, 200, nil
+}
+
+func (l *leaseController) notify(lease *model.Lease, body string) {
+	if err := l.mailer.Send([]string{lease.Email}, fmt.Sprintf("key-master: lease on %s %s", lease.SecretLabel, lease.Status), body); err != nil {
+		l.logger.Errorf("Lease notification could not be sent: %v", err)
+	}
+}
@@ -0,0 +1,214 @@
+package namespace
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/hbahadorzadeh/key-master/model"
+	"github.com/hbahadorzadeh/key-master/service"
+	"github.com/hbahadorzadeh/key-master/util"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type adminRequest struct {
+	Email     string `json:"email" validate:"required,email"`
+	FirstName string `json:"first_name" validate:"required"`
+	LastName  string `json:"last_name" validate:"required"`
+}
+
+type namespaceRequest struct {
+	Name        string         `json:"name" validate:"required,hostname_rfc1123"`
+	Description string         `json:"description"`
+	Admins      []adminRequest `json:"admins" validate:"required,min=1,dive"`
+}
+
+// namespaceController manages the namespaces, it is only served in the default namespace. Namespace
+// admins run their namespace with the regular user, role and policy routes under its prefix.
+type namespaceController struct {
+	tokenManager *service.TokenManager
+	mdb          *service.MongoDB
+	namespaces   *service.NamespaceRouter
+	validate     *validator.Validate
+	logger       *log.Logger
+}
+
+func NewNamespaceController(tokenManager *service.TokenManager, mdb *service.MongoDB, namespaces *service.NamespaceRouter, validate *validator.Validate) (n *namespaceController) {
+	return &namespaceController{
+		tokenManager: tokenManager,
+		mdb:          mdb,
+		namespaces:   namespaces,
+		validate:     validate,
+	}
+}
+
+func (n *namespaceController) Init(configs *util.Configs, logger *log.Logger, app *fiber.App) {
+	n.logger = logger
+	manage := n.tokenManager.Require(service.PermissionAll)
+
+	app.Get("/namespaces", manage, n.list)
+	app.Post("/namespaces", manage, n.create)
+	app.Get("/namespaces/:name", manage, n.get)
+	app.Delete("/namespaces/:name", manage, n.delete)
+	app.Get("/namespaces/:name/admins", manage, n.admins)
+	app.Put("/namespaces/:name/admins", manage, n.addAdmin)
+	app.Delete("/namespaces/:name/admins/:email", manage, n.removeAdmin)
+}
+
+func (n *namespaceController) list(ctx *fiber.Ctx) error {
+	namespaces := make([]service.Namespace, 0)
+	if err := n.mdb.SelectAll(&namespaces, bson.M{}); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	return ctx.JSON(namespaces)
+}
+
+func (n *namespaceController) get(ctx *fiber.Ctx) error {
+	namespace, err := n.namespaces.Find(ctx.Params("name"))
+	if err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	return ctx.JSON(namespace)
+}
+
+// create sets the namespace up and makes the admins of the request its first administrators.
+func (n *namespaceController) create(ctx *fiber.Ctx) error {
+	req := &namespaceRequest{}
+	if err := ctx.BodyParser(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if err := n.validate.Struct(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if strings.EqualFold(req.Name, service.DefaultNamespace) {
+		return ctx.Status(409).SendString(fmt.Sprintf("Namespace name `%s` is reserved", req.Name))
+	}
+	if _, err := n.namespaces.Find(req.Name); err == nil {
+		return ctx.Status(409).SendString(fmt.Sprintf("Namespace `%s` already exists", req.Name))
+	}
+	// A new namespace of the name would inherit the users, keys and grants left behind by the deleted one
+	if n.namespaces.Used(req.Name) {
+		return ctx.Status(409).SendString(fmt.Sprintf("Namespace name `%s` was used before", req.Name))
+	}
+	namespace := &service.Namespace{
+		Name:        req.Name,
+		Description: req.Description,
+		CreatedBy:   n.tokenManager.GetEmail(ctx),
+	}
+	if err := n.mdb.Create(namespace); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	// Building the app creates the collections and built in roles of the namespace
+	if _, err := n.namespaces.App(namespace.Name); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	for _, admin := range req.Admins {
+		if _, err := n.grantAdmin(namespace.Name, admin); err != nil {
+			return ctx.Status(500).SendString(err.Error())
+		}
+	}
+	n.logger.Infof("Namespace `%s` was created by `%s`", namespace.Name, namespace.CreatedBy)
+	return ctx.Status(201).JSON(namespace)
+}
+
+// delete stops serving the namespace, its documents are kept and its name is not used again.
+func (n *namespaceController) delete(ctx *fiber.Ctx) error {
+	namespace, err := n.namespaces.Find(ctx.Params("name"))
+	if err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	if err := n.mdb.Delete(namespace); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	n.namespaces.Evict(namespace.Name)
+	n.logger.Infof("Namespace `%s` was deleted by `%s`", namespace.Name, n.tokenManager.GetEmail(ctx))
+	return ctx.SendStatus(204)
+}
+
+func (n *namespaceController) admins(ctx *fiber.Ctx) error {
+	namespace, err := n.namespaces.Find(ctx.Params("name"))
+	if err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	users := make([]model.User, 0)
+	if err := n.mdb.Namespace(namespace.Name).SelectAll(&users, bson.M{"roles": model.RoleAdmin}); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	return ctx.JSON(users)
+}
+
+func (n *namespaceController) addAdmin(ctx *fiber.Ctx) error {
+	req := &adminRequest{}
+	if err := ctx.BodyParser(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if err := n.validate.Struct(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	namespace, err := n.namespaces.Find(ctx.Params("name"))
+	if err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	user, err := n.grantAdmin(namespace.Name, *req)
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	return ctx.JSON(user)
+}
+
+func (n *namespaceController) removeAdmin(ctx *fiber.Ctx) error {
+	namespace, err := n.namespaces.Find(ctx.Params("name"))
+	if err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	database := n.mdb.Namespace(namespace.Name)
+	user, err := model.FindUserByEmail(database, ctx.Params("email"))
+	if err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	roles := make([]string, 0, len(user.Roles))
+	for _, role := range user.Roles {
+		if role != model.RoleAdmin {
+			roles = append(roles, role)
+		}
+	}
+	if err := user.SetRoles(database, roles); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	// Tokens carry the admin role until they expire
+	if err := n.tokenManager.RevokeNamespaceUserSessions(namespace.Name, user.Email); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	n.logger.Infof("`%s` is no admin of namespace `%s` anymore, removed by `%s`", user.Email, namespace.Name, n.tokenManager.GetEmail(ctx))
+	return ctx.JSON(user)
+}
+
+// grantAdmin gives the user of the namespace the admin role, creating the user when missing.
+// New admins set their password through the password reset of the namespace.
+func (n *namespaceController) grantAdmin(namespace string, admin adminRequest) (*model.User, error) {
+	database := n.mdb.Namespace(namespace)
+	user, err := model.FindUserByEmail(database, admin.Email)
+	if err != nil {
+		user = &model.User{
+			Email:     admin.Email,
+			FirstName: admin.FirstName,
+			LastName:  admin.LastName,
+			Roles:     []string{},
+		}
+		if err := database.Create(user); err != nil {
+			return nil, err
+		}
+	}
+	for _, role := range user.Roles {
+		if role == model.RoleAdmin {
+			return user, nil
+		}
+	}
+	if err := user.SetRoles(database, append(user.Roles, model.RoleAdmin)); err != nil {
+		return nil, err
+	}
+	n.logger.Infof("`%s` is admin of namespace `%s`", user.Email, namespace)
+	return user, nil
+}
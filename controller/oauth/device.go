@@ -0,0 +1,136 @@
+package oauth
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/hbahadorzadeh/key-master/service"
+	"github.com/markbates/goth"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+const deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+var errDeviceApprover = errors.New("Devices can only be approved by a logged in user")
+
+// deviceAuthorizationRequest is the RFC 8628 device authorization form, the CLI is a public client.
+// Devices act with everything the approving user may do, a scope is refused rather than silently ignored.
+type deviceAuthorizationRequest struct {
+	ClientID string `form:"client_id" validate:"required"`
+	Scope    string `form:"scope"`
+}
+
+type deviceDecisionRequest struct {
+	UserCode string `json:"user_code" validate:"required"`
+	Approve  bool   `json:"approve"`
+}
+
+// deviceAuthorization starts a login for a device without a browser.
+func (o *oAuthController) deviceAuthorization(ctx *fiber.Ctx) error {
+	req := &deviceAuthorizationRequest{}
+	if err := ctx.BodyParser(req); err != nil {
+		return (&oAuthError{400, "invalid_request", err.Error()}).send(ctx)
+	}
+	if err := o.validate.Struct(req); err != nil {
+		return (&oAuthError{400, "invalid_request", err.Error()}).send(ctx)
+	}
+	if req.Scope != "" {
+		return (&oAuthError{400, "invalid_scope", "Device tokens can not be scoped"}).send(ctx)
+	}
+	device, err := o.tokenManager.StartDeviceAuthorization(req.ClientID)
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	ctx.Set(fiber.HeaderCacheControl, "no-store")
+	return ctx.JSON(fiber.Map{
+		"device_code":               device.DeviceCode,
+		"user_code":                 device.UserCode,
+		"verification_uri":          o.deviceVerificationUrl,
+		"verification_uri_complete": o.deviceVerificationUrl + "?user_code=" + device.UserCode,
+		"expires_in":                int(device.ExpiresAt.Sub(device.CreatedAt).Seconds()),
+		"interval":                  int(o.tokenManager.DevicePollInterval().Seconds()),
+	})
+}
+
+// deviceCodeGrant is polled by the device until the user decided, approved devices get a token pair of their own session.
+func (o *oAuthController) deviceCodeGrant(ctx *fiber.Ctx, req *grantRequest) error {
+	if req.DeviceCode == "" {
+		return (&oAuthError{400, "invalid_request", "device_code is required"}).send(ctx)
+	}
+	device, err := o.tokenManager.PollDeviceAuthorization(req.DeviceCode, req.ClientID)
+	switch err {
+	case nil:
+	case service.ErrDeviceAuthorizationPending, service.ErrDeviceSlowDown, service.ErrDeviceAccessDenied, service.ErrDeviceCodeExpired:
+		return (&oAuthError{400, err.Error(), ""}).send(ctx)
+	default:
+		return ctx.Status(500).SendString(err.Error())
+	}
+	token, refreshToken, err := o.tokenManager.InvokeTokens(ctx, device.User(), device.Provider, device.Amr...)
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	ctx.Set(fiber.HeaderCacheControl, "no-store")
+	return ctx.JSON(fiber.Map{
+		"access_token":  token,
+		"refresh_token": refreshToken,
+		"token_type":    "Bearer",
+		"expires_in":    int(o.tokenManager.AccessTokenTTL().Seconds()),
+	})
+}
+
+// getDevice shows the user what a code belongs to before they decide.
+func (o *oAuthController) getDevice(ctx *fiber.Ctx) error {
+	if _, _, status, err := o.deviceApprover(ctx); err != nil {
+		return ctx.Status(status).SendString(err.Error())
+	}
+	device, err := o.tokenManager.GetDeviceAuthorization(ctx.Query("user_code"))
+	if err == service.ErrDeviceUserCodeInvalid {
+		return ctx.Status(404).SendString(err.Error())
+	} else if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	return ctx.JSON(device)
+}
+
+// decideDevice approves or denies a device, the device gets the identity and factors of the approving login.
+func (o *oAuthController) decideDevice(ctx *fiber.Ctx) error {
+	user, provider, status, err := o.deviceApprover(ctx)
+	if err != nil {
+		return ctx.Status(status).SendString(err.Error())
+	}
+	req := &deviceDecisionRequest{}
+	if err := ctx.BodyParser(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if err := o.validate.Struct(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	claims := o.tokenManager.GetClaims(ctx)
+	amr := make([]string, 0)
+	if values, ok := claims["amr"].([]interface{}); ok {
+		// The first entry is the login provider itself
+		for i := 1; i < len(values); i++ {
+			if value, ok := values[i].(string); ok {
+				amr = append(amr, value)
+			}
+		}
+	}
+	device, err := o.tokenManager.DecideDeviceAuthorization(req.UserCode, req.Approve, user, provider, amr)
+	if err == service.ErrDeviceUserCodeInvalid {
+		return ctx.Status(404).SendString(err.Error())
+	} else if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	o.logger.Infof("Device authorization of client `%s` was %s by `%s`", device.ClientID, device.Status, user.Email)
+	return ctx.JSON(device)
+}
+
+// deviceApprover is the logged in user deciding on a device, service accounts cannot approve devices.
+func (o *oAuthController) deviceApprover(ctx *fiber.Ctx) (goth.User, string, int, error) {
+	claims := o.tokenManager.GetClaims(ctx)
+	email, _ := claims["email"].(string)
+	if _, ok := claims["service_account"]; ok || email == "" {
+		return goth.User{}, "", 403, errDeviceApprover
+	}
+	name, _ := claims["name"].(string)
+	provider, _ := claims["provider"].(string)
+	return goth.User{Email: email, Name: name}, provider, 0, nil
+}
@@ -0,0 +1,69 @@
+package oauth
+
+import (
+	"crypto/x509"
+	"strings"
+
+	jwt "github.com/form3tech-oss/jwt-go"
+	"github.com/hbahadorzadeh/key-master/model"
+	"github.com/markbates/goth"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+// authenticateClientCert is installed into the GetMiddleWare chain. DNS SANs and the common name are matched
+// against service account names first, then email SANs against users. Either has to be bound to the certificate
+// and certificates revoked by our own authorities are refused. Users with a second factor only get a token
+// which is accepted by the second factor paths.
+func (o *oAuthController) authenticateClientCert(cert *x509.Certificate) (jwt.MapClaims, error) {
+	if model.CertificateRevoked(o.mdb, cert) {
+		return nil, errors.Newf("Client certificate `%x` is revoked", cert.SerialNumber)
+	}
+	if account, err := o.certServiceAccount(cert); err == nil {
+		return o.tokenManager.ServiceClaims(account.Subject(), account.Name, "mtls", account.Scopes), nil
+	}
+	for _, email := range certEmails(cert) {
+		user, err := model.FindUserByEmail(o.mdb, email)
+		if err != nil || user.Disabled || !user.HasCertificate(cert) {
+			continue
+		}
+		name := strings.TrimSpace(user.FirstName + " " + user.LastName)
+		if user.HasSecondFactor() {
+			return o.tokenManager.MfaClaims(goth.User{Email: user.Email, Name: name}, "mtls"), nil
+		}
+		return o.tokenManager.UserClaims(goth.User{Email: user.Email, Name: name}, "mtls"), nil
+	}
+	return nil, errors.Newf("Client certificate `%s` does not identify a user or service account", cert.Subject)
+}
+
+// certServiceAccount finds the account named by the certificate, which has to be one the account is bound to.
+// Names alone are not enough, any authority trusted for client certificates could issue them.
+func (o *oAuthController) certServiceAccount(cert *x509.Certificate) (*model.ServiceAccount, error) {
+	names := append([]string{}, cert.DNSNames...)
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	for _, name := range names {
+		account, err := model.FindServiceAccount(o.mdb, strings.ToLower(name))
+		if err == nil && !account.Disabled && account.HasCertificate(cert) {
+			return account, nil
+		}
+	}
+	return nil, errors.New("No service account matches the certificate")
+}
+
+// certEmails lists the rfc822Name SANs, falling back to the deprecated emailAddress subject attribute.
+func certEmails(cert *x509.Certificate) []string {
+	if len(cert.EmailAddresses) > 0 {
+		return cert.EmailAddresses
+	}
+	emails := make([]string, 0)
+	for _, attr := range cert.Subject.Names {
+		// 1.2.840.113549.1.9.1 is PKCS #9 emailAddress
+		if attr.Type.String() == "1.2.840.113549.1.9.1" {
+			if email, ok := attr.Value.(string); ok {
+				emails = append(emails, email)
+			}
+		}
+	}
+	return emails
+}
@@ -0,0 +1,231 @@
+package oauth
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/hbahadorzadeh/key-master/model"
+	"github.com/hbahadorzadeh/key-master/service"
+	"github.com/hbahadorzadeh/key-master/util"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type clientRequest struct {
+	Name   string   `json:"name" validate:"required"`
+	Scopes []string `json:"scopes" validate:"required,min=1,dive,oneof=introspect revoke"`
+}
+
+// tokenRequest is the form body shared by RFC 7662 and RFC 7009.
+type tokenRequest struct {
+	Token         string `form:"token" validate:"required"`
+	TokenTypeHint string `form:"token_type_hint"`
+	ClientID      string `form:"client_id"`
+	ClientSecret  string `form:"client_secret"`
+}
+
+type oAuthController struct {
+	tokenManager *service.TokenManager
+	mdb          *service.MongoDB
+	validate     *validator.Validate
+	logger       *log.Logger
+	// deviceVerificationUrl is the UI page where users log in and enter device user codes
+	deviceVerificationUrl string
+}
+
+func NewOAuthController(tokenManager *service.TokenManager, mdb *service.MongoDB, validate *validator.Validate) (o *oAuthController) {
+	return &oAuthController{
+		tokenManager: tokenManager,
+		mdb:          mdb,
+		validate:     validate,
+	}
+}
+
+func (o *oAuthController) Init(configs *util.Configs, logger *log.Logger, app *fiber.App) {
+	o.logger = logger
+	o.deviceVerificationUrl = fmt.Sprintf("%s/device", strings.TrimSuffix(configs.Web.UiUrl, "/"))
+	o.mdb.CreateCollection(model.OAuthClient{})
+	o.mdb.CreateCollection(model.ServiceAccount{})
+	o.mdb.CreateCollection(model.ApiKey{})
+	// Authenticated with client credentials instead of a bearer token
+	o.tokenManager.AddPublicPath("/oauth/token")
+	o.tokenManager.AddPublicPath("/oauth/introspect")
+	o.tokenManager.AddPublicPath("/oauth/revoke")
+	o.tokenManager.AddPublicPath("/oauth/device_authorization")
+	o.tokenManager.SetApiKeyAuthenticator(o.authenticateApiKey)
+	o.tokenManager.SetClientCertAuthenticator(o.authenticateClientCert)
+	manage := o.tokenManager.Require(service.PermissionClientsManage)
+
+	app.Post("/oauth/clients", manage, o.createClient)
+	app.Get("/oauth/clients", manage, o.listClients)
+	app.Delete("/oauth/clients/:client_id", manage, o.deleteClient)
+	app.Post("/oauth/token", o.token)
+	app.Post("/oauth/introspect", o.introspect)
+	app.Post("/oauth/revoke", o.revoke)
+	app.Post("/oauth/device_authorization", o.deviceAuthorization)
+	app.Get("/oauth/device", o.getDevice)
+	app.Post("/oauth/device", o.decideDevice)
+
+	app.Post("/service-accounts", manage, o.createServiceAccount)
+	app.Get("/service-accounts", manage, o.listServiceAccounts)
+	app.Delete("/service-accounts/:name", manage, o.deleteServiceAccount)
+	app.Post("/service-accounts/:name/disable", manage, o.setServiceAccountDisabled(true))
+	app.Post("/service-accounts/:name/enable", manage, o.setServiceAccountDisabled(false))
+	app.Post("/service-accounts/:name/secret", manage, o.rotateServiceAccountSecret)
+	app.Put("/service-accounts/:name/certificates", manage, o.setServiceAccountCertificates)
+	app.Post("/service-accounts/:name/api-keys", manage, o.createApiKey)
+	app.Get("/service-accounts/:name/api-keys", manage, o.listApiKeys)
+	app.Delete("/service-accounts/:name/api-keys/:prefix", manage, o.deleteApiKey)
+	grant := o.tokenManager.Require(service.PermissionKeysManage)
+	app.Post("/service-accounts/:name/secrets/*", manage, grant, o.setServiceAccountSecret(true))
+	app.Delete("/service-accounts/:name/secrets/*", manage, grant, o.setServiceAccountSecret(false))
+}
+
+// createClient registers a client, the secret is only ever returned here.
+func (o *oAuthController) createClient(ctx *fiber.Ctx) error {
+	req := &clientRequest{}
+	if err := ctx.BodyParser(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if err := o.validate.Struct(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	clientID, clientSecret, err := newClientCredentials()
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	client := &model.OAuthClient{
+		Name:     req.Name,
+		ClientID: clientID,
+		Scopes:   req.Scopes,
+	}
+	client.SetSecret(clientSecret)
+	if err := o.mdb.Create(client); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	return ctx.JSON(fiber.Map{"client": client, "client_secret": clientSecret})
+}
+
+func (o *oAuthController) listClients(ctx *fiber.Ctx) error {
+	clients := make([]model.OAuthClient, 0)
+	if err := o.mdb.SelectAll(&clients, bson.M{}); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	return ctx.JSON(clients)
+}
+
+func (o *oAuthController) deleteClient(ctx *fiber.Ctx) error {
+	client, err := model.FindOAuthClient(o.mdb, ctx.Params("client_id"))
+	if err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	if err := o.mdb.Delete(client); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	return ctx.SendStatus(204)
+}
+
+// introspect implements RFC 7662, anything not active is reported as just `active: false`.
+func (o *oAuthController) introspect(ctx *fiber.Ctx) error {
+	req, oErr := o.authenticate(ctx, model.ClientScopeIntrospect)
+	if oErr != nil {
+		return oErr.send(ctx)
+	}
+	claims, active := o.tokenManager.Introspect(req.Token)
+	if !active {
+		return ctx.JSON(fiber.Map{"active": false})
+	}
+	res := fiber.Map{"active": true, "token_type": "Bearer"}
+	if typ, _ := claims["typ"].(string); typ == "refresh" {
+		res["token_type"] = "refresh_token"
+	}
+	for _, claim := range []string{"exp", "iat", "jti", "sid", "sub", "scope", "email", "name", "provider", "amr", "mfa", "roles", "service_account", "cnf"} {
+		if v, ok := claims[claim]; ok {
+			res[claim] = v
+		}
+	}
+	if email, ok := claims["email"]; ok {
+		res["username"] = email
+	}
+	return ctx.JSON(res)
+}
+
+// revoke implements RFC 7009, the response does not reveal whether the token was valid.
+func (o *oAuthController) revoke(ctx *fiber.Ctx) error {
+	req, oErr := o.authenticate(ctx, model.ClientScopeRevoke)
+	if oErr != nil {
+		return oErr.send(ctx)
+	}
+	if req.TokenTypeHint != "" && req.TokenTypeHint != "access_token" && req.TokenTypeHint != "refresh_token" {
+		return ctx.Status(400).JSON(fiber.Map{"error": "unsupported_token_type"})
+	}
+	if err := o.tokenManager.RevokeTokenValue(req.Token); err != nil {
+		return ctx.Status(503).SendString(err.Error())
+	}
+	return ctx.SendStatus(200)
+}
+
+// oAuthError is an RFC 6749 section 5.2 error response.
+type oAuthError struct {
+	status      int
+	code        string
+	description string
+}
+
+func (e *oAuthError) send(ctx *fiber.Ctx) error {
+	if e.status == 401 {
+		ctx.Set(fiber.HeaderWWWAuthenticate, `Basic realm="key-master"`)
+	}
+	res := fiber.Map{"error": e.code}
+	if e.description != "" {
+		res["error_description"] = e.description
+	}
+	return ctx.Status(e.status).JSON(res)
+}
+
+// authenticate parses the form and checks the client credentials, sent either as HTTP Basic or in the body.
+func (o *oAuthController) authenticate(ctx *fiber.Ctx, scope string) (*tokenRequest, *oAuthError) {
+	req := &tokenRequest{}
+	if err := ctx.BodyParser(req); err != nil {
+		return nil, &oAuthError{400, "invalid_request", err.Error()}
+	}
+	if err := o.validate.Struct(req); err != nil {
+		return nil, &oAuthError{400, "invalid_request", err.Error()}
+	}
+	clientID, clientSecret, ok := basicAuth(ctx)
+	if !ok {
+		clientID, clientSecret = req.ClientID, req.ClientSecret
+	}
+	client, err := model.FindOAuthClient(o.mdb, clientID)
+	if err != nil || !client.CheckSecret(clientSecret) {
+		return nil, &oAuthError{401, "invalid_client", ""}
+	}
+	if !client.HasScope(scope) {
+		return nil, &oAuthError{403, "unauthorized_client", ""}
+	}
+	return req, nil
+}
+
+func basicAuth(ctx *fiber.Ctx) (username, password string, ok bool) {
+	auth := ctx.Get(fiber.HeaderAuthorization)
+	const prefix = "Basic "
+	if len(auth) <= len(prefix) || auth[:len(prefix)] != prefix {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	// RFC 6749 section 2.3.1 form-encodes the credentials before putting them in the header
+	username, err1 := url.QueryUnescape(parts[0])
+	password, err2 := url.QueryUnescape(parts[1])
+	return username, password, err1 == nil && err2 == nil
+}
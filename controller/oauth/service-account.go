@@ -0,0 +1,358 @@
+package oauth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	jwt "github.com/form3tech-oss/jwt-go"
+	"github.com/gofiber/fiber/v2"
+	"github.com/hbahadorzadeh/key-master/model"
+	"github.com/hbahadorzadeh/key-master/service"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+// apiKeyTouchInterval limits last used tracking to one write per key and interval.
+const apiKeyTouchInterval = time.Minute
+
+type serviceAccountRequest struct {
+	Name        string   `json:"name" validate:"required,hostname_rfc1123"`
+	Description string   `json:"description"`
+	Scopes      []string `json:"scopes" validate:"dive,required"`
+}
+
+// certificatesRequest binds a service account to PEM encoded client certificates.
+type certificatesRequest struct {
+	Certificates []string `json:"certificates" validate:"dive,required"`
+}
+
+type apiKeyRequest struct {
+	Name   string   `json:"name" validate:"required"`
+	Scopes []string `json:"scopes"`
+	TTL    string   `json:"ttl"`
+}
+
+// grantRequest is the RFC 6749 token request form.
+type grantRequest struct {
+	GrantType    string `form:"grant_type" validate:"required"`
+	Scope        string `form:"scope"`
+	ClientID     string `form:"client_id"`
+	ClientSecret string `form:"client_secret"`
+	DeviceCode   string `form:"device_code"`
+}
+
+func (o *oAuthController) createServiceAccount(ctx *fiber.Ctx) error {
+	req := &serviceAccountRequest{}
+	if err := ctx.BodyParser(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if err := o.validate.Struct(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if _, err := model.FindServiceAccount(o.mdb, req.Name); err == nil {
+		return ctx.Status(409).SendString("Service account already exists")
+	}
+	account := &model.ServiceAccount{
+		Name:        req.Name,
+		Description: req.Description,
+		Scopes:      req.Scopes,
+		CreatedBy:   o.tokenManager.GetEmail(ctx),
+	}
+	clientID, secret, err := newClientCredentials()
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	account.ClientID = clientID
+	account.SetSecret(secret)
+	if err := o.mdb.Create(account); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	return ctx.JSON(fiber.Map{"service_account": account, "client_secret": secret})
+}
+
+func (o *oAuthController) listServiceAccounts(ctx *fiber.Ctx) error {
+	accounts := make([]model.ServiceAccount, 0)
+	if err := o.mdb.SelectAll(&accounts, bson.M{}); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	return ctx.JSON(accounts)
+}
+
+// deleteServiceAccount removes the account with its API keys and cuts off the tokens it already holds.
+func (o *oAuthController) deleteServiceAccount(ctx *fiber.Ctx) error {
+	account, status, err := o.pathServiceAccount(ctx)
+	if err != nil {
+		return ctx.Status(status).SendString(err.Error())
+	}
+	keys := make([]model.ApiKey, 0)
+	if err := o.mdb.SelectAll(&keys, bson.M{"service_account_id": account.ID}); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	for i := range keys {
+		if err := o.mdb.Delete(&keys[i]); err != nil {
+			return ctx.Status(500).SendString(err.Error())
+		}
+	}
+	if err := o.mdb.Delete(account); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	if err := o.tokenManager.RevokeUserSessions(account.Subject()); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	return ctx.SendStatus(204)
+}
+
+func (o *oAuthController) setServiceAccountDisabled(disabled bool) fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		account, status, err := o.pathServiceAccount(ctx)
+		if err != nil {
+			return ctx.Status(status).SendString(err.Error())
+		}
+		account.Disabled = disabled
+		if err := o.mdb.Update(account, bson.M{"$set": bson.M{"disabled": disabled}}); err != nil {
+			return ctx.Status(500).SendString(err.Error())
+		}
+		if disabled {
+			if err := o.tokenManager.RevokeUserSessions(account.Subject()); err != nil {
+				return ctx.Status(500).SendString(err.Error())
+			}
+		}
+		return ctx.JSON(account)
+	}
+}
+
+// setServiceAccountSecret grants a secret to the account or takes it back, keys are only used with a grant.
+func (o *oAuthController) setServiceAccountSecret(grant bool) fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		account, status, err := o.pathServiceAccount(ctx)
+		if err != nil {
+			return ctx.Status(status).SendString(err.Error())
+		}
+		secret := &model.Secret{}
+		if err := o.mdb.Select(secret, bson.M{"label": ctx.Params("*")}); err != nil {
+			return ctx.Status(404).SendString(err.Error())
+		}
+		if grant {
+			err = secret.GrantServiceAccount(o.mdb, account)
+		} else {
+			err = secret.RevokeServiceAccount(o.mdb, account)
+		}
+		if err != nil {
+			return ctx.Status(500).SendString(err.Error())
+		}
+		o.logger.Infof("Secret `%s` granted to service account `%s`: %t, by `%s`", secret.Label, account.Name, grant, o.tokenManager.GetEmail(ctx))
+		return ctx.SendStatus(204)
+	}
+}
+
+// setServiceAccountCertificates replaces the client certificates the account authenticates with.
+func (o *oAuthController) setServiceAccountCertificates(ctx *fiber.Ctx) error {
+	req := &certificatesRequest{}
+	if err := ctx.BodyParser(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if err := o.validate.Struct(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	account, status, err := o.pathServiceAccount(ctx)
+	if err != nil {
+		return ctx.Status(status).SendString(err.Error())
+	}
+	fingerprints, err := service.PemThumbprints(req.Certificates)
+	if err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	account.CertFingerprints = fingerprints
+	if err := o.mdb.Update(account, bson.M{"$set": bson.M{"cert_fingerprints": fingerprints}}); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	return ctx.JSON(account)
+}
+
+// rotateServiceAccountSecret replaces the client secret, the old one stops working at once.
+func (o *oAuthController) rotateServiceAccountSecret(ctx *fiber.Ctx) error {
+	account, status, err := o.pathServiceAccount(ctx)
+	if err != nil {
+		return ctx.Status(status).SendString(err.Error())
+	}
+	_, secret, err := newClientCredentials()
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	account.SetSecret(secret)
+	if err := o.mdb.Update(account, bson.M{"$set": bson.M{"secret_hash": account.SecretHash}}); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	return ctx.JSON(fiber.Map{"client_id": account.ClientID, "client_secret": secret})
+}
+
+func (o *oAuthController) createApiKey(ctx *fiber.Ctx) error {
+	account, status, err := o.pathServiceAccount(ctx)
+	if err != nil {
+		return ctx.Status(status).SendString(err.Error())
+	}
+	req := &apiKeyRequest{}
+	if err := ctx.BodyParser(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if err := o.validate.Struct(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	scopes, err := account.GrantScopes(req.Scopes)
+	if err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	var ttl time.Duration
+	if req.TTL != "" {
+		if ttl, err = time.ParseDuration(req.TTL); err != nil {
+			return ctx.Status(400).SendString(err.Error())
+		}
+	}
+	apiKey, plaintext, err := model.NewApiKey(account, req.Name, scopes, ttl)
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	if err := o.mdb.Create(apiKey); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	return ctx.JSON(fiber.Map{"api_key": apiKey, "key": plaintext})
+}
+
+func (o *oAuthController) listApiKeys(ctx *fiber.Ctx) error {
+	account, status, err := o.pathServiceAccount(ctx)
+	if err != nil {
+		return ctx.Status(status).SendString(err.Error())
+	}
+	keys := make([]model.ApiKey, 0)
+	if err := o.mdb.SelectAll(&keys, bson.M{"service_account_id": account.ID}); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	return ctx.JSON(keys)
+}
+
+func (o *oAuthController) deleteApiKey(ctx *fiber.Ctx) error {
+	account, status, err := o.pathServiceAccount(ctx)
+	if err != nil {
+		return ctx.Status(status).SendString(err.Error())
+	}
+	apiKey := &model.ApiKey{}
+	if err := o.mdb.Select(apiKey, bson.M{"service_account_id": account.ID, "prefix": ctx.Params("prefix")}); err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	if err := o.mdb.Delete(apiKey); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	return ctx.SendStatus(204)
+}
+
+// token implements the RFC 6749 token endpoint, service accounts use the client_credentials grant
+// and devices without a browser the RFC 8628 device_code grant.
+func (o *oAuthController) token(ctx *fiber.Ctx) error {
+	req := &grantRequest{}
+	if err := ctx.BodyParser(req); err != nil {
+		return (&oAuthError{400, "invalid_request", err.Error()}).send(ctx)
+	}
+	if err := o.validate.Struct(req); err != nil {
+		return (&oAuthError{400, "invalid_request", err.Error()}).send(ctx)
+	}
+	switch req.GrantType {
+	case "client_credentials":
+		return o.clientCredentialsGrant(ctx, req)
+	case deviceCodeGrantType:
+		return o.deviceCodeGrant(ctx, req)
+	}
+	return (&oAuthError{400, "unsupported_grant_type", ""}).send(ctx)
+}
+
+func (o *oAuthController) clientCredentialsGrant(ctx *fiber.Ctx, req *grantRequest) error {
+	clientID, clientSecret, ok := basicAuth(ctx)
+	if !ok {
+		clientID, clientSecret = req.ClientID, req.ClientSecret
+	}
+	cert := service.PeerCertificate(ctx)
+	account, err := model.FindServiceAccountByClientID(o.mdb, clientID)
+	if err != nil || account.Disabled {
+		return (&oAuthError{401, "invalid_client", ""}).send(ctx)
+	}
+	if clientSecret == "" && cert != nil {
+		// RFC 8705 tls_client_auth, the certificate has to identify the very same account
+		if certAccount, err := o.certServiceAccount(cert); err != nil || certAccount.ID != account.ID {
+			return (&oAuthError{401, "invalid_client", ""}).send(ctx)
+		}
+	} else if !account.CheckSecret(clientSecret) {
+		return (&oAuthError{401, "invalid_client", ""}).send(ctx)
+	}
+	scopes, err := account.GrantScopes(strings.Fields(req.Scope))
+	if err != nil {
+		return (&oAuthError{400, "invalid_scope", err.Error()}).send(ctx)
+	}
+	token, err := o.tokenManager.InvokeServiceToken(account.Subject(), account.Name, scopes, cert)
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	ctx.Set(fiber.HeaderCacheControl, "no-store")
+	return ctx.JSON(fiber.Map{
+		"access_token": token,
+		"token_type":   "Bearer",
+		"expires_in":   int(o.tokenManager.AccessTokenTTL().Seconds()),
+		"scope":        strings.Join(scopes, " "),
+	})
+}
+
+// authenticateApiKey is installed into the GetMiddleWare chain, API keys get the claims a service token would carry.
+func (o *oAuthController) authenticateApiKey(key string) (jwt.MapClaims, error) {
+	apiKey, err := model.FindApiKey(o.mdb, key)
+	if err != nil {
+		return nil, err
+	}
+	if apiKey.IsExpired() {
+		return nil, errors.New("API key is expired")
+	}
+	account := &model.ServiceAccount{}
+	if err := o.mdb.Select(account, bson.M{"_id": apiKey.ServiceAccountID}); err != nil || account.Disabled {
+		return nil, errors.New("Service account is disabled")
+	}
+	if time.Since(apiKey.LastUsedAt.Time()) > apiKeyTouchInterval {
+		if err := o.mdb.Update(apiKey, bson.M{"$set": bson.M{"last_used_at": primitive.NewDateTimeFromTime(time.Now())}}); err != nil {
+			o.logger.Error(err)
+		}
+	}
+	// Scopes taken away from the account since the key was created are not honoured any more
+	scopes := make([]string, 0, len(apiKey.Scopes))
+	for _, scope := range apiKey.Scopes {
+		if _, err := account.GrantScopes([]string{scope}); err == nil {
+			scopes = append(scopes, scope)
+		}
+	}
+	claims := o.tokenManager.ServiceClaims(account.Subject(), account.Name, "api_key", scopes)
+	claims["api_key"] = apiKey.Prefix
+	if apiKey.ExpiresAt != 0 {
+		claims["exp"] = apiKey.ExpiresAt.Time().Unix()
+	}
+	return claims, nil
+}
+
+// pathServiceAccount loads the account named in the path, the status goes with the error.
+func (o *oAuthController) pathServiceAccount(ctx *fiber.Ctx) (*model.ServiceAccount, int, error) {
+	account, err := model.FindServiceAccount(o.mdb, ctx.Params("name"))
+	if err != nil {
+		return nil, 404, err
+	}
+	return account, 200, nil
+}
+
+func newClientCredentials() (clientID, secret string, err error) {
+	id := make([]byte, 12)
+	buf := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return "", "", err
+	}
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	return hex.EncodeToString(id), base64.RawURLEncoding.EncodeToString(buf), nil
+}
@@ -0,0 +1,305 @@
+package pgp
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/hbahadorzadeh/key-master/model"
+	"github.com/hbahadorzadeh/key-master/service"
+	"github.com/hbahadorzadeh/key-master/util"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/clearsign"
+	"golang.org/x/crypto/openpgp/packet"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+var packetConfig = &packet.Config{
+	DefaultHash: crypto.SHA256,
+	RSABits:     4096,
+}
+
+type generateRequest struct {
+	Name    string `json:"name" validate:"required"`
+	Real    string `json:"real_name" validate:"required"`
+	Comment string `json:"comment"`
+	Email   string `json:"email" validate:"required,email"`
+}
+
+type importRequest struct {
+	Name       string `json:"name" validate:"required"`
+	PrivateKey string `json:"private_key" validate:"required"`
+	Passphrase string `json:"passphrase"`
+}
+
+type signRequest struct {
+	// Data is base64 encoded.
+	Data string `json:"data" validate:"required,base64"`
+	Mode string `json:"mode" validate:"omitempty,oneof=detached cleartext"`
+}
+
+type decryptRequest struct {
+	Message string `json:"message" validate:"required"`
+}
+
+type pgpController struct {
+	tokenManager *service.TokenManager
+	mdb          *service.MongoDB
+	sealer       *service.Sealer
+	policies     *service.PolicyEngine
+	validate     *validator.Validate
+	logger       *log.Logger
+}
+
+func NewPgpController(tokenManager *service.TokenManager, mdb *service.MongoDB, sealer *service.Sealer, policies *service.PolicyEngine, validate *validator.Validate) (p *pgpController) {
+	return &pgpController{
+		tokenManager: tokenManager,
+		mdb:          mdb,
+		sealer:       sealer,
+		policies:     policies,
+		validate:     validate,
+	}
+}
+
+func (p *pgpController) Init(configs *util.Configs, logger *log.Logger, app *fiber.App) {
+	p.logger = logger
+	p.mdb.CreateCollection(model.PgpKey{})
+
+	app.Post("/pgp/keys", p.tokenManager.Require(service.PermissionKeysManage), p.policies.Enforce(service.OperationCreate, "pgp"), p.generate)
+	app.Post("/pgp/keys/import", p.tokenManager.Require(service.PermissionKeysManage), p.policies.Enforce(service.OperationImport, "pgp"), p.importKey)
+	app.Post("/pgp/sign/:name", p.tokenManager.Require(service.PermissionKeysUse), p.policies.Enforce(service.OperationSign, "pgp"), p.sign)
+	app.Post("/pgp/decrypt/:name", p.tokenManager.Require(service.PermissionKeysUse), p.policies.Enforce(service.OperationDecrypt, "pgp"), p.decrypt)
+
+	// Public keys are distributed to package managers and correspondents.
+	p.tokenManager.AddPublicPath("/pgp/public/")
+	app.Get("/pgp/public/:name", p.publicKey)
+}
+
+func (p *pgpController) generate(ctx *fiber.Ctx) error {
+	req := &generateRequest{}
+	if err := ctx.BodyParser(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if err := p.validate.Struct(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	entity, err := openpgp.NewEntity(req.Real, req.Comment, req.Email, packetConfig)
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	return p.store(ctx, req.Name, entity)
+}
+
+func (p *pgpController) importKey(ctx *fiber.Ctx) error {
+	req := &importRequest{}
+	if err := ctx.BodyParser(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if err := p.validate.Struct(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(req.PrivateKey))
+	if err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if len(entities) != 1 {
+		return ctx.Status(400).SendString("Exactly one key is expected")
+	}
+	entity := entities[0]
+	if entity.PrivateKey == nil {
+		return ctx.Status(400).SendString("Key has no private part")
+	}
+	if err := decryptEntity(entity, []byte(req.Passphrase)); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	return p.store(ctx, req.Name, entity)
+}
+
+func (p *pgpController) store(ctx *fiber.Ctx, name string, entity *openpgp.Entity) error {
+	if p.mdb.Select(&model.PgpKey{}, bson.M{"name": name}) == nil {
+		return ctx.Status(409).SendString(fmt.Sprintf("Key `%s` already exists", name))
+	}
+	private := &bytes.Buffer{}
+	if err := entity.SerializePrivate(private, packetConfig); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	public := &bytes.Buffer{}
+	if err := entity.Serialize(public); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	secret, err := model.NewSecret(p.sealer, fmt.Sprintf("pgp/%s", name), model.SecretTypePGP, private.Bytes(), public.Bytes())
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	if owner, err := model.FindUserByEmail(p.mdb, p.tokenManager.GetEmail(ctx)); err == nil {
+		if err := secret.Grant(p.sealer, owner); err != nil {
+			return ctx.Status(500).SendString(err.Error())
+		}
+	}
+	if err := p.mdb.Create(secret); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	key := &model.PgpKey{
+		Name:        name,
+		Fingerprint: fmt.Sprintf("%X", entity.PrimaryKey.Fingerprint),
+		KeyID:       entity.PrimaryKey.KeyIdString(),
+		SecretID:    secret.ID,
+	}
+	for identity := range entity.Identities {
+		key.Identities = append(key.Identities, identity)
+	}
+	if err := p.mdb.Create(key); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	p.logger.Infof("PGP key `%s` stored with fingerprint `%s`", name, key.Fingerprint)
+	return ctx.JSON(key)
+}
+
+func (p *pgpController) publicKey(ctx *fiber.Ctx) error {
+	_, secret, err := p.loadKey(ctx.Params("name"))
+	if err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	armored := &bytes.Buffer{}
+	w, err := armor.Encode(armored, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	if _, err := w.Write(secret.Public); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	if err := w.Close(); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	ctx.Set(fiber.HeaderContentType, "application/pgp-keys")
+	return ctx.Send(armored.Bytes())
+}
+
+func (p *pgpController) sign(ctx *fiber.Ctx) error {
+	req := &signRequest{}
+	if err := ctx.BodyParser(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if err := p.validate.Struct(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	data, err := base64.StdEncoding.DecodeString(req.Data)
+	if err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	entity, status, err := p.loadEntity(ctx)
+	if err != nil {
+		return ctx.Status(status).SendString(err.Error())
+	}
+	signature := &bytes.Buffer{}
+	if req.Mode == "cleartext" {
+		w, err := clearsign.Encode(signature, entity.PrivateKey, packetConfig)
+		if err != nil {
+			return ctx.Status(500).SendString(err.Error())
+		}
+		if _, err := w.Write(data); err != nil {
+			return ctx.Status(500).SendString(err.Error())
+		}
+		if err := w.Close(); err != nil {
+			return ctx.Status(500).SendString(err.Error())
+		}
+	} else if err := openpgp.ArmoredDetachSign(signature, entity, bytes.NewReader(data), packetConfig); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	return ctx.JSON(fiber.Map{"signature": signature.String()})
+}
+
+// decrypt opens an armored message addressed to the stored key, the plaintext is returned base64 encoded.
+func (p *pgpController) decrypt(ctx *fiber.Ctx) error {
+	req := &decryptRequest{}
+	if err := ctx.BodyParser(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if err := p.validate.Struct(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	entity, status, err := p.loadEntity(ctx)
+	if err != nil {
+		return ctx.Status(status).SendString(err.Error())
+	}
+	block, err := armor.Decode(strings.NewReader(req.Message))
+	if err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if block.Type != "PGP MESSAGE" {
+		return ctx.Status(400).SendString(fmt.Sprintf("Unexpected armor type `%s`", block.Type))
+	}
+	md, err := openpgp.ReadMessage(block.Body, openpgp.EntityList{entity}, nil, packetConfig)
+	if err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	plaintext, err := ioutil.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	res := fiber.Map{
+		"data":      base64.StdEncoding.EncodeToString(plaintext),
+		"is_signed": md.IsSigned,
+	}
+	if md.IsSigned {
+		res["signed_by_key_id"] = fmt.Sprintf("%016X", md.SignedByKeyId)
+		res["signature_valid"] = md.SignatureError == nil && md.SignedBy != nil
+	}
+	return ctx.JSON(res)
+}
+
+func (p *pgpController) loadKey(name string) (*model.PgpKey, *model.Secret, error) {
+	key := &model.PgpKey{}
+	if err := p.mdb.Select(key, bson.M{"name": name}); err != nil {
+		return nil, nil, err
+	}
+	secret := &model.Secret{}
+	if err := p.mdb.Select(secret, bson.M{"_id": key.SecretID}); err != nil {
+		return nil, nil, err
+	}
+	return key, secret, nil
+}
+
+// loadEntity opens the private key named in the path, which the caller has to hold a grant on.
+func (p *pgpController) loadEntity(ctx *fiber.Ctx) (*openpgp.Entity, int, error) {
+	_, secret, err := p.loadKey(ctx.Params("name"))
+	if err != nil {
+		return nil, 404, err
+	}
+	if err := secret.CheckHolder(p.mdb, p.tokenManager.GetEmail(ctx), p.tokenManager.GetServiceAccount(ctx)); err != nil {
+		return nil, 403, err
+	}
+	private, err := secret.Private(p.sealer)
+	if err != nil {
+		return nil, 500, err
+	}
+	entity, err := openpgp.ReadEntity(packet.NewReader(bytes.NewReader(private)))
+	if err != nil {
+		return nil, 500, err
+	}
+	return entity, 200, nil
+}
+
+func decryptEntity(entity *openpgp.Entity, passphrase []byte) error {
+	if entity.PrivateKey.Encrypted {
+		if err := entity.PrivateKey.Decrypt(passphrase); err != nil {
+			return errors.Newf("Unable to decrypt private key: %s", err)
+		}
+	}
+	for _, subkey := range entity.Subkeys {
+		if subkey.PrivateKey != nil && subkey.PrivateKey.Encrypted {
+			if err := subkey.PrivateKey.Decrypt(passphrase); err != nil {
+				return errors.Newf("Unable to decrypt subkey: %s", err)
+			}
+		}
+	}
+	return nil
+}
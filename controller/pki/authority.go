@@ -0,0 +1,208 @@
+package pki
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/hbahadorzadeh/key-master/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type authorityRequest struct {
+	Name         string           `json:"name" validate:"required"`
+	CommonName   string           `json:"common_name" validate:"required"`
+	Organization string           `json:"organization"`
+	KeyType      model.SecretType `json:"key_type" validate:"omitempty,oneof=rsa ec ed25519"`
+	KeyBits      int              `json:"key_bits"`
+	TTL          string           `json:"ttl" validate:"required"`
+	MaxPathLen   int              `json:"max_path_len"`
+}
+
+func (p *pkiController) createRoot(ctx *fiber.Ctx) error {
+	return p.createAuthority(ctx, nil)
+}
+
+func (p *pkiController) createIntermediate(ctx *fiber.Ctx) error {
+	parent, _, err := p.loadAuthority(ctx.Params("name"))
+	if err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	return p.createAuthority(ctx, parent)
+}
+
+func (p *pkiController) createAuthority(ctx *fiber.Ctx, parent *model.CertificateAuthority) error {
+	req := &authorityRequest{}
+	if err := ctx.BodyParser(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if err := p.validate.Struct(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	ttl, err := time.ParseDuration(req.TTL)
+	if err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if ttl <= 0 {
+		return ctx.Status(400).SendString(fmt.Sprintf("TTL `%s` has to be positive", ttl))
+	}
+	if p.mdb.Select(&model.CertificateAuthority{}, bson.M{"name": req.Name}) == nil {
+		return ctx.Status(409).SendString(fmt.Sprintf("Certificate authority `%s` already exists", req.Name))
+	}
+	if req.KeyType == "" {
+		req.KeyType = model.SecretTypeEC
+	}
+	signer, err := model.GenerateKeyPair(req.KeyType, req.KeyBits)
+	if err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:   req.CommonName,
+			Organization: []string{req.Organization},
+		},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(ttl),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		MaxPathLen:            req.MaxPathLen,
+		MaxPathLenZero:        req.MaxPathLen == 0 && parent != nil,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+	}
+	if req.Organization == "" {
+		template.Subject.Organization = nil
+	}
+
+	issuerCert := template
+	var issuerSigner crypto.Signer = signer
+	parentID := primitive.NilObjectID
+	if parent != nil {
+		issuerCert, err = x509.ParseCertificate(parent.Certificate)
+		if err != nil {
+			return ctx.Status(500).SendString(err.Error())
+		}
+		if template.NotAfter.After(issuerCert.NotAfter) {
+			template.NotAfter = issuerCert.NotAfter
+		}
+		issuerSigner, err = p.authoritySigner(parent)
+		if err != nil {
+			return ctx.Status(500).SendString(err.Error())
+		}
+		p.addRevocationUrls(template, parent.Name)
+		parentID = parent.ID
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuerCert, signer.Public(), issuerSigner)
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+
+	secret, err := model.NewKeyPairSecret(p.sealer, fmt.Sprintf("pki/ca/%s", req.Name), signer)
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	if owner, err := model.FindUserByEmail(p.mdb, p.tokenManager.GetEmail(ctx)); err == nil {
+		if err := secret.Grant(p.sealer, owner); err != nil {
+			return ctx.Status(500).SendString(err.Error())
+		}
+	}
+	if err := p.mdb.Create(secret); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	ca := &model.CertificateAuthority{
+		Name:        req.Name,
+		SecretID:    secret.ID,
+		ParentID:    parentID,
+		Certificate: der,
+	}
+	if err := p.mdb.Create(ca); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	if parent != nil {
+		if err := p.recordCertificate(parent, "", req.CommonName, der); err != nil {
+			return ctx.Status(500).SendString(err.Error())
+		}
+	}
+	p.logger.Infof("Certificate authority `%s` created", req.Name)
+	return ctx.JSON(fiber.Map{
+		"name":          ca.Name,
+		"certificate":   encodePem("CERTIFICATE", der),
+		"serial_number": fmt.Sprintf("%x", serial),
+	})
+}
+
+func (p *pkiController) getAuthority(ctx *fiber.Ctx) error {
+	ca, cert, err := p.loadAuthority(ctx.Params("name"))
+	if err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	chain, err := p.chain(ca)
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	return ctx.JSON(fiber.Map{
+		"name":        ca.Name,
+		"is_root":     ca.IsRoot(),
+		"not_after":   cert.NotAfter,
+		"certificate": encodePem("CERTIFICATE", ca.Certificate),
+		"ca_chain":    chain,
+	})
+}
+
+func (p *pkiController) createRole(ctx *fiber.Ctx) error {
+	role := &model.PkiRole{}
+	if err := ctx.BodyParser(role); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if err := p.validate.Struct(role); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	for _, ttl := range []string{role.TTL, role.MaxTTL} {
+		if ttl == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(ttl); err != nil {
+			return ctx.Status(400).SendString(err.Error())
+		}
+	}
+	if _, err := keyUsage(role.KeyUsages); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if _, err := extKeyUsage(role.ExtKeyUsages); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if _, _, err := p.loadAuthority(role.Authority); err != nil {
+		return ctx.Status(400).SendString(fmt.Sprintf("Unknown certificate authority `%s`", role.Authority))
+	}
+	existing := &model.PkiRole{}
+	if err := p.mdb.Select(existing, bson.M{"name": role.Name}); err == nil {
+		role.ID = existing.ID
+		role.CreatedAt = existing.CreatedAt
+		if err := p.mdb.Set(role); err != nil {
+			return ctx.Status(500).SendString(err.Error())
+		}
+		return ctx.JSON(role)
+	}
+	if err := p.mdb.Create(role); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	return ctx.JSON(role)
+}
+
+func (p *pkiController) getRole(ctx *fiber.Ctx) error {
+	role := &model.PkiRole{}
+	if err := p.mdb.Select(role, bson.M{"name": ctx.Params("name")}); err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	return ctx.JSON(role)
+}
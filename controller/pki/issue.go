@@ -0,0 +1,326 @@
+package pki
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/hbahadorzadeh/key-master/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+type issueRequest struct {
+	CommonName string   `json:"common_name"`
+	AltNames   []string `json:"alt_names"`
+	IPSans     []string `json:"ip_sans"`
+	TTL        string   `json:"ttl"`
+	Csr        string   `json:"csr"`
+}
+
+type revokeRequest struct {
+	SerialNumber string `json:"serial_number" validate:"required"`
+	Reason       int    `json:"reason" validate:"min=0,max=10"`
+}
+
+var keyUsages = map[string]x509.KeyUsage{
+	"digital_signature":  x509.KeyUsageDigitalSignature,
+	"content_commitment": x509.KeyUsageContentCommitment,
+	"key_encipherment":   x509.KeyUsageKeyEncipherment,
+	"data_encipherment":  x509.KeyUsageDataEncipherment,
+	"key_agreement":      x509.KeyUsageKeyAgreement,
+}
+
+var extKeyUsages = map[string]x509.ExtKeyUsage{
+	"server_auth":      x509.ExtKeyUsageServerAuth,
+	"client_auth":      x509.ExtKeyUsageClientAuth,
+	"code_signing":     x509.ExtKeyUsageCodeSigning,
+	"email_protection": x509.ExtKeyUsageEmailProtection,
+	"time_stamping":    x509.ExtKeyUsageTimeStamping,
+	"ocsp_signing":     x509.ExtKeyUsageOCSPSigning,
+}
+
+func keyUsage(names []string) (x509.KeyUsage, error) {
+	var usage x509.KeyUsage
+	for _, name := range names {
+		u, ok := keyUsages[strings.ToLower(name)]
+		if !ok {
+			return 0, errors.Newf("Unknown key usage `%s`", name)
+		}
+		usage |= u
+	}
+	return usage, nil
+}
+
+func extKeyUsage(names []string) ([]x509.ExtKeyUsage, error) {
+	usages := make([]x509.ExtKeyUsage, 0, len(names))
+	for _, name := range names {
+		u, ok := extKeyUsages[strings.ToLower(name)]
+		if !ok {
+			return nil, errors.Newf("Unknown extended key usage `%s`", name)
+		}
+		usages = append(usages, u)
+	}
+	return usages, nil
+}
+
+// issue creates a certificate for a key pair generated by key-master, the private key is returned once and not kept.
+func (p *pkiController) issue(ctx *fiber.Ctx) error {
+	req := &issueRequest{}
+	if err := ctx.BodyParser(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	role := &model.PkiRole{}
+	if err := p.mdb.Select(role, bson.M{"name": ctx.Params("role")}); err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	keyType := role.KeyType
+	if keyType == "" {
+		keyType = model.SecretTypeEC
+	}
+	signer, err := model.GenerateKeyPair(keyType, role.KeyBits)
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	private, err := x509.MarshalPKCS8PrivateKey(signer)
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	res, status, err := p.createCertificate(role, req, signer.Public())
+	if err != nil {
+		return ctx.Status(status).SendString(err.Error())
+	}
+	res["private_key"] = encodePem("PRIVATE KEY", private)
+	return ctx.JSON(res)
+}
+
+func (p *pkiController) sign(ctx *fiber.Ctx) error {
+	req := &issueRequest{}
+	if err := ctx.BodyParser(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	role := &model.PkiRole{}
+	if err := p.mdb.Select(role, bson.M{"name": ctx.Params("role")}); err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	block, _ := pem.Decode([]byte(req.Csr))
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return ctx.Status(400).SendString("Missing or malformed CSR")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if req.CommonName == "" {
+		req.CommonName = csr.Subject.CommonName
+	}
+	req.AltNames = append(req.AltNames, csr.DNSNames...)
+	for _, ip := range csr.IPAddresses {
+		req.IPSans = append(req.IPSans, ip.String())
+	}
+	res, status, err := p.createCertificate(role, req, csr.PublicKey)
+	if err != nil {
+		return ctx.Status(status).SendString(err.Error())
+	}
+	return ctx.JSON(res)
+}
+
+func (p *pkiController) createCertificate(role *model.PkiRole, req *issueRequest, public crypto.PublicKey) (fiber.Map, int, error) {
+	if req.CommonName == "" {
+		return nil, 400, errors.New("common_name is required")
+	}
+	dnsNames := []string{}
+	for _, name := range append([]string{req.CommonName}, req.AltNames...) {
+		if !allowedName(role, name) {
+			return nil, 400, errors.Newf("Name `%s` is not allowed by role `%s`", name, role.Name)
+		}
+		if !contains(dnsNames, name) {
+			dnsNames = append(dnsNames, name)
+		}
+	}
+	ips := []net.IP{}
+	for _, s := range req.IPSans {
+		if !role.AllowIPSans {
+			return nil, 400, errors.Newf("IP SANs are not allowed by role `%s`", role.Name)
+		}
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, 400, errors.Newf("Invalid IP address `%s`", s)
+		}
+		ips = append(ips, ip)
+	}
+	ttl, err := roleTTL(role, req.TTL)
+	if err != nil {
+		return nil, 400, err
+	}
+	usage, err := keyUsage(role.KeyUsages)
+	if err != nil {
+		return nil, 500, err
+	}
+	extUsage, err := extKeyUsage(role.ExtKeyUsages)
+	if err != nil {
+		return nil, 500, err
+	}
+
+	ca, caCert, err := p.loadAuthority(role.Authority)
+	if err != nil {
+		return nil, 500, err
+	}
+	caSigner, err := p.authoritySigner(ca)
+	if err != nil {
+		return nil, 500, err
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, 500, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: req.CommonName},
+		DNSNames:              dnsNames,
+		IPAddresses:           ips,
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(ttl),
+		KeyUsage:              usage,
+		ExtKeyUsage:           extUsage,
+		BasicConstraintsValid: true,
+	}
+	if template.NotAfter.After(caCert.NotAfter) {
+		template.NotAfter = caCert.NotAfter
+	}
+	p.addRevocationUrls(template, ca.Name)
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, public, caSigner)
+	if err != nil {
+		return nil, 500, err
+	}
+	if err := p.recordCertificate(ca, role.Name, req.CommonName, der); err != nil {
+		return nil, 500, err
+	}
+	chain, err := p.chain(ca)
+	if err != nil {
+		return nil, 500, err
+	}
+	return fiber.Map{
+		"certificate":   encodePem("CERTIFICATE", der),
+		"issuing_ca":    encodePem("CERTIFICATE", ca.Certificate),
+		"ca_chain":      chain,
+		"serial_number": fmt.Sprintf("%x", serial),
+		"expiration":    template.NotAfter,
+	}, 200, nil
+}
+
+func (p *pkiController) revoke(ctx *fiber.Ctx) error {
+	req := &revokeRequest{}
+	if err := ctx.BodyParser(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if err := p.validate.Struct(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	cert := &model.IssuedCertificate{}
+	if err := p.mdb.Select(cert, bson.M{"serial_number": strings.ToLower(req.SerialNumber)}); err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	if !cert.IsRevoked() {
+		cert.RevokedAt = primitive.NewDateTimeFromTime(time.Now())
+		cert.RevocationReason = req.Reason
+		if err := p.mdb.Set(cert); err != nil {
+			return ctx.Status(500).SendString(err.Error())
+		}
+	}
+	ca := &model.CertificateAuthority{}
+	if err := p.mdb.Select(ca, bson.M{"_id": cert.AuthorityID}); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	if _, err := p.buildCRL(ca); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	p.logger.Infof("Certificate `%s` revoked", cert.SerialNumber)
+	return ctx.JSON(fiber.Map{"serial_number": cert.SerialNumber, "revoked_at": cert.RevokedAt})
+}
+
+func (p *pkiController) recordCertificate(ca *model.CertificateAuthority, role, commonName string, der []byte) error {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+	return p.mdb.Create(&model.IssuedCertificate{
+		SerialNumber: fmt.Sprintf("%x", cert.SerialNumber),
+		AuthorityID:  ca.ID,
+		Role:         role,
+		CommonName:   commonName,
+		Certificate:  der,
+		NotAfter:     primitive.NewDateTimeFromTime(cert.NotAfter),
+	})
+}
+
+func (p *pkiController) addRevocationUrls(template *x509.Certificate, authority string) {
+	template.CRLDistributionPoints = []string{fmt.Sprintf("%s/pki/crl/%s", p.baseUrl, authority)}
+	template.OCSPServer = []string{fmt.Sprintf("%s/pki/ocsp/%s", p.baseUrl, authority)}
+}
+
+func roleTTL(role *model.PkiRole, requested string) (time.Duration, error) {
+	ttl := 72 * time.Hour
+	if role.TTL != "" {
+		d, err := time.ParseDuration(role.TTL)
+		if err != nil {
+			return 0, err
+		}
+		ttl = d
+	}
+	if requested != "" {
+		d, err := time.ParseDuration(requested)
+		if err != nil {
+			return 0, err
+		}
+		ttl = d
+	}
+	if ttl <= 0 {
+		return 0, errors.Newf("TTL `%s` has to be positive", ttl)
+	}
+	if role.MaxTTL != "" {
+		max, err := time.ParseDuration(role.MaxTTL)
+		if err != nil {
+			return 0, err
+		}
+		if ttl > max {
+			return 0, errors.Newf("TTL `%s` exceeds the role maximum `%s`", ttl, max)
+		}
+	}
+	return ttl, nil
+}
+
+func allowedName(role *model.PkiRole, name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, domain := range role.AllowedDomains {
+		domain = strings.ToLower(domain)
+		if role.AllowBareDomains && name == domain {
+			return true
+		}
+		if role.AllowSubdomains && strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+package pki
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/hbahadorzadeh/key-master/model"
+	"github.com/hbahadorzadeh/key-master/service"
+	"github.com/hbahadorzadeh/key-master/util"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type pkiController struct {
+	tokenManager *service.TokenManager
+	mdb          *service.MongoDB
+	sealer       *service.Sealer
+	policies     *service.PolicyEngine
+	validate     *validator.Validate
+	logger       *log.Logger
+	baseUrl      string
+}
+
+func NewPkiController(tokenManager *service.TokenManager, mdb *service.MongoDB, sealer *service.Sealer, policies *service.PolicyEngine, validate *validator.Validate) (p *pkiController) {
+	return &pkiController{
+		tokenManager: tokenManager,
+		mdb:          mdb,
+		sealer:       sealer,
+		policies:     policies,
+		validate:     validate,
+	}
+}
+
+func (p *pkiController) Init(configs *util.Configs, logger *log.Logger, app *fiber.App) {
+	p.logger = logger
+	p.baseUrl = fmt.Sprintf("%s:%s", configs.Web.ApiBaseUrl, configs.Web.BindPort)
+	p.mdb.CreateCollection(model.CertificateAuthority{})
+	p.mdb.CreateCollection(model.PkiRole{})
+	p.mdb.CreateCollection(model.IssuedCertificate{})
+
+	app.Post("/pki/ca/root", p.tokenManager.Require(service.PermissionKeysManage), p.policies.Enforce(service.OperationCreate, "pki"), p.createRoot)
+	app.Post("/pki/ca/:name/intermediate", p.tokenManager.Require(service.PermissionKeysManage), p.policies.Enforce(service.OperationIssue, "pki"), p.createIntermediate)
+	app.Get("/pki/ca/:name", p.tokenManager.Require(service.PermissionKeysRead), p.policies.Enforce(service.OperationRead, "pki"), p.getAuthority)
+
+	app.Post("/pki/roles", p.tokenManager.Require(service.PermissionKeysManage), p.policies.Enforce(service.OperationCreate, "pki-role"), p.createRole)
+	app.Get("/pki/roles/:name", p.tokenManager.Require(service.PermissionKeysRead), p.policies.Enforce(service.OperationRead, "pki-role"), p.getRole)
+
+	app.Post("/pki/issue/:role", p.tokenManager.Require(service.PermissionKeysUse), p.policies.Enforce(service.OperationIssue, "pki-role"), p.issue)
+	app.Post("/pki/sign/:role", p.tokenManager.Require(service.PermissionKeysUse), p.policies.Enforce(service.OperationSign, "pki-role"), p.sign)
+	app.Post("/pki/revoke", p.tokenManager.Require(service.PermissionKeysManage), p.policies.Enforce(service.OperationRevoke, "pki"), p.revoke)
+
+	// CRLs and OCSP are fetched by TLS stacks which carry no key-master token.
+	p.tokenManager.AddPublicPath("/pki/crl/")
+	p.tokenManager.AddPublicPath("/pki/ocsp/")
+	app.Get("/pki/crl/:name", p.getCRL)
+	app.Post("/pki/ocsp/:name", p.ocsp)
+	app.Get("/pki/ocsp/:name/*", p.ocsp)
+}
+
+func (p *pkiController) loadAuthority(name string) (*model.CertificateAuthority, *x509.Certificate, error) {
+	ca := &model.CertificateAuthority{}
+	if err := p.mdb.Select(ca, bson.M{"name": name}); err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(ca.Certificate)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ca, cert, nil
+}
+
+func (p *pkiController) authoritySigner(ca *model.CertificateAuthority) (crypto.Signer, error) {
+	secret := &model.Secret{}
+	if err := p.mdb.Select(secret, bson.M{"_id": ca.SecretID}); err != nil {
+		return nil, err
+	}
+	return secret.Signer(p.sealer)
+}
+
+// chain returns the PEM certificates from ca up to and including its root.
+func (p *pkiController) chain(ca *model.CertificateAuthority) ([]string, error) {
+	chain := []string{}
+	for {
+		chain = append(chain, encodePem("CERTIFICATE", ca.Certificate))
+		if ca.IsRoot() {
+			return chain, nil
+		}
+		parent := &model.CertificateAuthority{}
+		if err := p.mdb.Select(parent, bson.M{"_id": ca.ParentID}); err != nil {
+			return nil, err
+		}
+		ca = parent
+	}
+}
+
+func newSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 159))
+}
+
+func encodePem(blockType string, der []byte) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}))
+}
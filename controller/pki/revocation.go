@@ -0,0 +1,135 @@
+package pki
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net/url"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/hbahadorzadeh/key-master/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/crypto/ocsp"
+)
+
+const crlValidity = 24 * time.Hour
+
+// buildCRL signs a new CRL for ca listing its revoked, unexpired certificates and stores it on ca.
+func (p *pkiController) buildCRL(ca *model.CertificateAuthority) ([]byte, error) {
+	caCert, err := x509.ParseCertificate(ca.Certificate)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := p.authoritySigner(ca)
+	if err != nil {
+		return nil, err
+	}
+	revoked := []model.IssuedCertificate{}
+	if err := p.mdb.SelectAll(&revoked, bson.M{
+		"authority_id": ca.ID,
+		"revoked_at":   bson.M{"$ne": primitive.DateTime(0)},
+		"not_after":    bson.M{"$gt": time.Now()},
+	}); err != nil {
+		return nil, err
+	}
+	entries := make([]pkix.RevokedCertificate, 0, len(revoked))
+	for _, c := range revoked {
+		serial, ok := new(big.Int).SetString(c.SerialNumber, 16)
+		if !ok {
+			continue
+		}
+		entries = append(entries, pkix.RevokedCertificate{
+			SerialNumber:   serial,
+			RevocationTime: c.RevokedAt.Time(),
+		})
+	}
+	now := time.Now()
+	ca.CRLNumber++
+	crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:              big.NewInt(ca.CRLNumber),
+		ThisUpdate:          now,
+		NextUpdate:          now.Add(crlValidity),
+		RevokedCertificates: entries,
+	}, caCert, signer)
+	if err != nil {
+		return nil, err
+	}
+	ca.CRL = crl
+	return crl, p.mdb.Set(ca)
+}
+
+func (p *pkiController) getCRL(ctx *fiber.Ctx) error {
+	ca, _, err := p.loadAuthority(ctx.Params("name"))
+	if err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	crl := ca.CRL
+	current, err := x509.ParseCRL(crl)
+	if err != nil || current.HasExpired(time.Now().Add(time.Hour)) {
+		crl, err = p.buildCRL(ca)
+		if err != nil {
+			return ctx.Status(500).SendString(err.Error())
+		}
+	}
+	if ctx.Query("format") == "pem" {
+		return ctx.SendString(encodePem("X509 CRL", crl))
+	}
+	ctx.Set(fiber.HeaderContentType, "application/pkix-crl")
+	return ctx.Send(crl)
+}
+
+// ocsp answers RFC 6960 requests sent either as a POST body or base64 in the GET path.
+func (p *pkiController) ocsp(ctx *fiber.Ctx) error {
+	ca, caCert, err := p.loadAuthority(ctx.Params("name"))
+	if err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	raw := ctx.Body()
+	if ctx.Method() == fiber.MethodGet {
+		encoded, err := url.PathUnescape(ctx.Params("*"))
+		if err != nil {
+			return ctx.Status(400).SendString(err.Error())
+		}
+		raw, err = base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return ctx.Status(400).SendString(err.Error())
+		}
+	}
+	req, err := ocsp.ParseRequest(raw)
+	if err != nil {
+		ctx.Set(fiber.HeaderContentType, "application/ocsp-response")
+		return ctx.Send(ocsp.MalformedRequestErrorResponse)
+	}
+	signer, err := p.authoritySigner(ca)
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	now := time.Now()
+	template := ocsp.Response{
+		Status:       ocsp.Unknown,
+		SerialNumber: req.SerialNumber,
+		ThisUpdate:   now,
+		NextUpdate:   now.Add(time.Hour),
+	}
+	cert := &model.IssuedCertificate{}
+	err = p.mdb.Select(cert, bson.M{"authority_id": ca.ID, "serial_number": fmt.Sprintf("%x", req.SerialNumber)})
+	if err == nil {
+		template.Status = ocsp.Good
+		if cert.IsRevoked() {
+			template.Status = ocsp.Revoked
+			template.RevokedAt = cert.RevokedAt.Time()
+			template.RevocationReason = cert.RevocationReason
+		}
+	}
+	res, err := ocsp.CreateResponse(caCert, caCert, template, signer)
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	ctx.Set(fiber.HeaderContentType, "application/ocsp-response")
+	return ctx.Send(res)
+}
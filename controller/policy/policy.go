@@ -0,0 +1,304 @@
+package policy
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/hbahadorzadeh/key-master/service"
+	"github.com/hbahadorzadeh/key-master/util"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type policyRequest struct {
+	Description string               `json:"description"`
+	Rules       []service.PolicyRule `json:"rules" validate:"required,min=1,dive"`
+}
+
+// evaluateRequest is a dry run, attributes left out are taken from the calling request.
+type evaluateRequest struct {
+	Operation string     `json:"operation" validate:"required"`
+	Key       string     `json:"key" validate:"required"`
+	Subject   string     `json:"subject"`
+	Roles     []string   `json:"roles"`
+	IP        string     `json:"ip" validate:"omitempty,ip"`
+	Time      *time.Time `json:"time"`
+	Mfa       *bool      `json:"mfa"`
+	// Draft is evaluated in place of the current version of the policy with the same name
+	Draft *service.Policy `json:"draft"`
+}
+
+// policyChange is a change waiting for approval, applied by apply once approved.
+type policyChange struct {
+	Action      string               `json:"action"`
+	Name        string               `json:"name"`
+	Description string               `json:"description,omitempty"`
+	Rules       []service.PolicyRule `json:"rules,omitempty"`
+	Version     int                  `json:"version,omitempty"`
+}
+
+type policyController struct {
+	tokenManager *service.TokenManager
+	mdb          *service.MongoDB
+	policies     *service.PolicyEngine
+	approvals    *service.ApprovalWorkflow
+	validate     *validator.Validate
+	logger       *log.Logger
+}
+
+func NewPolicyController(tokenManager *service.TokenManager, mdb *service.MongoDB, policies *service.PolicyEngine, approvals *service.ApprovalWorkflow, validate *validator.Validate) (p *policyController) {
+	return &policyController{
+		tokenManager: tokenManager,
+		mdb:          mdb,
+		policies:     policies,
+		approvals:    approvals,
+		validate:     validate,
+	}
+}
+
+func (p *policyController) Init(configs *util.Configs, logger *log.Logger, app *fiber.App) {
+	p.logger = logger
+	manage := p.tokenManager.Require(service.PermissionPoliciesManage)
+	p.approvals.Register(service.ApprovalPolicyChange, p.apply)
+
+	app.Post("/policies/evaluate", p.evaluate)
+	app.Get("/policies", manage, p.list)
+	app.Get("/policies/:name", manage, p.get)
+	app.Put("/policies/:name", manage, p.put)
+	app.Delete("/policies/:name", manage, p.delete)
+	app.Get("/policies/:name/versions", manage, p.versions)
+	app.Post("/policies/:name/versions/:version/restore", manage, p.restore)
+}
+
+func (p *policyController) list(ctx *fiber.Ctx) error {
+	policies := make([]service.Policy, 0)
+	if err := p.mdb.SelectAll(&policies, bson.M{"current": true}); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	return ctx.JSON(policies)
+}
+
+func (p *policyController) get(ctx *fiber.Ctx) error {
+	policy := &service.Policy{}
+	if err := p.mdb.Select(policy, bson.M{"name": ctx.Params("name"), "current": true}); err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	return ctx.JSON(policy)
+}
+
+// put stores the body as the next version of the policy.
+func (p *policyController) put(ctx *fiber.Ctx) error {
+	req := &policyRequest{}
+	if err := ctx.BodyParser(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if err := p.validate.Struct(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	for i := range req.Rules {
+		if err := req.Rules[i].Validate(); err != nil {
+			return ctx.Status(400).SendString(err.Error())
+		}
+	}
+	if p.approvals.PolicyChangesApproved() {
+		return p.submit(ctx, policyChange{Action: "put", Name: ctx.Params("name"), Description: req.Description, Rules: req.Rules})
+	}
+	policy, err := p.store(p.tokenManager.GetEmail(ctx), ctx.Params("name"), req.Description, req.Rules)
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	return ctx.JSON(policy)
+}
+
+// delete retires the current version, the history is kept.
+func (p *policyController) delete(ctx *fiber.Ctx) error {
+	policy := &service.Policy{}
+	if err := p.mdb.Select(policy, bson.M{"name": ctx.Params("name"), "current": true}); err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	if p.approvals.PolicyChangesApproved() {
+		return p.submit(ctx, policyChange{Action: "delete", Name: policy.Name})
+	}
+	if err := p.retire(p.tokenManager.GetEmail(ctx), policy); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	return ctx.SendStatus(204)
+}
+
+func (p *policyController) retire(author string, policy *service.Policy) error {
+	if err := p.mdb.Update(policy, bson.M{"$set": bson.M{"current": false}}); err != nil {
+		return err
+	}
+	p.policies.Invalidate()
+	p.logger.Infof("Policy `%s` was retired by `%s`", policy.Name, author)
+	return nil
+}
+
+func (p *policyController) versions(ctx *fiber.Ctx) error {
+	versions, err := p.history(ctx.Params("name"))
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	if len(versions) == 0 {
+		return ctx.Status(404).SendString("Policy not found")
+	}
+	return ctx.JSON(versions)
+}
+
+// restore stores an old version again as the next version.
+func (p *policyController) restore(ctx *fiber.Ctx) error {
+	version, err := strconv.Atoi(ctx.Params("version"))
+	if err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	old := &service.Policy{}
+	if err := p.mdb.Select(old, bson.M{"name": ctx.Params("name"), "version": version}); err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	if p.approvals.PolicyChangesApproved() {
+		return p.submit(ctx, policyChange{Action: "restore", Name: old.Name, Description: old.Description, Rules: old.Rules, Version: old.Version})
+	}
+	policy, err := p.store(p.tokenManager.GetEmail(ctx), old.Name, old.Description, old.Rules)
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	return ctx.JSON(policy)
+}
+
+// evaluate tells whether a request would be allowed. Anyone may ask about their own requests,
+// asking on behalf of another subject or other roles takes the permission to manage policies.
+func (p *policyController) evaluate(ctx *fiber.Ctx) error {
+	body := &evaluateRequest{}
+	if err := ctx.BodyParser(body); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if err := p.validate.Struct(body); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	req, err := p.policies.Request(ctx, body.Operation, body.Key)
+	if err != nil {
+		return ctx.Status(503).SendString(err.Error())
+	}
+	if body.Subject != "" || body.Roles != nil || body.Draft != nil {
+		allowed, err := p.tokenManager.HasPermission(ctx, service.PermissionPoliciesManage)
+		if err != nil {
+			return ctx.Status(503).SendString(err.Error())
+		}
+		if !allowed {
+			return ctx.Status(403).SendString(fmt.Sprintf("Permission `%s` is required to evaluate for others or drafts", service.PermissionPoliciesManage))
+		}
+	}
+	if body.Subject != "" {
+		req.Subject = body.Subject
+	}
+	if body.Roles != nil {
+		req.Roles = body.Roles
+	}
+	if body.IP != "" {
+		req.IP = body.IP
+	}
+	if body.Time != nil {
+		req.Time = *body.Time
+	}
+	if body.Mfa != nil {
+		req.Mfa = *body.Mfa
+	}
+	if body.Draft == nil {
+		decision, err := p.policies.Evaluate(req)
+		if err != nil {
+			return ctx.Status(503).SendString(err.Error())
+		}
+		return ctx.JSON(fiber.Map{"request": req, "decision": decision})
+	}
+
+	for i := range body.Draft.Rules {
+		if err := body.Draft.Rules[i].Validate(); err != nil {
+			return ctx.Status(400).SendString(err.Error())
+		}
+	}
+	policies := make([]service.Policy, 0)
+	if err := p.mdb.SelectAll(&policies, bson.M{"current": true, "name": bson.M{"$ne": body.Draft.Name}}); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	policies = append(policies, *body.Draft)
+	return ctx.JSON(fiber.Map{"request": req, "decision": service.EvaluatePolicies(policies, req)})
+}
+
+// submit holds a change back until the approvers agreed to it.
+func (p *policyController) submit(ctx *fiber.Ctx, change policyChange) error {
+	reason := ctx.Get("X-Change-Reason")
+	if reason == "" {
+		return ctx.Status(400).SendString("Policy changes need approval, give the reason in the X-Change-Reason header")
+	}
+	request, err := p.approvals.Submit(p.tokenManager.GetEmail(ctx), service.ApprovalPolicyChange, service.KeyLabel("policy", change.Name), reason, change)
+	if err == service.ErrApprovalDisabled {
+		return ctx.Status(503).SendString(err.Error())
+	}
+	if err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	return ctx.Status(202).JSON(request)
+}
+
+// apply executes an approved change on behalf of its requester.
+func (p *policyController) apply(request *service.ApprovalRequest) ([]byte, error) {
+	change := policyChange{}
+	if err := request.DecodeParams(&change); err != nil {
+		return nil, err
+	}
+	if change.Action == "delete" {
+		policy := &service.Policy{}
+		if err := p.mdb.Select(policy, bson.M{"name": change.Name, "current": true}); err != nil {
+			return nil, err
+		}
+		return nil, p.retire(request.RequestedBy, policy)
+	}
+	_, err := p.store(request.RequestedBy, change.Name, change.Description, change.Rules)
+	return nil, err
+}
+
+// store adds the next version of a policy and makes it the current one.
+func (p *policyController) store(author, name, description string, rules []service.PolicyRule) (*service.Policy, error) {
+	versions, err := p.history(name)
+	if err != nil {
+		return nil, err
+	}
+	policy := &service.Policy{
+		Name:        name,
+		Version:     1,
+		Description: description,
+		Rules:       rules,
+		Current:     true,
+		Author:      author,
+	}
+	for i := range versions {
+		if versions[i].Version >= policy.Version {
+			policy.Version = versions[i].Version + 1
+		}
+		if versions[i].Current {
+			if err := p.mdb.Update(&versions[i], bson.M{"$set": bson.M{"current": false}}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := p.mdb.Create(policy); err != nil {
+		return nil, err
+	}
+	p.policies.Invalidate()
+	p.logger.Infof("Policy `%s` version %d was stored by `%s`", policy.Name, policy.Version, policy.Author)
+	return policy, nil
+}
+
+// history lists every version of a policy, the newest first.
+func (p *policyController) history(name string) ([]service.Policy, error) {
+	versions := make([]service.Policy, 0)
+	if err := p.mdb.SelectAll(&versions, bson.M{"name": name}); err != nil {
+		return nil, err
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Version > versions[j].Version })
+	return versions, nil
+}
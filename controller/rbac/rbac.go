@@ -0,0 +1,309 @@
+package rbac
+
+import (
+	"sort"
+
+	jwt "github.com/form3tech-oss/jwt-go"
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/hbahadorzadeh/key-master/model"
+	"github.com/hbahadorzadeh/key-master/service"
+	"github.com/hbahadorzadeh/key-master/util"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+type roleRequest struct {
+	Name           string   `json:"name" validate:"required,hostname_rfc1123"`
+	Description    string   `json:"description"`
+	Permissions    []string `json:"permissions" validate:"dive,required"`
+	Groups         []string `json:"groups" validate:"dive,required"`
+	ExternalGroups []string `json:"external_groups" validate:"dive,required"`
+}
+
+type rbacController struct {
+	tokenManager *service.TokenManager
+	mdb          *service.MongoDB
+	validate     *validator.Validate
+	logger       *log.Logger
+}
+
+func NewRbacController(tokenManager *service.TokenManager, mdb *service.MongoDB, validate *validator.Validate) (r *rbacController) {
+	return &rbacController{
+		tokenManager: tokenManager,
+		mdb:          mdb,
+		validate:     validate,
+	}
+}
+
+func (r *rbacController) Init(configs *util.Configs, logger *log.Logger, app *fiber.App) {
+	r.logger = logger
+	r.mdb.CreateCollection(model.Role{})
+	if err := model.CreateBuiltInRoles(r.mdb); err != nil {
+		logger.Errorf("Built in roles could not be created: %v", err)
+	}
+	r.tokenManager.SetAuthorizer(r)
+	manage := r.tokenManager.Require(service.PermissionRolesManage)
+
+	app.Get("/auth/permissions", r.permissions)
+
+	app.Get("/roles", manage, r.listRoles)
+	app.Post("/roles", manage, r.createRole)
+	app.Put("/roles/:name", manage, r.updateRole)
+	app.Delete("/roles/:name", manage, r.deleteRole)
+	app.Post("/roles/:name/users/:email", manage, r.assignUser(true))
+	app.Delete("/roles/:name/users/:email", manage, r.assignUser(false))
+	app.Post("/roles/:name/service-accounts/:account", manage, r.assignServiceAccount(true))
+	app.Delete("/roles/:name/service-accounts/:account", manage, r.assignServiceAccount(false))
+	app.Post("/roles/:name/groups/:group", manage, r.assignGroup(false, true))
+	app.Delete("/roles/:name/groups/:group", manage, r.assignGroup(false, false))
+	app.Post("/roles/:name/external-groups/:group", manage, r.assignGroup(true, true))
+	app.Delete("/roles/:name/external-groups/:group", manage, r.assignGroup(true, false))
+}
+
+// Roles implements service.Authorizer. Service accounts have their own roles, users have theirs
+// plus the roles of every key-master group they are a member of and of the groups their identity provider asserts.
+func (r *rbacController) Roles(claims jwt.MapClaims) ([]string, error) {
+	if name, ok := claims["service_account"].(string); ok {
+		account, err := model.FindServiceAccount(r.mdb, name)
+		if err != nil || account.Disabled {
+			return []string{}, nil
+		}
+		return normalize(account.Roles), nil
+	}
+	email, _ := claims["email"].(string)
+	if email == "" {
+		return []string{}, nil
+	}
+	user, err := model.FindUserByEmail(r.mdb, email)
+	if err != nil || user.Disabled {
+		return []string{}, nil
+	}
+	roles, err := user.EffectiveRoles(r.mdb)
+	if err != nil {
+		return nil, err
+	}
+	return normalize(roles), nil
+}
+
+// Permissions implements service.Authorizer.
+func (r *rbacController) Permissions(roles []string) ([]string, error) {
+	return model.RolePermissions(r.mdb, roles)
+}
+
+// permissions shows callers what they may do, e.g. for the UI to hide what they may not.
+func (r *rbacController) permissions(ctx *fiber.Ctx) error {
+	roles, err := r.tokenManager.GetRoles(ctx)
+	if err != nil {
+		return ctx.Status(503).SendString(err.Error())
+	}
+	permissions, err := r.tokenManager.GetPermissions(ctx)
+	if err != nil {
+		return ctx.Status(503).SendString(err.Error())
+	}
+	return ctx.JSON(fiber.Map{"roles": roles, "permissions": permissions})
+}
+
+func (r *rbacController) listRoles(ctx *fiber.Ctx) error {
+	roles := make([]model.Role, 0)
+	if err := r.mdb.SelectAll(&roles, bson.M{}); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	return ctx.JSON(roles)
+}
+
+func (r *rbacController) createRole(ctx *fiber.Ctx) error {
+	req, err := r.parseRole(ctx)
+	if err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if status, err := r.mayGrant(ctx, false, req.Permissions); err != nil {
+		return ctx.Status(status).SendString(err.Error())
+	}
+	if _, err := model.FindRole(r.mdb, req.Name); err == nil {
+		return ctx.Status(409).SendString("Role already exists")
+	}
+	role := &model.Role{
+		Name:           req.Name,
+		Description:    req.Description,
+		Permissions:    normalize(req.Permissions),
+		Groups:         normalize(req.Groups),
+		ExternalGroups: normalize(req.ExternalGroups),
+	}
+	if err := r.mdb.Create(role); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	return ctx.JSON(role)
+}
+
+// updateRole replaces the description, permissions and group mappings of a role, the name stays.
+func (r *rbacController) updateRole(ctx *fiber.Ctx) error {
+	role, err := model.FindRole(r.mdb, ctx.Params("name"))
+	if err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	req, err := r.parseRole(ctx)
+	if err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if status, err := r.mayGrant(ctx, role.BuiltIn, append(role.Permissions, req.Permissions...)); err != nil {
+		return ctx.Status(status).SendString(err.Error())
+	}
+	role.Description = req.Description
+	role.Permissions = normalize(req.Permissions)
+	role.Groups = normalize(req.Groups)
+	role.ExternalGroups = normalize(req.ExternalGroups)
+	if err := r.mdb.Update(role, bson.M{"$set": bson.M{
+		"description":     role.Description,
+		"permissions":     role.Permissions,
+		"groups":          role.Groups,
+		"external_groups": role.ExternalGroups,
+	}}); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	return ctx.JSON(role)
+}
+
+func (r *rbacController) deleteRole(ctx *fiber.Ctx) error {
+	role, err := model.FindRole(r.mdb, ctx.Params("name"))
+	if err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	if role.BuiltIn {
+		return ctx.Status(409).SendString("Built in roles cannot be deleted")
+	}
+	if err := r.mdb.Delete(role); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	return ctx.SendStatus(204)
+}
+
+func (r *rbacController) assignUser(grant bool) fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		role, err := model.FindRole(r.mdb, ctx.Params("name"))
+		if err != nil {
+			return ctx.Status(404).SendString(err.Error())
+		}
+		if status, err := r.mayGrant(ctx, false, role.Permissions); err != nil {
+			return ctx.Status(status).SendString(err.Error())
+		}
+		user, err := model.FindUserByEmail(r.mdb, ctx.Params("email"))
+		if err != nil {
+			return ctx.Status(404).SendString(err.Error())
+		}
+		if err := user.SetRoles(r.mdb, assign(user.Roles, role.Name, grant)); err != nil {
+			return ctx.Status(500).SendString(err.Error())
+		}
+		return ctx.JSON(user)
+	}
+}
+
+func (r *rbacController) assignServiceAccount(grant bool) fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		role, err := model.FindRole(r.mdb, ctx.Params("name"))
+		if err != nil {
+			return ctx.Status(404).SendString(err.Error())
+		}
+		if status, err := r.mayGrant(ctx, false, role.Permissions); err != nil {
+			return ctx.Status(status).SendString(err.Error())
+		}
+		account, err := model.FindServiceAccount(r.mdb, ctx.Params("account"))
+		if err != nil {
+			return ctx.Status(404).SendString(err.Error())
+		}
+		account.Roles = assign(account.Roles, role.Name, grant)
+		if err := r.mdb.Update(account, bson.M{"$set": bson.M{"roles": account.Roles}}); err != nil {
+			return ctx.Status(500).SendString(err.Error())
+		}
+		return ctx.JSON(account)
+	}
+}
+
+// assignGroup maps a key-master group, or a group asserted by identity providers when external is set, to the role.
+func (r *rbacController) assignGroup(external, grant bool) fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		role, err := model.FindRole(r.mdb, ctx.Params("name"))
+		if err != nil {
+			return ctx.Status(404).SendString(err.Error())
+		}
+		if status, err := r.mayGrant(ctx, role.BuiltIn, role.Permissions); err != nil {
+			return ctx.Status(status).SendString(err.Error())
+		}
+		change := bson.M{}
+		if external {
+			role.ExternalGroups = assign(role.ExternalGroups, ctx.Params("group"), grant)
+			change["external_groups"] = role.ExternalGroups
+		} else {
+			role.Groups = assign(role.Groups, ctx.Params("group"), grant)
+			change["groups"] = role.Groups
+		}
+		if err := r.mdb.Update(role, bson.M{"$set": change}); err != nil {
+			return ctx.Status(500).SendString(err.Error())
+		}
+		return ctx.JSON(role)
+	}
+}
+
+// mayGrant makes sure the caller holds every permission it hands on, so roles:manage cannot be turned into more.
+// Built in roles are only changed by holders of every permission.
+func (r *rbacController) mayGrant(ctx *fiber.Ctx, builtIn bool, permissions []string) (int, error) {
+	if builtIn {
+		permissions = []string{service.PermissionAll}
+	}
+	allowed, err := r.tokenManager.HasPermissions(ctx, permissions)
+	if err != nil {
+		return 503, err
+	}
+	if !allowed {
+		return 403, errors.New("You cannot grant permissions you do not hold")
+	}
+	return 200, nil
+}
+
+func (r *rbacController) parseRole(ctx *fiber.Ctx) (*roleRequest, error) {
+	req := &roleRequest{}
+	if err := ctx.BodyParser(req); err != nil {
+		return nil, err
+	}
+	if ctx.Params("name") != "" {
+		req.Name = ctx.Params("name")
+	}
+	if err := r.validate.Struct(req); err != nil {
+		return nil, err
+	}
+	for _, permission := range req.Permissions {
+		if !service.IsPermission(permission) {
+			return nil, errors.Newf("Permission `%s` is unknown", permission)
+		}
+	}
+	return req, nil
+}
+
+// assign adds or removes name from a set of names.
+func assign(names []string, name string, grant bool) []string {
+	result := make([]string, 0, len(names)+1)
+	for _, n := range names {
+		if n != name {
+			result = append(result, n)
+		}
+	}
+	if grant {
+		result = append(result, name)
+	}
+	return normalize(result)
+}
+
+// normalize sorts names and drops duplicates.
+func normalize(names []string) []string {
+	seen := map[string]bool{}
+	result := make([]string, 0, len(names))
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			result = append(result, name)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,72 @@
+package rbac
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	jwt "github.com/form3tech-oss/jwt-go"
+	"github.com/gofiber/fiber/v2"
+	"github.com/hbahadorzadeh/key-master/service"
+	"github.com/stretchr/testify/assert"
+)
+
+// fixedRoles grants the permissions of a fixed role table, the roles come from the token.
+type fixedRoles map[string][]string
+
+func (f fixedRoles) Roles(claims jwt.MapClaims) ([]string, error) {
+	return []string{}, nil
+}
+
+func (f fixedRoles) Permissions(roles []string) ([]string, error) {
+	permissions := make([]string, 0)
+	for _, role := range roles {
+		permissions = append(permissions, f[role]...)
+	}
+	return permissions, nil
+}
+
+func TestMayGrant(t *testing.T) {
+	tokenManager := &service.TokenManager{}
+	tokenManager.SetAuthorizer(fixedRoles{
+		"admin":       {service.PermissionAll},
+		"role-admin":  {service.PermissionRolesManage, service.PermissionKeysRead, service.PermissionKeysUse},
+		"crypto-user": {service.PermissionKeysRead, service.PermissionKeysUse},
+	})
+	r := &rbacController{tokenManager: tokenManager}
+
+	samples := []struct {
+		role        string
+		builtIn     bool
+		permissions []string
+		status      int
+	}{
+		{"role-admin", false, []string{service.PermissionKeysUse}, 200},
+		{"role-admin", false, []string{service.PermissionKeysUse, service.PermissionKeysManage}, 403},
+		{"role-admin", false, []string{service.PermissionAll}, 403},
+		// Built in roles are only changed by holders of every permission, whatever they grant
+		{"role-admin", true, []string{service.PermissionKeysRead}, 403},
+		{"crypto-user", true, []string{}, 403},
+		{"admin", true, []string{service.PermissionKeysRead}, 200},
+		{"admin", false, []string{service.PermissionUsersManage}, 200},
+	}
+	for _, sample := range samples {
+		status := 0
+		app := fiber.New()
+		app.Get("/", func(ctx *fiber.Ctx) error {
+			ctx.Locals("user", &jwt.Token{Claims: jwt.MapClaims{"roles": []interface{}{sample.role}}, Valid: true})
+			status, _ = r.mayGrant(ctx, sample.builtIn, sample.permissions)
+			return ctx.SendStatus(204)
+		})
+		_, err := app.Test(httptest.NewRequest("GET", "/", nil))
+		assert.NoError(t, err)
+		assert.Equal(t, sample.status, status, "%s granting %v, built in: %t", sample.role, sample.permissions, sample.builtIn)
+	}
+}
+
+func TestAssign(t *testing.T) {
+	assert.Equal(t, []string{"a", "b", "c"}, assign([]string{"c", "a"}, "b", true))
+	assert.Equal(t, []string{"a", "c"}, assign([]string{"c", "a"}, "a", true))
+	assert.Equal(t, []string{"c"}, assign([]string{"c", "a"}, "a", false))
+	assert.Equal(t, []string{}, assign(nil, "a", false))
+	assert.Equal(t, []string{"a", "b"}, normalize([]string{"b", "a", "b"}))
+}
@@ -0,0 +1,378 @@
+package ssh_ca
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/hbahadorzadeh/key-master/model"
+	"github.com/hbahadorzadeh/key-master/service"
+	"github.com/hbahadorzadeh/key-master/util"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+const (
+	defaultUserTTL    = 8 * time.Hour
+	defaultMaxUserTTL = 24 * time.Hour
+	defaultHostTTL    = 30 * 24 * time.Hour
+	defaultMaxHostTTL = 365 * 24 * time.Hour
+)
+
+type authorityRequest struct {
+	Name       string           `json:"name" validate:"required"`
+	KeyType    model.SecretType `json:"key_type" validate:"omitempty,oneof=rsa ec ed25519"`
+	KeyBits    int              `json:"key_bits"`
+	MaxUserTTL string           `json:"max_user_ttl"`
+	MaxHostTTL string           `json:"max_host_ttl"`
+	// AllowedHosts may contain `*.example.com` wildcards, without any no host certificate is signed
+	AllowedHosts []string `json:"allowed_hosts" validate:"dive,required"`
+}
+
+type hostsRequest struct {
+	AllowedHosts []string `json:"allowed_hosts" validate:"required,dive,required"`
+}
+
+type principalsRequest struct {
+	Principals []string `json:"principals" validate:"dive,required"`
+}
+
+type signRequest struct {
+	PublicKey  string   `json:"public_key" validate:"required"`
+	Principals []string `json:"principals"`
+	TTL        string   `json:"ttl"`
+}
+
+type sshCaController struct {
+	tokenManager *service.TokenManager
+	mdb          *service.MongoDB
+	sealer       *service.Sealer
+	policies     *service.PolicyEngine
+	validate     *validator.Validate
+	logger       *log.Logger
+}
+
+func NewSshCaController(tokenManager *service.TokenManager, mdb *service.MongoDB, sealer *service.Sealer, policies *service.PolicyEngine, validate *validator.Validate) (s *sshCaController) {
+	return &sshCaController{
+		tokenManager: tokenManager,
+		mdb:          mdb,
+		sealer:       sealer,
+		policies:     policies,
+		validate:     validate,
+	}
+}
+
+func (s *sshCaController) Init(configs *util.Configs, logger *log.Logger, app *fiber.App) {
+	s.logger = logger
+	s.mdb.CreateCollection(model.SshAuthority{})
+
+	manage := s.tokenManager.Require(service.PermissionKeysManage)
+
+	app.Post("/ssh/ca", manage, s.policies.Enforce(service.OperationCreate, "ssh"), s.createAuthority)
+	app.Put("/ssh/ca/:name/hosts", manage, s.policies.Enforce(service.OperationManage, "ssh"), s.setAllowedHosts)
+	app.Put("/ssh/principals/:email", manage, s.policies.Enforce(service.OperationManage, "ssh"), s.setPrincipals)
+	app.Post("/ssh/sign/user/:name", s.tokenManager.Require(service.PermissionKeysUse), s.policies.Enforce(service.OperationSign, "ssh"), s.signUser)
+	// A host certificate lets its holder impersonate the host to every client trusting the authority
+	app.Post("/ssh/sign/host/:name", manage, s.policies.Enforce(service.OperationSign, "ssh"), s.signHost)
+
+	// sshd and known_hosts provisioning fetch the CA key without a token.
+	s.tokenManager.AddPublicPath("/ssh/public-key/")
+	app.Get("/ssh/public-key/:name", s.getPublicKey)
+}
+
+func (s *sshCaController) createAuthority(ctx *fiber.Ctx) error {
+	req := &authorityRequest{}
+	if err := ctx.BodyParser(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if err := s.validate.Struct(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	for _, ttl := range []string{req.MaxUserTTL, req.MaxHostTTL} {
+		if ttl == "" {
+			continue
+		}
+		d, err := time.ParseDuration(ttl)
+		if err != nil {
+			return ctx.Status(400).SendString(err.Error())
+		}
+		if d <= 0 {
+			return ctx.Status(400).SendString(fmt.Sprintf("TTL `%s` has to be positive", d))
+		}
+	}
+	if s.mdb.Select(&model.SshAuthority{}, bson.M{"name": req.Name}) == nil {
+		return ctx.Status(409).SendString(fmt.Sprintf("SSH authority `%s` already exists", req.Name))
+	}
+	if req.KeyType == "" {
+		req.KeyType = model.SecretTypeEd25519
+	}
+	signer, err := model.GenerateKeyPair(req.KeyType, req.KeyBits)
+	if err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	public, err := ssh.NewPublicKey(signer.Public())
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	secret, err := model.NewKeyPairSecret(s.sealer, fmt.Sprintf("ssh/ca/%s", req.Name), signer)
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	if owner, err := model.FindUserByEmail(s.mdb, s.tokenManager.GetEmail(ctx)); err == nil {
+		if err := secret.Grant(s.sealer, owner); err != nil {
+			return ctx.Status(500).SendString(err.Error())
+		}
+	}
+	if err := s.mdb.Create(secret); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	authority := &model.SshAuthority{
+		Name:       req.Name,
+		SecretID:   secret.ID,
+		PublicKey:  strings.TrimSpace(string(ssh.MarshalAuthorizedKey(public))),
+		MaxUserTTL: req.MaxUserTTL,
+		MaxHostTTL: req.MaxHostTTL,
+
+		AllowedHosts: req.AllowedHosts,
+	}
+	if err := s.mdb.Create(authority); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	s.logger.Infof("SSH authority `%s` created", req.Name)
+	return ctx.JSON(authority)
+}
+
+// setAllowedHosts replaces the host names the authority signs host certificates for.
+func (s *sshCaController) setAllowedHosts(ctx *fiber.Ctx) error {
+	req := &hostsRequest{}
+	if err := ctx.BodyParser(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if err := s.validate.Struct(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	authority := &model.SshAuthority{}
+	if err := s.mdb.Select(authority, bson.M{"name": ctx.Params("name")}); err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	authority.AllowedHosts = req.AllowedHosts
+	if err := s.mdb.Update(authority, bson.M{"$set": bson.M{"allowed_hosts": req.AllowedHosts}}); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	s.logger.Infof("SSH authority `%s` signs hosts %v, changed by `%s`", authority.Name, authority.AllowedHosts, s.tokenManager.GetEmail(ctx))
+	return ctx.JSON(authority)
+}
+
+// setPrincipals replaces the login names a user may get certificates for besides the email. Login names
+// like root are worth as much as the account they log into, so only users of at most the caller's rank get them.
+func (s *sshCaController) setPrincipals(ctx *fiber.Ctx) error {
+	req := &principalsRequest{}
+	if err := ctx.BodyParser(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if err := s.validate.Struct(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	user, err := model.FindUserByEmail(s.mdb, ctx.Params("email"))
+	if err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	permissions, err := model.UserPermissions(s.mdb, user)
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	if allowed, err := s.tokenManager.HasPermissions(ctx, permissions); err != nil {
+		return ctx.Status(503).SendString(err.Error())
+	} else if !allowed {
+		return ctx.Status(403).SendString(fmt.Sprintf("User `%s` holds permissions you do not hold", user.Email))
+	}
+	if req.Principals == nil {
+		req.Principals = []string{}
+	}
+	user.SshPrincipals = req.Principals
+	if err := s.mdb.Update(user, bson.M{"$set": bson.M{"ssh_principals": user.SshPrincipals}}); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	s.logger.Infof("SSH principals of `%s` set to %v by `%s`", user.Email, user.SshPrincipals, s.tokenManager.GetEmail(ctx))
+	return ctx.JSON(user)
+}
+
+func (s *sshCaController) getPublicKey(ctx *fiber.Ctx) error {
+	authority := &model.SshAuthority{}
+	if err := s.mdb.Select(authority, bson.M{"name": ctx.Params("name")}); err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	return ctx.SendString(authority.PublicKey + "\n")
+}
+
+// signUser certifies the caller's public key for their email and the login names stored for them.
+// Tokens only carry the email, the other login names are read from the user so that changing them
+// takes effect without waiting for the tokens of the user to expire.
+func (s *sshCaController) signUser(ctx *fiber.Ctx) error {
+	email := s.tokenManager.GetEmail(ctx)
+	if email == "" {
+		return ctx.Status(403).SendString("Token carries no email claim")
+	}
+	allowed := []string{email}
+	if user, err := model.FindUserByEmail(s.mdb, email); err == nil {
+		allowed = append(user.SshPrincipals, email)
+	}
+	return s.sign(ctx, ssh.UserCert, email, func(_ *model.SshAuthority, principal string) bool {
+		return contains(allowed, principal)
+	}, allowed)
+}
+
+func (s *sshCaController) signHost(ctx *fiber.Ctx) error {
+	return s.sign(ctx, ssh.HostCert, s.tokenManager.GetEmail(ctx), (*model.SshAuthority).HostAllowed, nil)
+}
+
+// sign issues a certificate of certType for the requested principals, or defaults when none are requested.
+// Every principal has to be allowed.
+func (s *sshCaController) sign(ctx *fiber.Ctx, certType uint32, keyId string, allowed func(*model.SshAuthority, string) bool, defaults []string) error {
+	req := &signRequest{}
+	if err := ctx.BodyParser(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if err := s.validate.Struct(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	authority := &model.SshAuthority{}
+	if err := s.mdb.Select(authority, bson.M{"name": ctx.Params("name")}); err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	public, _, _, _, err := ssh.ParseAuthorizedKey([]byte(req.PublicKey))
+	if err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	principals := req.Principals
+	if len(principals) == 0 {
+		principals = defaults
+	}
+	for _, p := range principals {
+		if !allowed(authority, p) {
+			return ctx.Status(403).SendString(fmt.Sprintf("Principal `%s` is not allowed", p))
+		}
+	}
+	if len(principals) == 0 {
+		return ctx.Status(400).SendString("At least one principal is required")
+	}
+	ttl, err := certTTL(authority, certType, req.TTL)
+	if err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	signer, err := s.authoritySigner(authority)
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	serial := make([]byte, 8)
+	if _, err := rand.Read(serial); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             public,
+		Serial:          binary.BigEndian.Uint64(serial),
+		CertType:        certType,
+		KeyId:           keyId,
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(now.Add(-time.Minute).Unix()),
+		ValidBefore:     uint64(now.Add(ttl).Unix()),
+	}
+	if certType == ssh.UserCert {
+		cert.Permissions = ssh.Permissions{
+			Extensions: map[string]string{
+				"permit-X11-forwarding":   "",
+				"permit-agent-forwarding": "",
+				"permit-port-forwarding":  "",
+				"permit-pty":              "",
+				"permit-user-rc":          "",
+			},
+		}
+	}
+	if err := cert.SignCert(rand.Reader, signer); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	s.logger.Infof("SSH certificate `%d` signed by `%s` for `%s`", cert.Serial, authority.Name, keyId)
+	return ctx.JSON(fiber.Map{
+		"serial_number": fmt.Sprintf("%d", cert.Serial),
+		"signed_key":    string(ssh.MarshalAuthorizedKey(cert)),
+		"principals":    principals,
+		"valid_before":  time.Unix(int64(cert.ValidBefore), 0),
+	})
+}
+
+func (s *sshCaController) authoritySigner(authority *model.SshAuthority) (ssh.Signer, error) {
+	secret := &model.Secret{}
+	if err := s.mdb.Select(secret, bson.M{"_id": authority.SecretID}); err != nil {
+		return nil, err
+	}
+	key, err := secret.Signer(s.sealer)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromSigner(key)
+	if err != nil {
+		return nil, err
+	}
+	// OpenSSH no longer accepts SHA-1 ssh-rsa signatures, which is what SignCert picks by default.
+	if algorithmSigner, ok := signer.(ssh.AlgorithmSigner); ok && signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		return &rsaSha512Signer{algorithmSigner}, nil
+	}
+	return signer, nil
+}
+
+type rsaSha512Signer struct {
+	ssh.AlgorithmSigner
+}
+
+func (r *rsaSha512Signer) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return r.SignWithAlgorithm(rand, data, ssh.SigAlgoRSASHA2512)
+}
+
+func certTTL(authority *model.SshAuthority, certType uint32, requested string) (time.Duration, error) {
+	ttl, max, maxStr := defaultUserTTL, defaultMaxUserTTL, authority.MaxUserTTL
+	if certType == ssh.HostCert {
+		ttl, max, maxStr = defaultHostTTL, defaultMaxHostTTL, authority.MaxHostTTL
+	}
+	if maxStr != "" {
+		d, err := time.ParseDuration(maxStr)
+		if err != nil {
+			return 0, err
+		}
+		max = d
+	}
+	if requested == "" {
+		// The default gives way to a shorter maximum of the authority
+		if ttl > max {
+			ttl = max
+		}
+		return ttl, nil
+	}
+	ttl, err := time.ParseDuration(requested)
+	if err != nil {
+		return 0, err
+	}
+	if ttl <= 0 {
+		return 0, errors.Newf("TTL `%s` has to be positive", ttl)
+	}
+	if ttl > max {
+		return 0, errors.Newf("TTL `%s` exceeds the maximum `%s`", ttl, max)
+	}
+	return ttl, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
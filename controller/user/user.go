@@ -0,0 +1,392 @@
+package user
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/hbahadorzadeh/key-master/model"
+	"github.com/hbahadorzadeh/key-master/service"
+	"github.com/hbahadorzadeh/key-master/util"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+type createUserRequest struct {
+	Email     string   `json:"email" validate:"required,email"`
+	FirstName string   `json:"first_name" validate:"required"`
+	LastName  string   `json:"last_name" validate:"required"`
+	Password  string   `json:"password" validate:"omitempty,min=12"`
+	Roles     []string `json:"roles" validate:"dive,required"`
+}
+
+// updateUserRequest changes the fields which are present.
+type updateUserRequest struct {
+	Email     *string `json:"email" validate:"omitempty,email"`
+	FirstName *string `json:"first_name" validate:"omitempty,min=1"`
+	LastName  *string `json:"last_name" validate:"omitempty,min=1"`
+	Password  *string `json:"password" validate:"omitempty,min=12"`
+}
+
+// certificatesRequest binds a user to PEM encoded client certificates.
+type certificatesRequest struct {
+	Certificates []string `json:"certificates" validate:"dive,required"`
+}
+
+type userController struct {
+	tokenManager *service.TokenManager
+	mdb          *service.MongoDB
+	sealer       *service.Sealer
+	validate     *validator.Validate
+	logger       *log.Logger
+}
+
+func NewUserController(tokenManager *service.TokenManager, mdb *service.MongoDB, sealer *service.Sealer, validate *validator.Validate) (u *userController) {
+	return &userController{
+		tokenManager: tokenManager,
+		mdb:          mdb,
+		sealer:       sealer,
+		validate:     validate,
+	}
+}
+
+func (u *userController) Init(configs *util.Configs, logger *log.Logger, app *fiber.App) {
+	u.logger = logger
+	manage := u.tokenManager.Require(service.PermissionUsersManage)
+
+	// Forced logout is DELETE /admin/users/:email/sessions, served next to the sessions of the token controller
+	app.Get("/admin/users", manage, u.list)
+	app.Post("/admin/users", manage, u.create)
+	app.Get("/admin/users/:email", manage, u.get)
+	app.Patch("/admin/users/:email", manage, u.update)
+	app.Delete("/admin/users/:email", manage, u.delete)
+	app.Post("/admin/users/:email/disable", manage, u.setDisabled(true))
+	app.Post("/admin/users/:email/enable", manage, u.setDisabled(false))
+	app.Delete("/admin/users/:email/mfa", manage, u.resetMfa)
+	app.Put("/admin/users/:email/certificates", manage, u.setCertificates)
+}
+
+// list searches users by email and name, `q` matches case insensitively anywhere in them.
+func (u *userController) list(ctx *fiber.Ctx) error {
+	page, err := strconv.Atoi(ctx.Query("page", "1"))
+	if err != nil || page < 1 {
+		return ctx.Status(400).SendString("page must be a positive number")
+	}
+	size, err := strconv.Atoi(ctx.Query("per_page", strconv.Itoa(defaultPageSize)))
+	if err != nil || size < 1 || size > maxPageSize {
+		return ctx.Status(400).SendString("per_page must be between 1 and 100")
+	}
+	filter := bson.M{}
+	if q := strings.TrimSpace(ctx.Query("q")); q != "" {
+		pattern := primitive.Regex{Pattern: regexp.QuoteMeta(q), Options: "i"}
+		filter["$or"] = bson.A{
+			bson.M{"email": pattern},
+			bson.M{"first_name": pattern},
+			bson.M{"last_name": pattern},
+		}
+	}
+	if disabled := ctx.Query("disabled"); disabled != "" {
+		value, err := strconv.ParseBool(disabled)
+		if err != nil {
+			return ctx.Status(400).SendString("disabled must be true or false")
+		}
+		filter["disabled"] = value
+	}
+	if remote := ctx.Query("remote"); remote != "" {
+		value, err := strconv.ParseBool(remote)
+		if err != nil {
+			return ctx.Status(400).SendString("remote must be true or false")
+		}
+		filter["is_remote"] = value
+	}
+	users := make([]model.User, 0)
+	total, err := u.mdb.SelectPage(&users, filter, bson.D{{Key: "email", Value: 1}}, int64((page-1)*size), int64(size))
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	return ctx.JSON(fiber.Map{"users": users, "page": page, "per_page": size, "total": total})
+}
+
+// create adds a local user. Without a password the user sets one through the forgotten password flow.
+func (u *userController) create(ctx *fiber.Ctx) error {
+	req := &createUserRequest{}
+	if err := ctx.BodyParser(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if err := u.validate.Struct(req); err != nil {
+		return validationFailed(ctx, err)
+	}
+	if _, err := model.FindUserByEmail(u.mdb, req.Email); err == nil {
+		return ctx.Status(409).SendString("User already exists")
+	}
+	for _, name := range req.Roles {
+		if _, err := model.FindRole(u.mdb, name); err != nil {
+			return ctx.Status(400).SendString(fmt.Sprintf("Role `%s` does not exist", name))
+		}
+	}
+	if len(req.Roles) > 0 {
+		if status, err := u.mayAssignRoles(ctx, req.Roles); err != nil {
+			return ctx.Status(status).SendString(err.Error())
+		}
+	}
+	user := &model.User{
+		Email:     req.Email,
+		FirstName: req.FirstName,
+		LastName:  req.LastName,
+		Roles:     req.Roles,
+	}
+	if err := u.validate.Struct(user); err != nil {
+		return validationFailed(ctx, err)
+	}
+	if err := u.mdb.Create(user); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	if req.Password != "" {
+		if err := user.SetPassword(u.mdb, req.Password); err != nil {
+			return ctx.Status(500).SendString(err.Error())
+		}
+	}
+	u.logger.Infof("User `%s` was created by `%s`", user.Email, u.tokenManager.GetEmail(ctx))
+	return ctx.Status(201).JSON(user)
+}
+
+func (u *userController) get(ctx *fiber.Ctx) error {
+	user, err := model.FindUserByEmail(u.mdb, ctx.Params("email"))
+	if err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	groups, err := model.GroupsOfUser(u.mdb, user.ID)
+	if err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	return ctx.JSON(fiber.Map{"user": user, "groups": model.GroupNames(groups)})
+}
+
+// update changes the profile of a user, profiles of directory users are owned by the directory.
+func (u *userController) update(ctx *fiber.Ctx) error {
+	user, err := model.FindUserByEmail(u.mdb, ctx.Params("email"))
+	if err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	req := &updateUserRequest{}
+	if err := ctx.BodyParser(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if err := u.validate.Struct(req); err != nil {
+		return validationFailed(ctx, err)
+	}
+	if user.IsRemote && (req.Email != nil || req.Password != nil) {
+		return ctx.Status(409).SendString("Email and password of remote users are managed by their identity provider")
+	}
+	// A new password or address lets whoever set it log in as the user
+	if req.Password != nil || (req.Email != nil && !strings.EqualFold(*req.Email, user.Email)) {
+		if status, err := u.mayTakeOver(ctx, user); err != nil {
+			return ctx.Status(status).SendString(err.Error())
+		}
+	}
+	changes := bson.M{}
+	if req.Email != nil && !strings.EqualFold(*req.Email, user.Email) {
+		if _, err := model.FindUserByEmail(u.mdb, *req.Email); err == nil {
+			return ctx.Status(409).SendString("Email is already in use")
+		}
+		// Tokens carry the old address
+		if err := u.tokenManager.RevokeUserSessions(user.Email); err != nil {
+			return ctx.Status(500).SendString(err.Error())
+		}
+		user.Email = *req.Email
+		changes["email"] = user.Email
+	}
+	if req.FirstName != nil {
+		user.FirstName = *req.FirstName
+		changes["first_name"] = user.FirstName
+	}
+	if req.LastName != nil {
+		user.LastName = *req.LastName
+		changes["last_name"] = user.LastName
+	}
+	if len(changes) > 0 {
+		if err := u.mdb.Update(user, bson.M{"$set": changes}); err != nil {
+			return ctx.Status(500).SendString(err.Error())
+		}
+	}
+	if req.Password != nil {
+		if err := user.SetPassword(u.mdb, *req.Password); err != nil {
+			return ctx.Status(500).SendString(err.Error())
+		}
+		if err := u.tokenManager.RevokeUserSessions(user.Email); err != nil {
+			return ctx.Status(500).SendString(err.Error())
+		}
+	}
+	return ctx.JSON(user)
+}
+
+// delete removes the user from its groups, which takes back the secrets granted through them, and logs it out.
+func (u *userController) delete(ctx *fiber.Ctx) error {
+	user, err := model.FindUserByEmail(u.mdb, ctx.Params("email"))
+	if err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	if user.Email == u.tokenManager.GetEmail(ctx) {
+		return ctx.Status(409).SendString("You cannot delete yourself")
+	}
+	if status, err := u.mayTakeOver(ctx, user); err != nil {
+		return ctx.Status(status).SendString(err.Error())
+	}
+	groups := make([]model.Group, 0)
+	if err := u.mdb.SelectAll(&groups, bson.M{"members": user.ID}); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	for i := range groups {
+		members := make([]primitive.ObjectID, 0, len(groups[i].Members))
+		for _, id := range groups[i].Members {
+			if id != user.ID {
+				members = append(members, id)
+			}
+		}
+		if err := u.mdb.Update(&groups[i], bson.M{"$set": bson.M{"members": members}}); err != nil {
+			return ctx.Status(500).SendString(err.Error())
+		}
+	}
+	if err := model.SyncGroupSecrets(u.mdb, u.sealer, user); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	if err := u.mdb.Delete(user); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	if err := u.tokenManager.RevokeUserSessions(user.Email); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	u.logger.Infof("User `%s` was deleted by `%s`", user.Email, u.tokenManager.GetEmail(ctx))
+	return ctx.SendStatus(204)
+}
+
+// setDisabled blocks or unblocks logins, disabling also ends every session of the user.
+func (u *userController) setDisabled(disabled bool) fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		user, err := model.FindUserByEmail(u.mdb, ctx.Params("email"))
+		if err != nil {
+			return ctx.Status(404).SendString(err.Error())
+		}
+		if disabled && user.Email == u.tokenManager.GetEmail(ctx) {
+			return ctx.Status(409).SendString("You cannot disable yourself")
+		}
+		if status, err := u.mayTakeOver(ctx, user); err != nil {
+			return ctx.Status(status).SendString(err.Error())
+		}
+		user.Disabled = disabled
+		if err := u.mdb.Update(user, bson.M{"$set": bson.M{"disabled": disabled}}); err != nil {
+			return ctx.Status(500).SendString(err.Error())
+		}
+		if disabled {
+			if err := u.tokenManager.RevokeUserSessions(user.Email); err != nil {
+				return ctx.Status(500).SendString(err.Error())
+			}
+		}
+		u.logger.Infof("User `%s` was disabled: %t, by `%s`", user.Email, disabled, u.tokenManager.GetEmail(ctx))
+		return ctx.JSON(user)
+	}
+}
+
+// resetMfa removes the second factors of a user who lost them, the next login enrolls new ones.
+func (u *userController) resetMfa(ctx *fiber.Ctx) error {
+	user, err := model.FindUserByEmail(u.mdb, ctx.Params("email"))
+	if err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	if status, err := u.mayTakeOver(ctx, user); err != nil {
+		return ctx.Status(status).SendString(err.Error())
+	}
+	if err := user.ResetMfa(u.mdb); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	if err := u.tokenManager.RevokeUserSessions(user.Email); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	u.logger.Infof("Second factors of `%s` were reset by `%s`", user.Email, u.tokenManager.GetEmail(ctx))
+	return ctx.SendStatus(204)
+}
+
+// setCertificates replaces the client certificates the user may log in with over mTLS.
+func (u *userController) setCertificates(ctx *fiber.Ctx) error {
+	req := &certificatesRequest{}
+	if err := ctx.BodyParser(req); err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	if err := u.validate.Struct(req); err != nil {
+		return validationFailed(ctx, err)
+	}
+	user, err := model.FindUserByEmail(u.mdb, ctx.Params("email"))
+	if err != nil {
+		return ctx.Status(404).SendString(err.Error())
+	}
+	if status, err := u.mayTakeOver(ctx, user); err != nil {
+		return ctx.Status(status).SendString(err.Error())
+	}
+	fingerprints, err := service.PemThumbprints(req.Certificates)
+	if err != nil {
+		return ctx.Status(400).SendString(err.Error())
+	}
+	user.CertFingerprints = fingerprints
+	if err := u.mdb.Update(user, bson.M{"$set": bson.M{"cert_fingerprints": fingerprints}}); err != nil {
+		return ctx.Status(500).SendString(err.Error())
+	}
+	u.logger.Infof("Client certificates of `%s` were set by `%s`", user.Email, u.tokenManager.GetEmail(ctx))
+	return ctx.JSON(user)
+}
+
+// mayAssignRoles makes sure that roles are only handed out by role managers who hold every permission they grant.
+func (u *userController) mayAssignRoles(ctx *fiber.Ctx, roles []string) (int, error) {
+	allowed, err := u.tokenManager.HasPermission(ctx, service.PermissionRolesManage)
+	if err != nil {
+		return 503, err
+	}
+	if !allowed {
+		return 403, errors.Newf("Permission `%s` is required to assign roles", service.PermissionRolesManage)
+	}
+	permissions, err := model.RolePermissions(u.mdb, roles)
+	if err != nil {
+		return 500, err
+	}
+	if allowed, err = u.tokenManager.HasPermissions(ctx, permissions); err != nil {
+		return 503, err
+	} else if !allowed {
+		return 403, errors.New("You cannot grant permissions you do not hold")
+	}
+	return 200, nil
+}
+
+// mayTakeOver refuses to change the credentials, address or state of a user who holds permissions the caller
+// does not. Setting the password, address, certificates or second factors would let the caller log in as that
+// user and gain them, deleting or disabling would lock out someone the caller could never have replaced.
+func (u *userController) mayTakeOver(ctx *fiber.Ctx, user *model.User) (int, error) {
+	permissions, err := model.UserPermissions(u.mdb, user)
+	if err != nil {
+		return 500, err
+	}
+	allowed, err := u.tokenManager.HasPermissions(ctx, permissions)
+	if err != nil {
+		return 503, err
+	}
+	if !allowed {
+		return 403, errors.Newf("User `%s` holds permissions you do not hold", user.Email)
+	}
+	return 200, nil
+}
+
+// validationFailed reports validator errors per field, other errors as they are.
+func validationFailed(ctx *fiber.Ctx, err error) error {
+	if errs, ok := service.ValidationErrors(err); ok {
+		return ctx.Status(400).JSON(fiber.Map{"errors": errs})
+	}
+	return ctx.Status(400).SendString(err.Error())
+}
@@ -4,12 +4,14 @@ go 1.16
 
 require (
 	github.com/andybalholm/brotli v1.0.4 // indirect
+	github.com/duo-labs/webauthn v0.0.0-20210727191636-9f1b88ef44cc
 	github.com/form3tech-oss/jwt-go v3.2.3+incompatible
+	github.com/go-asn1-ber/asn1-ber v1.5.1
+	github.com/go-ldap/ldap/v3 v3.3.0
 	github.com/go-playground/validator/v10 v10.9.0
 	github.com/go-redis/redis/v8 v8.9.0
 	github.com/gofiber/adaptor/v2 v2.1.15
 	github.com/gofiber/fiber/v2 v2.23.0
-	github.com/gofiber/jwt/v2 v2.2.2
 	github.com/markbates/goth v1.67.1
 	github.com/pquerna/otp v1.3.0
 	github.com/prometheus/client_golang v1.7.1
@@ -21,6 +23,7 @@ require (
 	go.uber.org/dig v1.13.0 // indirect
 	go.uber.org/fx v1.14.2
 	go.uber.org/multierr v1.7.0 // indirect
+	golang.org/x/crypto v0.0.0-20210711020723-a769d52b0f97
 	golang.org/x/sys v0.0.0-20211205182925-97ca703d548d // indirect
 	gopkg.in/errgo.v2 v2.1.0
 )
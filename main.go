@@ -2,13 +2,30 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"os"
 	"os/signal"
 
+	"github.com/go-playground/validator/v10"
 	"github.com/go-redis/redis/v8"
 	"github.com/gofiber/fiber/v2"
+	"github.com/hbahadorzadeh/key-master/controller/approval"
+	"github.com/hbahadorzadeh/key-master/controller/audit"
 	"github.com/hbahadorzadeh/key-master/controller/auth"
+	break_glass "github.com/hbahadorzadeh/key-master/controller/break-glass"
+	"github.com/hbahadorzadeh/key-master/controller/fpe"
+	"github.com/hbahadorzadeh/key-master/controller/group"
+	"github.com/hbahadorzadeh/key-master/controller/jose"
+	"github.com/hbahadorzadeh/key-master/controller/lease"
+	"github.com/hbahadorzadeh/key-master/controller/namespace"
+	"github.com/hbahadorzadeh/key-master/controller/oauth"
+	"github.com/hbahadorzadeh/key-master/controller/pgp"
+	"github.com/hbahadorzadeh/key-master/controller/pki"
+	"github.com/hbahadorzadeh/key-master/controller/policy"
+	"github.com/hbahadorzadeh/key-master/controller/rbac"
+	ssh_ca "github.com/hbahadorzadeh/key-master/controller/ssh-ca"
+	"github.com/hbahadorzadeh/key-master/controller/user"
 	"github.com/hbahadorzadeh/key-master/model"
 	"github.com/hbahadorzadeh/key-master/service"
 	"github.com/hbahadorzadeh/key-master/util"
@@ -36,7 +53,17 @@ func main() {
 		fx.Provide(service.NewMongoDatabase),
 		fx.Invoke(closeMongodb),
 		fx.Invoke(initDatabases),
+		fx.Provide(service.NewSealer),
+		fx.Provide(service.NewOtpValidator),
 		fx.Provide(service.NewTokenManager),
+		fx.Provide(service.NewMailer),
+		fx.Provide(service.NewLdapAuthenticator),
+		fx.Provide(service.NewPolicyEngine),
+		fx.Provide(service.NewApprovalWorkflow),
+		fx.Provide(service.NewAuditLog),
+		fx.Provide(service.NewNamespaceRouter),
+		fx.Invoke(rotateSigningKeys),
+		fx.Invoke(reapLeases),
 		fx.Provide(service.NewWebserver),
 		fx.Invoke(initControllers),
 		fx.Invoke(runHttpServer),
@@ -67,10 +94,50 @@ func main() {
 
 func runHttpServer(lifecycle fx.Lifecycle, app *fiber.App, configs *util.Configs) {
 	lifecycle.Append(fx.Hook{OnStart: func(context.Context) error {
-		return app.Listen(fmt.Sprintf("%s:%s", configs.Web.BindAddress, configs.Web.BindPort))
+		address := fmt.Sprintf("%s:%s", configs.Web.BindAddress, configs.Web.BindPort)
+		if configs.Web.TLS.CertFile == "" {
+			return app.Listen(address)
+		}
+		tlsConfig, err := service.NewTLSConfig(configs)
+		if err != nil {
+			return err
+		}
+		listener, err := tls.Listen("tcp", address, tlsConfig)
+		if err != nil {
+			return err
+		}
+		return app.Listener(listener)
 	}})
 }
 
+func rotateSigningKeys(lifecycle fx.Lifecycle, tokenManager *service.TokenManager) {
+	ctx, cancel := context.WithCancel(context.Background())
+	lifecycle.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			go tokenManager.RotateSigningKeys(ctx)
+			return nil
+		},
+		OnStop: func(context.Context) error {
+			cancel()
+			return nil
+		},
+	})
+}
+
+func reapLeases(lifecycle fx.Lifecycle, mdb *service.MongoDB, logger *log.Logger) {
+	ctx, cancel := context.WithCancel(context.Background())
+	lifecycle.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			go model.ReapLeases(ctx, mdb, logger)
+			return nil
+		},
+		OnStop: func(context.Context) error {
+			cancel()
+			return nil
+		},
+	})
+}
+
 func closeRedis(lifecycle fx.Lifecycle, rdb *redis.Client) {
 	lifecycle.Append(fx.Hook{OnStop: func(context.Context) error {
 		return rdb.Close()
@@ -83,11 +150,65 @@ func closeMongodb(lifecycle fx.Lifecycle, mdb *service.MongoDB) {
 	}})
 }
 
-func initControllers(lifecycle fx.Lifecycle, config *util.Configs, logger *log.Logger, app *fiber.App, mdb *service.MongoDB, tokenManager *service.TokenManager) {
-	lifecycle.Append(fx.Hook{OnStart: func(context.Context) error {
-		auth.NewOAuthController(tokenManager).Init(config, logger, app)
-		return nil
-	}})
+func initControllers(lifecycle fx.Lifecycle, config *util.Configs, logger *log.Logger, app *fiber.App, mdb *service.MongoDB, rdb *redis.Client, tokenManager *service.TokenManager, sealer *service.Sealer, otpValidator *service.OtpValidator, mailer *service.Mailer, ldapAuthenticator *service.LdapAuthenticator, policies *service.PolicyEngine, approvals *service.ApprovalWorkflow, auditLog *service.AuditLog, namespaces *service.NamespaceRouter, validate *validator.Validate) {
+	lifecycle.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			mountControllers(config, logger, app, mdb, rdb, tokenManager, sealer, otpValidator, mailer, ldapAuthenticator, policies, approvals, auditLog, validate)
+			namespace.NewNamespaceController(tokenManager, mdb, namespaces, validate).Init(config, logger, app)
+			namespaces.SetBuilder(func(name string) (*fiber.App, func(), error) {
+				return buildNamespace(config, logger, mdb.Namespace(name), rdb, sealer, otpValidator, mailer, ldapAuthenticator, validate)
+			})
+			return nil
+		},
+		OnStop: func(context.Context) error {
+			namespaces.Close()
+			return nil
+		},
+	})
+}
+
+// mountControllers serves every controller of a namespace on app.
+func mountControllers(config *util.Configs, logger *log.Logger, app *fiber.App, mdb *service.MongoDB, rdb *redis.Client, tokenManager *service.TokenManager, sealer *service.Sealer, otpValidator *service.OtpValidator, mailer *service.Mailer, ldapAuthenticator *service.LdapAuthenticator, policies *service.PolicyEngine, approvals *service.ApprovalWorkflow, auditLog *service.AuditLog, validate *validator.Validate) {
+	auth.NewOAuthController(tokenManager, mdb).Init(config, logger, app)
+	auth.NewTokenController(tokenManager, validate).Init(config, logger, app)
+	auth.NewPasswordController(tokenManager, mdb, rdb, mailer, validate).Init(config, logger, app)
+	auth.NewLdapController(tokenManager, mdb, ldapAuthenticator, validate).Init(config, logger, app)
+	auth.NewOtpController(tokenManager, mdb, otpValidator, validate).Init(config, logger, app)
+	auth.NewWebAuthnController(tokenManager, mdb, rdb, validate).Init(config, logger, app)
+	rbac.NewRbacController(tokenManager, mdb, validate).Init(config, logger, app)
+	group.NewGroupController(tokenManager, mdb, sealer, validate).Init(config, logger, app)
+	user.NewUserController(tokenManager, mdb, sealer, validate).Init(config, logger, app)
+	oauth.NewOAuthController(tokenManager, mdb, validate).Init(config, logger, app)
+	policy.NewPolicyController(tokenManager, mdb, policies, approvals, validate).Init(config, logger, app)
+	pki.NewPkiController(tokenManager, mdb, sealer, policies, validate).Init(config, logger, app)
+	ssh_ca.NewSshCaController(tokenManager, mdb, sealer, policies, validate).Init(config, logger, app)
+	jose.NewJoseController(tokenManager, mdb, sealer, policies, validate).Init(config, logger, app)
+	pgp.NewPgpController(tokenManager, mdb, sealer, policies, validate).Init(config, logger, app)
+	fpe.NewFpeController(tokenManager, mdb, sealer, policies, validate).Init(config, logger, app)
+	lease.NewLeaseController(tokenManager, mdb, sealer, mailer, validate).Init(config, logger, app)
+	approval.NewApprovalController(tokenManager, mdb, sealer, policies, approvals, validate).Init(config, logger, app)
+	audit.NewAuditController(tokenManager, auditLog).Init(config, logger, app)
+	break_glass.NewBreakGlassController(tokenManager, mdb, mailer, auditLog, validate).Init(config, logger, app)
+}
+
+// buildNamespace sets the services and controllers of a namespace up on a MongoDB handle bound to it,
+// so the namespace has its own users, signing keys, policies and audit log.
+func buildNamespace(config *util.Configs, logger *log.Logger, mdb *service.MongoDB, rdb *redis.Client, sealer *service.Sealer, otpValidator *service.OtpValidator, mailer *service.Mailer, ldapAuthenticator *service.LdapAuthenticator, validate *validator.Validate) (*fiber.App, func(), error) {
+	mdb.CreateCollection(model.User{})
+	tokenManager, err := service.CreateTokenManager(config, rdb, mdb, sealer, logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	policies := service.NewPolicyEngine(tokenManager, mdb, logger)
+	approvals := service.NewApprovalWorkflow(config, mdb, mailer, sealer, logger)
+	auditLog := service.NewAuditLog(mdb, logger)
+	app := service.NewNamespaceWebserver(tokenManager, auditLog)
+	mountControllers(config, logger, app, mdb, rdb, tokenManager, sealer, otpValidator, mailer, ldapAuthenticator, policies, approvals, auditLog, validate)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go tokenManager.RotateSigningKeys(ctx)
+	go model.ReapLeases(ctx, mdb, logger)
+	return app, cancel, nil
 }
 
 func initDatabases(lifecycle fx.Lifecycle, mdb *service.MongoDB, logger *log.Logger) {
@@ -98,11 +219,11 @@ func initDatabases(lifecycle fx.Lifecycle, mdb *service.MongoDB, logger *log.Log
 			LastName:  "dada",
 			Email:     "aa@bb.cc",
 			IsRemote:  false,
+			Roles:     []string{model.RoleAdmin},
 		}
 		mdb.Create(u)
 		logger.Infof("ID: %s", u.ID)
-		u.Password = "asdddddddd"
-		mdb.Update(u)
+		u.SetPassword(mdb, "asdddddddd")
 		return nil
 	}})
 }
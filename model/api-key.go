@@ -0,0 +1,76 @@
+package model
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hbahadorzadeh/key-master/service"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+// ApiKeyPrefix marks key-master API keys so they can be told apart from JWTs and found by secret scanners.
+const ApiKeyPrefix = "km_"
+
+// ApiKey is a long lived credential of a ServiceAccount. Keys look like `km_<prefix>_<secret>`,
+// only the prefix is stored in clear to find the record, the whole key is stored hashed.
+type ApiKey struct {
+	service.BasicData
+
+	Name             string             `json:"name" bson:"name" validate:"required"`
+	Prefix           string             `json:"prefix" bson:"prefix" validate:"required"`
+	Hash             string             `json:"-" bson:"hash"`
+	ServiceAccountID primitive.ObjectID `json:"service_account_id" bson:"service_account_id"`
+	Scopes           []string           `json:"scopes" bson:"scopes"`
+	ExpiresAt        primitive.DateTime `json:"expires_at" bson:"expires_at"`
+	LastUsedAt       primitive.DateTime `json:"last_used_at" bson:"last_used_at"`
+}
+
+// NewApiKey generates a key for account, the returned plaintext is not stored anywhere.
+func NewApiKey(account *ServiceAccount, name string, scopes []string, ttl time.Duration) (*ApiKey, string, error) {
+	prefix := make([]byte, 4)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+	apiKey := &ApiKey{
+		Name:             name,
+		Prefix:           hex.EncodeToString(prefix),
+		ServiceAccountID: account.ID,
+		Scopes:           scopes,
+	}
+	if ttl > 0 {
+		apiKey.ExpiresAt = primitive.NewDateTimeFromTime(time.Now().Add(ttl))
+	}
+	plaintext := fmt.Sprintf("%s%s_%s", ApiKeyPrefix, apiKey.Prefix, base64.RawURLEncoding.EncodeToString(secret))
+	apiKey.Hash = service.HashSecret(plaintext)
+	return apiKey, plaintext, nil
+}
+
+func (k *ApiKey) IsExpired() bool {
+	return k.ExpiresAt != 0 && k.ExpiresAt.Time().Before(time.Now())
+}
+
+// FindApiKey looks a plaintext key up by its prefix and checks the rest of it.
+func FindApiKey(database *service.MongoDB, plaintext string) (*ApiKey, error) {
+	parts := strings.SplitN(strings.TrimPrefix(plaintext, ApiKeyPrefix), "_", 2)
+	if !strings.HasPrefix(plaintext, ApiKeyPrefix) || len(parts) != 2 {
+		return nil, errors.New("Malformed API key")
+	}
+	k := &ApiKey{}
+	if err := database.Select(k, bson.M{"prefix": parts[0]}); err != nil {
+		return nil, errors.New("Unknown API key")
+	}
+	if !service.CheckSecret(k.Hash, plaintext) {
+		return nil, errors.New("Unknown API key")
+	}
+	return k, nil
+}
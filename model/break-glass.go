@@ -0,0 +1,81 @@
+package model
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/hbahadorzadeh/key-master/service"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const BreakGlassPrefix = "bg_"
+
+// BreakGlassCredential is the sealed emergency credential, only its hash is stored. It is used once,
+// after that a new one can only be sealed when every incident has been reviewed.
+type BreakGlassCredential struct {
+	service.BasicData
+
+	Hash     string             `json:"-" bson:"hash" validate:"required"`
+	Hint     string             `json:"hint" bson:"hint"`
+	SealedBy string             `json:"sealed_by" bson:"sealed_by" validate:"required"`
+	UsedAt   primitive.DateTime `json:"used_at,omitempty" bson:"used_at"`
+	Incident primitive.ObjectID `json:"incident,omitempty" bson:"incident,omitempty"`
+}
+
+// NewBreakGlassCredential generates a credential, the plaintext is shown once to be sealed away offline.
+func NewBreakGlassCredential(sealedBy string) (*BreakGlassCredential, string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+	plaintext := fmt.Sprintf("%s%s", BreakGlassPrefix, base64.RawURLEncoding.EncodeToString(secret))
+	return &BreakGlassCredential{
+		Hash:     service.HashSecret(plaintext),
+		Hint:     plaintext[len(plaintext)-4:],
+		SealedBy: sealedBy,
+	}, plaintext, nil
+}
+
+// BreakGlassIncident is one use of a break-glass credential. It stays open for review until
+// a reviewer records what happened.
+type BreakGlassIncident struct {
+	service.BasicData
+
+	CredentialID primitive.ObjectID `json:"credential_id" bson:"credential_id"`
+	Operator     string             `json:"operator" bson:"operator" validate:"required"`
+	Reason       string             `json:"reason" bson:"reason" validate:"required"`
+	IP           string             `json:"ip" bson:"ip"`
+	Roles        []string           `json:"roles" bson:"roles"`
+	ExpiresAt    primitive.DateTime `json:"expires_at" bson:"expires_at"`
+	ClosedAt     primitive.DateTime `json:"closed_at,omitempty" bson:"closed_at"`
+	ClosedBy     string             `json:"closed_by,omitempty" bson:"closed_by"`
+	Review       *IncidentReview    `json:"review" bson:"review"`
+}
+
+type IncidentReview struct {
+	Reviewer  string             `json:"reviewer" bson:"reviewer"`
+	Summary   string             `json:"summary" bson:"summary"`
+	RootCause string             `json:"root_cause" bson:"root_cause"`
+	Actions   []string           `json:"actions" bson:"actions"`
+	At        primitive.DateTime `json:"at" bson:"at"`
+}
+
+// UnreviewedIncidents lists the incidents still waiting for their post-incident review.
+func UnreviewedIncidents(database *service.MongoDB) ([]BreakGlassIncident, error) {
+	incidents := make([]BreakGlassIncident, 0)
+	if err := database.SelectAll(&incidents, bson.M{"review": nil}); err != nil {
+		return nil, err
+	}
+	return incidents, nil
+}
+
+// Admins lists the enabled users holding the admin role, they are alerted on break-glass use.
+func Admins(database *service.MongoDB) ([]User, error) {
+	users := make([]User, 0)
+	if err := database.SelectAll(&users, bson.M{"roles": RoleAdmin, "disabled": bson.M{"$ne": true}}); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
@@ -0,0 +1,23 @@
+package model
+
+import (
+	"github.com/hbahadorzadeh/key-master/service"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type CertificateAuthority struct {
+	service.BasicData
+
+	Name        string             `json:"name" bson:"name" validate:"required"`
+	SecretID    primitive.ObjectID `json:"secret_id" bson:"secret_id"`
+	ParentID    primitive.ObjectID `json:"parent_id" bson:"parent_id"`
+	Certificate []byte             `json:"certificate" bson:"certificate" validate:"required"`
+
+	//Revocation
+	CRL       []byte `json:"crl" bson:"crl"`
+	CRLNumber int64  `json:"crl_number" bson:"crl_number"`
+}
+
+func (ca *CertificateAuthority) IsRoot() bool {
+	return ca.ParentID == primitive.NilObjectID
+}
@@ -0,0 +1,23 @@
+package model
+
+import (
+	"github.com/hbahadorzadeh/key-master/service"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type FpeMode string
+
+const (
+	FpeModeFF1  FpeMode = "ff1"
+	FpeModeFF31 FpeMode = "ff3-1"
+)
+
+// FpeKey binds an AES Secret to a format-preserving mode and alphabet.
+type FpeKey struct {
+	service.BasicData
+
+	Name     string             `json:"name" bson:"name" validate:"required"`
+	Mode     FpeMode            `json:"mode" bson:"mode" validate:"required,oneof=ff1 ff3-1"`
+	Alphabet string             `json:"alphabet" bson:"alphabet" validate:"required"`
+	SecretID primitive.ObjectID `json:"secret_id" bson:"secret_id"`
+}
@@ -0,0 +1,217 @@
+package model
+
+import (
+	"github.com/hbahadorzadeh/key-master/service"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+// Group is a team of users. Members of a subgroup are members of the group as well, and every member
+// is granted the Secrets of the group and of the groups it is nested in.
+type Group struct {
+	service.BasicData
+
+	Name        string               `json:"name" bson:"name" validate:"required,hostname_rfc1123"`
+	Description string               `json:"description" bson:"description"`
+	Members     []primitive.ObjectID `json:"members" bson:"members"`
+	Subgroups   []string             `json:"subgroups" bson:"subgroups"`
+	Secrets     []primitive.ObjectID `json:"secrets" bson:"secrets"`
+	CreatedBy   string               `json:"created_by" bson:"created_by"`
+}
+
+func FindGroup(database *service.MongoDB, name string) (*Group, error) {
+	g := &Group{}
+	if err := database.Select(g, bson.M{"name": name}); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// ExpandMembers returns the ids of the direct members and of the members of every nested group.
+func (g *Group) ExpandMembers(database *service.MongoDB) ([]primitive.ObjectID, error) {
+	members := map[primitive.ObjectID]bool{}
+	visited := map[string]bool{}
+	queue := []*Group{g}
+	for len(queue) > 0 {
+		group := queue[0]
+		queue = queue[1:]
+		if visited[group.Name] {
+			continue
+		}
+		visited[group.Name] = true
+		for _, id := range group.Members {
+			members[id] = true
+		}
+		for _, name := range group.Subgroups {
+			if visited[name] {
+				continue
+			}
+			subgroup, err := FindGroup(database, name)
+			if err != nil {
+				// Deleted subgroups are dropped from their parents, a dangling name grants nothing
+				continue
+			}
+			queue = append(queue, subgroup)
+		}
+	}
+	ids := make([]primitive.ObjectID, 0, len(members))
+	for id := range members {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// Ancestors returns g and every group it is nested in, directly or through other groups.
+// Their secrets and roles are what members of g are granted.
+func (g *Group) Ancestors(database *service.MongoDB) ([]Group, error) {
+	groups := make([]Group, 0)
+	visited := map[string]bool{}
+	queue := []Group{*g}
+	for len(queue) > 0 {
+		group := queue[0]
+		queue = queue[1:]
+		if visited[group.Name] {
+			continue
+		}
+		visited[group.Name] = true
+		groups = append(groups, group)
+		parents := make([]Group, 0)
+		if err := database.SelectAll(&parents, bson.M{"subgroups": group.Name}); err != nil {
+			return nil, err
+		}
+		queue = append(queue, parents...)
+	}
+	return groups, nil
+}
+
+// GroupsOfUser returns the groups user is a member of, directly or through nested groups.
+func GroupsOfUser(database *service.MongoDB, userID primitive.ObjectID) ([]Group, error) {
+	direct := make([]Group, 0)
+	if err := database.SelectAll(&direct, bson.M{"members": userID}); err != nil {
+		return nil, err
+	}
+	groups := make([]Group, 0, len(direct))
+	visited := map[string]bool{}
+	queue := direct
+	for len(queue) > 0 {
+		group := queue[0]
+		queue = queue[1:]
+		if visited[group.Name] {
+			continue
+		}
+		visited[group.Name] = true
+		groups = append(groups, group)
+		parents := make([]Group, 0)
+		if err := database.SelectAll(&parents, bson.M{"subgroups": group.Name}); err != nil {
+			return nil, err
+		}
+		queue = append(queue, parents...)
+	}
+	return groups, nil
+}
+
+// GroupNames returns the names of groups.
+func GroupNames(groups []Group) []string {
+	names := make([]string, 0, len(groups))
+	for _, g := range groups {
+		names = append(names, g.Name)
+	}
+	return names
+}
+
+// CheckNesting refuses to nest subgroup into g when g is already nested in subgroup.
+func (g *Group) CheckNesting(database *service.MongoDB, subgroup *Group) error {
+	if g.Name == subgroup.Name {
+		return errors.New("A group cannot be nested in itself")
+	}
+	visited := map[string]bool{}
+	queue := []string{subgroup.Name}
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		if visited[name] {
+			continue
+		}
+		visited[name] = true
+		if name == g.Name {
+			return errors.Newf("Group `%s` is already nested in `%s`", g.Name, subgroup.Name)
+		}
+		group, err := FindGroup(database, name)
+		if err != nil {
+			continue
+		}
+		queue = append(queue, group.Subgroups...)
+	}
+	return nil
+}
+
+// SyncGroupSecrets makes the group grants of user match its memberships: secrets of its groups are
+// granted, wrapping their data keys with the user key, and group grants it is no longer entitled to are dropped.
+// Grants made to the user directly are left alone.
+func SyncGroupSecrets(database *service.MongoDB, sealer *service.Sealer, user *User) error {
+	groups, err := GroupsOfUser(database, user.ID)
+	if err != nil {
+		return err
+	}
+	entitled := map[primitive.ObjectID]string{}
+	for _, group := range groups {
+		for _, id := range group.Secrets {
+			if _, ok := entitled[id]; !ok {
+				entitled[id] = group.Name
+			}
+		}
+	}
+
+	held := make([]Secret, 0)
+	if err := database.SelectAll(&held, bson.M{"encrypted_keys": bson.M{"$elemMatch": bson.M{
+		"owner": user.ID,
+		"group": bson.M{"$exists": true, "$ne": ""},
+	}}}); err != nil {
+		return err
+	}
+	for i := range held {
+		if _, ok := entitled[held[i].ID]; ok {
+			delete(entitled, held[i].ID)
+			continue
+		}
+		if err := held[i].revokeGroupGrant(database, user.ID); err != nil {
+			return err
+		}
+	}
+
+	for id, group := range entitled {
+		secret := &Secret{}
+		if err := database.Select(secret, bson.M{"_id": id}); err != nil {
+			continue
+		}
+		if secret.IsOwner(user.ID) {
+			continue
+		}
+		if err := secret.Grant(sealer, user); err != nil {
+			return err
+		}
+		grant := secret.EncryptedKeys[len(secret.EncryptedKeys)-1]
+		grant.Group = group
+		// Pushed alone, rewriting the whole array would undo grants and revocations made meanwhile
+		if _, err := database.UpdateIf(secret, bson.M{"encrypted_keys.owner": bson.M{"$ne": user.ID}},
+			bson.M{"$push": bson.M{"encrypted_keys": grant}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Secret) revokeGroupGrant(database *service.MongoDB, owner primitive.ObjectID) error {
+	keys := make([]EncryptedKey, 0, len(s.EncryptedKeys))
+	for _, k := range s.EncryptedKeys {
+		if k.Owner != owner || k.Group == "" {
+			keys = append(keys, k)
+		}
+	}
+	s.EncryptedKeys = keys
+	return database.Update(s, bson.M{"$pull": bson.M{"encrypted_keys": bson.M{
+		"owner": owner,
+		"group": bson.M{"$exists": true, "$ne": ""},
+	}}})
+}
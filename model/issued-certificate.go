@@ -0,0 +1,39 @@
+package model
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+
+	"github.com/hbahadorzadeh/key-master/service"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type IssuedCertificate struct {
+	service.BasicData
+
+	SerialNumber string             `json:"serial_number" bson:"serial_number" validate:"required"`
+	AuthorityID  primitive.ObjectID `json:"authority_id" bson:"authority_id"`
+	Role         string             `json:"role" bson:"role"`
+	CommonName   string             `json:"common_name" bson:"common_name"`
+	Certificate  []byte             `json:"certificate" bson:"certificate" validate:"required"`
+	NotAfter     primitive.DateTime `json:"not_after" bson:"not_after"`
+
+	//Revocation
+	RevokedAt        primitive.DateTime `json:"revoked_at" bson:"revoked_at"`
+	RevocationReason int                `json:"revocation_reason" bson:"revocation_reason"`
+}
+
+func (c *IssuedCertificate) IsRevoked() bool {
+	return c.RevokedAt != 0
+}
+
+// CertificateRevoked tells whether cert was issued by one of our authorities and revoked since.
+func CertificateRevoked(database *service.MongoDB, cert *x509.Certificate) bool {
+	issued := &IssuedCertificate{}
+	if err := database.Select(issued, bson.M{"serial_number": fmt.Sprintf("%x", cert.SerialNumber)}); err != nil {
+		return false
+	}
+	return issued.IsRevoked() && bytes.Equal(issued.Certificate, cert.Raw)
+}
@@ -0,0 +1,16 @@
+package model
+
+import (
+	"github.com/hbahadorzadeh/key-master/service"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// JoseKey is a named Secret used to sign application JWTs with a fixed algorithm.
+type JoseKey struct {
+	service.BasicData
+
+	Name      string             `json:"name" bson:"name" validate:"required"`
+	Algorithm string             `json:"algorithm" bson:"algorithm" validate:"required"`
+	KeyID     string             `json:"kid" bson:"kid"`
+	SecretID  primitive.ObjectID `json:"secret_id" bson:"secret_id"`
+}
@@ -0,0 +1,189 @@
+package model
+
+import (
+	"context"
+	"time"
+
+	"github.com/hbahadorzadeh/key-master/service"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+const (
+	LeaseStatusPending = "pending"
+	LeaseStatusActive  = "active"
+	LeaseStatusDenied  = "denied"
+	LeaseStatusExpired = "expired"
+	LeaseStatusRevoked = "revoked"
+
+	// MaxLeaseDuration bounds how long a lease may be granted for
+	MaxLeaseDuration = time.Hour * 72
+	// leaseRequestTTL is how long a lease request waits for an approver
+	leaseRequestTTL = time.Hour * 24
+)
+
+// Lease is temporary access of a user to a secret. Once granted the user holds a grant of the secret
+// tagged with the lease, which is taken back when the lease expires or is revoked.
+type Lease struct {
+	service.BasicData
+
+	UserID        primitive.ObjectID `json:"user_id" bson:"user_id"`
+	Email         string             `json:"email" bson:"email" validate:"required,email"`
+	SecretID      primitive.ObjectID `json:"secret_id" bson:"secret_id"`
+	SecretLabel   string             `json:"secret_label" bson:"secret_label" validate:"required"`
+	Justification string             `json:"justification" bson:"justification" validate:"required"`
+	Duration      string             `json:"duration" bson:"duration" validate:"required"`
+	Status        string             `json:"status" bson:"status"`
+	DecidedBy     string             `json:"decided_by,omitempty" bson:"decided_by"`
+	Comment       string             `json:"comment,omitempty" bson:"comment"`
+	GrantedAt     primitive.DateTime `json:"granted_at,omitempty" bson:"granted_at"`
+	ExpiresAt     primitive.DateTime `json:"expires_at,omitempty" bson:"expires_at"`
+	RevokedBy     string             `json:"revoked_by,omitempty" bson:"revoked_by"`
+}
+
+func FindLease(database *service.MongoDB, id string) (*Lease, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+	lease := &Lease{}
+	if err := database.Select(lease, bson.M{"_id": objectID}); err != nil {
+		return nil, err
+	}
+	return lease, nil
+}
+
+// Grant activates a pending lease for duration, wrapping the data key of the secret for the user.
+func (l *Lease) Grant(database *service.MongoDB, sealer *service.Sealer, approver string, duration time.Duration, comment string) error {
+	if l.Status != LeaseStatusPending {
+		return errors.Newf("Lease is %s, not pending", l.Status)
+	}
+	if duration <= 0 || duration > MaxLeaseDuration {
+		return errors.Newf("Lease duration has to be positive and at most %s", MaxLeaseDuration)
+	}
+	user := &User{}
+	if err := database.Select(user, bson.M{"_id": l.UserID}); err != nil {
+		return err
+	}
+	secret := &Secret{}
+	if err := database.Select(secret, bson.M{"_id": l.SecretID}); err != nil {
+		return err
+	}
+	if secret.IsOwner(user.ID) {
+		return errors.Newf("`%s` already has access to `%s`", user.Email, secret.Label)
+	}
+	now := time.Now()
+	ok, err := database.UpdateIf(l, bson.M{"status": LeaseStatusPending}, bson.M{"$set": bson.M{
+		"status":     LeaseStatusActive,
+		"decided_by": approver,
+		"comment":    comment,
+		"duration":   duration.String(),
+		"granted_at": primitive.NewDateTimeFromTime(now),
+		"expires_at": primitive.NewDateTimeFromTime(now.Add(duration)),
+	}})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("Lease was decided meanwhile")
+	}
+	if err := secret.Grant(sealer, user); err != nil {
+		return err
+	}
+	grant := secret.EncryptedKeys[len(secret.EncryptedKeys)-1]
+	grant.Lease = l.ID
+	// Pushed alone, rewriting the whole array would undo grants and revocations made meanwhile
+	if err := database.Update(secret, bson.M{"$push": bson.M{"encrypted_keys": grant}}); err != nil {
+		return err
+	}
+	return database.Select(l, bson.M{"_id": l.ID})
+}
+
+// Deny closes a pending lease without granting it.
+func (l *Lease) Deny(database *service.MongoDB, approver, comment string) error {
+	ok, err := database.UpdateIf(l, bson.M{"status": LeaseStatusPending}, bson.M{"$set": bson.M{
+		"status":     LeaseStatusDenied,
+		"decided_by": approver,
+		"comment":    comment,
+	}})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("Lease is no longer pending")
+	}
+	return database.Select(l, bson.M{"_id": l.ID})
+}
+
+// ErrLeaseNotActive is returned when a lease to revoke was revoked or expired meanwhile.
+var ErrLeaseNotActive = errors.New("Lease is not active")
+
+// Revoke ends an active lease with status and takes its grant back, by is empty when the lease expired.
+func (l *Lease) Revoke(database *service.MongoDB, status, by string) error {
+	ok, err := database.UpdateIf(l, bson.M{"status": LeaseStatusActive}, bson.M{"$set": bson.M{
+		"status":     status,
+		"revoked_by": by,
+	}})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrLeaseNotActive
+	}
+	secret := &Secret{}
+	if err := database.Select(secret, bson.M{"_id": l.SecretID}); err == nil {
+		if err := database.Update(secret, bson.M{"$pull": bson.M{"encrypted_keys": bson.M{"lease": l.ID}}}); err != nil {
+			return err
+		}
+	}
+	return database.Select(l, bson.M{"_id": l.ID})
+}
+
+// ExpireLeases revokes the active leases past their end and closes requests nobody decided on in time.
+func ExpireLeases(database *service.MongoDB) (int, error) {
+	now := time.Now()
+	leases := make([]Lease, 0)
+	if err := database.SelectAll(&leases, bson.M{"$or": bson.A{
+		bson.M{"status": LeaseStatusActive, "expires_at": bson.M{"$lte": primitive.NewDateTimeFromTime(now)}},
+		bson.M{"status": LeaseStatusPending, "created_at": bson.M{"$lte": primitive.NewDateTimeFromTime(now.Add(-leaseRequestTTL))}},
+	}}); err != nil {
+		return 0, err
+	}
+	expired := 0
+	for i := range leases {
+		if leases[i].Status == LeaseStatusPending {
+			if _, err := database.UpdateIf(&leases[i], bson.M{"status": LeaseStatusPending}, bson.M{"$set": bson.M{"status": LeaseStatusExpired}}); err != nil {
+				return expired, err
+			}
+			continue
+		}
+		if err := leases[i].Revoke(database, LeaseStatusExpired, ""); err == ErrLeaseNotActive {
+			// Revoked by hand since it was selected
+			continue
+		} else if err != nil {
+			return expired, err
+		}
+		expired++
+	}
+	return expired, nil
+}
+
+// ReapLeases expires leases every minute until ctx is done.
+func ReapLeases(ctx context.Context, database *service.MongoDB, logger *log.Logger) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		if expired, err := ExpireLeases(database); err != nil {
+			logger.Errorf("Expiring leases failed: %v", err)
+		} else if expired > 0 {
+			logger.Infof("%d leases expired and were revoked", expired)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package model
+
+import (
+	"github.com/hbahadorzadeh/key-master/service"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Scopes a confidential client may be granted on the /oauth endpoints.
+const (
+	ClientScopeIntrospect = "introspect"
+	ClientScopeRevoke     = "revoke"
+)
+
+// OAuthClient is a confidential client, e.g. an API gateway, calling the /oauth endpoints.
+type OAuthClient struct {
+	service.BasicData
+
+	Name       string   `json:"name" bson:"name" validate:"required"`
+	ClientID   string   `json:"client_id" bson:"client_id" validate:"required"`
+	SecretHash string   `json:"-" bson:"secret_hash"`
+	Scopes     []string `json:"scopes" bson:"scopes"`
+}
+
+func (c *OAuthClient) SetSecret(secret string) {
+	c.SecretHash = service.HashSecret(secret)
+}
+
+func (c *OAuthClient) CheckSecret(secret string) bool {
+	return service.CheckSecret(c.SecretHash, secret)
+}
+
+func (c *OAuthClient) HasScope(scope string) bool {
+	return hasScope(c.Scopes, scope)
+}
+
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func FindOAuthClient(database *service.MongoDB, clientID string) (*OAuthClient, error) {
+	c := &OAuthClient{}
+	if err := database.Select(c, bson.M{"client_id": clientID}); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
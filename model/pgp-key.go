@@ -0,0 +1,17 @@
+package model
+
+import (
+	"github.com/hbahadorzadeh/key-master/service"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// PgpKey is an OpenPGP entity whose serialized private packets are held in a Secret.
+type PgpKey struct {
+	service.BasicData
+
+	Name        string             `json:"name" bson:"name" validate:"required"`
+	Fingerprint string             `json:"fingerprint" bson:"fingerprint" validate:"required"`
+	KeyID       string             `json:"key_id" bson:"key_id"`
+	Identities  []string           `json:"identities" bson:"identities"`
+	SecretID    primitive.ObjectID `json:"secret_id" bson:"secret_id"`
+}
@@ -0,0 +1,27 @@
+package model
+
+import "github.com/hbahadorzadeh/key-master/service"
+
+// PkiRole restricts what a CertificateAuthority issues on behalf of callers.
+type PkiRole struct {
+	service.BasicData
+
+	Name      string `json:"name" bson:"name" validate:"required"`
+	Authority string `json:"authority" bson:"authority" validate:"required"`
+
+	//Names
+	AllowedDomains   []string `json:"allowed_domains" bson:"allowed_domains"`
+	AllowSubdomains  bool     `json:"allow_subdomains" bson:"allow_subdomains"`
+	AllowBareDomains bool     `json:"allow_bare_domains" bson:"allow_bare_domains"`
+	AllowIPSans      bool     `json:"allow_ip_sans" bson:"allow_ip_sans"`
+
+	//Validity, as time.Duration strings
+	TTL    string `json:"ttl" bson:"ttl"`
+	MaxTTL string `json:"max_ttl" bson:"max_ttl"`
+
+	//Keys
+	KeyType      SecretType `json:"key_type" bson:"key_type"`
+	KeyBits      int        `json:"key_bits" bson:"key_bits"`
+	KeyUsages    []string   `json:"key_usages" bson:"key_usages"`
+	ExtKeyUsages []string   `json:"ext_key_usages" bson:"ext_key_usages"`
+}
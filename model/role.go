@@ -0,0 +1,121 @@
+package model
+
+import (
+	"github.com/hbahadorzadeh/key-master/service"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Built in roles, they are created on start up and can be edited but not deleted.
+const (
+	RoleAdmin      = "admin"
+	RoleKeyAdmin   = "key-admin"
+	RoleCryptoUser = "crypto-user"
+	RoleAuditor    = "auditor"
+)
+
+// Role is a named set of permissions. It is granted to users and service accounts by name, to every member
+// of one of its key-master Groups and to users whose identity provider asserts one of its ExternalGroups.
+// The two are kept apart, a key-master group named after an external group grants nothing it maps to.
+type Role struct {
+	service.BasicData
+
+	Name           string   `json:"name" bson:"name" validate:"required,hostname_rfc1123"`
+	Description    string   `json:"description" bson:"description"`
+	Permissions    []string `json:"permissions" bson:"permissions"`
+	Groups         []string `json:"groups" bson:"groups"`
+	ExternalGroups []string `json:"external_groups" bson:"external_groups"`
+	BuiltIn        bool     `json:"built_in" bson:"built_in"`
+}
+
+// BuiltInRoles are the roles every installation starts with.
+var BuiltInRoles = []Role{
+	{
+		Name:        RoleAdmin,
+		Description: "Full access",
+		Permissions: []string{service.PermissionAll},
+	},
+	{
+		Name:        RoleKeyAdmin,
+		Description: "Creates, imports and retires keys and certificate authorities",
+		Permissions: []string{service.PermissionKeysRead, service.PermissionKeysManage},
+	},
+	{
+		Name:        RoleCryptoUser,
+		Description: "Signs, encrypts and decrypts with existing keys",
+		Permissions: []string{service.PermissionKeysRead, service.PermissionKeysUse},
+	},
+	{
+		Name:        RoleAuditor,
+		Description: "Reads keys and the audit trail",
+		Permissions: []string{service.PermissionKeysRead, service.PermissionAuditRead},
+	},
+}
+
+// CreateBuiltInRoles adds the built in roles which are missing, edits of existing ones are kept.
+func CreateBuiltInRoles(database *service.MongoDB) error {
+	for _, role := range BuiltInRoles {
+		if _, err := FindRole(database, role.Name); err == nil {
+			continue
+		}
+		role := role
+		role.BuiltIn = true
+		if err := database.Create(&role); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func FindRole(database *service.MongoDB, name string) (*Role, error) {
+	r := &Role{}
+	if err := database.Select(r, bson.M{"name": name}); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// FindRolesOfGroups returns the roles granted to any of the key-master groups or any of the external groups.
+func FindRolesOfGroups(database *service.MongoDB, groups, externalGroups []string) ([]Role, error) {
+	roles := make([]Role, 0)
+	filter := groupRolesFilter(groups, externalGroups)
+	if filter == nil {
+		return roles, nil
+	}
+	return roles, database.SelectAll(&roles, filter)
+}
+
+func groupRolesFilter(groups, externalGroups []string) bson.M {
+	clauses := bson.A{}
+	if len(groups) > 0 {
+		clauses = append(clauses, bson.M{"groups": bson.M{"$in": groups}})
+	}
+	if len(externalGroups) > 0 {
+		clauses = append(clauses, bson.M{"external_groups": bson.M{"$in": externalGroups}})
+	}
+	if len(clauses) == 0 {
+		return nil
+	}
+	return bson.M{"$or": clauses}
+}
+
+// RolePermissions returns the union of the permissions of the named roles, unknown names grant nothing.
+func RolePermissions(database *service.MongoDB, names []string) ([]string, error) {
+	if len(names) == 0 {
+		return []string{}, nil
+	}
+	roles := make([]Role, 0)
+	if err := database.SelectAll(&roles, bson.M{"name": bson.M{"$in": names}}); err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	permissions := make([]string, 0)
+	for _, role := range roles {
+		for _, permission := range role.Permissions {
+			if !seen[permission] {
+				seen[permission] = true
+				permissions = append(permissions, permission)
+			}
+		}
+	}
+	return permissions, nil
+}
@@ -0,0 +1,24 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestGroupRolesFilter(t *testing.T) {
+	assert.Nil(t, groupRolesFilter(nil, []string{}))
+
+	// Key-master group names are only matched against groups, external ones only against external_groups
+	assert.Equal(t, bson.M{"$or": bson.A{
+		bson.M{"groups": bson.M{"$in": []string{"ops"}}},
+	}}, groupRolesFilter([]string{"ops"}, nil))
+	assert.Equal(t, bson.M{"$or": bson.A{
+		bson.M{"external_groups": bson.M{"$in": []string{"admins"}}},
+	}}, groupRolesFilter(nil, []string{"admins"}))
+	assert.Equal(t, bson.M{"$or": bson.A{
+		bson.M{"groups": bson.M{"$in": []string{"ops"}}},
+		bson.M{"external_groups": bson.M{"$in": []string{"admins"}}},
+	}}, groupRolesFilter([]string{"ops"}, []string{"admins"}))
+}
@@ -1,19 +1,232 @@
 package model
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+
 	"github.com/hbahadorzadeh/key-master/service"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+type SecretType string
+
+const (
+	SecretTypeRSA     SecretType = "rsa"
+	SecretTypeEC      SecretType = "ec"
+	SecretTypeEd25519 SecretType = "ed25519"
+	SecretTypeAES     SecretType = "aes"
+	SecretTypePGP     SecretType = "pgp"
 )
 
 type Secret struct {
 	service.BasicData
 
-	Public []byte `json:"public_key" bson:"public_key"`
-	EncryptedPrivate []byte `json:"encrypted_private_key" bson:"encrypted_private_key" validate:"required"`
-	EncryptedKeys []EncryptedKey `json:"encrypted_keys" bson:"encrypted_keys"`
+	Label            string         `json:"label" bson:"label" validate:"required"`
+	Type             SecretType     `json:"type" bson:"type" validate:"required"`
+	Public           []byte         `json:"public_key" bson:"public_key"`
+	EncryptedPrivate []byte         `json:"encrypted_private_key" bson:"encrypted_private_key" validate:"required"`
+	SealedKey        []byte         `json:"-" bson:"sealed_key"`
+	EncryptedKeys    []EncryptedKey `json:"encrypted_keys" bson:"encrypted_keys"`
 }
 
 type EncryptedKey struct {
-	Key []byte `json:"key" bson:"key"`
+	Key   []byte             `json:"key" bson:"key"`
 	Owner primitive.ObjectID `json:"owner" bson:"owner"`
+	// Group the grant comes from, it is revoked when the owner leaves the group
+	Group string `json:"group,omitempty" bson:"group,omitempty"`
+	// Lease the grant comes from, it is revoked when the lease ends
+	Lease primitive.ObjectID `json:"lease,omitempty" bson:"lease,omitempty"`
+}
+
+// NewSecret encrypts private with a fresh data key which is itself sealed with the server master key.
+func NewSecret(sealer *service.Sealer, label string, secretType SecretType, private []byte, public []byte) (*Secret, error) {
+	key, sealedKey, err := sealer.NewDataKey()
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := service.Encrypt(key, private)
+	if err != nil {
+		return nil, err
+	}
+	return &Secret{
+		Label:            label,
+		Type:             secretType,
+		Public:           public,
+		EncryptedPrivate: encrypted,
+		SealedKey:        sealedKey,
+		EncryptedKeys:    []EncryptedKey{},
+	}, nil
+}
+
+// NewKeyPairSecret stores signer as PKCS#8 with its PKIX public key.
+func NewKeyPairSecret(sealer *service.Sealer, label string, signer crypto.Signer) (*Secret, error) {
+	var secretType SecretType
+	switch signer.(type) {
+	case *rsa.PrivateKey:
+		secretType = SecretTypeRSA
+	case *ecdsa.PrivateKey:
+		secretType = SecretTypeEC
+	case ed25519.PrivateKey:
+		secretType = SecretTypeEd25519
+	default:
+		return nil, errors.New("Key type not supported")
+	}
+	private, err := x509.MarshalPKCS8PrivateKey(signer)
+	if err != nil {
+		return nil, err
+	}
+	public, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	return NewSecret(sealer, label, secretType, private, public)
+}
+
+// GenerateKeyPair creates a private key of the given type, bits is the modulus size for RSA and the curve size for EC.
+func GenerateKeyPair(secretType SecretType, bits int) (crypto.Signer, error) {
+	switch secretType {
+	case SecretTypeRSA:
+		if bits == 0 {
+			bits = 2048
+		}
+		if bits < 2048 {
+			return nil, errors.New("RSA keys must be at least 2048 bits")
+		}
+		return rsa.GenerateKey(rand.Reader, bits)
+	case SecretTypeEC:
+		var curve elliptic.Curve
+		switch bits {
+		case 0, 256:
+			curve = elliptic.P256()
+		case 384:
+			curve = elliptic.P384()
+		case 521:
+			curve = elliptic.P521()
+		default:
+			return nil, errors.Newf("EC curve size `%d` not supported", bits)
+		}
+		return ecdsa.GenerateKey(curve, rand.Reader)
+	case SecretTypeEd25519:
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		return private, err
+	}
+	return nil, errors.Newf("Key type `%s` not supported", secretType)
+}
+
+func (s *Secret) Private(sealer *service.Sealer) ([]byte, error) {
+	key, err := sealer.Open(s.SealedKey)
+	if err != nil {
+		return nil, err
+	}
+	return service.Decrypt(key, s.EncryptedPrivate)
+}
+
+func (s *Secret) Signer(sealer *service.Sealer) (crypto.Signer, error) {
+	private, err := s.Private(sealer)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("Secret is not a signing key")
+	}
+	return signer, nil
+}
+
+func (s *Secret) PublicKey() (crypto.PublicKey, error) {
+	return x509.ParsePKIXPublicKey(s.Public)
+}
+
+// Grant gives user ownership of the secret, wrapping the data key with the user's first key when there is one.
+func (s *Secret) Grant(sealer *service.Sealer, user *User) error {
+	if s.IsOwner(user.ID) {
+		return nil
+	}
+	grant := EncryptedKey{Owner: user.ID}
+	if len(user.Keys) > 0 {
+		key, err := sealer.Open(s.SealedKey)
+		if err != nil {
+			return err
+		}
+		public, err := x509.ParsePKIXPublicKey(user.Keys[0].PublicKey)
+		if err != nil {
+			return err
+		}
+		rsaPublic, ok := public.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("User key is not an RSA key")
+		}
+		grant.Key, err = rsa.EncryptOAEP(sha256.New(), rand.Reader, rsaPublic, key, []byte(s.Label))
+		if err != nil {
+			return err
+		}
+	}
+	s.EncryptedKeys = append(s.EncryptedKeys, grant)
+	return nil
+}
+
+// GrantServiceAccount gives a service account ownership of the secret, its data key stays sealed with the master key.
+func (s *Secret) GrantServiceAccount(database *service.MongoDB, account *ServiceAccount) error {
+	if s.IsOwner(account.ID) {
+		return nil
+	}
+	grant := EncryptedKey{Owner: account.ID}
+	s.EncryptedKeys = append(s.EncryptedKeys, grant)
+	return database.Update(s, bson.M{"$push": bson.M{"encrypted_keys": grant}})
+}
+
+// RevokeServiceAccount takes the grant of a service account back.
+func (s *Secret) RevokeServiceAccount(database *service.MongoDB, account *ServiceAccount) error {
+	keys := make([]EncryptedKey, 0, len(s.EncryptedKeys))
+	for _, k := range s.EncryptedKeys {
+		if k.Owner != account.ID {
+			keys = append(keys, k)
+		}
+	}
+	s.EncryptedKeys = keys
+	return database.Update(s, bson.M{"$pull": bson.M{"encrypted_keys": bson.M{"owner": account.ID}}})
+}
+
+// CheckHolder makes sure the caller holds a grant on the secret, its own or one through a group or a lease.
+// Service accounts only hold what was granted to their account.
+func (s *Secret) CheckHolder(database *service.MongoDB, email, serviceAccount string) error {
+	var id primitive.ObjectID
+	if serviceAccount != "" {
+		account, err := FindServiceAccount(database, serviceAccount)
+		if err != nil || account.Disabled {
+			return errors.Newf("Service account `%s` holds no grant on `%s`", serviceAccount, s.Label)
+		}
+		id = account.ID
+	} else {
+		user, err := FindUserByEmail(database, email)
+		if err != nil || user.Disabled {
+			return errors.Newf("`%s` holds no grant on `%s`", email, s.Label)
+		}
+		id = user.ID
+	}
+	if !s.IsOwner(id) {
+		return errors.Newf("No grant on `%s`", s.Label)
+	}
+	return nil
+}
+
+func (s *Secret) IsOwner(id primitive.ObjectID) bool {
+	for _, k := range s.EncryptedKeys {
+		if k.Owner == id {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,86 @@
+package model
+
+import (
+	"crypto/subtle"
+	"crypto/x509"
+	"fmt"
+
+	"github.com/hbahadorzadeh/key-master/service"
+	"go.mongodb.org/mongo-driver/bson"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+// ServiceAccount is a non human identity, e.g. a CI job or a daemon. It logs in with the client_credentials
+// grant or with one of its ApiKeys and can never be granted more than its Scopes, its Roles decide what it may do.
+type ServiceAccount struct {
+	service.BasicData
+
+	Name        string   `json:"name" bson:"name" validate:"required,hostname_rfc1123"`
+	Description string   `json:"description" bson:"description"`
+	ClientID    string   `json:"client_id" bson:"client_id" validate:"required"`
+	SecretHash  string   `json:"-" bson:"secret_hash"`
+	Scopes      []string `json:"scopes" bson:"scopes"`
+	Roles       []string `json:"roles" bson:"roles"`
+	Disabled    bool     `json:"disabled" bson:"disabled"`
+	CreatedBy   string   `json:"created_by" bson:"created_by"`
+
+	//x5t#S256 thumbprints of the client certificates the account authenticates with
+	CertFingerprints []string `json:"cert_fingerprints" bson:"cert_fingerprints"`
+}
+
+// Subject is how the account shows up in the sub claim of its tokens.
+func (s *ServiceAccount) Subject() string {
+	return fmt.Sprintf("service-account:%s", s.Name)
+}
+
+// HasCertificate tells whether the account is bound to the client certificate.
+func (s *ServiceAccount) HasCertificate(cert *x509.Certificate) bool {
+	return boundToCertificate(s.CertFingerprints, cert)
+}
+
+func boundToCertificate(fingerprints []string, cert *x509.Certificate) bool {
+	thumbprint := service.CertThumbprint(cert)
+	for _, fingerprint := range fingerprints {
+		if subtle.ConstantTimeCompare([]byte(fingerprint), []byte(thumbprint)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *ServiceAccount) SetSecret(secret string) {
+	s.SecretHash = service.HashSecret(secret)
+}
+
+func (s *ServiceAccount) CheckSecret(secret string) bool {
+	return service.CheckSecret(s.SecretHash, secret)
+}
+
+// GrantScopes narrows requested to the scopes of the account, nothing requested means all of them.
+func (s *ServiceAccount) GrantScopes(requested []string) ([]string, error) {
+	if len(requested) == 0 {
+		return s.Scopes, nil
+	}
+	for _, scope := range requested {
+		if !hasScope(s.Scopes, scope) {
+			return nil, errors.Newf("Scope `%s` is not granted to `%s`", scope, s.Name)
+		}
+	}
+	return requested, nil
+}
+
+func FindServiceAccount(database *service.MongoDB, name string) (*ServiceAccount, error) {
+	s := &ServiceAccount{}
+	if err := database.Select(s, bson.M{"name": name}); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func FindServiceAccountByClientID(database *service.MongoDB, clientID string) (*ServiceAccount, error) {
+	s := &ServiceAccount{}
+	if err := database.Select(s, bson.M{"client_id": clientID}); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
@@ -0,0 +1,38 @@
+package model
+
+import (
+	"strings"
+
+	"github.com/hbahadorzadeh/key-master/service"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type SshAuthority struct {
+	service.BasicData
+
+	Name      string             `json:"name" bson:"name" validate:"required"`
+	SecretID  primitive.ObjectID `json:"secret_id" bson:"secret_id"`
+	PublicKey string             `json:"public_key" bson:"public_key" validate:"required"`
+
+	//Validity, as time.Duration strings
+	MaxUserTTL string `json:"max_user_ttl" bson:"max_user_ttl"`
+	MaxHostTTL string `json:"max_host_ttl" bson:"max_host_ttl"`
+
+	//Host names host certificates may be issued for, `*.example.com` matches any subdomain
+	AllowedHosts []string `json:"allowed_hosts" bson:"allowed_hosts"`
+}
+
+// HostAllowed tells whether a host certificate may name host.
+func (a *SshAuthority) HostAllowed(host string) bool {
+	host = strings.ToLower(host)
+	for _, pattern := range a.AllowedHosts {
+		pattern = strings.ToLower(pattern)
+		if pattern == host {
+			return true
+		}
+		if strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:]) && len(host) > len(pattern)-1 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,35 @@
+package model
+
+import (
+	"github.com/hbahadorzadeh/key-master/service"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TokenVault maps sensitive values to random tokens, only Detokenizers may resolve tokens back.
+type TokenVault struct {
+	service.BasicData
+
+	Name         string             `json:"name" bson:"name" validate:"required"`
+	Alphabet     string             `json:"alphabet" bson:"alphabet"`
+	Owner        string             `json:"owner" bson:"owner" validate:"required,email"`
+	Detokenizers []string           `json:"detokenizers" bson:"detokenizers"`
+	SecretID     primitive.ObjectID `json:"secret_id" bson:"secret_id"`
+}
+
+func (v *TokenVault) CanDetokenize(email string) bool {
+	for _, d := range v.Detokenizers {
+		if d == email {
+			return true
+		}
+	}
+	return false
+}
+
+type VaultToken struct {
+	service.BasicData
+
+	VaultID        primitive.ObjectID `json:"vault_id" bson:"vault_id"`
+	Token          string             `json:"token" bson:"token" validate:"required"`
+	ValueHash      string             `json:"-" bson:"value_hash" validate:"required"`
+	EncryptedValue []byte             `json:"-" bson:"encrypted_value" validate:"required"`
+}
@@ -2,8 +2,12 @@ package model
 
 import (
 	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
 	"fmt"
 	"github.com/hbahadorzadeh/key-master/service"
+	"go.mongodb.org/mongo-driver/bson"
+	"gopkg.in/errgo.v2/fmt/errors"
 )
 
 type TokenType string
@@ -11,22 +15,190 @@ type TokenType string
 type User struct {
 	service.BasicData
 	Email    string `json:"email" bson:"email,omitempty" validate:"required,email"`
-	IsRemote bool   `json:"is_remote" bson:"is_remote" validate:"required"`
-	Password string `json:"_" bson:"password"`
+	IsRemote bool   `json:"is_remote" bson:"is_remote"`
+	//Identity provider and subject within it which own a remote user
+	Provider        string `json:"provider,omitempty" bson:"provider"`
+	ProviderSubject string `json:"-" bson:"provider_subject"`
+	Password        string `json:"-" bson:"password"`
+	Disabled        bool   `json:"disabled" bson:"disabled"`
 
 	//User info
 	FirstName string `json:"first_name" bson:"first_name,omitempty" validate:"required"`
 	LastName  string `json:"last_name" bson:"last_name,omitempty" validate:"required"`
 
+	//Groups asserted by the identity provider on the last login
+	ExternalGroups []string `json:"external_groups" bson:"external_groups"`
+
+	//Roles granted to the user
+	Roles []string `json:"roles" bson:"roles"`
+
+	//Roles mapped from the directory groups of the user on its last LDAP login, on top of Roles
+	DirectoryRoles []string `json:"directory_roles" bson:"directory_roles"`
+
+	//Login names the user may get SSH certificates for, besides the email
+	SshPrincipals []string `json:"ssh_principals" bson:"ssh_principals"`
+
 	//Keys
 	Keys []UserKey `json:"keys" bson:"keys"`
+
+	//Second factor, the TOTP secret is sealed with the server master key
+	TotpSecret    []byte   `json:"-" bson:"totp_secret"`
+	TotpEnabled   bool     `json:"totp_enabled" bson:"totp_enabled"`
+	RecoveryCodes []string `json:"-" bson:"recovery_codes"`
+
+	//Security keys and platform authenticators
+	WebAuthnCredentials []WebAuthnCredential `json:"web_authn_credentials" bson:"web_authn_credentials"`
+
+	//x5t#S256 thumbprints of the client certificates the user may log in with
+	CertFingerprints []string `json:"cert_fingerprints" bson:"cert_fingerprints"`
 }
 
 func (u *User) SetPassword(database *service.MongoDB, password string) error {
-	u.Password = fmt.Sprintf("%x", sha256.Sum256(
+	hash, err := service.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	u.Password = hash
+	return database.Update(u, bson.M{"$set": bson.M{"password": u.Password}})
+}
+
+// CheckPassword verifies password, upgrading hashes from the legacy salted SHA-256 scheme to Argon2id on success.
+func (u *User) CheckPassword(database *service.MongoDB, password string) (bool, error) {
+	if u.Password == "" {
+		return false, nil
+	}
+	if service.IsArgon2Hash(u.Password) {
+		return service.VerifyPassword(u.Password, password)
+	}
+	legacy := fmt.Sprintf("%x", sha256.Sum256(
 		[]byte(fmt.Sprintf("%s%x",
 			u.Email,
 			sha256.Sum256([]byte(password))))))
-	database.Update(u)
-	return nil
+	if subtle.ConstantTimeCompare([]byte(legacy), []byte(u.Password)) != 1 {
+		return false, nil
+	}
+	return true, u.SetPassword(database, password)
+}
+
+// HasSecondFactor tells whether logins must be completed with a second factor.
+func (u *User) HasSecondFactor() bool {
+	return u.TotpEnabled || len(u.WebAuthnCredentials) > 0
+}
+
+// HasCertificate tells whether the user is bound to the client certificate.
+func (u *User) HasCertificate(cert *x509.Certificate) bool {
+	return boundToCertificate(u.CertFingerprints, cert)
+}
+
+func FindUserByEmail(database *service.MongoDB, email string) (*User, error) {
+	u := &User{}
+	if err := database.Select(u, bson.M{"email": email}); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// ErrLocalAccount is returned when an identity provider asserts the email of a local account, which it does not own.
+var ErrLocalAccount = errors.New("Email address belongs to a local account")
+
+// ErrOtherProvider is returned when an identity provider asserts the email of a remote user owned by another one.
+var ErrOtherProvider = errors.New("Email address belongs to an account of another identity provider")
+
+// OwnedBy tells whether the remote user belongs to the subject of provider. Users provisioned before the owner
+// was recorded belong to whoever logs in first.
+func (u *User) OwnedBy(provider, subject string) bool {
+	if u.Provider == "" {
+		return true
+	}
+	return u.Provider == provider && (u.ProviderSubject == "" || u.ProviderSubject == subject)
+}
+
+// ProvisionRemoteUser creates the record of a user authenticated by an external identity provider on first login
+// and refreshes its profile and groups on later ones. Local accounts and users of other providers are never taken over.
+func ProvisionRemoteUser(database *service.MongoDB, provider, subject, email, firstName, lastName string, groups []string) (*User, error) {
+	u, err := FindUserByEmail(database, email)
+	if err != nil {
+		u = &User{
+			Email:           email,
+			IsRemote:        true,
+			Provider:        provider,
+			ProviderSubject: subject,
+			FirstName:       firstName,
+			LastName:        lastName,
+			ExternalGroups:  groups,
+		}
+		if err := database.Create(u); err != nil {
+			return nil, err
+		}
+		return u, nil
+	}
+	if !u.IsRemote {
+		return nil, ErrLocalAccount
+	}
+	if !u.OwnedBy(provider, subject) {
+		return nil, ErrOtherProvider
+	}
+	u.ExternalGroups = groups
+	u.Provider, u.ProviderSubject = provider, subject
+	changes := bson.M{"external_groups": groups, "provider": provider, "provider_subject": subject}
+	if firstName != "" {
+		u.FirstName = firstName
+		changes["first_name"] = firstName
+	}
+	if lastName != "" {
+		u.LastName = lastName
+		changes["last_name"] = lastName
+	}
+	return u, database.Update(u, bson.M{"$set": changes})
+}
+
+func (u *User) SetRoles(database *service.MongoDB, roles []string) error {
+	u.Roles = roles
+	return database.Update(u, bson.M{"$set": bson.M{"roles": roles}})
+}
+
+func (u *User) SetDirectoryRoles(database *service.MongoDB, roles []string) error {
+	u.DirectoryRoles = roles
+	return database.Update(u, bson.M{"$set": bson.M{"directory_roles": roles}})
+}
+
+// EffectiveRoles returns the roles of the user, its own plus the roles of every directory and key-master group
+// it is a member of.
+func (u *User) EffectiveRoles(database *service.MongoDB) ([]string, error) {
+	roles := append(append([]string{}, u.Roles...), u.DirectoryRoles...)
+	groups, err := GroupsOfUser(database, u.ID)
+	if err != nil {
+		return nil, err
+	}
+	groupRoles, err := FindRolesOfGroups(database, GroupNames(groups), u.ExternalGroups)
+	if err != nil {
+		return nil, err
+	}
+	for _, role := range groupRoles {
+		roles = append(roles, role.Name)
+	}
+	return roles, nil
+}
+
+// UserPermissions returns the permissions the effective roles of user grant.
+func UserPermissions(database *service.MongoDB, user *User) ([]string, error) {
+	roles, err := user.EffectiveRoles(database)
+	if err != nil {
+		return nil, err
+	}
+	return RolePermissions(database, roles)
+}
+
+// ResetMfa removes every second factor, e.g. when the user lost its phone and security keys.
+func (u *User) ResetMfa(database *service.MongoDB) error {
+	u.TotpSecret = nil
+	u.TotpEnabled = false
+	u.RecoveryCodes = nil
+	u.WebAuthnCredentials = []WebAuthnCredential{}
+	return database.Update(u, bson.M{"$set": bson.M{
+		"totp_secret":           nil,
+		"totp_enabled":          false,
+		"recovery_codes":        nil,
+		"web_authn_credentials": u.WebAuthnCredentials,
+	}})
 }
@@ -0,0 +1,14 @@
+package model
+
+import "go.mongodb.org/mongo-driver/bson/primitive"
+
+type WebAuthnCredential struct {
+	ID              []byte             `json:"id" bson:"id"`
+	Name            string             `json:"name" bson:"name"`
+	PublicKey       []byte             `json:"-" bson:"public_key"`
+	AttestationType string             `json:"attestation_type" bson:"attestation_type"`
+	AAGUID          []byte             `json:"aaguid" bson:"aaguid"`
+	SignCount       uint32             `json:"sign_count" bson:"sign_count"`
+	CreatedAt       primitive.DateTime `json:"created_at" bson:"created_at"`
+	LastUsedAt      primitive.DateTime `json:"last_used_at" bson:"last_used_at"`
+}
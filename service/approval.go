@@ -0,0 +1,374 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hbahadorzadeh/key-master/util"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+// Operations which are only executed once a quorum of approvers agreed.
+const (
+	ApprovalRootKeyExport = "root-key-export"
+	ApprovalKeyDestroy    = "key-destroy"
+	ApprovalPolicyChange  = "policy-change"
+)
+
+const (
+	ApprovalStatusPending   = "pending"
+	ApprovalStatusExecuting = "executing"
+	ApprovalStatusExecuted  = "executed"
+	ApprovalStatusFailed    = "failed"
+	ApprovalStatusRejected  = "rejected"
+	ApprovalStatusCancelled = "cancelled"
+	ApprovalStatusExpired   = "expired"
+)
+
+var (
+	ErrApprovalDisabled    = errors.New("Approval workflow is not configured, no approvers are designated")
+	ErrApprovalClosed      = errors.New("Approval request is no longer pending")
+	ErrApprovalNotApprover = errors.New("You are not a designated approver of this request")
+	ErrApprovalMfa         = errors.New("Approvals require a login with a second factor")
+)
+
+// ApprovalExecutor performs an approved operation, the result is handed to the requester once.
+type ApprovalExecutor func(request *ApprovalRequest) (result []byte, err error)
+
+// ApprovalRequest is a sensitive operation waiting for Quorum of its Approvers. The Trail records
+// every step from submission to execution.
+type ApprovalRequest struct {
+	BasicData
+
+	Operation    string             `json:"operation" bson:"operation" validate:"required"`
+	Target       string             `json:"target" bson:"target"`
+	Params       string             `json:"params" bson:"params"`
+	Reason       string             `json:"reason" bson:"reason"`
+	RequestedBy  string             `json:"requested_by" bson:"requested_by" validate:"required"`
+	Status       string             `json:"status" bson:"status"`
+	Quorum       int                `json:"quorum" bson:"quorum"`
+	Approvers    []string           `json:"approvers" bson:"approvers"`
+	Decisions    []ApprovalDecision `json:"decisions" bson:"decisions"`
+	ExpiresAt    primitive.DateTime `json:"expires_at" bson:"expires_at"`
+	SealedResult []byte             `json:"-" bson:"sealed_result"`
+	HasResult    bool               `json:"has_result" bson:"has_result"`
+	Error        string             `json:"error,omitempty" bson:"error"`
+	Trail        []ApprovalEvent    `json:"trail" bson:"trail"`
+}
+
+type ApprovalDecision struct {
+	Approver string    `json:"approver" bson:"approver"`
+	Approve  bool      `json:"approve" bson:"approve"`
+	Comment  string    `json:"comment" bson:"comment"`
+	IP       string    `json:"ip" bson:"ip"`
+	At       time.Time `json:"at" bson:"at"`
+}
+
+type ApprovalEvent struct {
+	At     time.Time `json:"at" bson:"at"`
+	Actor  string    `json:"actor" bson:"actor"`
+	Action string    `json:"action" bson:"action"`
+	Detail string    `json:"detail,omitempty" bson:"detail,omitempty"`
+}
+
+// Approvals counts the approving decisions.
+func (r *ApprovalRequest) Approvals() int {
+	n := 0
+	for _, d := range r.Decisions {
+		if d.Approve {
+			n++
+		}
+	}
+	return n
+}
+
+// DecodeParams unmarshals the parameters the operation was submitted with.
+func (r *ApprovalRequest) DecodeParams(params interface{}) error {
+	return json.Unmarshal([]byte(r.Params), params)
+}
+
+func (r *ApprovalRequest) isApprover(email string) bool {
+	for _, approver := range r.Approvers {
+		if strings.EqualFold(approver, email) {
+			return true
+		}
+	}
+	return false
+}
+
+type ApprovalWorkflow struct {
+	mdb       *MongoDB
+	mailer    *Mailer
+	sealer    *Sealer
+	logger    *log.Logger
+	quorum    int
+	window    time.Duration
+	approvers []string
+	uiUrl     string
+	executors map[string]ApprovalExecutor
+	// directPolicyChanges skips the approval of policy changes, it is only ever set explicitly
+	directPolicyChanges bool
+}
+
+func NewApprovalWorkflow(configs *util.Configs, mdb *MongoDB, mailer *Mailer, sealer *Sealer, logger *log.Logger) *ApprovalWorkflow {
+	window, err := time.ParseDuration(configs.Approval.Window)
+	if err != nil || window <= 0 {
+		logger.Warnf("Approval window `%s` is invalid, using 24h", configs.Approval.Window)
+		window = time.Hour * 24
+	}
+	approvers := make([]string, 0, len(configs.Approval.Approvers))
+	for _, approver := range configs.Approval.Approvers {
+		if approver = strings.TrimSpace(approver); approver != "" {
+			approvers = append(approvers, approver)
+		}
+	}
+	quorum := configs.Approval.Quorum
+	if quorum < 1 {
+		quorum = 1
+	}
+	mdb.CreateCollection(ApprovalRequest{})
+	return &ApprovalWorkflow{
+		mdb:                 mdb,
+		mailer:              mailer,
+		sealer:              sealer,
+		logger:              logger,
+		quorum:              quorum,
+		window:              window,
+		approvers:           approvers,
+		directPolicyChanges: configs.Approval.DirectPolicyChanges,
+		uiUrl:               strings.TrimSuffix(configs.Web.UiUrl, "/"),
+		executors:           map[string]ApprovalExecutor{},
+	}
+}
+
+// Enabled tells whether approvers are designated.
+func (w *ApprovalWorkflow) Enabled() bool {
+	return len(w.approvers) > 0
+}
+
+// PolicyChangesApproved tells whether policy changes have to be approved, they are refused while
+// no approvers are designated.
+func (w *ApprovalWorkflow) PolicyChangesApproved() bool {
+	return !w.directPolicyChanges
+}
+
+// Register names the executor of an operation.
+func (w *ApprovalWorkflow) Register(operation string, executor ApprovalExecutor) {
+	w.executors[operation] = executor
+}
+
+// Submit stores a pending request and notifies its approvers, requesters never approve their own requests.
+func (w *ApprovalWorkflow) Submit(requester, operation, target, reason string, params interface{}) (*ApprovalRequest, error) {
+	if !w.Enabled() {
+		return nil, ErrApprovalDisabled
+	}
+	if _, ok := w.executors[operation]; !ok {
+		return nil, errors.Newf("Operation `%s` cannot be approved", operation)
+	}
+	approvers := make([]string, 0, len(w.approvers))
+	for _, approver := range w.approvers {
+		if !strings.EqualFold(approver, requester) {
+			approvers = append(approvers, approver)
+		}
+	}
+	if len(approvers) < w.quorum {
+		return nil, errors.Newf("A quorum of %d needs more approvers than the %d designated besides the requester", w.quorum, len(approvers))
+	}
+	encoded, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	request := &ApprovalRequest{
+		Operation:   operation,
+		Target:      target,
+		Params:      string(encoded),
+		Reason:      reason,
+		RequestedBy: requester,
+		Status:      ApprovalStatusPending,
+		Quorum:      w.quorum,
+		Approvers:   approvers,
+		Decisions:   []ApprovalDecision{},
+		ExpiresAt:   primitive.NewDateTimeFromTime(now.Add(w.window)),
+		Trail:       []ApprovalEvent{{At: now, Actor: requester, Action: "submitted", Detail: reason}},
+	}
+	if err := w.mdb.Create(request); err != nil {
+		return nil, err
+	}
+	w.logger.Infof("Approval request `%s` for %s of `%s` submitted by `%s`", request.ID.Hex(), operation, target, requester)
+	w.notify(approvers, fmt.Sprintf("key-master: approval requested for %s of %s", operation, target),
+		fmt.Sprintf("%s requests %s of %s.\n\nReason: %s\n\n%d of you have to approve before %s:\n%s\n",
+			requester, operation, target, reason, w.quorum, request.ExpiresAt.Time().Format(time.RFC1123), w.link(request)))
+	return request, nil
+}
+
+// Find loads a request, pending requests past their window are expired on the way.
+func (w *ApprovalWorkflow) Find(id string) (*ApprovalRequest, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+	request := &ApprovalRequest{}
+	if err := w.mdb.Select(request, bson.M{"_id": objectID}); err != nil {
+		return nil, err
+	}
+	if request.Status == ApprovalStatusPending && time.Now().After(request.ExpiresAt.Time()) {
+		if err := w.close(request, ApprovalStatusExpired, "key-master", "expired", ""); err != nil {
+			return nil, err
+		}
+	}
+	return request, nil
+}
+
+// List returns the requests matching filter, newest first.
+func (w *ApprovalWorkflow) List(filter bson.M) ([]ApprovalRequest, error) {
+	requests := make([]ApprovalRequest, 0)
+	_, err := w.mdb.SelectPage(&requests, filter, bson.D{{Key: "created_at", Value: -1}}, 0, 0)
+	return requests, err
+}
+
+// Decide records the decision of an approver and executes the operation once the quorum is reached.
+// The request is rejected as soon as too few approvers are left to reach it.
+func (w *ApprovalWorkflow) Decide(request *ApprovalRequest, approver string, approve, mfa bool, comment, ip string) error {
+	if request.Status != ApprovalStatusPending {
+		return ErrApprovalClosed
+	}
+	if !request.isApprover(approver) {
+		return ErrApprovalNotApprover
+	}
+	if !mfa {
+		return ErrApprovalMfa
+	}
+	now := time.Now()
+	decision := ApprovalDecision{Approver: approver, Approve: approve, Comment: comment, IP: ip, At: now}
+	action := "rejected"
+	if approve {
+		action = "approved"
+	}
+	ok, err := w.mdb.UpdateIf(request, bson.M{"status": ApprovalStatusPending, "decisions.approver": bson.M{"$ne": approver}}, bson.M{
+		"$push": bson.M{
+			"decisions": decision,
+			"trail":     ApprovalEvent{At: now, Actor: approver, Action: action, Detail: comment},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("You already decided on this request or it is no longer pending")
+	}
+	if err := w.mdb.Select(request, bson.M{"_id": request.ID}); err != nil {
+		return err
+	}
+	if request.Approvals() >= request.Quorum {
+		return w.execute(request)
+	}
+	if len(request.Approvers)-(len(request.Decisions)-request.Approvals()) < request.Quorum {
+		if err := w.close(request, ApprovalStatusRejected, "key-master", "rejected", "Quorum can no longer be reached"); err != nil {
+			return err
+		}
+		w.notify([]string{request.RequestedBy}, fmt.Sprintf("key-master: %s of %s was rejected", request.Operation, request.Target),
+			fmt.Sprintf("Your request was rejected by the approvers:\n%s\n", w.link(request)))
+	}
+	return nil
+}
+
+// Cancel withdraws a pending request, only its requester may.
+func (w *ApprovalWorkflow) Cancel(request *ApprovalRequest, requester string) error {
+	if request.RequestedBy != requester {
+		return errors.New("Only the requester can cancel a request")
+	}
+	if err := w.close(request, ApprovalStatusCancelled, requester, "cancelled", ""); err != nil {
+		return err
+	}
+	w.notify(request.Approvers, fmt.Sprintf("key-master: %s of %s was cancelled", request.Operation, request.Target),
+		fmt.Sprintf("%s cancelled the request:\n%s\n", requester, w.link(request)))
+	return nil
+}
+
+// TakeResult hands the result of an executed request to its requester, it can be taken only once.
+func (w *ApprovalWorkflow) TakeResult(request *ApprovalRequest, requester string) ([]byte, error) {
+	if request.RequestedBy != requester {
+		return nil, errors.New("Only the requester can take the result")
+	}
+	if request.Status != ApprovalStatusExecuted || !request.HasResult {
+		return nil, errors.New("Request has no result to take")
+	}
+	sealed := request.SealedResult
+	ok, err := w.mdb.UpdateIf(request, bson.M{"has_result": true}, bson.M{
+		"$set":  bson.M{"has_result": false, "sealed_result": nil},
+		"$push": bson.M{"trail": ApprovalEvent{At: time.Now(), Actor: requester, Action: "result taken"}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("Result was already taken")
+	}
+	return w.sealer.Open(sealed)
+}
+
+func (w *ApprovalWorkflow) execute(request *ApprovalRequest) error {
+	ok, err := w.mdb.UpdateIf(request, bson.M{"status": ApprovalStatusPending}, bson.M{
+		"$set":  bson.M{"status": ApprovalStatusExecuting},
+		"$push": bson.M{"trail": ApprovalEvent{At: time.Now(), Actor: "key-master", Action: "quorum reached"}},
+	})
+	if err != nil || !ok {
+		// Another approval reached the quorum at the same time and executes it
+		return err
+	}
+	result, err := w.executors[request.Operation](request)
+	changes := bson.M{"status": ApprovalStatusExecuted, "has_result": len(result) > 0}
+	event := ApprovalEvent{At: time.Now(), Actor: "key-master", Action: "executed"}
+	if err != nil {
+		changes = bson.M{"status": ApprovalStatusFailed, "error": err.Error()}
+		event.Action, event.Detail = "failed", err.Error()
+	} else if len(result) > 0 {
+		if sealed, err := w.sealer.Seal(result); err != nil {
+			// The operation ran but its result is lost, the request must not look like it is still executing
+			changes = bson.M{"status": ApprovalStatusFailed, "error": err.Error()}
+			event.Action, event.Detail = "failed", "result could not be sealed: "+err.Error()
+		} else {
+			changes["sealed_result"] = sealed
+		}
+	}
+	if err := w.mdb.Update(request, bson.M{"$set": changes, "$push": bson.M{"trail": event}}); err != nil {
+		return err
+	}
+	if err := w.mdb.Select(request, bson.M{"_id": request.ID}); err != nil {
+		return err
+	}
+	w.logger.Infof("Approval request `%s` for %s of `%s` %s", request.ID.Hex(), request.Operation, request.Target, request.Status)
+	w.notify(append([]string{request.RequestedBy}, request.Approvers...), fmt.Sprintf("key-master: %s of %s %s", request.Operation, request.Target, request.Status),
+		fmt.Sprintf("The approved request was %s.\n%s\n", request.Status, w.link(request)))
+	return nil
+}
+
+func (w *ApprovalWorkflow) close(request *ApprovalRequest, status, actor, action, detail string) error {
+	ok, err := w.mdb.UpdateIf(request, bson.M{"status": ApprovalStatusPending}, bson.M{
+		"$set":  bson.M{"status": status},
+		"$push": bson.M{"trail": ApprovalEvent{At: time.Now(), Actor: actor, Action: action, Detail: detail}},
+	})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrApprovalClosed
+	}
+	return w.mdb.Select(request, bson.M{"_id": request.ID})
+}
+
+func (w *ApprovalWorkflow) notify(to []string, subject, body string) {
+	if err := w.mailer.Send(to, subject, body); err != nil {
+		w.logger.Errorf("Approval notification `%s` could not be sent: %v", subject, err)
+	}
+}
+
+func (w *ApprovalWorkflow) link(request *ApprovalRequest) string {
+	return fmt.Sprintf("%s/approvals/%s", w.uiUrl, request.ID.Hex())
+}
@@ -0,0 +1,78 @@
+package service
+
+import (
+	"fmt"
+
+	"github.com/gofiber/fiber/v2"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// AuditEntry records who did what to which target, entries are only ever appended.
+type AuditEntry struct {
+	BasicData
+
+	Actor  string `json:"actor" bson:"actor" validate:"required"`
+	Action string `json:"action" bson:"action" validate:"required"`
+	Target string `json:"target" bson:"target"`
+	IP     string `json:"ip" bson:"ip"`
+	Detail string `json:"detail,omitempty" bson:"detail,omitempty"`
+	// Incident is set on entries recorded under a break-glass token
+	Incident string `json:"incident,omitempty" bson:"incident,omitempty"`
+}
+
+type AuditLog struct {
+	mdb    *MongoDB
+	logger *log.Logger
+}
+
+func NewAuditLog(mdb *MongoDB, logger *log.Logger) *AuditLog {
+	mdb.CreateCollection(AuditEntry{})
+	return &AuditLog{
+		mdb:    mdb,
+		logger: logger,
+	}
+}
+
+// Record appends an entry, it is logged as well so the trail survives a database outage.
+func (a *AuditLog) Record(entry *AuditEntry) error {
+	a.logger.WithFields(log.Fields{
+		"audit":    entry.Action,
+		"actor":    entry.Actor,
+		"target":   entry.Target,
+		"ip":       entry.IP,
+		"incident": entry.Incident,
+	}).Info(entry.Detail)
+	return a.mdb.Create(entry)
+}
+
+// Search returns one page of the entries matching filter, the newest first, and how many match in total.
+func (a *AuditLog) Search(filter bson.M, skip, limit int64) ([]AuditEntry, int64, error) {
+	entries := make([]AuditEntry, 0)
+	total, err := a.mdb.SelectPage(&entries, filter, bson.D{{Key: "created_at", Value: -1}}, skip, limit)
+	return entries, total, err
+}
+
+// BreakGlassTrail records every request made with a break-glass token, whatever its outcome.
+// It has to follow TokenManager.GetMiddleWare, which puts the claims in place.
+func (a *AuditLog) BreakGlassTrail(tokenManager *TokenManager) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		incident := tokenManager.GetBreakGlassIncident(c)
+		if incident == "" {
+			return c.Next()
+		}
+		err := c.Next()
+		subject, _ := tokenManager.GetClaims(c)["sub"].(string)
+		if err := a.Record(&AuditEntry{
+			Actor:    subject,
+			Action:   "break-glass.request",
+			Target:   fmt.Sprintf("%s %s", c.Method(), c.OriginalURL()),
+			IP:       c.IP(),
+			Detail:   fmt.Sprintf("status %d", c.Response().StatusCode()),
+			Incident: incident,
+		}); err != nil {
+			a.logger.Errorf("Audit entry of break-glass incident `%s` could not be stored: %v", incident, err)
+		}
+		return err
+	}
+}
@@ -18,11 +18,14 @@ import (
 	"gopkg.in/errgo.v2/fmt/errors"
 )
 
+// MongoDB is the data access layer. Every handle is bound to a namespace, the one returned by
+// NewMongoDatabase to the default namespace, and never reads or writes documents of another one.
 type MongoDB struct {
-	client   *mongo.Client
-	dbname   string
-	logger   *log.Logger
-	validate *validator.Validate
+	client    *mongo.Client
+	dbname    string
+	logger    *log.Logger
+	validate  *validator.Validate
+	namespace string
 }
 
 func NewMongoDatabase(config *util.Configs, logger *log.Logger, validate *validator.Validate) *MongoDB {
@@ -32,7 +35,7 @@ func NewMongoDatabase(config *util.Configs, logger *log.Logger, validate *valida
 	clientOptions := options.Client().SetAppName("key-master")
 
 	hosts := make([]string, 0)
-	logger.Infof("DB Address: `%`", config.DB.MongoServers)
+	logger.Infof("DB Address: `%v`", config.DB.MongoServers)
 	for _, host := range config.DB.MongoServers {
 		hosts = append(hosts, fmt.Sprintf("%s:%d", host.MongoHost, host.MongoPort))
 	}
@@ -73,6 +76,42 @@ func NewMongoDatabase(config *util.Configs, logger *log.Logger, validate *valida
 func (mdb MongoDB) database() *mongo.Database {
 	return mdb.client.Database(mdb.dbname)
 }
+
+// Namespace returns a handle bound to namespace sharing the connection of mdb, only the handle
+// of NewMongoDatabase may be closed.
+func (mdb *MongoDB) Namespace(namespace string) *MongoDB {
+	scoped := *mdb
+	scoped.namespace = namespace
+	if namespace == DefaultNamespace {
+		scoped.namespace = ""
+	}
+	return &scoped
+}
+
+// NamespaceName is the namespace the handle is bound to.
+func (mdb *MongoDB) NamespaceName() string {
+	if mdb.namespace == "" {
+		return DefaultNamespace
+	}
+	return mdb.namespace
+}
+
+// scope restricts filter to the documents of the namespace which are not deleted.
+func (mdb *MongoDB) scope(filter bson.M) bson.M {
+	return mdb.owned(notDeleted(filter))
+}
+
+// owned restricts query to the documents of the namespace, whatever query says about it.
+// Documents of the default namespace carry no namespace at all.
+func (mdb *MongoDB) owned(query bson.M) bson.M {
+	if mdb.namespace == "" {
+		query["namespace"] = nil
+	} else {
+		query["namespace"] = mdb.namespace
+	}
+	return query
+}
+
 func (mdb *MongoDB) Close() error {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -86,8 +125,9 @@ func (mdb *MongoDB) GetCollection(model interface{}) string {
 
 func (mdb *MongoDB) CreateCollection(model interface{}) {
 	collection := mdb.GetCollection(model)
-	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
-	query := bson.D{{"name", collection}}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	query := bson.D{{Key: "name", Value: collection}}
 	res, err := mdb.database().ListCollectionNames(ctx, query)
 	if err != nil {
 		mdb.logger.Error(err)
@@ -100,7 +140,72 @@ func (mdb *MongoDB) CreateCollection(model interface{}) {
 	}
 }
 
-func (mdb *MongoDB) Select(model interface{}, changes bson.M) error {
+// CreateUniqueIndex makes the combination of keys unique among the documents of model.
+func (mdb *MongoDB) CreateUniqueIndex(model interface{}, keys ...string) {
+	collection := mdb.GetCollection(model)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	index := bson.D{}
+	for _, key := range keys {
+		index = append(index, bson.E{Key: key, Value: 1})
+	}
+	_, err := mdb.database().Collection(collection).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    index,
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		mdb.logger.Error(err)
+	}
+}
+
+// IsDuplicate tells whether err is a write refused by a unique index.
+func IsDuplicate(err error) bool {
+	return mongo.IsDuplicateKeyError(err)
+}
+
+func (mdb *MongoDB) Select(model interface{}, filter bson.M) error {
+	collection := mdb.GetCollection(model)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return mdb.database().Collection(collection).FindOne(ctx, mdb.scope(filter)).Decode(model)
+}
+
+// SelectAll decodes every document matching filter into models, which must be a pointer to a slice of a model.
+func (mdb *MongoDB) SelectAll(models interface{}, filter bson.M) error {
+	collection := mdb.GetCollection(models)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cursor, err := mdb.database().Collection(collection).Find(ctx, mdb.scope(filter))
+	if err != nil {
+		return err
+	}
+	return cursor.All(ctx, models)
+}
+
+// SelectPage decodes one page of the documents matching filter into models ordered by sort,
+// and returns how many documents match in total.
+func (mdb *MongoDB) SelectPage(models interface{}, filter bson.M, sort bson.D, skip, limit int64) (int64, error) {
+	collection := mdb.GetCollection(models)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	total, err := mdb.database().Collection(collection).CountDocuments(ctx, mdb.scope(filter))
+	if err != nil {
+		return 0, err
+	}
+	cursor, err := mdb.database().Collection(collection).Find(ctx, mdb.scope(filter), options.Find().SetSort(sort).SetSkip(skip).SetLimit(limit))
+	if err != nil {
+		return 0, err
+	}
+	return total, cursor.All(ctx, models)
+}
+
+// notDeleted excludes documents soft-deleted by Delete unless filter already matches on deleted_at.
+func notDeleted(filter bson.M) bson.M {
+	query := bson.M{"deleted_at": primitive.DateTime(0)}
+	for k, v := range filter {
+		query[k] = v
+	}
+	return query
 }
 
 func (mdb *MongoDB) Create(model interface{}) error {
@@ -112,7 +217,9 @@ func (mdb *MongoDB) Create(model interface{}) error {
 	collection := mdb.GetCollection(model)
 
 	setBasicData(model, CreatedAt, primitive.NewDateTimeFromTime(time.Now()))
-	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+	setBasicData(model, NamespaceField, mdb.namespace)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 	res, err := mdb.database().Collection(collection).InsertOne(ctx, model)
 	if err != nil {
 		return err
@@ -135,11 +242,34 @@ func (mdb *MongoDB) Update(model interface{}, changes bson.M) error {
 	if id == primitive.NilObjectID || id.String() == "" {
 		return errors.New("ID is not set")
 	}
-	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
-	_, err = mdb.database().Collection(collection).UpdateByID(ctx, bson.M{"_id": id}, changes)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err = mdb.database().Collection(collection).UpdateOne(ctx, mdb.owned(bson.M{"_id": id}), changes)
 	return err
 }
 
+// UpdateIf applies changes to the model only while its stored document also matches filter,
+// it tells whether it did. Concurrent state transitions use it to let exactly one writer win.
+func (mdb *MongoDB) UpdateIf(model interface{}, filter bson.M, changes bson.M) (bool, error) {
+	collection := mdb.GetCollection(model)
+	id := getBasicDataID(model)
+	if id == primitive.NilObjectID || id.String() == "" {
+		return false, errors.New("ID is not set")
+	}
+	query := bson.M{"_id": id}
+	for k, v := range filter {
+		query[k] = v
+	}
+	query = mdb.owned(query)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	res, err := mdb.database().Collection(collection).UpdateOne(ctx, query, changes)
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount > 0, nil
+}
+
 func (mdb *MongoDB) Set(model interface{}) error {
 	err := mdb.validate.Struct(model)
 	if err != nil {
@@ -153,8 +283,10 @@ func (mdb *MongoDB) Set(model interface{}) error {
 	if id == primitive.NilObjectID || id.String() == "" {
 		return errors.New("ID is not set")
 	}
-	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
-	_, err = mdb.database().Collection(collection).ReplaceOne(ctx, bson.M{"_id": id}, model)
+	setBasicData(model, NamespaceField, mdb.namespace)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err = mdb.database().Collection(collection).ReplaceOne(ctx, mdb.owned(bson.M{"_id": id}), model)
 	return err
 }
 
@@ -171,25 +303,29 @@ func (mdb *MongoDB) Delete(model interface{}) error {
 	if id == primitive.NilObjectID || id.String() == "" {
 		return errors.New("ID is not set")
 	}
-	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
-	_, err = mdb.database().Collection(collection).ReplaceOne(ctx, bson.M{"_id": id}, model)
+	setBasicData(model, NamespaceField, mdb.namespace)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err = mdb.database().Collection(collection).ReplaceOne(ctx, mdb.owned(bson.M{"_id": id}), model)
 	return err
 }
 
 type BasicDataField string
 
 const (
-	ID        BasicDataField = "ID"
-	CreatedAt BasicDataField = "CreatedAt"
-	UpdatedAt BasicDataField = "UpdatedAt"
-	DeletedAt BasicDataField = "DeletedAt"
+	ID             BasicDataField = "ID"
+	CreatedAt      BasicDataField = "CreatedAt"
+	UpdatedAt      BasicDataField = "UpdatedAt"
+	DeletedAt      BasicDataField = "DeletedAt"
+	NamespaceField BasicDataField = "Namespace"
 )
 
 type BasicData struct {
-	ID        primitive.ObjectID `json:"id" bson:"-"`
+	ID        primitive.ObjectID `json:"id" bson:"_id,omitempty"`
 	CreatedAt primitive.DateTime `json:"created_at" bson:"created_at"`
 	UpdatedAt primitive.DateTime `json:"updated_at" bson:"updated_at"`
 	DeletedAt primitive.DateTime `json:"deleted_at" bson:"deleted_at"`
+	Namespace string             `json:"-" bson:"namespace,omitempty"`
 }
 
 func setBasicData(model interface{}, field BasicDataField, value interface{}) error {
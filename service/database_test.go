@@ -0,0 +1,32 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestNamespaceScope(t *testing.T) {
+	root := &MongoDB{}
+	tenant := root.Namespace("acme")
+
+	assert.Equal(t, DefaultNamespace, root.NamespaceName())
+	assert.Equal(t, "acme", tenant.NamespaceName())
+	assert.Equal(t, DefaultNamespace, tenant.Namespace(DefaultNamespace).NamespaceName())
+
+	query := root.scope(bson.M{"name": "x"})
+	assert.Nil(t, query["namespace"])
+	assert.Contains(t, query, "namespace")
+	assert.Equal(t, primitive.DateTime(0), query["deleted_at"])
+
+	// A filter naming another namespace cannot escape the handle
+	query = tenant.scope(bson.M{"name": "x", "namespace": "other"})
+	assert.Equal(t, "acme", query["namespace"])
+	assert.Equal(t, "x", query["name"])
+
+	id := primitive.NewObjectID()
+	query = tenant.owned(bson.M{"_id": id})
+	assert.Equal(t, bson.M{"_id": id, "namespace": "acme"}, query)
+}
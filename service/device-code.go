@@ -0,0 +1,241 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	redis "github.com/go-redis/redis/v8"
+	"github.com/markbates/goth"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+const (
+	deviceCodeTTL      = time.Minute * 10
+	devicePollInterval = time.Second * 5
+	// userCodeAlphabet leaves out vowels and look-alike characters as RFC 8628 section 6.1 suggests
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLength   = 8
+)
+
+// Device authorization states, the errors double as the RFC 8628 token endpoint error codes.
+const (
+	DeviceStatusPending  = "pending"
+	DeviceStatusApproved = "approved"
+	DeviceStatusDenied   = "denied"
+)
+
+var (
+	ErrDeviceAuthorizationPending = errors.New("authorization_pending")
+	ErrDeviceSlowDown             = errors.New("slow_down")
+	ErrDeviceAccessDenied         = errors.New("access_denied")
+	ErrDeviceCodeExpired          = errors.New("expired_token")
+	ErrDeviceUserCodeInvalid      = errors.New("User code is invalid or expired")
+)
+
+// DeviceAuthorization is a pending RFC 8628 login of a device without a browser,
+// it is approved by a user who is logged in elsewhere and consumed by the first successful poll.
+type DeviceAuthorization struct {
+	DeviceCode string    `json:"-"`
+	UserCode   string    `json:"user_code"`
+	ClientID   string    `json:"client_id"`
+	Namespace  string    `json:"namespace"`
+	Status     string    `json:"status"`
+	Email      string    `json:"email,omitempty"`
+	Name       string    `json:"name,omitempty"`
+	Provider   string    `json:"provider,omitempty"`
+	Amr        []string  `json:"amr,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// User is the identity the tokens of an approved device are issued to.
+func (d *DeviceAuthorization) User() goth.User {
+	return goth.User{Email: d.Email, Name: d.Name}
+}
+
+// DevicePollInterval is the minimum number of seconds a device waits between polls.
+func (t *TokenManager) DevicePollInterval() time.Duration {
+	return devicePollInterval
+}
+
+// StartDeviceAuthorization creates the device and user code pair of a new device authorization.
+func (t *TokenManager) StartDeviceAuthorization(clientID string) (*DeviceAuthorization, error) {
+	deviceCode, err := newTokenID()
+	if err != nil {
+		return nil, err
+	}
+	userCode, err := newUserCode()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	device := &DeviceAuthorization{
+		DeviceCode: deviceCode,
+		UserCode:   userCode,
+		ClientID:   clientID,
+		Namespace:  t.mdb.NamespaceName(),
+		Status:     DeviceStatusPending,
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(deviceCodeTTL),
+	}
+	data, err := json.Marshal(device)
+	if err != nil {
+		return nil, err
+	}
+	// The user code is short, SetNX keeps a collision from taking over another pending request
+	ok, err := t.rdb.SetNX(ctx, deviceUserKey(t.Subject(userCode)), deviceCodeHash(deviceCode), deviceCodeTTL).Result()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("User code collision, try again")
+	}
+	if err := t.rdb.Set(ctx, deviceHashKey(t.Subject(deviceCodeHash(deviceCode))), data, deviceCodeTTL).Err(); err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+// GetDeviceAuthorization looks a pending request up by the code the user typed in.
+func (t *TokenManager) GetDeviceAuthorization(userCode string) (*DeviceAuthorization, error) {
+	hash, err := t.rdb.Get(ctx, deviceUserKey(t.Subject(NormalizeUserCode(userCode)))).Result()
+	if err == redis.Nil {
+		return nil, ErrDeviceUserCodeInvalid
+	} else if err != nil {
+		return nil, err
+	}
+	device, err := t.loadDevice(hash)
+	if err == redis.Nil {
+		return nil, ErrDeviceUserCodeInvalid
+	}
+	return device, err
+}
+
+// DecideDeviceAuthorization approves or denies a pending request on behalf of the user.
+func (t *TokenManager) DecideDeviceAuthorization(userCode string, approve bool, user goth.User, provider string, amr []string) (*DeviceAuthorization, error) {
+	userCode = NormalizeUserCode(userCode)
+	hash, err := t.rdb.GetDel(ctx, deviceUserKey(t.Subject(userCode))).Result()
+	if err == redis.Nil {
+		return nil, ErrDeviceUserCodeInvalid
+	} else if err != nil {
+		return nil, err
+	}
+	device, err := t.loadDevice(hash)
+	if err == redis.Nil {
+		return nil, ErrDeviceUserCodeInvalid
+	} else if err != nil {
+		return nil, err
+	}
+	if device.Status != DeviceStatusPending || device.Namespace != t.mdb.NamespaceName() {
+		return nil, ErrDeviceUserCodeInvalid
+	}
+	device.Status = DeviceStatusDenied
+	if approve {
+		device.Status = DeviceStatusApproved
+		device.Email = user.Email
+		device.Name = user.Name
+		device.Provider = provider
+		device.Amr = amr
+	}
+	return device, t.storeDevice(hash, device)
+}
+
+// PollDeviceAuthorization answers a device polling the token endpoint, an approved authorization
+// is handed out once and removed.
+func (t *TokenManager) PollDeviceAuthorization(deviceCode, clientID string) (*DeviceAuthorization, error) {
+	hash := deviceCodeHash(deviceCode)
+	device, err := t.loadDevice(hash)
+	if err == redis.Nil {
+		return nil, ErrDeviceCodeExpired
+	} else if err != nil {
+		return nil, err
+	}
+	if device.ClientID != clientID || device.Namespace != t.mdb.NamespaceName() {
+		return nil, ErrDeviceCodeExpired
+	}
+	switch device.Status {
+	case DeviceStatusApproved:
+		deleted, err := t.rdb.Del(ctx, deviceHashKey(t.Subject(hash))).Result()
+		if err != nil {
+			return nil, err
+		}
+		if deleted == 0 {
+			// A concurrent poll got it first
+			return nil, ErrDeviceCodeExpired
+		}
+		return device, nil
+	case DeviceStatusDenied:
+		t.rdb.Del(ctx, deviceHashKey(t.Subject(hash)))
+		return nil, ErrDeviceAccessDenied
+	}
+	// The poll time has a key of its own, writing the authorization back could undo a decision made meanwhile
+	if polled, err := t.rdb.SetNX(ctx, devicePollKey(t.Subject(hash)), time.Now().Unix(), devicePollInterval).Result(); err != nil {
+		return nil, err
+	} else if !polled {
+		return nil, ErrDeviceSlowDown
+	}
+	return nil, ErrDeviceAuthorizationPending
+}
+
+func (t *TokenManager) loadDevice(hash string) (*DeviceAuthorization, error) {
+	data, err := t.rdb.Get(ctx, deviceHashKey(t.Subject(hash))).Bytes()
+	if err != nil {
+		return nil, err
+	}
+	device := &DeviceAuthorization{}
+	if err := json.Unmarshal(data, device); err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+func (t *TokenManager) storeDevice(hash string, device *DeviceAuthorization) error {
+	data, err := json.Marshal(device)
+	if err != nil {
+		return err
+	}
+	return t.rdb.Set(ctx, deviceHashKey(t.Subject(hash)), data, redis.KeepTTL).Err()
+}
+
+// NormalizeUserCode accepts user codes typed in lower case, with or without the dash.
+func NormalizeUserCode(userCode string) string {
+	userCode = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(userCode))
+	if len(userCode) != userCodeLength {
+		return userCode
+	}
+	return userCode[:userCodeLength/2] + "-" + userCode[userCodeLength/2:]
+}
+
+func newUserCode() (string, error) {
+	code := make([]byte, userCodeLength)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(userCodeAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		code[i] = userCodeAlphabet[n.Int64()]
+	}
+	return NormalizeUserCode(string(code)), nil
+}
+
+// Device codes are stored hashed so a Redis dump cannot be replayed.
+func deviceCodeHash(deviceCode string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(deviceCode)))
+}
+
+func deviceHashKey(hash string) string {
+	return fmt.Sprintf("device:code:%s", hash)
+}
+
+func devicePollKey(hash string) string {
+	return fmt.Sprintf("device:poll:%s", hash)
+}
+
+func deviceUserKey(userCode string) string {
+	return fmt.Sprintf("device:user:%s", userCode)
+}
@@ -0,0 +1,319 @@
+package service
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"math"
+	"math/big"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+// Format-preserving encryption as specified by NIST SP 800-38G (FF1) and its first revision (FF3-1).
+
+const (
+	ff1Rounds = 10
+	ff3Rounds = 8
+)
+
+// Alphabet maps the characters of a format onto numerals 0..radix-1.
+type Alphabet struct {
+	chars   []rune
+	numeral map[rune]uint16
+}
+
+func NewAlphabet(chars string) (*Alphabet, error) {
+	a := &Alphabet{numeral: map[rune]uint16{}}
+	for _, c := range chars {
+		if _, ok := a.numeral[c]; ok {
+			return nil, errors.Newf("Duplicate character `%c` in alphabet", c)
+		}
+		a.numeral[c] = uint16(len(a.chars))
+		a.chars = append(a.chars, c)
+	}
+	if len(a.chars) < 2 || len(a.chars) > 1<<16 {
+		return nil, errors.New("Alphabet must have between 2 and 65536 characters")
+	}
+	return a, nil
+}
+
+func (a *Alphabet) Radix() int {
+	return len(a.chars)
+}
+
+// Split returns the numerals of the characters of s in the alphabet and a template keeping the others in place.
+func (a *Alphabet) Split(s string) ([]uint16, []rune) {
+	numerals := make([]uint16, 0, utf8.RuneCountInString(s))
+	template := []rune(s)
+	for i, c := range template {
+		if n, ok := a.numeral[c]; ok {
+			numerals = append(numerals, n)
+			template[i] = -1
+		}
+	}
+	return numerals, template
+}
+
+// Join is the inverse of Split.
+func (a *Alphabet) Join(numerals []uint16, template []rune) string {
+	b := strings.Builder{}
+	i := 0
+	for _, c := range template {
+		if c == -1 {
+			b.WriteRune(a.chars[numerals[i]])
+			i++
+		} else {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+type FF1 struct {
+	block cipher.Block
+	radix int
+}
+
+func NewFF1(key []byte, radix int) (*FF1, error) {
+	if radix < 2 || radix > 1<<16 {
+		return nil, errors.New("Radix must be between 2 and 65536")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &FF1{block: block, radix: radix}, nil
+}
+
+func (f *FF1) Encrypt(x []uint16, tweak []byte) ([]uint16, error) {
+	return f.cipher(x, tweak, true)
+}
+
+func (f *FF1) Decrypt(x []uint16, tweak []byte) ([]uint16, error) {
+	return f.cipher(x, tweak, false)
+}
+
+func (f *FF1) cipher(x []uint16, tweak []byte, encrypt bool) ([]uint16, error) {
+	n := len(x)
+	if err := checkDomain(n, f.radix, 1<<32-1); err != nil {
+		return nil, err
+	}
+	u := n / 2
+	v := n - u
+	a := append([]uint16{}, x[:u]...)
+	b := append([]uint16{}, x[u:]...)
+	t := len(tweak)
+	bl := int(math.Ceil(math.Ceil(float64(v)*math.Log2(float64(f.radix))) / 8))
+	d := 4*((bl+3)/4) + 4
+
+	p := []byte{1, 2, 1, byte(f.radix >> 16), byte(f.radix >> 8), byte(f.radix), 10, byte(u),
+		byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n),
+		byte(t >> 24), byte(t >> 16), byte(t >> 8), byte(t)}
+	pad := ((-t-bl-1)%16 + 16) % 16
+	radix := big.NewInt(int64(f.radix))
+
+	for r := 0; r < ff1Rounds; r++ {
+		i := r
+		if !encrypt {
+			i = ff1Rounds - 1 - r
+		}
+		src := b
+		if !encrypt {
+			src = a
+		}
+		q := make([]byte, 0, t+pad+1+bl)
+		q = append(q, tweak...)
+		q = append(q, make([]byte, pad)...)
+		q = append(q, byte(i))
+		q = append(q, fixedBytes(num(src, radix), bl)...)
+
+		y := new(big.Int).SetBytes(f.expand(f.prf(append(append([]byte{}, p...), q...)), d))
+		m := u
+		if i%2 == 1 {
+			m = v
+		}
+		mod := new(big.Int).Exp(radix, big.NewInt(int64(m)), nil)
+		if encrypt {
+			c := new(big.Int).Add(num(a, radix), y)
+			c.Mod(c, mod)
+			a, b = b, str(c, radix, m)
+		} else {
+			c := new(big.Int).Sub(num(b, radix), y)
+			c.Mod(c, mod)
+			a, b = str(c, radix, m), a
+		}
+	}
+	return append(a, b...), nil
+}
+
+// prf is AES-CBC-MAC with a zero IV over data, a multiple of the block size.
+func (f *FF1) prf(data []byte) []byte {
+	y := make([]byte, aes.BlockSize)
+	for i := 0; i < len(data); i += aes.BlockSize {
+		for j := 0; j < aes.BlockSize; j++ {
+			y[j] ^= data[i+j]
+		}
+		f.block.Encrypt(y, y)
+	}
+	return y
+}
+
+func (f *FF1) expand(r []byte, d int) []byte {
+	s := append([]byte{}, r...)
+	for j := 1; len(s) < d; j++ {
+		block := append([]byte{}, r...)
+		for k := 0; k < 8; k++ {
+			block[aes.BlockSize-1-k] ^= byte(uint64(j) >> (8 * k))
+		}
+		f.block.Encrypt(block, block)
+		s = append(s, block...)
+	}
+	return s[:d]
+}
+
+type FF3 struct {
+	block cipher.Block
+	radix int
+}
+
+func NewFF3(key []byte, radix int) (*FF3, error) {
+	if radix < 2 || radix > 1<<16 {
+		return nil, errors.New("Radix must be between 2 and 65536")
+	}
+	block, err := aes.NewCipher(reverseBytes(key))
+	if err != nil {
+		return nil, err
+	}
+	return &FF3{block: block, radix: radix}, nil
+}
+
+// Encrypt applies FF3-1, which takes a 56 bit tweak.
+func (f *FF3) Encrypt(x []uint16, tweak []byte) ([]uint16, error) {
+	tl, tr, err := ff31Tweak(tweak)
+	if err != nil {
+		return nil, err
+	}
+	return f.cipher(x, tl, tr, true)
+}
+
+func (f *FF3) Decrypt(x []uint16, tweak []byte) ([]uint16, error) {
+	tl, tr, err := ff31Tweak(tweak)
+	if err != nil {
+		return nil, err
+	}
+	return f.cipher(x, tl, tr, false)
+}
+
+func ff31Tweak(tweak []byte) ([]byte, []byte, error) {
+	if len(tweak) != 7 {
+		return nil, nil, errors.New("FF3-1 tweak must be 7 bytes")
+	}
+	tl := []byte{tweak[0], tweak[1], tweak[2], tweak[3] & 0xf0}
+	tr := []byte{tweak[4], tweak[5], tweak[6], tweak[3] << 4}
+	return tl, tr, nil
+}
+
+func (f *FF3) cipher(x []uint16, tl, tr []byte, encrypt bool) ([]uint16, error) {
+	n := len(x)
+	maxLen := 2 * int(math.Floor(96/math.Log2(float64(f.radix))))
+	if err := checkDomain(n, f.radix, maxLen); err != nil {
+		return nil, err
+	}
+	u := (n + 1) / 2
+	v := n - u
+	a := append([]uint16{}, x[:u]...)
+	b := append([]uint16{}, x[u:]...)
+	radix := big.NewInt(int64(f.radix))
+
+	for r := 0; r < ff3Rounds; r++ {
+		i := r
+		if !encrypt {
+			i = ff3Rounds - 1 - r
+		}
+		m, w := u, tr
+		if i%2 == 1 {
+			m, w = v, tl
+		}
+		src := b
+		if !encrypt {
+			src = a
+		}
+		p := make([]byte, 16)
+		copy(p, w)
+		p[3] ^= byte(i)
+		copy(p[4:], fixedBytes(num(reverseNumerals(src), radix), 12))
+		s := reverseBytes(p)
+		f.block.Encrypt(s, s)
+		y := new(big.Int).SetBytes(reverseBytes(s))
+
+		mod := new(big.Int).Exp(radix, big.NewInt(int64(m)), nil)
+		if encrypt {
+			c := new(big.Int).Add(num(reverseNumerals(a), radix), y)
+			c.Mod(c, mod)
+			a, b = b, reverseNumerals(str(c, radix, m))
+		} else {
+			c := new(big.Int).Sub(num(reverseNumerals(b), radix), y)
+			c.Mod(c, mod)
+			a, b = reverseNumerals(str(c, radix, m)), a
+		}
+	}
+	return append(a, b...), nil
+}
+
+// checkDomain enforces radix^minlen >= 1,000,000 and the algorithm's maximum length.
+func checkDomain(n, radix, maxLen int) error {
+	minLen := int(math.Ceil(6 / math.Log10(float64(radix))))
+	if minLen < 2 {
+		minLen = 2
+	}
+	if n < minLen || n > maxLen {
+		return errors.Newf("Input must have between `%d` and `%d` characters of the alphabet", minLen, maxLen)
+	}
+	return nil
+}
+
+func num(x []uint16, radix *big.Int) *big.Int {
+	r := new(big.Int)
+	for _, d := range x {
+		r.Mul(r, radix)
+		r.Add(r, big.NewInt(int64(d)))
+	}
+	return r
+}
+
+func str(x *big.Int, radix *big.Int, m int) []uint16 {
+	out := make([]uint16, m)
+	x = new(big.Int).Set(x)
+	d := new(big.Int)
+	for i := m - 1; i >= 0; i-- {
+		x.DivMod(x, radix, d)
+		out[i] = uint16(d.Int64())
+	}
+	return out
+}
+
+func fixedBytes(x *big.Int, size int) []byte {
+	b := x.Bytes()
+	if len(b) >= size {
+		return b[len(b)-size:]
+	}
+	return append(make([]byte, size-len(b)), b...)
+}
+
+func reverseBytes(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i := range b {
+		r[len(b)-1-i] = b[i]
+	}
+	return r
+}
+
+func reverseNumerals(x []uint16) []uint16 {
+	r := make([]uint16, len(x))
+	for i := range x {
+		r[len(x)-1-i] = x[i]
+	}
+	return r
+}
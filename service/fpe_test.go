@@ -0,0 +1,88 @@
+package service
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// Samples from the NIST SP 800-38G example values.
+func TestFF1(t *testing.T) {
+	samples := []struct {
+		key, tweak, alphabet, plaintext, ciphertext string
+	}{
+		{"2B7E151628AED2A6ABF7158809CF4F3C", "", "0123456789", "0123456789", "2433477484"},
+		{"2B7E151628AED2A6ABF7158809CF4F3C", "39383736353433323130", "0123456789", "0123456789", "6124200773"},
+		{"2B7E151628AED2A6ABF7158809CF4F3C", "3737373770717273373737", "0123456789abcdefghijklmnopqrstuvwxyz", "0123456789abcdefghi", "a9tv40mll9kdu509eum"},
+		{"2B7E151628AED2A6ABF7158809CF4F3CEF4359D8D580AA4F7F036D6F04FC6A94", "", "0123456789", "0123456789", "6657667009"},
+	}
+	for _, s := range samples {
+		alphabet, err := NewAlphabet(s.alphabet)
+		assert.Nil(t, err)
+		ff1, err := NewFF1(mustHex(s.key), alphabet.Radix())
+		assert.Nil(t, err)
+
+		x, template := alphabet.Split(s.plaintext)
+		y, err := ff1.Encrypt(x, mustHex(s.tweak))
+		assert.Nil(t, err)
+		assert.Equal(t, s.ciphertext, alphabet.Join(y, template))
+
+		z, err := ff1.Decrypt(y, mustHex(s.tweak))
+		assert.Nil(t, err)
+		assert.Equal(t, s.plaintext, alphabet.Join(z, template))
+	}
+}
+
+// FF3-1 shares its rounds with FF3, so the FF3 samples exercise them with the 64 bit tweak split directly.
+func TestFF3(t *testing.T) {
+	samples := []struct {
+		key, tweak, alphabet, plaintext, ciphertext string
+	}{
+		{"EF4359D8D580AA4F7F036D6F04FC6A94", "D8E7920AFA330A73", "0123456789", "890121234567890000", "750918814058654607"},
+		{"EF4359D8D580AA4F7F036D6F04FC6A94", "9A768A92F60E12D8", "0123456789", "890121234567890000", "018989839189395384"},
+	}
+	for _, s := range samples {
+		alphabet, err := NewAlphabet(s.alphabet)
+		assert.Nil(t, err)
+		ff3, err := NewFF3(mustHex(s.key), alphabet.Radix())
+		assert.Nil(t, err)
+		tweak := mustHex(s.tweak)
+
+		x, template := alphabet.Split(s.plaintext)
+		y, err := ff3.cipher(x, tweak[:4], tweak[4:], true)
+		assert.Nil(t, err)
+		assert.Equal(t, s.ciphertext, alphabet.Join(y, template))
+
+		z, err := ff3.cipher(y, tweak[:4], tweak[4:], false)
+		assert.Nil(t, err)
+		assert.Equal(t, s.plaintext, alphabet.Join(z, template))
+	}
+}
+
+func TestFF3_1PreservesFormat(t *testing.T) {
+	alphabet, _ := NewAlphabet("0123456789")
+	ff3, err := NewFF3(mustHex("EF4359D8D580AA4F7F036D6F04FC6A94"), alphabet.Radix())
+	assert.Nil(t, err)
+	tweak := mustHex("D8E7920AFA330A")
+
+	x, template := alphabet.Split("4111-1111-1111-1111")
+	y, err := ff3.Encrypt(x, tweak)
+	assert.Nil(t, err)
+	encrypted := alphabet.Join(y, template)
+	assert.Len(t, encrypted, 19)
+	assert.Equal(t, "-", string(encrypted[4]))
+	assert.NotEqual(t, "4111-1111-1111-1111", encrypted)
+
+	z, err := ff3.Decrypt(y, tweak)
+	assert.Nil(t, err)
+	assert.Equal(t, "4111-1111-1111-1111", alphabet.Join(z, template))
+}
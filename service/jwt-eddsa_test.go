@@ -0,0 +1,31 @@
+package service
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	jwt "github.com/form3tech-oss/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSigningMethodEdDSA(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+
+	signed, err := jwt.NewWithClaims(jwt.GetSigningMethod("EdDSA"), jwt.MapClaims{"sub": "key-master"}).SignedString(private)
+	assert.Nil(t, err)
+
+	token, err := jwt.Parse(signed, func(token *jwt.Token) (interface{}, error) {
+		return public, nil
+	})
+	assert.Nil(t, err)
+	assert.True(t, token.Valid)
+	assert.Equal(t, "key-master", token.Claims.(jwt.MapClaims)["sub"])
+
+	other, _, _ := ed25519.GenerateKey(rand.Reader)
+	_, err = jwt.Parse(signed, func(token *jwt.Token) (interface{}, error) {
+		return other, nil
+	})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,218 @@
+package service
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/hbahadorzadeh/key-master/util"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+const (
+	defaultLdapUserFilter  = "(|(uid=%[1]s)(mail=%[1]s)(sAMAccountName=%[1]s)(userPrincipalName=%[1]s))"
+	defaultLdapGroupFilter = "(|(member=%[1]s)(uniqueMember=%[1]s))"
+)
+
+var ErrLdapInvalidCredentials = errors.New("Invalid username or password")
+
+// LdapUser is a directory entry which passed authentication.
+type LdapUser struct {
+	DN        string
+	Email     string
+	FirstName string
+	LastName  string
+	Groups    []string
+}
+
+// LdapAuthenticator authenticates users against an LDAP server or Active Directory: it binds with the service
+// credentials, searches the user entry, binds as the user to check the password and looks up group membership.
+type LdapAuthenticator struct {
+	configs   *util.LdapConfigs
+	tlsConfig *tls.Config
+	logger    *log.Logger
+}
+
+func NewLdapAuthenticator(configs *util.Configs, logger *log.Logger) *LdapAuthenticator {
+	l := &LdapAuthenticator{
+		configs: configs.Ldap,
+		logger:  logger,
+	}
+	if l.configs.Url == "" {
+		return l
+	}
+	u, err := url.Parse(l.configs.Url)
+	if err != nil {
+		logger.Panicf("Invalid LDAP url: %s", err)
+	}
+	l.tlsConfig = &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}
+	if l.configs.CAFile != "" {
+		data, err := ioutil.ReadFile(l.configs.CAFile)
+		if err != nil {
+			logger.Panicf("Reading LDAP CA file failed: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			logger.Panicf("No certificate found in LDAP CA file `%s`", l.configs.CAFile)
+		}
+		l.tlsConfig.RootCAs = pool
+	}
+	return l
+}
+
+func (l *LdapAuthenticator) Enabled() bool {
+	return l.configs.Url != ""
+}
+
+func (l *LdapAuthenticator) dial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(l.configs.Url, ldap.DialWithTLSConfig(l.tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	if l.configs.StartTLS {
+		if err := conn.StartTLS(l.tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// bindService binds with the configured search credentials, or stays anonymous without them.
+func (l *LdapAuthenticator) bindService(conn *ldap.Conn) error {
+	if l.configs.BindDN == "" {
+		return nil
+	}
+	return conn.Bind(l.configs.BindDN, l.configs.BindPassword)
+}
+
+func (l *LdapAuthenticator) Authenticate(username, password string) (*LdapUser, error) {
+	// An empty password would make an unauthenticated bind, which most servers accept
+	if username == "" || password == "" {
+		return nil, ErrLdapInvalidCredentials
+	}
+	conn, err := l.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := l.bindService(conn); err != nil {
+		return nil, err
+	}
+
+	emailAttribute := orDefault(l.configs.EmailAttribute, "mail")
+	firstNameAttribute := orDefault(l.configs.FirstNameAttribute, "givenName")
+	lastNameAttribute := orDefault(l.configs.LastNameAttribute, "sn")
+	res, err := conn.Search(ldap.NewSearchRequest(
+		l.configs.UserBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 10, false,
+		fmt.Sprintf(orDefault(l.configs.UserFilter, defaultLdapUserFilter), ldap.EscapeFilter(username)),
+		[]string{emailAttribute, firstNameAttribute, lastNameAttribute, "memberOf"},
+		nil,
+	))
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Entries) != 1 {
+		return nil, ErrLdapInvalidCredentials
+	}
+	entry := res.Entries[0]
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrLdapInvalidCredentials
+		}
+		return nil, err
+	}
+	user := &LdapUser{
+		DN:        entry.DN,
+		Email:     strings.ToLower(entry.GetAttributeValue(emailAttribute)),
+		FirstName: entry.GetAttributeValue(firstNameAttribute),
+		LastName:  entry.GetAttributeValue(lastNameAttribute),
+	}
+	if user.Email == "" {
+		return nil, errors.Newf("Directory entry `%s` has no `%s` attribute", entry.DN, emailAttribute)
+	}
+
+	// Group lookups run with the search credentials, users often may not read groups themselves
+	if err := l.bindService(conn); err != nil {
+		return nil, err
+	}
+	if user.Groups, err = l.groups(conn, entry); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// groups merges Active Directory style memberOf values with groups found by searching for the member.
+func (l *LdapAuthenticator) groups(conn *ldap.Conn, entry *ldap.Entry) ([]string, error) {
+	nameAttribute := orDefault(l.configs.GroupNameAttribute, "cn")
+	seen := map[string]bool{}
+	groups := make([]string, 0)
+	add := func(name string) {
+		if name != "" && !seen[strings.ToLower(name)] {
+			seen[strings.ToLower(name)] = true
+			groups = append(groups, name)
+		}
+	}
+	for _, dn := range entry.GetAttributeValues("memberOf") {
+		add(rdnValue(dn, nameAttribute))
+	}
+	if l.configs.GroupBaseDN == "" {
+		return groups, nil
+	}
+	res, err := conn.Search(ldap.NewSearchRequest(
+		l.configs.GroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 10, false,
+		fmt.Sprintf(orDefault(l.configs.GroupFilter, defaultLdapGroupFilter), ldap.EscapeFilter(entry.DN)),
+		[]string{nameAttribute},
+		nil,
+	))
+	if err != nil {
+		return nil, err
+	}
+	for _, group := range res.Entries {
+		add(group.GetAttributeValue(nameAttribute))
+	}
+	return groups, nil
+}
+
+// Roles maps directory groups to key-master roles, group names compare case insensitively.
+func (l *LdapAuthenticator) Roles(groups []string) []string {
+	roles := make([]string, 0)
+	seen := map[string]bool{}
+	for group, role := range l.configs.GroupRoles {
+		for _, g := range groups {
+			if strings.EqualFold(g, group) && !seen[role] {
+				seen[role] = true
+				roles = append(roles, role)
+			}
+		}
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+// rdnValue extracts the value of attribute from the first RDN of dn, e.g. the cn of a group DN.
+func rdnValue(dn, attribute string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil || len(parsed.RDNs) == 0 {
+		return ""
+	}
+	for _, attr := range parsed.RDNs[0].Attributes {
+		if strings.EqualFold(attr.Type, attribute) {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+func orDefault(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
@@ -0,0 +1,238 @@
+package service
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/hbahadorzadeh/key-master/util"
+	log "github.com/sirupsen/logrus"
+)
+
+type ldapTestEntry struct {
+	dn         string
+	password   string
+	attributes map[string][]string
+}
+
+// ldapTestServer is a minimal in-process directory speaking just enough LDAPv3 for LdapAuthenticator:
+// simple binds, searches with and/or/not/equality/present filters and unbind.
+type ldapTestServer struct {
+	listener net.Listener
+	entries  []ldapTestEntry
+}
+
+func newLdapTestServer(t *testing.T, entries []ldapTestEntry) *ldapTestServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &ldapTestServer{listener: listener, entries: entries}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return s
+}
+
+func (s *ldapTestServer) url() string {
+	return "ldap://" + s.listener.Addr().String()
+}
+
+func (s *ldapTestServer) serve(conn net.Conn) {
+	defer conn.Close()
+	bound := ""
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := op.Children[1].Data.String()
+			password := op.Children[2].Data.String()
+			code := int64(ldap.LDAPResultInvalidCredentials)
+			if entry := s.find(dn); entry != nil && entry.password != "" && entry.password == password {
+				code = ldap.LDAPResultSuccess
+				bound = entry.dn
+			}
+			conn.Write(ldapTestResponse(id, ldap.ApplicationBindResponse, ldapTestResult(code)...).Bytes())
+		case ldap.ApplicationSearchRequest:
+			if bound == "" {
+				conn.Write(ldapTestResponse(id, ldap.ApplicationSearchResultDone, ldapTestResult(ldap.LDAPResultInsufficientAccessRights)...).Bytes())
+				continue
+			}
+			base := strings.ToLower(op.Children[0].Data.String())
+			for _, entry := range s.entries {
+				if strings.HasSuffix(strings.ToLower(entry.dn), base) && ldapTestMatch(op.Children[6], entry) {
+					attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+					for name, values := range entry.attributes {
+						attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+						attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, ""))
+						set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+						for _, value := range values {
+							set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, ""))
+						}
+						attribute.AppendChild(set)
+						attributes.AppendChild(attribute)
+					}
+					conn.Write(ldapTestResponse(id, ldap.ApplicationSearchResultEntry,
+						ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.dn, ""),
+						attributes).Bytes())
+				}
+			}
+			conn.Write(ldapTestResponse(id, ldap.ApplicationSearchResultDone, ldapTestResult(ldap.LDAPResultSuccess)...).Bytes())
+		case ldap.ApplicationUnbindRequest:
+			return
+		}
+	}
+}
+
+func (s *ldapTestServer) find(dn string) *ldapTestEntry {
+	for i := range s.entries {
+		if strings.EqualFold(s.entries[i].dn, dn) {
+			return &s.entries[i]
+		}
+	}
+	return nil
+}
+
+func ldapTestMatch(filter *ber.Packet, entry ldapTestEntry) bool {
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, child := range filter.Children {
+			if !ldapTestMatch(child, entry) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, child := range filter.Children {
+			if ldapTestMatch(child, entry) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterNot:
+		return !ldapTestMatch(filter.Children[0], entry)
+	case ldap.FilterEqualityMatch:
+		for _, value := range ldapTestAttribute(entry, filter.Children[0].Data.String()) {
+			if strings.EqualFold(value, filter.Children[1].Data.String()) {
+				return true
+			}
+		}
+	case ldap.FilterPresent:
+		return len(ldapTestAttribute(entry, filter.Data.String())) > 0
+	}
+	return false
+}
+
+func ldapTestAttribute(entry ldapTestEntry, name string) []string {
+	for k, v := range entry.attributes {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return nil
+}
+
+func ldapTestResult(code int64) []*ber.Packet {
+	return []*ber.Packet{
+		ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, ""),
+		ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""),
+		ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""),
+	}
+}
+
+func ldapTestResponse(id int64, tag ber.Tag, children ...*ber.Packet) *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	for _, child := range children {
+		op.AppendChild(child)
+	}
+	packet.AppendChild(op)
+	return packet
+}
+
+func newTestLdapAuthenticator(t *testing.T) *LdapAuthenticator {
+	server := newLdapTestServer(t, []ldapTestEntry{
+		{dn: "cn=admin,dc=example,dc=org", password: "admin-secret", attributes: map[string][]string{
+			"cn": {"admin"},
+		}},
+		{dn: "uid=alice,ou=people,dc=example,dc=org", password: "wonderland", attributes: map[string][]string{
+			"uid":       {"alice"},
+			"mail":      {"Alice@Example.org"},
+			"givenName": {"Alice"},
+			"sn":        {"Liddell"},
+			"memberOf":  {"cn=AD-Admins,ou=groups,dc=example,dc=org"},
+		}},
+		{dn: "uid=bob,ou=people,dc=example,dc=org", password: "builder", attributes: map[string][]string{
+			"uid": {"bob"},
+		}},
+		{dn: "cn=crypto-users,ou=groups,dc=example,dc=org", attributes: map[string][]string{
+			"cn":     {"crypto-users"},
+			"member": {"uid=alice,ou=people,dc=example,dc=org"},
+		}},
+	})
+	return NewLdapAuthenticator(&util.Configs{Ldap: &util.LdapConfigs{
+		Url:          server.url(),
+		BindDN:       "cn=admin,dc=example,dc=org",
+		BindPassword: "admin-secret",
+		UserBaseDN:   "ou=people,dc=example,dc=org",
+		GroupBaseDN:  "ou=groups,dc=example,dc=org",
+		GroupRoles: map[string]string{
+			"ad-admins":    "key-admin",
+			"crypto-users": "crypto-user",
+			"auditors":     "auditor",
+		},
+	}}, log.New())
+}
+
+func TestLdapAuthenticate(t *testing.T) {
+	authenticator := newTestLdapAuthenticator(t)
+
+	user, err := authenticator.Authenticate("alice", "wonderland")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.DN != "uid=alice,ou=people,dc=example,dc=org" || user.Email != "alice@example.org" ||
+		user.FirstName != "Alice" || user.LastName != "Liddell" {
+		t.Errorf("Unexpected user %+v", user)
+	}
+	if !reflect.DeepEqual(user.Groups, []string{"AD-Admins", "crypto-users"}) {
+		t.Errorf("Groups %v", user.Groups)
+	}
+	if roles := authenticator.Roles(user.Groups); !reflect.DeepEqual(roles, []string{"crypto-user", "key-admin"}) {
+		t.Errorf("Roles %v", roles)
+	}
+}
+
+func TestLdapAuthenticateRejects(t *testing.T) {
+	authenticator := newTestLdapAuthenticator(t)
+
+	for _, c := range []struct{ username, password string }{
+		{"alice", "looking-glass"},
+		{"alice", ""},
+		{"carol", "wonderland"},
+		{"*", "wonderland"},
+	} {
+		if _, err := authenticator.Authenticate(c.username, c.password); err != ErrLdapInvalidCredentials {
+			t.Errorf("%s/%s: expected invalid credentials, got %v", c.username, c.password, err)
+		}
+	}
+	if _, err := authenticator.Authenticate("bob", "builder"); err == nil || err == ErrLdapInvalidCredentials {
+		t.Errorf("Entry without mail attribute should fail with a configuration error, got %v", err)
+	}
+}
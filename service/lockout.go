@@ -0,0 +1,41 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	redis "github.com/go-redis/redis/v8"
+)
+
+const (
+	maxLoginFailures   = 5
+	loginLockoutWindow = 15 * time.Minute
+)
+
+// LoginLocked tells whether the identifier has failed too often within the lockout window.
+func (t *TokenManager) LoginLocked(identifier string) (bool, error) {
+	failures, err := t.rdb.Get(ctx, loginFailuresKey(t.Subject(identifier))).Int()
+	if err != nil && err != redis.Nil {
+		return false, err
+	}
+	return failures >= maxLoginFailures, nil
+}
+
+// LoginFailed counts a failed attempt of the identifier, the count is forgotten after the lockout window.
+func (t *TokenManager) LoginFailed(identifier string) error {
+	pipe := t.rdb.TxPipeline()
+	pipe.Incr(ctx, loginFailuresKey(t.Subject(identifier)))
+	pipe.Expire(ctx, loginFailuresKey(t.Subject(identifier)), loginLockoutWindow)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// LoginSucceeded forgets the failed attempts of the identifier.
+func (t *TokenManager) LoginSucceeded(identifier string) {
+	t.rdb.Del(ctx, loginFailuresKey(t.Subject(identifier)))
+}
+
+func loginFailuresKey(identifier string) string {
+	return fmt.Sprintf("login:failures:%s", strings.ToLower(identifier))
+}
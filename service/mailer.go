@@ -0,0 +1,41 @@
+package service
+
+import (
+	"fmt"
+	"net/smtp"
+	"strings"
+
+	"github.com/hbahadorzadeh/key-master/util"
+	log "github.com/sirupsen/logrus"
+)
+
+type Mailer struct {
+	configs *util.MailConfigs
+	logger  *log.Logger
+}
+
+func NewMailer(configs *util.Configs, logger *log.Logger) *Mailer {
+	return &Mailer{
+		configs: configs.Mail,
+		logger:  logger,
+	}
+}
+
+// Send delivers a plain text message through the configured SMTP relay.
+func (m *Mailer) Send(to []string, subject, body string) error {
+	if m.configs.Host == "" {
+		m.logger.Warnf("Mail is not configured, dropping `%s` to `%s`", subject, strings.Join(to, ","))
+		return nil
+	}
+	port := m.configs.Port
+	if port == 0 {
+		port = 587
+	}
+	var auth smtp.Auth
+	if m.configs.Username != "" {
+		auth = smtp.PlainAuth("", m.configs.Username, m.configs.Password, m.configs.Host)
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s\r\n",
+		m.configs.SenderAddress, strings.Join(to, ", "), subject, body)
+	return smtp.SendMail(fmt.Sprintf("%s:%d", m.configs.Host, port), auth, m.configs.SenderAddress, to, []byte(msg))
+}
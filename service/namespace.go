@@ -0,0 +1,167 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	// DefaultNamespace holds everything which existed before namespaces, and the namespaces themselves.
+	DefaultNamespace = "default"
+	// NamespaceHeader routes a request to a namespace, as does the /ns/<namespace> path prefix.
+	NamespaceHeader     = "X-Namespace"
+	namespacePathPrefix = "/ns/"
+	namespaceClaim      = "ns"
+)
+
+// Namespace is a tenant, its users, keys, tokens, policies and audit log are invisible to every other one.
+type Namespace struct {
+	BasicData
+
+	Name        string `json:"name" bson:"name" validate:"required,hostname_rfc1123"`
+	Description string `json:"description" bson:"description"`
+	CreatedBy   string `json:"created_by" bson:"created_by"`
+}
+
+// NamespaceBuilder sets up the routes of a namespace on top of a MongoDB handle bound to it,
+// stop ends its background work once the namespace is gone.
+type NamespaceBuilder func(namespace string) (app *fiber.App, stop func(), err error)
+
+type namespaceApp struct {
+	app  *fiber.App
+	stop func()
+}
+
+// NamespaceRouter hands requests for a namespace to the app of that namespace, building it on first use.
+type NamespaceRouter struct {
+	mdb     *MongoDB
+	logger  *log.Logger
+	builder NamespaceBuilder
+
+	lock sync.Mutex
+	apps map[string]*namespaceApp
+}
+
+func NewNamespaceRouter(mdb *MongoDB, logger *log.Logger) *NamespaceRouter {
+	mdb.CreateCollection(Namespace{})
+	return &NamespaceRouter{
+		mdb:    mdb,
+		logger: logger,
+		apps:   map[string]*namespaceApp{},
+	}
+}
+
+// SetBuilder enables namespaces, without a builder only the default namespace is served.
+func (r *NamespaceRouter) SetBuilder(builder NamespaceBuilder) {
+	r.builder = builder
+}
+
+// Find loads a namespace other than the default one.
+func (r *NamespaceRouter) Find(name string) (*Namespace, error) {
+	namespace := &Namespace{}
+	if err := r.mdb.Select(namespace, bson.M{"name": name}); err != nil {
+		return nil, err
+	}
+	return namespace, nil
+}
+
+// Used tells whether a namespace of that name exists or ever existed, deleted namespaces keep their
+// documents so their names are never handed out again.
+func (r *NamespaceRouter) Used(name string) bool {
+	namespace := &Namespace{}
+	return r.mdb.Select(namespace, bson.M{"name": name, "deleted_at": bson.M{"$exists": true}}) == nil
+}
+
+// App returns the app serving namespace.
+func (r *NamespaceRouter) App(name string) (*fiber.App, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if app, ok := r.apps[name]; ok {
+		return app.app, nil
+	}
+	if r.builder == nil {
+		return nil, fiber.ErrNotFound
+	}
+	if _, err := r.Find(name); err != nil {
+		return nil, err
+	}
+	app, stop, err := r.builder(name)
+	if err != nil {
+		return nil, err
+	}
+	r.apps[name] = &namespaceApp{app: app, stop: stop}
+	r.logger.Infof("Namespace `%s` is served", name)
+	return app, nil
+}
+
+// Evict stops serving a namespace, which is built again should it come back.
+func (r *NamespaceRouter) Evict(name string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if app, ok := r.apps[name]; ok {
+		app.stop()
+		delete(r.apps, name)
+	}
+}
+
+// Dispatch routes requests naming a namespace by header or path prefix to its app, with the prefix cut off.
+// The rest falls through to the default namespace. It has to precede TokenManager.GetMiddleWare, every
+// namespace validates its own tokens.
+func (r *NamespaceRouter) Dispatch() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		name, path := c.Get(NamespaceHeader), c.Path()
+		if strings.HasPrefix(path, namespacePathPrefix) {
+			prefixed := path[len(namespacePathPrefix):]
+			path = "/"
+			if i := strings.IndexByte(prefixed, '/'); i >= 0 {
+				prefixed, path = prefixed[:i], prefixed[i:]
+			}
+			if name != "" && name != prefixed {
+				return c.Status(400).SendString("Namespace header and path prefix disagree")
+			}
+			name = prefixed
+			c.Path(path)
+		}
+		if name == "" || name == DefaultNamespace {
+			return c.Next()
+		}
+		app, err := r.App(name)
+		if err != nil {
+			return c.Status(404).SendString("Namespace not found")
+		}
+		app.Handler()(c.Context())
+		return nil
+	}
+}
+
+// Close stops the background work of every namespace served.
+func (r *NamespaceRouter) Close() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for name, app := range r.apps {
+		app.stop()
+		delete(r.apps, name)
+	}
+}
+
+// Subject tells users of different namespaces apart where state is kept in Redis by email or another
+// identifier, Redis is shared by every namespace.
+func (t *TokenManager) Subject(identifier string) string {
+	if t.mdb.namespace == "" {
+		return identifier
+	}
+	return fmt.Sprintf("%s/%s", t.mdb.namespace, identifier)
+}
+
+// RevokeNamespaceUserSessions is RevokeUserSessions for a user of namespace, e.g. for the namespace routes
+// of the default namespace which change users of other namespaces.
+func (t *TokenManager) RevokeNamespaceUserSessions(namespace, email string) error {
+	scoped := *t
+	scoped.mdb = t.mdb.Namespace(namespace)
+	return scoped.RevokeUserSessions(email)
+}
@@ -0,0 +1,183 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/form3tech-oss/jwt-go"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+// jwksMinRefresh bounds how often an unknown kid may trigger a JWKS download.
+const jwksMinRefresh = time.Minute
+
+// OidcVerifier validates ID tokens issued by an OpenID Connect provider against the keys it publishes.
+type OidcVerifier struct {
+	issuer    string
+	clientId  string
+	jwksUri   string
+	client    *http.Client
+	mu        sync.RWMutex
+	keys      map[string]interface{}
+	fetchedAt time.Time
+}
+
+type oidcDiscovery struct {
+	Issuer  string `json:"issuer"`
+	JwksUri string `json:"jwks_uri"`
+}
+
+func NewOidcVerifier(discoveryUrl, clientId string) (*OidcVerifier, error) {
+	v := &OidcVerifier{
+		clientId: clientId,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		keys:     map[string]interface{}{},
+	}
+	discovery := new(oidcDiscovery)
+	if err := v.getJSON(discoveryUrl, discovery); err != nil {
+		return nil, err
+	}
+	if discovery.Issuer == "" || discovery.JwksUri == "" {
+		return nil, errors.Newf("Discovery document at `%s` lacks issuer or jwks_uri", discoveryUrl)
+	}
+	v.issuer = discovery.Issuer
+	v.jwksUri = discovery.JwksUri
+	if err := v.refresh(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Verify checks the signature, issuer, audience and expiry of an ID token and returns its claims.
+func (v *OidcVerifier) Verify(idToken string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(idToken, claims, func(token *jwt.Token) (interface{}, error) {
+		switch token.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS, *jwt.SigningMethodECDSA, *SigningMethodEdDSA:
+		default:
+			return nil, errors.Newf("Signing method `%s` not accepted", token.Method.Alg())
+		}
+		kid, _ := token.Header["kid"].(string)
+		return v.key(kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !claims.VerifyIssuer(v.issuer, true) {
+		return nil, errors.New("Issuer does not match the discovery document")
+	}
+	if !claims.VerifyAudience(v.clientId, true) {
+		return nil, errors.New("Audience does not match the client id")
+	}
+	if _, ok := claims["exp"]; !ok {
+		return nil, errors.New("ID token has no expiry")
+	}
+	return claims, nil
+}
+
+func (v *OidcVerifier) key(kid string) (interface{}, error) {
+	v.mu.RLock()
+	key, ok := v.lookup(kid)
+	stale := time.Since(v.fetchedAt) > jwksMinRefresh
+	v.mu.RUnlock()
+	if ok {
+		return key, nil
+	}
+	// The provider may have rotated its keys since we last looked
+	if stale {
+		if err := v.refresh(); err != nil {
+			return nil, err
+		}
+		v.mu.RLock()
+		defer v.mu.RUnlock()
+		if key, ok := v.lookup(kid); ok {
+			return key, nil
+		}
+	}
+	return nil, errors.Newf("No key with kid `%s`", kid)
+}
+
+func (v *OidcVerifier) lookup(kid string) (interface{}, bool) {
+	if kid == "" && len(v.keys) == 1 {
+		for _, key := range v.keys {
+			return key, true
+		}
+	}
+	key, ok := v.keys[kid]
+	return key, ok
+}
+
+func (v *OidcVerifier) refresh() error {
+	set := new(JSONWebKeySet)
+	if err := v.getJSON(v.jwksUri, set); err != nil {
+		return err
+	}
+	keys := map[string]interface{}{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.PublicKey()
+		if err != nil {
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	v.mu.Lock()
+	v.keys = keys
+	v.fetchedAt = time.Now()
+	v.mu.Unlock()
+	return nil
+}
+
+func (v *OidcVerifier) getJSON(url string, out interface{}) error {
+	resp, err := v.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Newf("GET `%s` returned %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// ClaimString reads a claim addressed by a dotted path, e.g. `realm_access.roles`.
+func ClaimString(claims map[string]interface{}, path string) string {
+	if v, ok := claimValue(claims, path).(string); ok {
+		return v
+	}
+	return ""
+}
+
+// ClaimStrings reads a string or list claim addressed by a dotted path.
+func ClaimStrings(claims map[string]interface{}, path string) []string {
+	switch v := claimValue(claims, path).(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func claimValue(claims map[string]interface{}, path string) interface{} {
+	var current interface{} = claims
+	for _, part := range strings.Split(path, ".") {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		current = m[part]
+	}
+	return current
+}
@@ -0,0 +1,65 @@
+package service
+
+import (
+	"fmt"
+	"time"
+
+	redis "github.com/go-redis/redis/v8"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+const (
+	otpPeriod = 30
+	otpSkew   = 1
+)
+
+// OtpValidator checks TOTP codes against sealed secrets and rejects codes already used in Redis.
+type OtpValidator struct {
+	sealer *Sealer
+	rdb    *redis.Client
+}
+
+func NewOtpValidator(sealer *Sealer, rdb *redis.Client) *OtpValidator {
+	return &OtpValidator{
+		sealer: sealer,
+		rdb:    rdb,
+	}
+}
+
+// Generate creates a TOTP key for accountName and returns it with its sealed secret.
+func (o *OtpValidator) Generate(issuer, accountName string) (*otp.Key, []byte, error) {
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      issuer,
+		AccountName: accountName,
+		Period:      otpPeriod,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	sealed, err := o.sealer.Seal([]byte(key.Secret()))
+	return key, sealed, err
+}
+
+// Validate returns true once per valid code, subject scopes the replay protection.
+func (o *OtpValidator) Validate(subject string, sealedSecret []byte, code string) (bool, error) {
+	secret, err := o.sealer.Open(sealedSecret)
+	if err != nil {
+		return false, err
+	}
+	valid, err := totp.ValidateCustom(code, string(secret), time.Now(), totp.ValidateOpts{
+		Period:    otpPeriod,
+		Skew:      otpSkew,
+		Digits:    otp.DigitsSix,
+		Algorithm: otp.AlgorithmSHA1,
+	})
+	if err != nil || !valid {
+		return false, nil
+	}
+	window := time.Duration(otpPeriod*(2*otpSkew+1)) * time.Second
+	fresh, err := o.rdb.SetNX(ctx, fmt.Sprintf("otp:used:%s:%s", subject, code), 1, window).Result()
+	if err != nil {
+		return false, err
+	}
+	return fresh, nil
+}
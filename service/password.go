@@ -0,0 +1,91 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+// Argon2id parameters following the RFC 9106 second recommended option.
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+	argon2KeyLen  = 32
+	argon2SaltLen = 16
+)
+
+// HashPassword returns password hashed with Argon2id in the PHC string format.
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	hash := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, argon2Memory, argon2Time, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(hash)), nil
+}
+
+// dummyHash has the parameters of HashPassword, no password matches its all zero hash.
+var dummyHash = fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+	argon2.Version, argon2Memory, argon2Time, argon2Threads,
+	base64.RawStdEncoding.EncodeToString(make([]byte, argon2SaltLen)),
+	base64.RawStdEncoding.EncodeToString(make([]byte, argon2KeyLen)))
+
+// SimulatePasswordCheck takes as long as checking a password against a real hash, logins of unknown accounts
+// take it so response times do not tell which accounts exist.
+func SimulatePasswordCheck(password string) {
+	_, _ = VerifyPassword(dummyHash, password)
+}
+
+func IsArgon2Hash(encoded string) bool {
+	return strings.HasPrefix(encoded, "$argon2id$")
+}
+
+// VerifyPassword checks password against a hash from HashPassword using its embedded parameters.
+func VerifyPassword(encoded, password string) (bool, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false, errors.New("Not an Argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return false, err
+	}
+	if version != argon2.Version {
+		return false, errors.Newf("Argon2 version `%d` not supported", version)
+	}
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false, err
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, err
+	}
+	hash, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, err
+	}
+	computed := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(hash)))
+	return subtle.ConstantTimeCompare(hash, computed) == 1, nil
+}
+
+// HashSecret hashes generated, high entropy secrets like client secrets and API keys,
+// a slow password hash would add nothing but latency on every request.
+func HashSecret(secret string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(secret)))
+}
+
+func CheckSecret(hash, secret string) bool {
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(HashSecret(secret))) == 1
+}
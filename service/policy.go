@@ -0,0 +1,427 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+// Operations policies are matched against, routes name the one they perform.
+const (
+	OperationCreate     = "create"
+	OperationImport     = "import"
+	OperationRead       = "read"
+	OperationEncrypt    = "encrypt"
+	OperationDecrypt    = "decrypt"
+	OperationSign       = "sign"
+	OperationExport     = "export"
+	OperationIssue      = "issue"
+	OperationRevoke     = "revoke"
+	OperationTokenize   = "tokenize"
+	OperationDetokenize = "detokenize"
+	OperationManage     = "manage"
+	OperationDestroy    = "destroy"
+)
+
+// Operations lists every operation a policy rule may name, `*` matches all of them.
+var Operations = []string{
+	OperationCreate,
+	OperationImport,
+	OperationRead,
+	OperationEncrypt,
+	OperationDecrypt,
+	OperationSign,
+	OperationExport,
+	OperationIssue,
+	OperationRevoke,
+	OperationTokenize,
+	OperationDetokenize,
+	OperationManage,
+	OperationDestroy,
+}
+
+const (
+	PolicyEffectAllow = "allow"
+	PolicyEffectDeny  = "deny"
+)
+
+// policyCacheTTL bounds how long another instance keeps evaluating a replaced policy version.
+const policyCacheTTL = time.Second * 10
+
+// Policy is one version of a named policy document, every change stores a new version
+// and only the Current one is evaluated.
+type Policy struct {
+	BasicData
+
+	Name        string       `json:"name" bson:"name" validate:"required"`
+	Version     int          `json:"version" bson:"version"`
+	Description string       `json:"description" bson:"description"`
+	Rules       []PolicyRule `json:"rules" bson:"rules"`
+	Current     bool         `json:"current" bson:"current"`
+	Author      string       `json:"author" bson:"author"`
+}
+
+// PolicyRule allows or denies the Operations on the Keys it targets. A rule applies when every one of its
+// non empty conditions holds. Denies win, and once an allow rule targets a key and operation
+// only requests matching one of the allow rules get through.
+type PolicyRule struct {
+	Effect     string   `json:"effect" bson:"effect" validate:"required,oneof=allow deny"`
+	Operations []string `json:"operations" bson:"operations"`
+	// Keys are path.Match patterns on key labels, e.g. `pgp/release-*`
+	Keys []string `json:"keys" bson:"keys"`
+	// Subjects are path.Match patterns on the sub claim, e.g. `service-account:ci-*`
+	Subjects  []string    `json:"subjects" bson:"subjects"`
+	Roles     []string    `json:"roles" bson:"roles"`
+	SourceIPs []string    `json:"source_ips" bson:"source_ips"`
+	Time      *TimeWindow `json:"time,omitempty" bson:"time,omitempty"`
+	Mfa       *bool       `json:"mfa,omitempty" bson:"mfa,omitempty"`
+}
+
+// TimeWindow holds from From to To, which may wrap around midnight, on the listed Days.
+type TimeWindow struct {
+	Days     []string `json:"days" bson:"days"`
+	From     string   `json:"from" bson:"from"`
+	To       string   `json:"to" bson:"to"`
+	Location string   `json:"location" bson:"location"`
+}
+
+// PolicyRequest are the attributes of a request policies are evaluated against.
+type PolicyRequest struct {
+	Subject   string    `json:"subject"`
+	Roles     []string  `json:"roles"`
+	Operation string    `json:"operation"`
+	Key       string    `json:"key"`
+	IP        string    `json:"ip"`
+	Time      time.Time `json:"time"`
+	Mfa       bool      `json:"mfa"`
+}
+
+// PolicyDecision tells whether a request is allowed and which rule decided it.
+type PolicyDecision struct {
+	Allowed bool   `json:"allowed"`
+	Policy  string `json:"policy,omitempty"`
+	Version int    `json:"version,omitempty"`
+	Rule    int    `json:"rule"`
+	Reason  string `json:"reason"`
+}
+
+type PolicyEngine struct {
+	tokenManager *TokenManager
+	mdb          *MongoDB
+	logger       *log.Logger
+
+	lock     sync.RWMutex
+	policies []Policy
+	loadedAt time.Time
+}
+
+func NewPolicyEngine(tokenManager *TokenManager, mdb *MongoDB, logger *log.Logger) *PolicyEngine {
+	mdb.CreateCollection(Policy{})
+	return &PolicyEngine{
+		tokenManager: tokenManager,
+		mdb:          mdb,
+		logger:       logger,
+	}
+}
+
+// Enforce is the route middleware evaluating the policies for operation on the key of kind named by the request.
+// It has to follow TokenManager.GetMiddleWare, which puts the claims in place.
+func (e *PolicyEngine) Enforce(operation, kind string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		req, err := e.Request(c, operation, KeyLabel(kind, requestKeyName(c)))
+		if err != nil {
+			return c.Status(503).SendString(err.Error())
+		}
+		decision, err := e.Evaluate(req)
+		if err != nil {
+			return c.Status(503).SendString(err.Error())
+		}
+		if !decision.Allowed {
+			e.logger.Warnf("Policy denied `%s` on `%s` to `%s`: %s", req.Operation, req.Key, req.Subject, decision.Reason)
+			return c.Status(403).SendString(decision.Reason)
+		}
+		return c.Next()
+	}
+}
+
+// Request collects the attributes of the calling request.
+func (e *PolicyEngine) Request(c *fiber.Ctx, operation, key string) (*PolicyRequest, error) {
+	claims := e.tokenManager.GetClaims(c)
+	roles, err := e.tokenManager.GetRoles(c)
+	if err != nil {
+		return nil, err
+	}
+	subject, _ := claims["sub"].(string)
+	mfa, _ := claims["mfa"].(bool)
+	return &PolicyRequest{
+		Subject:   subject,
+		Roles:     roles,
+		Operation: operation,
+		Key:       key,
+		IP:        c.IP(),
+		Time:      time.Now(),
+		Mfa:       mfa,
+	}, nil
+}
+
+// Evaluate decides a request against the current policies.
+func (e *PolicyEngine) Evaluate(req *PolicyRequest) (*PolicyDecision, error) {
+	policies, err := e.currentPolicies()
+	if err != nil {
+		return nil, err
+	}
+	return EvaluatePolicies(policies, req), nil
+}
+
+// Invalidate drops the cached policies after a change.
+func (e *PolicyEngine) Invalidate() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.policies = nil
+}
+
+func (e *PolicyEngine) currentPolicies() ([]Policy, error) {
+	e.lock.RLock()
+	policies, loadedAt := e.policies, e.loadedAt
+	e.lock.RUnlock()
+	if policies != nil && time.Since(loadedAt) < policyCacheTTL {
+		return policies, nil
+	}
+	policies = make([]Policy, 0)
+	if err := e.mdb.SelectAll(&policies, bson.M{"current": true}); err != nil {
+		return nil, err
+	}
+	e.lock.Lock()
+	e.policies, e.loadedAt = policies, time.Now()
+	e.lock.Unlock()
+	return policies, nil
+}
+
+// EvaluatePolicies decides req against policies, a request no rule targets is left to the roles alone.
+func EvaluatePolicies(policies []Policy, req *PolicyRequest) *PolicyDecision {
+	var allowed *PolicyDecision
+	var targeted *PolicyDecision
+	for _, policy := range policies {
+		for i, rule := range policy.Rules {
+			if !rule.targets(req) {
+				continue
+			}
+			decision := &PolicyDecision{Policy: policy.Name, Version: policy.Version, Rule: i}
+			if rule.Effect == PolicyEffectDeny {
+				if rule.matches(req) {
+					decision.Reason = fmt.Sprintf("Denied by rule %d of policy `%s`", i, policy.Name)
+					return decision
+				}
+				continue
+			}
+			if allowed == nil && rule.matches(req) {
+				decision.Allowed = true
+				decision.Reason = fmt.Sprintf("Allowed by rule %d of policy `%s`", i, policy.Name)
+				allowed = decision
+			} else if targeted == nil {
+				targeted = decision
+			}
+		}
+	}
+	if allowed != nil {
+		return allowed
+	}
+	if targeted != nil {
+		targeted.Reason = fmt.Sprintf("No allow rule of policy `%s` matches the request", targeted.Policy)
+		return targeted
+	}
+	return &PolicyDecision{Allowed: true, Rule: -1, Reason: "No policy applies"}
+}
+
+// targets tells whether the rule is about the operation and key of the request.
+func (r *PolicyRule) targets(req *PolicyRequest) bool {
+	if len(r.Operations) > 0 && !contains(r.Operations, req.Operation) && !contains(r.Operations, "*") {
+		return false
+	}
+	return len(r.Keys) == 0 || matchAny(r.Keys, req.Key)
+}
+
+// matches tells whether every condition of the rule holds for the request.
+func (r *PolicyRule) matches(req *PolicyRequest) bool {
+	if len(r.Subjects) > 0 && !matchAny(r.Subjects, req.Subject) {
+		return false
+	}
+	if len(r.Roles) > 0 {
+		found := false
+		for _, role := range req.Roles {
+			found = found || contains(r.Roles, role)
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(r.SourceIPs) > 0 && !ipInAny(r.SourceIPs, req.IP) {
+		return false
+	}
+	if r.Time != nil && !r.Time.contains(req.Time) {
+		return false
+	}
+	return r.Mfa == nil || *r.Mfa == req.Mfa
+}
+
+// Validate checks a rule before it is stored, so evaluation never meets a broken pattern.
+func (r *PolicyRule) Validate() error {
+	for _, operation := range r.Operations {
+		if operation != "*" && !contains(Operations, operation) {
+			return errors.Newf("Operation `%s` is unknown", operation)
+		}
+	}
+	for _, pattern := range append(append([]string{}, r.Keys...), r.Subjects...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.Newf("Pattern `%s` is malformed", pattern)
+		}
+	}
+	for _, source := range r.SourceIPs {
+		if _, _, err := net.ParseCIDR(source); err != nil && net.ParseIP(source) == nil {
+			return errors.Newf("Source `%s` is neither an IP nor a CIDR", source)
+		}
+	}
+	if r.Time != nil {
+		if _, _, _, err := r.Time.parse(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *TimeWindow) parse() (from, to time.Duration, location *time.Location, err error) {
+	location = time.UTC
+	if w.Location != "" {
+		if location, err = time.LoadLocation(w.Location); err != nil {
+			return 0, 0, nil, err
+		}
+	}
+	for _, day := range w.Days {
+		if _, ok := weekdays[strings.ToLower(day)]; !ok {
+			return 0, 0, nil, errors.Newf("Day `%s` is unknown", day)
+		}
+	}
+	if from, err = parseClock(w.From, 0); err != nil {
+		return 0, 0, nil, err
+	}
+	if to, err = parseClock(w.To, time.Hour*24); err != nil {
+		return 0, 0, nil, err
+	}
+	return from, to, location, nil
+}
+
+func (w *TimeWindow) contains(t time.Time) bool {
+	from, to, location, err := w.parse()
+	if err != nil {
+		return false
+	}
+	t = t.In(location)
+	clock := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	day := t.Weekday()
+	inside := clock >= from && clock < to
+	if from > to {
+		// The window wraps around midnight, the early hours belong to the day it started on
+		inside = clock >= from || clock < to
+		if clock < to {
+			day = (day + 6) % 7
+		}
+	}
+	if !inside {
+		return false
+	}
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, d := range w.Days {
+		if weekdays[strings.ToLower(d)] == day {
+			return true
+		}
+	}
+	return false
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func parseClock(clock string, empty time.Duration) (time.Duration, error) {
+	if clock == "" {
+		return empty, nil
+	}
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, errors.Newf("Time `%s` is not formatted as 15:04", clock)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// KeyLabel is how a key is named in policies, its kind and its name, e.g. `pgp/release`.
+func KeyLabel(kind, name string) string {
+	return fmt.Sprintf("%s/%s", kind, name)
+}
+
+// requestKeyName finds the key a request is about, in the path or else in the name field of a JSON body.
+func requestKeyName(c *fiber.Ctx) string {
+	for _, param := range []string{"name", "role"} {
+		if name := c.Params(param); name != "" {
+			return name
+		}
+	}
+	body := struct {
+		Name string `json:"name"`
+	}{}
+	if strings.HasPrefix(c.Get(fiber.HeaderContentType), fiber.MIMEApplicationJSON) {
+		json.Unmarshal(c.Body(), &body)
+	}
+	return body.Name
+}
+
+func matchAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func ipInAny(sources []string, value string) bool {
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return false
+	}
+	for _, source := range sources {
+		if _, network, err := net.ParseCIDR(source); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+		} else if other := net.ParseIP(source); other != nil && other.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEvaluatePolicies(t *testing.T) {
+	mfa := true
+	policies := []Policy{
+		{
+			Name:    "release-signing",
+			Version: 2,
+			Rules: []PolicyRule{
+				{Effect: PolicyEffectAllow, Operations: []string{OperationSign}, Keys: []string{"pgp/release-*"}, Subjects: []string{"service-account:ci-*"}, SourceIPs: []string{"10.0.0.0/8"}},
+				{Effect: PolicyEffectAllow, Operations: []string{OperationSign}, Keys: []string{"pgp/release-*"}, Roles: []string{"key-admin"}, Mfa: &mfa},
+			},
+		},
+		{
+			Name:    "office-hours",
+			Version: 1,
+			Rules: []PolicyRule{
+				{Effect: PolicyEffectDeny, Operations: []string{"*"}, Keys: []string{"fpe/*"}, Time: &TimeWindow{From: "18:00", To: "08:00"}},
+			},
+		},
+	}
+	noon := time.Date(2021, 6, 2, 12, 0, 0, 0, time.UTC)
+	night := time.Date(2021, 6, 2, 23, 0, 0, 0, time.UTC)
+
+	samples := []struct {
+		req     PolicyRequest
+		allowed bool
+		policy  string
+	}{
+		{PolicyRequest{Subject: "service-account:ci-build", Operation: OperationSign, Key: "pgp/release-2021", IP: "10.1.2.3", Time: noon}, true, "release-signing"},
+		{PolicyRequest{Subject: "service-account:ci-build", Operation: OperationSign, Key: "pgp/release-2021", IP: "192.168.1.1", Time: noon}, false, "release-signing"},
+		{PolicyRequest{Subject: "alice@example.com", Roles: []string{"key-admin"}, Operation: OperationSign, Key: "pgp/release-2021", Mfa: true, Time: noon}, true, "release-signing"},
+		{PolicyRequest{Subject: "alice@example.com", Roles: []string{"key-admin"}, Operation: OperationSign, Key: "pgp/release-2021", Time: noon}, false, "release-signing"},
+		{PolicyRequest{Subject: "alice@example.com", Operation: OperationSign, Key: "pgp/personal", Time: noon}, true, ""},
+		{PolicyRequest{Subject: "alice@example.com", Operation: OperationEncrypt, Key: "fpe/cards", Time: noon}, true, ""},
+		{PolicyRequest{Subject: "alice@example.com", Operation: OperationEncrypt, Key: "fpe/cards", Time: night}, false, "office-hours"},
+	}
+	for _, s := range samples {
+		decision := EvaluatePolicies(policies, &s.req)
+		assert.Equal(t, s.allowed, decision.Allowed, decision.Reason)
+		assert.Equal(t, s.policy, decision.Policy)
+	}
+}
+
+func TestTimeWindow(t *testing.T) {
+	window := &TimeWindow{Days: []string{"mon", "fri"}, From: "22:00", To: "02:00"}
+	assert.Nil(t, (&PolicyRule{Effect: PolicyEffectAllow, Time: window}).Validate())
+	// Friday 23:00 and the early hours of Saturday belong to the Friday window
+	assert.True(t, window.contains(time.Date(2021, 6, 4, 23, 0, 0, 0, time.UTC)))
+	assert.True(t, window.contains(time.Date(2021, 6, 5, 1, 0, 0, 0, time.UTC)))
+	assert.False(t, window.contains(time.Date(2021, 6, 5, 23, 0, 0, 0, time.UTC)))
+	assert.False(t, window.contains(time.Date(2021, 6, 4, 12, 0, 0, 0, time.UTC)))
+
+	assert.NotNil(t, (&PolicyRule{Effect: PolicyEffectAllow, Time: &TimeWindow{From: "25:00"}}).Validate())
+	assert.NotNil(t, (&PolicyRule{Effect: PolicyEffectAllow, Operations: []string{"launch"}}).Validate())
+	assert.NotNil(t, (&PolicyRule{Effect: PolicyEffectAllow, SourceIPs: []string{"10.0.0.0/33"}}).Validate())
+	assert.NotNil(t, (&PolicyRule{Effect: PolicyEffectAllow, Keys: []string{"pgp/["}}).Validate())
+}
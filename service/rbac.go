@@ -0,0 +1,181 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	jwt "github.com/form3tech-oss/jwt-go"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Permissions checked by the routes, roles grant them and PermissionAll grants every one.
+const (
+	PermissionAll            = "*"
+	PermissionKeysRead       = "keys:read"
+	PermissionKeysUse        = "keys:use"
+	PermissionKeysManage     = "keys:manage"
+	PermissionUsersManage    = "users:manage"
+	PermissionClientsManage  = "clients:manage"
+	PermissionRolesManage    = "roles:manage"
+	PermissionPoliciesManage = "policies:manage"
+	PermissionAuditRead      = "audit:read"
+)
+
+const (
+	permissionsLocal = "permissions"
+	rolesClaim       = "roles"
+	scopeClaim       = "scope"
+)
+
+// Permissions lists every permission a role may grant.
+var Permissions = []string{
+	PermissionAll,
+	PermissionKeysRead,
+	PermissionKeysUse,
+	PermissionKeysManage,
+	PermissionUsersManage,
+	PermissionClientsManage,
+	PermissionRolesManage,
+	PermissionPoliciesManage,
+	PermissionAuditRead,
+}
+
+// Authorizer resolves the roles of an identity and the permissions of roles, the roles are stored in Mongo
+// which is out of reach of the service package so the rbac controller installs it.
+type Authorizer interface {
+	Roles(claims jwt.MapClaims) ([]string, error)
+	Permissions(roles []string) ([]string, error)
+}
+
+// SetAuthorizer enables role based access control, without an Authorizer every Require check fails.
+func (t *TokenManager) SetAuthorizer(authorizer Authorizer) {
+	t.authorizer = authorizer
+}
+
+// resolveRoles embeds the roles into claims about to be signed, a missing Authorizer embeds none.
+func (t *TokenManager) resolveRoles(claims jwt.MapClaims) error {
+	if t.authorizer == nil {
+		return nil
+	}
+	roles, err := t.authorizer.Roles(claims)
+	if err != nil {
+		return err
+	}
+	claims[rolesClaim] = roles
+	return nil
+}
+
+// GetRoles returns the roles of the request, taken from the token or resolved for API keys and client certificates.
+func (t *TokenManager) GetRoles(c *fiber.Ctx) ([]string, error) {
+	claims := t.GetClaims(c)
+	if values, ok := claims[rolesClaim].([]interface{}); ok {
+		roles := make([]string, 0, len(values))
+		for _, value := range values {
+			if role, ok := value.(string); ok {
+				roles = append(roles, role)
+			}
+		}
+		return roles, nil
+	}
+	if roles, ok := claims[rolesClaim].([]string); ok {
+		return roles, nil
+	}
+	if t.authorizer == nil || len(claims) == 0 {
+		return []string{}, nil
+	}
+	return t.authorizer.Roles(claims)
+}
+
+// GetPermissions returns the permissions granted to the request, they are resolved once per request.
+// Tokens and API keys with scopes only get the permissions of their roles which are among the scopes.
+func (t *TokenManager) GetPermissions(c *fiber.Ctx) ([]string, error) {
+	if permissions, ok := c.Locals(permissionsLocal).([]string); ok {
+		return permissions, nil
+	}
+	if t.authorizer == nil {
+		return []string{}, nil
+	}
+	roles, err := t.GetRoles(c)
+	if err != nil {
+		return nil, err
+	}
+	permissions, err := t.authorizer.Permissions(roles)
+	if err != nil {
+		return nil, err
+	}
+	if scope, _ := t.GetClaims(c)[scopeClaim].(string); scope != "" {
+		permissions = scopePermissions(permissions, strings.Fields(scope))
+	}
+	sort.Strings(permissions)
+	c.Locals(permissionsLocal, permissions)
+	return permissions, nil
+}
+
+// HasPermission tells whether the roles of the request grant permission.
+func (t *TokenManager) HasPermission(c *fiber.Ctx, permission string) (bool, error) {
+	permissions, err := t.GetPermissions(c)
+	if err != nil {
+		return false, err
+	}
+	for _, p := range permissions {
+		if p == permission || p == PermissionAll {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// HasPermissions tells whether the roles of the request grant every one of permissions, e.g. before they are
+// handed on to someone else.
+func (t *TokenManager) HasPermissions(c *fiber.Ctx, permissions []string) (bool, error) {
+	for _, permission := range permissions {
+		allowed, err := t.HasPermission(c, permission)
+		if err != nil || !allowed {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// Require is the route middleware guarding a handler with a permission.
+func (t *TokenManager) Require(permission string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		allowed, err := t.HasPermission(c, permission)
+		if err != nil {
+			return c.Status(503).SendString(err.Error())
+		}
+		if !allowed {
+			return c.Status(403).SendString(fmt.Sprintf("Permission `%s` is required", permission))
+		}
+		return c.Next()
+	}
+}
+
+// scopePermissions narrows permissions to scopes, PermissionAll on either side stands for every permission.
+func scopePermissions(permissions, scopes []string) []string {
+	granted := map[string]bool{}
+	for _, p := range permissions {
+		granted[p] = true
+	}
+	scoped := make([]string, 0, len(scopes))
+	for _, scope := range scopes {
+		if scope == PermissionAll {
+			return permissions
+		}
+		if granted[scope] || granted[PermissionAll] {
+			scoped = append(scoped, scope)
+		}
+	}
+	return scoped
+}
+
+// IsPermission tells whether a role may grant permission.
+func IsPermission(permission string) bool {
+	for _, p := range Permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
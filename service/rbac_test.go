@@ -0,0 +1,120 @@
+package service
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	jwt "github.com/form3tech-oss/jwt-go"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// rolesAuthorizer grants the permissions of a fixed role table and resolves no roles of its own.
+type rolesAuthorizer map[string][]string
+
+func (a rolesAuthorizer) Roles(claims jwt.MapClaims) ([]string, error) {
+	return []string{}, nil
+}
+
+func (a rolesAuthorizer) Permissions(roles []string) ([]string, error) {
+	permissions := make([]string, 0)
+	for _, role := range roles {
+		permissions = append(permissions, a[role]...)
+	}
+	return permissions, nil
+}
+
+// rbacApp serves handlers behind a stand in for GetMiddleWare which accepts claims as they are.
+func rbacApp(claims jwt.MapClaims, handlers ...fiber.Handler) *fiber.App {
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals("user", &jwt.Token{Claims: claims, Valid: true})
+		return c.Next()
+	})
+	app.Get("/", handlers...)
+	return app
+}
+
+var testRoles = rolesAuthorizer{
+	"admin":       {PermissionAll},
+	"key-admin":   {PermissionKeysRead, PermissionKeysManage},
+	"crypto-user": {PermissionKeysRead, PermissionKeysUse},
+}
+
+func TestScopePermissions(t *testing.T) {
+	samples := []struct {
+		permissions []string
+		scopes      []string
+		scoped      []string
+	}{
+		{[]string{PermissionKeysUse, PermissionKeysManage}, []string{PermissionKeysUse}, []string{PermissionKeysUse}},
+		{[]string{PermissionKeysUse}, []string{PermissionKeysUse, PermissionUsersManage}, []string{PermissionKeysUse}},
+		{[]string{PermissionAll}, []string{PermissionKeysRead}, []string{PermissionKeysRead}},
+		{[]string{PermissionKeysUse}, []string{PermissionAll}, []string{PermissionKeysUse}},
+		{[]string{PermissionKeysUse}, []string{"deploy"}, []string{}},
+		{[]string{PermissionAll}, []string{"deploy"}, []string{"deploy"}},
+	}
+	for _, sample := range samples {
+		assert.Equal(t, sample.scoped, scopePermissions(sample.permissions, sample.scopes), "%v scoped to %v", sample.permissions, sample.scopes)
+	}
+}
+
+func TestRequire(t *testing.T) {
+	tokenManager := &TokenManager{}
+	tokenManager.SetAuthorizer(testRoles)
+	ok := func(c *fiber.Ctx) error { return c.SendStatus(204) }
+	samples := []struct {
+		claims     jwt.MapClaims
+		permission string
+		status     int
+	}{
+		{jwt.MapClaims{"roles": []interface{}{"key-admin"}}, PermissionKeysManage, 204},
+		{jwt.MapClaims{"roles": []interface{}{"crypto-user"}}, PermissionKeysManage, 403},
+		{jwt.MapClaims{"roles": []interface{}{"admin"}}, PermissionUsersManage, 204},
+		{jwt.MapClaims{"roles": []interface{}{"unknown"}}, PermissionKeysRead, 403},
+		{jwt.MapClaims{}, PermissionKeysRead, 403},
+		// Scopes narrow what the roles grant
+		{jwt.MapClaims{"roles": []interface{}{"admin"}, "scope": PermissionKeysUse}, PermissionKeysUse, 204},
+		{jwt.MapClaims{"roles": []interface{}{"admin"}, "scope": PermissionKeysUse}, PermissionKeysManage, 403},
+	}
+	for _, sample := range samples {
+		app := rbacApp(sample.claims, tokenManager.Require(sample.permission), ok)
+		res, err := app.Test(httptest.NewRequest("GET", "/", nil))
+		assert.NoError(t, err)
+		assert.Equal(t, sample.status, res.StatusCode, "%v requiring %s", sample.claims, sample.permission)
+	}
+
+	// Without an Authorizer nothing is granted
+	tokenManager = &TokenManager{}
+	app := rbacApp(jwt.MapClaims{"roles": []interface{}{"admin"}}, tokenManager.Require(PermissionKeysRead), ok)
+	res, err := app.Test(httptest.NewRequest("GET", "/", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, 403, res.StatusCode)
+}
+
+func TestHasPermissions(t *testing.T) {
+	tokenManager := &TokenManager{}
+	tokenManager.SetAuthorizer(testRoles)
+	samples := []struct {
+		roles       []interface{}
+		permissions []string
+		allowed     bool
+	}{
+		{[]interface{}{"key-admin"}, []string{PermissionKeysRead, PermissionKeysManage}, true},
+		{[]interface{}{"key-admin"}, []string{PermissionKeysManage, PermissionKeysUse}, false},
+		{[]interface{}{"key-admin", "crypto-user"}, []string{PermissionKeysManage, PermissionKeysUse}, true},
+		{[]interface{}{"admin"}, []string{PermissionAll}, true},
+		{[]interface{}{"key-admin", "crypto-user"}, []string{PermissionAll}, false},
+		{[]interface{}{}, []string{}, true},
+	}
+	for _, sample := range samples {
+		var allowed bool
+		app := rbacApp(jwt.MapClaims{"roles": sample.roles}, func(c *fiber.Ctx) (err error) {
+			allowed, err = tokenManager.HasPermissions(c, sample.permissions)
+			return err
+		})
+		_, err := app.Test(httptest.NewRequest("GET", "/", nil))
+		assert.NoError(t, err)
+		assert.Equal(t, sample.allowed, allowed, "%v holding %v", sample.roles, sample.permissions)
+	}
+}
@@ -0,0 +1,83 @@
+package service
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+
+	"github.com/hbahadorzadeh/key-master/util"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+// Sealer protects data keys with the server master key so key material never reaches Mongo in clear.
+// The master key is configured hex encoded since env and arg values are lower-cased and split on `=`.
+type Sealer struct {
+	masterKey []byte
+}
+
+func NewSealer(configs *util.Configs, logger *log.Logger) *Sealer {
+	masterKey, err := hex.DecodeString(configs.Vault.MasterKey)
+	if err != nil {
+		logger.Panicf("Error decoding master key: %s", err)
+	}
+	if len(masterKey) != 32 {
+		logger.Panicf("Master key must be 32 bytes, got `%d`", len(masterKey))
+	}
+	return &Sealer{
+		masterKey: masterKey,
+	}
+}
+
+func (s *Sealer) Seal(plaintext []byte) ([]byte, error) {
+	return Encrypt(s.masterKey, plaintext)
+}
+
+func (s *Sealer) Open(ciphertext []byte) ([]byte, error) {
+	return Decrypt(s.masterKey, ciphertext)
+}
+
+// NewDataKey returns a fresh 256 bit data key together with its sealed form.
+func (s *Sealer) NewDataKey() (key []byte, sealed []byte, err error) {
+	key = make([]byte, 32)
+	if _, err = io.ReadFull(rand.Reader, key); err != nil {
+		return nil, nil, err
+	}
+	sealed, err = s.Seal(key)
+	return key, sealed, err
+}
+
+// Encrypt encrypts plaintext with AES-GCM, prefixing the output with the random nonce.
+func Encrypt(key, plaintext []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func Decrypt(key, ciphertext []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("Ciphertext is too short")
+	}
+	nonce := ciphertext[:aead.NonceSize()]
+	return aead.Open(nil, nonce, ciphertext[aead.NonceSize():], nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,219 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	jwt "github.com/form3tech-oss/jwt-go"
+	redis "github.com/go-redis/redis/v8"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Session is a login on one device, it lives as long as its refresh token family.
+type Session struct {
+	ID          string    `json:"id"`
+	Email       string    `json:"email"`
+	Provider    string    `json:"provider"`
+	Device      string    `json:"device"`
+	IP          string    `json:"ip"`
+	IssuedAt    time.Time `json:"issued_at"`
+	RefreshedAt time.Time `json:"refreshed_at,omitempty"`
+	Current     bool      `json:"current"`
+}
+
+func (t *TokenManager) startSession(c *fiber.Ctx, id, email, provider string) error {
+	session := &Session{
+		ID:       id,
+		Email:    email,
+		Provider: provider,
+		Device:   c.Get(fiber.HeaderUserAgent),
+		IP:       c.IP(),
+		IssuedAt: time.Now(),
+	}
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	pipe := t.rdb.TxPipeline()
+	pipe.Set(ctx, sessionKey(id), data, refreshFamilyTTL)
+	pipe.SAdd(ctx, userSessionsKey(t.Subject(email)), id)
+	pipe.Expire(ctx, userSessionsKey(t.Subject(email)), refreshFamilyTTL)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func (t *TokenManager) touchSession(id string) {
+	data, err := t.rdb.Get(ctx, sessionKey(id)).Bytes()
+	if err != nil {
+		return
+	}
+	session := &Session{}
+	if err := json.Unmarshal(data, session); err != nil {
+		return
+	}
+	session.RefreshedAt = time.Now()
+	if data, err = json.Marshal(session); err == nil {
+		t.rdb.Set(ctx, sessionKey(id), data, redis.KeepTTL)
+	}
+}
+
+// GetSessions lists the active sessions of a user, current marks the one of the calling token.
+func (t *TokenManager) GetSessions(email, current string) ([]*Session, error) {
+	ids, err := t.rdb.SMembers(ctx, userSessionsKey(t.Subject(email))).Result()
+	if err != nil {
+		return nil, err
+	}
+	sessions := make([]*Session, 0, len(ids))
+	for _, id := range ids {
+		data, err := t.rdb.Get(ctx, sessionKey(id)).Bytes()
+		if err == redis.Nil {
+			t.rdb.SRem(ctx, userSessionsKey(t.Subject(email)), id)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		session := &Session{}
+		if err := json.Unmarshal(data, session); err != nil {
+			return nil, err
+		}
+		session.Current = id == current
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+// RevokeSession logs a single device out, its refresh tokens stop working and its access tokens are rejected.
+func (t *TokenManager) RevokeSession(email, id string) error {
+	pipe := t.rdb.TxPipeline()
+	pipe.Del(ctx, refreshFamilyKey(id), sessionKey(id))
+	pipe.SRem(ctx, userSessionsKey(t.Subject(email)), id)
+	pipe.Set(ctx, revokedSessionKey(id), 1, accessTokenTTL)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// RevokeUserSessions logs a user out everywhere, tokens issued up to now are rejected whether or not they belong to a session.
+func (t *TokenManager) RevokeUserSessions(email string) error {
+	ids, err := t.rdb.SMembers(ctx, userSessionsKey(t.Subject(email))).Result()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := t.RevokeSession(email, id); err != nil {
+			return err
+		}
+	}
+	return t.rdb.Set(ctx, revokedUserKey(t.Subject(email)), time.Now().UnixNano()/int64(time.Millisecond), accessTokenTTL).Err()
+}
+
+// RevokeToken rejects a single access token by its jti until it expires.
+func (t *TokenManager) RevokeToken(token *jwt.Token) error {
+	claims := token.Claims.(jwt.MapClaims)
+	jti, _ := claims["jti"].(string)
+	exp, _ := claims["exp"].(float64)
+	if jti == "" {
+		return nil
+	}
+	ttl := time.Until(time.Unix(int64(exp), 0))
+	if ttl <= 0 {
+		return nil
+	}
+	return t.rdb.Set(ctx, revokedTokenKey(jti), 1, ttl).Err()
+}
+
+// isRevoked checks the token, its session and the user wide cut off.
+func (t *TokenManager) isRevoked(claims jwt.MapClaims) (bool, error) {
+	jti, _ := claims["jti"].(string)
+	sid, _ := claims["sid"].(string)
+	email, _ := claims["email"].(string)
+	if email == "" {
+		// Service accounts have no email, their subject is cut off instead
+		email, _ = claims["sub"].(string)
+	}
+	iat, _ := claims["iat"].(float64)
+
+	keys := []string{revokedTokenKey(jti)}
+	if sid != "" {
+		keys = append(keys, revokedSessionKey(sid))
+	}
+	pipe := t.rdb.Pipeline()
+	exists := pipe.Exists(ctx, keys...)
+	cutOff := pipe.Get(ctx, revokedUserKey(t.Subject(email)))
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return false, err
+	}
+	if exists.Val() > 0 {
+		return true, nil
+	}
+	if revokedAt, err := cutOff.Int64(); err == nil && int64(math.Round(iat*1000)) <= revokedAt {
+		return true, nil
+	}
+	return false, nil
+}
+
+// issuedAt is the iat claim in milliseconds, a login right after the sessions of the user were revoked
+// is told apart from the tokens revoked in the same second.
+func issuedAt(now time.Time) float64 {
+	return float64(now.UnixNano()/int64(time.Millisecond)) / 1000
+}
+
+func sessionKey(id string) string {
+	return fmt.Sprintf("session:%s", id)
+}
+
+func userSessionsKey(email string) string {
+	return fmt.Sprintf("sessions:%s", email)
+}
+
+func revokedTokenKey(jti string) string {
+	return fmt.Sprintf("revoked:token:%s", jti)
+}
+
+func revokedSessionKey(id string) string {
+	return fmt.Sprintf("revoked:session:%s", id)
+}
+
+func revokedUserKey(email string) string {
+	return fmt.Sprintf("revoked:user:%s", email)
+}
+
+// Introspect validates a token the way GetMiddleWare and RefreshToken would and returns its claims when it is active.
+func (t *TokenManager) Introspect(token string) (jwt.MapClaims, bool) {
+	claims := jwt.MapClaims{}
+	if _, err := jwt.ParseWithClaims(token, claims, t.keyFunc); err != nil {
+		return nil, false
+	}
+	if pending, _ := claims["mfa_pending"].(bool); pending {
+		return nil, false
+	}
+	if typ, _ := claims["typ"].(string); typ == refreshTokenType {
+		sid, _ := claims["sid"].(string)
+		jti, _ := claims["jti"].(string)
+		current, err := t.rdb.Get(ctx, refreshFamilyKey(sid)).Result()
+		return claims, err == nil && current == jti
+	}
+	revoked, err := t.isRevoked(claims)
+	if err != nil {
+		t.logger.Error(err)
+		return nil, false
+	}
+	return claims, !revoked
+}
+
+// RevokeTokenValue revokes an access token alone, or the whole session of a refresh token.
+// Tokens which are invalid already are silently accepted, as RFC 7009 asks.
+func (t *TokenManager) RevokeTokenValue(token string) error {
+	parsed, err := jwt.ParseWithClaims(token, jwt.MapClaims{}, t.keyFunc)
+	if err != nil {
+		return nil
+	}
+	claims := parsed.Claims.(jwt.MapClaims)
+	if typ, _ := claims["typ"].(string); typ == refreshTokenType {
+		sid, _ := claims["sid"].(string)
+		email, _ := claims["email"].(string)
+		return t.RevokeSession(email, sid)
+	}
+	return t.RevokeToken(parsed)
+}
@@ -0,0 +1,18 @@
+package service
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIssuedAtKeepsMilliseconds(t *testing.T) {
+	revokedAt := time.Unix(1700000000, int64(400*time.Millisecond))
+	before, after := revokedAt.Add(-300*time.Millisecond), revokedAt.Add(300*time.Millisecond)
+	cutOff := revokedAt.UnixNano() / int64(time.Millisecond)
+	assert.LessOrEqual(t, int64(math.Round(issuedAt(before)*1000)), cutOff)
+	assert.Greater(t, int64(math.Round(issuedAt(after)*1000)), cutOff)
+	assert.Equal(t, before.Unix(), int64(issuedAt(before)))
+}
@@ -0,0 +1,323 @@
+package service
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"sort"
+	"sync"
+	"time"
+
+	jwt "github.com/form3tech-oss/jwt-go"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+// JwtSigningKey is a generated token signing key, the private part is sealed with the master key.
+type JwtSigningKey struct {
+	BasicData
+	KeyID         string             `json:"kid" bson:"kid"`
+	Algorithm     string             `json:"algorithm" bson:"algorithm"`
+	SealedPrivate []byte             `json:"-" bson:"sealed_private"`
+	RetireAt      primitive.DateTime `json:"retire_at" bson:"retire_at"`
+}
+
+type signingKey struct {
+	kid       string
+	method    jwt.SigningMethod
+	private   crypto.Signer
+	public    crypto.PublicKey
+	createdAt time.Time
+	retireAt  time.Time
+}
+
+// keyRing holds the keys tokens are signed with, the newest one signs and every non retired one verifies.
+type keyRing struct {
+	mu   sync.RWMutex
+	keys []*signingKey
+}
+
+func (r *keyRing) current() *signingKey {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.keys) == 0 {
+		return nil
+	}
+	return r.keys[len(r.keys)-1]
+}
+
+func (r *keyRing) get(kid string) *signingKey {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	now := time.Now()
+	for _, key := range r.keys {
+		if key.kid == kid && (key.retireAt.IsZero() || key.retireAt.After(now)) {
+			return key
+		}
+	}
+	return nil
+}
+
+func (r *keyRing) set(keys []*signingKey) {
+	sort.SliceStable(keys, func(i, j int) bool {
+		return keys[i].createdAt.Before(keys[j].createdAt)
+	})
+	r.mu.Lock()
+	r.keys = keys
+	r.mu.Unlock()
+}
+
+func (r *keyRing) all() []*signingKey {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]*signingKey{}, r.keys...)
+}
+
+var signingMethods = map[string]jwt.SigningMethod{
+	"RS256": jwt.SigningMethodRS256,
+	"RS384": jwt.SigningMethodRS384,
+	"RS512": jwt.SigningMethodRS512,
+	"PS256": jwt.SigningMethodPS256,
+	"PS384": jwt.SigningMethodPS384,
+	"PS512": jwt.SigningMethodPS512,
+	"ES256": jwt.SigningMethodES256,
+	"ES384": jwt.SigningMethodES384,
+	"ES512": jwt.SigningMethodES512,
+	"EDDSA": SigningMethodEd25519,
+}
+
+var methodCurves = map[string]elliptic.Curve{
+	"ES256": elliptic.P256(),
+	"ES384": elliptic.P384(),
+	"ES512": elliptic.P521(),
+}
+
+// generateSigningKey creates a key suited to the algorithm.
+func generateSigningKey(alg string) (crypto.Signer, error) {
+	switch alg[:2] {
+	case "RS", "PS":
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case "ES":
+		return ecdsa.GenerateKey(methodCurves[alg], rand.Reader)
+	case "ED":
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		return private, err
+	}
+	return nil, errors.Newf("Algorithm `%s` not supported", alg)
+}
+
+// checkKeyType makes sure a configured key can actually produce signatures of the algorithm.
+func checkKeyType(alg string, key crypto.Signer) error {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if alg[:2] == "RS" || alg[:2] == "PS" {
+			return nil
+		}
+	case *ecdsa.PrivateKey:
+		if curve, ok := methodCurves[alg]; ok && curve == k.Curve {
+			return nil
+		}
+	case ed25519.PrivateKey:
+		if alg == "EDDSA" {
+			return nil
+		}
+	}
+	return errors.Newf("Signing key does not match algorithm `%s`", alg)
+}
+
+// parseSigningKey reads a PEM encoded PKCS#1, SEC 1 or PKCS#8 private key, optionally encrypted with password.
+func parseSigningKey(data []byte, password string) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("No PEM block found")
+	}
+	der := block.Bytes
+	if x509.IsEncryptedPEMBlock(block) {
+		var err error
+		if der, err = x509.DecryptPEMBlock(block, []byte(password)); err != nil {
+			return nil, err
+		}
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("Key type not supported")
+	}
+	return signer, nil
+}
+
+func (t *TokenManager) newSigningKey(private crypto.Signer, createdAt, retireAt time.Time) (*signingKey, error) {
+	jwk, err := NewJSONWebKey(private.Public(), t.signingMethod.Alg())
+	if err != nil {
+		return nil, err
+	}
+	return &signingKey{
+		kid:       jwk.Kid,
+		method:    t.signingMethod,
+		private:   private,
+		public:    private.Public(),
+		createdAt: createdAt,
+		retireAt:  retireAt,
+	}, nil
+}
+
+// loadSigningKeys rebuilds the key ring from the configured key and the generated keys other instances may have added.
+func (t *TokenManager) loadSigningKeys() error {
+	keys := make([]*signingKey, 0)
+	if t.configuredKey != nil {
+		keys = append(keys, t.configuredKey)
+	}
+	records := make([]JwtSigningKey, 0)
+	if err := t.mdb.SelectAll(&records, bson.M{"algorithm": t.signingMethod.Alg(), "retire_at": bson.M{"$gt": primitive.NewDateTimeFromTime(time.Now())}}); err != nil {
+		return err
+	}
+	for _, record := range records {
+		der, err := t.sealer.Open(record.SealedPrivate)
+		if err != nil {
+			return err
+		}
+		private, err := x509.ParsePKCS8PrivateKey(der)
+		if err != nil {
+			return err
+		}
+		key, err := t.newSigningKey(private.(crypto.Signer), record.CreatedAt.Time(), record.RetireAt.Time())
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+	t.keys.set(keys)
+	return nil
+}
+
+// rotateSigningKey generates a new signing key once the current one is older than the rotation period.
+// Keys stay valid for verification for the period plus the overlap, so tokens signed right before a rotation
+// keep working until they expire.
+func (t *TokenManager) rotateSigningKey() error {
+	current := t.keys.current()
+	if current != nil && time.Since(current.createdAt) < t.rotationPeriod {
+		return nil
+	}
+	private, err := generateSigningKey(t.signingMethodStr)
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return err
+	}
+	sealed, err := t.sealer.Seal(der)
+	if err != nil {
+		return err
+	}
+	key, err := t.newSigningKey(private, time.Now(), time.Now().Add(t.rotationPeriod+signingKeyOverlap))
+	if err != nil {
+		return err
+	}
+	record := &JwtSigningKey{
+		KeyID:         key.kid,
+		Algorithm:     t.signingMethod.Alg(),
+		SealedPrivate: sealed,
+		RetireAt:      primitive.NewDateTimeFromTime(key.retireAt),
+	}
+	if err := t.mdb.Create(record); err != nil {
+		return err
+	}
+	t.logger.Infof("Token signing key `%s` generated", key.kid)
+	return t.loadSigningKeys()
+}
+
+// RotateSigningKeys keeps the key ring in sync with the database and rotates keys until ctx is done.
+func (t *TokenManager) RotateSigningKeys(ctx context.Context) {
+	if t.rotationPeriod == 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		if err := t.loadSigningKeys(); err != nil {
+			t.logger.Errorf("Loading signing keys failed: %v", err)
+		} else if err := t.rotateSigningKey(); err != nil {
+			t.logger.Errorf("Rotating signing key failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// GetJWKS publishes the public part of every key tokens may currently be verified with.
+func (t *TokenManager) GetJWKS() (*JSONWebKeySet, error) {
+	set := &JSONWebKeySet{Keys: []JSONWebKey{}}
+	now := time.Now()
+	for _, key := range t.keys.all() {
+		if !key.retireAt.IsZero() && key.retireAt.Before(now) {
+			continue
+		}
+		jwk, err := NewJSONWebKey(key.public, key.method.Alg())
+		if err != nil {
+			return nil, err
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set, nil
+}
+
+// sign signs claims with the current key and names it in the kid header.
+func (t *TokenManager) sign(claims jwt.MapClaims) (string, error) {
+	key := t.keys.current()
+	if t.rotationPeriod == 0 {
+		// Keys generated while rotation was enabled only remain for verification
+		key = t.configuredKey
+	}
+	if key == nil {
+		return "", errors.New("No signing key available")
+	}
+	if t.mdb.namespace != "" {
+		claims[namespaceClaim] = t.mdb.namespace
+	}
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.kid
+	return token.SignedString(key.private)
+}
+
+func (t *TokenManager) keyFunc(token *jwt.Token) (interface{}, error) {
+	if claims, ok := token.Claims.(jwt.MapClaims); ok {
+		// Namespaces may share a configured signing key, their tokens must not be
+		if namespace, _ := claims[namespaceClaim].(string); namespace != t.mdb.namespace {
+			return nil, errors.New("Token was issued for another namespace")
+		}
+	}
+	var key *signingKey
+	if kid, ok := token.Header["kid"].(string); ok {
+		key = t.keys.get(kid)
+	} else {
+		// Tokens issued before kid headers were added
+		key = t.configuredKey
+	}
+	if key == nil {
+		return nil, errors.Newf("Unknown key id `%v`", token.Header["kid"])
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, errors.Newf("Unexpected signing method `%s`", token.Method.Alg())
+	}
+	return key.public, nil
+}
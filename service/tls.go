@@ -0,0 +1,79 @@
+package service
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+
+	jwt "github.com/form3tech-oss/jwt-go"
+	"github.com/gofiber/fiber/v2"
+	"github.com/hbahadorzadeh/key-master/util"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+// ClientCertAuthenticator maps a verified client certificate to the claims of the user or service account it identifies.
+type ClientCertAuthenticator func(cert *x509.Certificate) (jwt.MapClaims, error)
+
+// NewTLSConfig builds the server side TLS settings. Client certificates are optional so bearer tokens keep working,
+// but any certificate presented has to chain up to one of the configured CA bundles.
+func NewTLSConfig(configs *util.Configs) (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(configs.Web.TLS.CertFile, configs.Web.TLS.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if len(configs.Web.TLS.ClientCAFiles) == 0 {
+		return tlsConfig, nil
+	}
+	pool := x509.NewCertPool()
+	for _, file := range configs.Web.TLS.ClientCAFiles {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.Newf("No certificate found in CA bundle `%s`", file)
+		}
+	}
+	tlsConfig.ClientCAs = pool
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	return tlsConfig, nil
+}
+
+// PeerCertificate returns the verified client certificate of the request, if there is one.
+func PeerCertificate(c *fiber.Ctx) *x509.Certificate {
+	state := c.Context().TLSConnectionState()
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
+
+// CertThumbprint is the RFC 8705 `x5t#S256` confirmation of a certificate.
+func CertThumbprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// PemThumbprints parses PEM encoded certificates into their thumbprints, see CertThumbprint.
+func PemThumbprints(certificates []string) ([]string, error) {
+	thumbprints := make([]string, 0, len(certificates))
+	for _, data := range certificates {
+		block, _ := pem.Decode([]byte(data))
+		if block == nil || block.Type != "CERTIFICATE" {
+			return nil, errors.New("Certificates have to be PEM encoded")
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		thumbprints = append(thumbprints, CertThumbprint(cert))
+	}
+	return thumbprints, nil
+}
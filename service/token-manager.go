@@ -2,132 +2,446 @@ package service
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
 	"strings"
 	"time"
 
 	jwt "github.com/form3tech-oss/jwt-go"
 	redis "github.com/go-redis/redis/v8"
 	"github.com/gofiber/fiber/v2"
-	jwtware "github.com/gofiber/jwt/v2"
 	"github.com/hbahadorzadeh/key-master/util"
 	"github.com/markbates/goth"
 	log "github.com/sirupsen/logrus"
+	"gopkg.in/errgo.v2/fmt/errors"
 )
 
 var ctx = context.Background()
 
+const (
+	accessTokenTTL   = 15 * time.Minute
+	refreshTokenTTL  = 24 * time.Hour
+	refreshFamilyTTL = 30 * 24 * time.Hour
+	refreshTokenType = "refresh"
+)
+
+var ErrRefreshTokenReuse = errors.New("Refresh token was already used, all tokens of its session are revoked")
+
+// signingKeyOverlap keeps a rotated key verifiable at least as long as the tokens it signed live.
+const signingKeyOverlap = refreshTokenTTL
+
 type TokenManager struct {
 	logger           *log.Logger
 	signingMethod    jwt.SigningMethod
 	signingMethodStr string
-	signingKey       interface{}
+	configuredKey    *signingKey
+	keys             *keyRing
+	rotationPeriod   time.Duration
 	rdb              *redis.Client
+	mdb              *MongoDB
+	sealer           *Sealer
+	publicPaths      []string
+	mfaPaths         []string
+	apiKeyAuth       ApiKeyAuthenticator
+	clientCertAuth   ClientCertAuthenticator
+	authorizer       Authorizer
 }
 
-func NewTokenManager(configs *util.Configs, rdb *redis.Client, logger *log.Logger) *TokenManager {
+// ApiKeyAuthenticator resolves an API key presented instead of a JWT into the claims a token would carry.
+type ApiKeyAuthenticator func(key string) (jwt.MapClaims, error)
+
+func NewTokenManager(configs *util.Configs, rdb *redis.Client, mdb *MongoDB, sealer *Sealer, logger *log.Logger) *TokenManager {
+	tokenManager, err := CreateTokenManager(configs, rdb, mdb, sealer, logger)
+	if err != nil {
+		logger.Panic(err)
+	}
+	return tokenManager
+}
+
+// CreateTokenManager is NewTokenManager for callers which outlive a misconfiguration, e.g. namespaces built
+// while serving requests.
+func CreateTokenManager(configs *util.Configs, rdb *redis.Client, mdb *MongoDB, sealer *Sealer, logger *log.Logger) (*TokenManager, error) {
 	tokenManager := &TokenManager{
 		logger:           logger,
 		rdb:              rdb,
+		mdb:              mdb,
+		sealer:           sealer,
+		keys:             &keyRing{},
 		signingMethodStr: strings.ToUpper(configs.Web.JwtConfigs.SigningMethod),
 	}
-	switch tokenManager.signingMethodStr {
-	case "ES256":
-		tokenManager.signingMethod = jwt.SigningMethodES256
-	case "ES384":
-		tokenManager.signingMethod = jwt.SigningMethodES384
-	case "ES512":
-		tokenManager.signingMethod = jwt.SigningMethodES512
-	case "HS256":
-		tokenManager.signingMethod = jwt.SigningMethodHS256
-	case "HS384":
-		tokenManager.signingMethod = jwt.SigningMethodHS384
-	case "HS512":
-		tokenManager.signingMethod = jwt.SigningMethodHS512
-	case "RS256":
-		tokenManager.signingMethod = jwt.SigningMethodRS256
-	case "RS384":
-		tokenManager.signingMethod = jwt.SigningMethodRS384
-	case "RS512":
-		tokenManager.signingMethod = jwt.SigningMethodRS512
-	case "PS256":
-		tokenManager.signingMethod = jwt.SigningMethodPS256
-	case "PS384":
-		tokenManager.signingMethod = jwt.SigningMethodPS384
-	case "PS512":
-		tokenManager.signingMethod = jwt.SigningMethodPS512
-	}
-
-	//logger.Infof("Token Key: `%s`", configs.Web.JwtConfigs.SigningKey)
-	//if _, err := os.Stat(configs.Web.JwtConfigs.SigningKey); errors.Is(err, os.ErrNotExist) {
-	//	pwd, _ := os.Getwd()
-	//	logger.Panicf("File not exists!Path: `%s`, PWD: `%s`", configs.Web.JwtConfigs.SigningKey, pwd)
-	//}
-	//data, err := ioutil.ReadFile(configs.Web.JwtConfigs.SigningKey)
-	//if (err!= nil){
-	//	logger.Panicf("Error reading pem file: %s", err)
-	//}
-	private, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(configs.Web.JwtConfigs.SigningKey))
-	if err != nil {
-		logger.Panicf("Error parsing pem file: %s", err)
+	if tokenManager.signingMethodStr == "" {
+		tokenManager.signingMethodStr = "RS256"
+	}
+	method, ok := signingMethods[tokenManager.signingMethodStr]
+	if !ok {
+		return nil, errors.Newf("Signing method `%s` is not supported, use an asymmetric algorithm so tokens can be verified through the JWKS", tokenManager.signingMethodStr)
 	}
-	tokenManager.signingKey = private
+	tokenManager.signingMethod = method
 
-	return tokenManager
+	if period := configs.Web.JwtConfigs.RotationPeriod; period != "" {
+		rotationPeriod, err := time.ParseDuration(period)
+		if err != nil {
+			return nil, errors.Newf("Invalid signing key rotation period: %s", err)
+		}
+		tokenManager.rotationPeriod = rotationPeriod
+	}
+
+	if configs.Web.JwtConfigs.SigningKey != "" {
+		private, err := parseSigningKey([]byte(configs.Web.JwtConfigs.SigningKey), configs.Web.JwtConfigs.SigningKeyPW)
+		if err != nil {
+			return nil, errors.Newf("Error parsing pem file: %s", err)
+		}
+		if err := checkKeyType(tokenManager.signingMethodStr, private); err != nil {
+			return nil, err
+		}
+		if tokenManager.configuredKey, err = tokenManager.newSigningKey(private, time.Time{}, time.Time{}); err != nil {
+			return nil, err
+		}
+	} else if tokenManager.rotationPeriod == 0 {
+		return nil, errors.New("Either a signing key or a key rotation period has to be configured")
+	}
+	if err := tokenManager.loadSigningKeys(); err != nil {
+		return nil, errors.Newf("Loading signing keys failed: %s", err)
+	}
+	if tokenManager.rotationPeriod > 0 {
+		if err := tokenManager.rotateSigningKey(); err != nil {
+			return nil, errors.Newf("Generating signing key failed: %s", err)
+		}
+	}
+
+	return tokenManager, nil
 }
 
 func (t *TokenManager) CheckRevokedTokens(c *fiber.Ctx) error {
 	user := c.Locals("user").(*jwt.Token)
 
 	claims := user.Claims.(jwt.MapClaims)
-	_, err := t.rdb.Get(ctx, claims["email"].(string)).Result()
-	if err == redis.Nil {
-		return c.Next()
-	} else if err != nil {
+	if pending, _ := claims["mfa_pending"].(bool); pending && !t.isMfaPath(c) {
+		return c.Status(401).SendString("Second factor required")
+	}
+	if typ, _ := claims["typ"].(string); typ == refreshTokenType {
+		return c.Status(401).SendString("Refresh tokens are only accepted by /auth/refresh")
+	}
+	if cnf, ok := claims["cnf"].(map[string]interface{}); ok {
+		cert := PeerCertificate(c)
+		if cert == nil || cnf["x5t#S256"] != CertThumbprint(cert) {
+			return c.Status(401).SendString("Token is bound to a client certificate which was not presented")
+		}
+	}
+	revoked, err := t.isRevoked(claims)
+	if err != nil {
 		t.logger.Error(err)
+		return c.Status(503).SendString("Token revocation state is unavailable")
+	}
+	if revoked {
+		return c.Status(401).SendString("Token is revoked")
 	}
-	user.Valid = false
-	c.Locals("user", user)
 	return c.Next()
 }
 
-func (t *TokenManager) InvokeToken(user goth.User, provider string) (string, error) {
-	token := jwt.New(jwt.SigningMethodRS256)
+// InvokeToken issues an access token, amr lists the factors passed on top of the login provider.
+func (t *TokenManager) InvokeToken(user goth.User, provider string, amr ...string) (string, error) {
+	return t.invokeAccessToken(user, provider, "", amr)
+}
+
+func (t *TokenManager) invokeAccessToken(user goth.User, provider, family string, amr []string) (string, error) {
+	jti, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
 	// Set claims
-	claims := token.Claims.(jwt.MapClaims)
+	claims := t.UserClaims(user, provider, amr...)
+	claims["jti"] = jti
+	claims["iat"] = issuedAt(time.Now())
+	if family != "" {
+		claims["sid"] = family
+	}
+	claims["exp"] = time.Now().Add(accessTokenTTL).Unix()
+	if err := t.resolveRoles(claims); err != nil {
+		return "", err
+	}
+	return t.sign(claims)
+}
+
+// UserClaims are the identity claims of a user, shared by access tokens and requests authenticated otherwise.
+func (t *TokenManager) UserClaims(user goth.User, provider string, amr ...string) jwt.MapClaims {
+	return jwt.MapClaims{
+		"sub":      user.Email,
+		"name":     user.Name,
+		"email":    user.Email,
+		"provider": provider,
+		"amr":      append([]string{provider}, amr...),
+		"mfa":      len(amr) > 0,
+	}
+}
+
+// ServiceClaims are the identity claims of a service account.
+func (t *TokenManager) ServiceClaims(subject, name, provider string, scopes []string) jwt.MapClaims {
+	return jwt.MapClaims{
+		"sub":             subject,
+		"service_account": name,
+		"scope":           strings.Join(scopes, " "),
+		"provider":        provider,
+	}
+}
+
+// InvokeServiceToken issues an access token to a service account through the client_credentials grant.
+// A client certificate binds the token to it as RFC 8705 describes.
+func (t *TokenManager) InvokeServiceToken(subject, name string, scopes []string, cert *x509.Certificate) (string, error) {
+	jti, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+	claims := t.ServiceClaims(subject, name, "client_credentials", scopes)
+	claims["jti"] = jti
+	claims["iat"] = issuedAt(time.Now())
+	claims["exp"] = time.Now().Add(accessTokenTTL).Unix()
+	if cert != nil {
+		claims["cnf"] = map[string]string{"x5t#S256": CertThumbprint(cert)}
+	}
+	if err := t.resolveRoles(claims); err != nil {
+		return "", err
+	}
+	return t.sign(claims)
+}
+
+// AccessTokenTTL is the lifetime of access tokens, as reported in expires_in.
+func (t *TokenManager) AccessTokenTTL() time.Duration {
+	return accessTokenTTL
+}
+
+// SetApiKeyAuthenticator lets GetMiddleWare accept API keys carrying the `km_` prefix in place of a JWT.
+func (t *TokenManager) SetApiKeyAuthenticator(authenticator ApiKeyAuthenticator) {
+	t.apiKeyAuth = authenticator
+}
+
+// SetClientCertAuthenticator lets GetMiddleWare accept verified TLS client certificates on requests without a token.
+func (t *TokenManager) SetClientCertAuthenticator(authenticator ClientCertAuthenticator) {
+	t.clientCertAuth = authenticator
+}
+
+// InvokeMfaToken issues a short lived token which is only accepted on second factor paths.
+func (t *TokenManager) InvokeMfaToken(user goth.User, provider string) (string, error) {
+	return t.sign(t.MfaClaims(user, provider))
+}
+
+// MfaClaims are the claims of a login waiting for its second factor, see InvokeMfaToken.
+func (t *TokenManager) MfaClaims(user goth.User, provider string) jwt.MapClaims {
+	claims := jwt.MapClaims{}
 	claims["name"] = user.Name
 	claims["email"] = user.Email
-	claims["admin"] = true
-	claims["exp"] = time.Now().Add(time.Minute * 15).Unix()
-	return token.SignedString(t.signingKey)
+	claims["provider"] = provider
+	claims["mfa_pending"] = true
+	claims["exp"] = time.Now().Add(time.Minute * 5).Unix()
+	return claims
+}
+
+// InvokeTokens completes a login with an access token and the first refresh token of a new token family,
+// the family id doubles as the id of the session recorded for the requesting device.
+func (t *TokenManager) InvokeTokens(c *fiber.Ctx, user goth.User, provider string, amr ...string) (token, refreshToken string, err error) {
+	family, err := newTokenID()
+	if err != nil {
+		return "", "", err
+	}
+	jti, err := newTokenID()
+	if err != nil {
+		return "", "", err
+	}
+	if err := t.rdb.Set(ctx, refreshFamilyKey(family), jti, refreshFamilyTTL).Err(); err != nil {
+		return "", "", err
+	}
+	if err := t.startSession(c, family, user.Email, provider); err != nil {
+		return "", "", err
+	}
+	if token, err = t.invokeAccessToken(user, provider, family, amr); err != nil {
+		return "", "", err
+	}
+	refreshToken, err = t.invokeRefreshToken(user, provider, family, jti, amr)
+	return token, refreshToken, err
 }
-func (t *TokenManager) InvokeRefreshToken(user goth.User) (string, error) {
-	token := jwt.New(jwt.SigningMethodRS256)
+
+func (t *TokenManager) invokeRefreshToken(user goth.User, provider, family, jti string, amr []string) (string, error) {
 	// Set claims
-	claims := token.Claims.(jwt.MapClaims)
+	claims := jwt.MapClaims{}
+	claims["typ"] = refreshTokenType
+	claims["jti"] = jti
+	claims["sid"] = family
+	claims["name"] = user.Name
 	claims["email"] = user.Email
-	claims["exp"] = time.Now().Add(time.Hour * 4).Unix()
-	return token.SignedString(t.signingKey)
+	claims["provider"] = provider
+	claims["amr"] = amr
+	claims["exp"] = time.Now().Add(refreshTokenTTL).Unix()
+	return t.sign(claims)
+}
+
+// refreshRotateScript moves a family to its next refresh token id if the presented one is current,
+// and drops the family when an already rotated id comes back.
+var refreshRotateScript = redis.NewScript(`
+local current = redis.call('GET', KEYS[1])
+if not current then
+	return 0
+end
+if current ~= ARGV[1] then
+	redis.call('DEL', KEYS[1])
+	return -1
+end
+redis.call('SET', KEYS[1], ARGV[2], 'PX', redis.call('PTTL', KEYS[1]))
+return 1
+`)
+
+// RefreshToken exchanges a refresh token for a new access token and the next refresh token of its family.
+// Presenting a refresh token a second time revokes the whole family.
+func (t *TokenManager) RefreshToken(refreshToken string) (token, nextRefreshToken string, err error) {
+	claims := jwt.MapClaims{}
+	if _, err := jwt.ParseWithClaims(refreshToken, claims, t.keyFunc); err != nil {
+		return "", "", err
+	}
+	if typ, _ := claims["typ"].(string); typ != refreshTokenType {
+		return "", "", errors.New("Not a refresh token")
+	}
+	family, _ := claims["sid"].(string)
+	jti, _ := claims["jti"].(string)
+	if family == "" || jti == "" {
+		return "", "", errors.New("Refresh token lacks a family")
+	}
+	next, err := newTokenID()
+	if err != nil {
+		return "", "", err
+	}
+	res, err := refreshRotateScript.Run(ctx, t.rdb, []string{refreshFamilyKey(family)}, jti, next).Int()
+	if err != nil {
+		return "", "", err
+	}
+	switch res {
+	case 0:
+		return "", "", errors.New("Refresh token is revoked or expired")
+	case -1:
+		t.logger.Warnf("Refresh token reuse detected for `%v`, family `%s` revoked", claims["email"], family)
+		email, _ := claims["email"].(string)
+		if err := t.RevokeSession(email, family); err != nil {
+			t.logger.Error(err)
+		}
+		return "", "", ErrRefreshTokenReuse
+	}
+
+	t.touchSession(family)
+
+	user := goth.User{}
+	user.Name, _ = claims["name"].(string)
+	user.Email, _ = claims["email"].(string)
+	provider, _ := claims["provider"].(string)
+	amr := make([]string, 0)
+	if values, ok := claims["amr"].([]interface{}); ok {
+		for _, v := range values {
+			if s, ok := v.(string); ok {
+				amr = append(amr, s)
+			}
+		}
+	}
+	if token, err = t.invokeAccessToken(user, provider, family, amr); err != nil {
+		return "", "", err
+	}
+	nextRefreshToken, err = t.invokeRefreshToken(user, provider, family, next, amr)
+	return token, nextRefreshToken, err
+}
+
+func refreshFamilyKey(family string) string {
+	return fmt.Sprintf("refresh:family:%s", family)
+}
+
+func newTokenID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// AddPublicPath lets requests under prefix through GetMiddleWare without a token.
+func (t *TokenManager) AddPublicPath(prefix string) {
+	t.publicPaths = append(t.publicPaths, prefix)
 }
 
-func (t *TokenManager) RefreshToken(token jwt.Token, refreshToken jwt.Token) (string, error) {
-	claims := token.Claims.(jwt.MapClaims)
-	refreshClaims := refreshToken.Claims.(jwt.MapClaims)
-	if time.Unix(claims["exp"].(int64), 0).Before(time.Now()) && time.Unix(refreshClaims["exp"].(int64), 0).Before(time.Now()) {
+func (t *TokenManager) isPublicPath(c *fiber.Ctx) bool {
+	for _, prefix := range t.publicPaths {
+		if strings.HasPrefix(c.Path(), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// AddMfaPath accepts tokens from InvokeMfaToken on requests under prefix.
+func (t *TokenManager) AddMfaPath(prefix string) {
+	t.mfaPaths = append(t.mfaPaths, prefix)
+}
+
+func (t *TokenManager) isMfaPath(c *fiber.Ctx) bool {
+	for _, prefix := range t.mfaPaths {
+		if strings.HasPrefix(c.Path(), prefix) {
+			return true
+		}
+	}
+	return false
+}
 
+// GetClaims returns the claims of the token validated by GetMiddleWare.
+func (t *TokenManager) GetClaims(c *fiber.Ctx) jwt.MapClaims {
+	user, ok := c.Locals("user").(*jwt.Token)
+	if !ok {
+		return jwt.MapClaims{}
 	}
-	//claims["email"] = user.Email
-	claims["exp"] = time.Now().Add(time.Hour * 4).Unix()
-	return token.SignedString(t.signingKey)
+	return user.Claims.(jwt.MapClaims)
+}
+
+// GetEmail returns the email claim of the validated token or an empty string.
+func (t *TokenManager) GetEmail(c *fiber.Ctx) string {
+	email, _ := t.GetClaims(c)["email"].(string)
+	return email
 }
-func (t *TokenManager) RevokeToken(token jwt.Token) error {
-	claims := token.Claims.(jwt.MapClaims)
-	timeDiff := time.Unix(claims["exp"].(int64), 0).Sub(time.Now())
-	return t.rdb.Set(ctx, claims["email"].(string), 0, timeDiff).Err()
+
+// GetServiceAccount returns the service account the validated token was issued to or an empty string.
+func (t *TokenManager) GetServiceAccount(c *fiber.Ctx) string {
+	name, _ := t.GetClaims(c)["service_account"].(string)
+	return name
 }
+
+// GetMiddleWare validates the bearer token of every non public request against the key ring.
 func (t *TokenManager) GetMiddleWare() fiber.Handler {
-	return jwtware.New(jwtware.Config{
-		SigningKey:     t.signingKey,
-		SigningMethod:  t.signingMethodStr,
-		SuccessHandler: t.CheckRevokedTokens,
-	})
+	return func(c *fiber.Ctx) error {
+		if t.isPublicPath(c) {
+			return c.Next()
+		}
+		auth := c.Get(fiber.HeaderAuthorization)
+		if cert := PeerCertificate(c); auth == "" && cert != nil && t.clientCertAuth != nil {
+			claims, err := t.clientCertAuth(cert)
+			if err != nil {
+				return c.Status(fiber.StatusUnauthorized).SendString(err.Error())
+			}
+			if pending, _ := claims["mfa_pending"].(bool); pending && !t.isMfaPath(c) {
+				return c.Status(fiber.StatusUnauthorized).SendString("Second factor required")
+			}
+			c.Locals("user", &jwt.Token{Claims: claims, Valid: true})
+			return c.Next()
+		}
+		if len(auth) <= len("Bearer ") || !strings.EqualFold(auth[:len("Bearer ")], "Bearer ") {
+			return c.Status(fiber.StatusBadRequest).SendString("Missing or malformed JWT")
+		}
+		if strings.HasPrefix(auth[len("Bearer "):], "km_") && t.apiKeyAuth != nil {
+			claims, err := t.apiKeyAuth(auth[len("Bearer "):])
+			if err != nil {
+				return c.Status(fiber.StatusUnauthorized).SendString(err.Error())
+			}
+			c.Locals("user", &jwt.Token{Claims: claims, Valid: true})
+			return c.Next()
+		}
+		token, err := jwt.Parse(auth[len("Bearer "):], t.keyFunc)
+		if err != nil || !token.Valid {
+			return c.Status(fiber.StatusUnauthorized).SendString("Invalid or expired JWT")
+		}
+		c.Locals("user", token)
+		return t.CheckRevokedTokens(c)
+	}
 }
@@ -1,8 +1,50 @@
 package service
 
-import "github.com/go-playground/validator/v10"
+import (
+	"reflect"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// FieldError is a validation failure as reported to API clients.
+type FieldError struct {
+	Field   string `json:"field"`
+	Tag     string `json:"tag"`
+	Param   string `json:"param,omitempty"`
+	Message string `json:"message"`
+}
 
 func NewValidate() *validator.Validate {
 	validate := validator.New()
+	// Report fields by the names clients send them with
+	validate.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+		if name == "-" {
+			return ""
+		}
+		if name == "" {
+			return field.Name
+		}
+		return name
+	})
 	return validate
 }
+
+// ValidationErrors breaks the error of validate.Struct down per field, ok is false for other errors.
+func ValidationErrors(err error) (errs []FieldError, ok bool) {
+	failures, ok := err.(validator.ValidationErrors)
+	if !ok {
+		return nil, false
+	}
+	errs = make([]FieldError, 0, len(failures))
+	for _, failure := range failures {
+		errs = append(errs, FieldError{
+			Field:   failure.Field(),
+			Tag:     failure.Tag(),
+			Param:   failure.Param(),
+			Message: failure.Error(),
+		})
+	}
+	return errs, true
+}
@@ -0,0 +1,27 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidationErrors(t *testing.T) {
+	req := struct {
+		Email    string `json:"email" validate:"required,email"`
+		Password string `json:"password,omitempty" validate:"omitempty,min=12"`
+		IsRemote bool   `json:"is_remote"`
+	}{Email: "not-an-address", Password: "short"}
+
+	errs, ok := ValidationErrors(NewValidate().Struct(req))
+	assert.True(t, ok)
+	assert.Len(t, errs, 2)
+	assert.Equal(t, "email", errs[0].Field)
+	assert.Equal(t, "email", errs[0].Tag)
+	assert.Equal(t, "password", errs[1].Field)
+	assert.Equal(t, "min", errs[1].Tag)
+	assert.Equal(t, "12", errs[1].Param)
+
+	_, ok = ValidationErrors(assert.AnError)
+	assert.False(t, ok)
+}
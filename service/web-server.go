@@ -14,7 +14,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-func NewWebserver(defaultLogger *log.Logger, tokenManager *TokenManager) *fiber.App {
+func NewWebserver(defaultLogger *log.Logger, tokenManager *TokenManager, audit *AuditLog, namespaces *NamespaceRouter) *fiber.App {
 	app := fiber.New()
 	metrics := NewMetricService("fiber", "http", "/metrics")
 	metrics.Register(app)
@@ -23,11 +23,22 @@ func NewWebserver(defaultLogger *log.Logger, tokenManager *TokenManager) *fiber.
 		Output: defaultLogger.Writer(),
 	}))
 
+	app.Use(namespaces.Dispatch())
 	app.Use(tokenManager.GetMiddleWare())
+	app.Use(audit.BreakGlassTrail(tokenManager))
 
 	return app
 }
 
+// NewNamespaceWebserver serves the routes of a namespace, its requests come through NamespaceRouter.Dispatch
+// of the main server which already logged and measured them.
+func NewNamespaceWebserver(tokenManager *TokenManager, audit *AuditLog) *fiber.App {
+	app := fiber.New()
+	app.Use(tokenManager.GetMiddleWare())
+	app.Use(audit.BreakGlassTrail(tokenManager))
+	return app
+}
+
 type MetricService struct {
 	Namespace   string
 	Subsystem   string
@@ -21,6 +21,10 @@ func NewConfigs(logger *log.Logger) *Configs {
 		Web:            &WebConfigs{},
 		Mail:           &MailConfigs{},
 		Redis:          &RedisConfigs{},
+		Vault:          &VaultConfigs{},
+		Ldap:           &LdapConfigs{},
+		Approval:       &ApprovalConfigs{Quorum: 2, Window: "24h"},
+		BreakGlass:     &BreakGlassConfigs{Window: "1h", Roles: []string{"admin"}},
 	}
 	configs.ParseConfigFile(logger)
 	configs.ParseEnvs(logger, os.Environ())
@@ -103,6 +107,12 @@ type OAuthProvider struct {
 	ClientSecret string `json:"client_secret"`
 	ClientId     string `json:"client_token"`
 	Name         string `json:"name"`
+
+	//Generic OpenID Connect providers, e.g. Keycloak, Dex, Azure AD or Okta
+	DiscoveryUrl string   `json:"discovery_url"`
+	Scopes       []string `json:"scopes"`
+	EmailClaim   string   `json:"email_claim"`
+	GroupsClaim  string   `json:"groups_claim"`
 }
 
 func (configs *Configs) parseOAuthProvider(key, value string) {
@@ -116,6 +126,8 @@ type JwtConfigs struct {
 	SigningKey    string `json:"signing_key"`
 	SigningMethod string `json:"signing_method"`
 	SigningKeyPW  string `json:"signing_key_pw"`
+	//Generate a new signing key every period, e.g. 720h, empty keeps the configured key
+	RotationPeriod string `json:"rotation_period"`
 }
 
 type WebConfigs struct {
@@ -123,7 +135,23 @@ type WebConfigs struct {
 	BindAddress string `json:"bind_address"`
 	BindPort    string `json:"bind_port"`
 	UiUrl       string
-	JwtConfigs  JwtConfigs `json:"jwt_configs"`
+	JwtConfigs  JwtConfigs      `json:"jwt_configs"`
+	WebAuthn    WebAuthnConfigs `json:"web_authn"`
+	TLS         TLSConfigs      `json:"tls"`
+}
+
+// TLSConfigs turns the listener into HTTPS when a certificate is set, client certificates
+// chaining up to one of the CA bundles authenticate requests without a token.
+type TLSConfigs struct {
+	CertFile      string   `json:"cert_file"`
+	KeyFile       string   `json:"key_file"`
+	ClientCAFiles []string `json:"client_ca_files"`
+}
+
+type WebAuthnConfigs struct {
+	RPID          string `json:"rp_id"`
+	RPOrigin      string `json:"rp_origin"`
+	RPDisplayName string `json:"rp_display_name"`
 }
 
 func (configs *Configs) parseWebConfigs(key, value string) {
@@ -138,6 +166,18 @@ func (configs *Configs) parseWebConfigs(key, value string) {
 		configs.Web.JwtConfigs.SigningKey = value
 	case "jwt-configs-signing-method":
 		configs.Web.JwtConfigs.SigningMethod = value
+	case "jwt-configs-rotation-period":
+		configs.Web.JwtConfigs.RotationPeriod = value
+	case "web-authn-rp-id":
+		configs.Web.WebAuthn.RPID = value
+	case "web-authn-rp-origin":
+		configs.Web.WebAuthn.RPOrigin = value
+	case "tls-cert-file":
+		configs.Web.TLS.CertFile = value
+	case "tls-key-file":
+		configs.Web.TLS.KeyFile = value
+	case "tls-client-ca-files":
+		configs.Web.TLS.ClientCAFiles = strings.Split(value, ",")
 	}
 }
 
@@ -149,6 +189,24 @@ type MailConfigs struct {
 	Port          int    `json:"port"`
 }
 
+func (configs *Configs) parseMailConfigs(key, value string) {
+	switch key {
+	case "username":
+		configs.Mail.Username = value
+	case "password":
+		configs.Mail.Password = value
+	case "host":
+		configs.Mail.Host = value
+	case "sender-address":
+		configs.Mail.SenderAddress = value
+	case "port":
+		port, err := strconv.Atoi(value)
+		if err == nil {
+			configs.Mail.Port = port
+		}
+	}
+}
+
 type RedisConfigs struct {
 	Address  string `json:"address"`
 	Password string `json:"password"`
@@ -171,20 +229,138 @@ func (configs *Configs) parseRedisConfigs(key, value string) {
 	}
 }
 
+// LdapConfigs enables the LDAP / Active Directory login when Url is set. Filters are fmt templates,
+// the user filter gets the escaped username and the group filter the escaped user DN as %[1]s.
+type LdapConfigs struct {
+	Url                string            `json:"url"`
+	StartTLS           bool              `json:"start_tls"`
+	CAFile             string            `json:"ca_file"`
+	BindDN             string            `json:"bind_dn"`
+	BindPassword       string            `json:"bind_password"`
+	UserBaseDN         string            `json:"user_base_dn"`
+	UserFilter         string            `json:"user_filter"`
+	EmailAttribute     string            `json:"email_attribute"`
+	FirstNameAttribute string            `json:"first_name_attribute"`
+	LastNameAttribute  string            `json:"last_name_attribute"`
+	GroupBaseDN        string            `json:"group_base_dn"`
+	GroupFilter        string            `json:"group_filter"`
+	GroupNameAttribute string            `json:"group_name_attribute"`
+	GroupRoles         map[string]string `json:"group_roles"`
+}
+
+func (configs *Configs) parseLdapConfigs(key, value string) {
+	switch key {
+	case "url":
+		configs.Ldap.Url = value
+	case "start-tls":
+		configs.Ldap.StartTLS = value == "true"
+	case "ca-file":
+		configs.Ldap.CAFile = value
+	case "bind-dn":
+		configs.Ldap.BindDN = value
+	case "bind-password":
+		configs.Ldap.BindPassword = value
+	case "user-base-dn":
+		configs.Ldap.UserBaseDN = value
+	case "user-filter":
+		configs.Ldap.UserFilter = value
+	case "email-attribute":
+		configs.Ldap.EmailAttribute = value
+	case "first-name-attribute":
+		configs.Ldap.FirstNameAttribute = value
+	case "last-name-attribute":
+		configs.Ldap.LastNameAttribute = value
+	case "group-base-dn":
+		configs.Ldap.GroupBaseDN = value
+	case "group-filter":
+		configs.Ldap.GroupFilter = value
+	case "group-name-attribute":
+		configs.Ldap.GroupNameAttribute = value
+	case "group-roles":
+		roles := make(map[string]string)
+		for _, v := range strings.Split(value, ",") {
+			if strings.Index(v, ":") > 0 {
+				roles[strings.Split(v, ":")[0]] = strings.Split(v, ":")[1]
+			}
+		}
+		configs.Ldap.GroupRoles = roles
+	}
+}
+
+// ApprovalConfigs designates who approves sensitive operations, Quorum of the Approvers
+// have to approve within Window. Without approvers the workflow is disabled and the operations
+// are refused, unless DirectPolicyChanges lets policy changes apply without approval.
+type ApprovalConfigs struct {
+	Quorum              int      `json:"quorum"`
+	Window              string   `json:"window"`
+	Approvers           []string `json:"approvers"`
+	DirectPolicyChanges bool     `json:"direct_policy_changes"`
+}
+
+func (configs *Configs) parseApprovalConfigs(key, value string) {
+	switch key {
+	case "quorum":
+		quorum, err := strconv.Atoi(value)
+		if err == nil {
+			configs.Approval.Quorum = quorum
+		}
+	case "window":
+		configs.Approval.Window = value
+	case "approvers":
+		configs.Approval.Approvers = strings.Split(value, ",")
+	case "direct_policy_changes":
+		configs.Approval.DirectPolicyChanges = strings.ToLower(value) == "true"
+	}
+}
+
+// BreakGlassConfigs shape emergency access: the elevated token carries Roles for Window,
+// and activations are posted to Webhook on top of the mail to every admin.
+type BreakGlassConfigs struct {
+	Window  string   `json:"window"`
+	Roles   []string `json:"roles"`
+	Webhook string   `json:"webhook"`
+}
+
+func (configs *Configs) parseBreakGlassConfigs(key, value string) {
+	switch key {
+	case "window":
+		configs.BreakGlass.Window = value
+	case "roles":
+		configs.BreakGlass.Roles = strings.Split(value, ",")
+	case "webhook":
+		configs.BreakGlass.Webhook = value
+	}
+}
+
+type VaultConfigs struct {
+	MasterKey string `json:"master_key"`
+}
+
+func (configs *Configs) parseVaultConfigs(key, value string) {
+	switch key {
+	case "master-key":
+		configs.Vault.MasterKey = value
+	}
+}
+
 type Configs struct {
-	DebugMode      bool             `json:"debug_mode"`
-	DB             *DBConfigs       `json:"db"`
-	OAuthProviders []*OAuthProvider `json:"o_auth_providers"`
-	Web            *WebConfigs      `json:"web"`
-	Mail           *MailConfigs     `json:"mail"`
-	Redis          *RedisConfigs    `json:"redis"`
+	DebugMode      bool               `json:"debug_mode"`
+	DB             *DBConfigs         `json:"db"`
+	OAuthProviders []*OAuthProvider   `json:"o_auth_providers"`
+	Web            *WebConfigs        `json:"web"`
+	Mail           *MailConfigs       `json:"mail"`
+	Redis          *RedisConfigs      `json:"redis"`
+	Vault          *VaultConfigs      `json:"vault"`
+	Ldap           *LdapConfigs       `json:"ldap"`
+	Approval       *ApprovalConfigs   `json:"approval"`
+	BreakGlass     *BreakGlassConfigs `json:"break_glass"`
 }
 
 func (configs *Configs) ParseConfigFile(logger *log.Logger) {
 	if file, err := ioutil.ReadFile(ConfigFilePath); err == nil {
 		json.Unmarshal([]byte(file), configs)
 	} else {
-		logger.Printf("Failed to read config file: `%i`", err)
+		logger.Printf("Failed to read config file: `%v`", err)
 	}
 }
 
@@ -204,7 +380,7 @@ func parseArg(arg string) (section, key, value string) {
 		keyValueStr = arg[strings.Index(arg, "-")+1:]
 	}
 
-	keyValue := strings.Split(keyValueStr, "=")
+	keyValue := strings.SplitN(keyValueStr, "=", 2)
 	key = keyValue[0]
 	value = keyValue[1]
 	return
@@ -220,6 +396,16 @@ func (configs *Configs) setConfigs(section, key, value string) {
 		configs.parseDBConfigs(key, value)
 	case "redis":
 		configs.parseRedisConfigs(key, value)
+	case "vault":
+		configs.parseVaultConfigs(key, value)
+	case "mail":
+		configs.parseMailConfigs(key, value)
+	case "ldap":
+		configs.parseLdapConfigs(key, value)
+	case "approval":
+		configs.parseApprovalConfigs(key, value)
+	case "breakglass":
+		configs.parseBreakGlassConfigs(key, value)
 	}
 }
 
@@ -230,7 +416,7 @@ func (configs *Configs) ParseEnvs(logger *log.Logger, envs []string) {
 			continue
 		}
 		section = strings.ToLower(strings.Split(env, "_")[0])
-		keyValue := strings.Split(strings.ReplaceAll(strings.ToLower(env[strings.Index(env, "_")+1:]), "_", "-"), "=")
+		keyValue := strings.SplitN(strings.ReplaceAll(strings.ToLower(env[strings.Index(env, "_")+1:]), "_", "-"), "=", 2)
 		if len(keyValue) <= 1 {
 			continue
 		}
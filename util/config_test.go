@@ -9,12 +9,12 @@ func TestConfigs_ParseConfigFile(t *testing.T) {
 	conf := &Configs{
 		DebugMode: true,
 		DB: &DBConfigs{
-			Host: "127.0.0.1",
+			MongoDB: "key-master",
 		},
 	}
 
-	conf.ParseConfigFile()
+	conf.ParseConfigFile(NewLogger())
 
 	assert.Equal(t, true, conf.DebugMode)
-	assert.Equal(t, "127.0.0.1", conf.DB.Host)
+	assert.Equal(t, "key-master", conf.DB.MongoDB)
 }